@@ -0,0 +1,477 @@
+package srt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sen1or/lets-live/pkg/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ackInterval       = 10 * time.Millisecond
+	minNAKInterval    = 20 * time.Millisecond
+	keepAliveInterval = time.Second
+	peerIdleTimeout   = 5 * time.Second
+
+	incomingQueueSize = 1024
+	readQueueSize     = 4096
+
+	// how far ahead of the next delivered packet we accept data, it is also the flow window we advertise
+	// anything further is dropped so a bogus sequence number can't blow up the buffer and the loss list
+	receiveWindow = 8192
+
+	// the control information field of a NAK is kept within a single udp datagram
+	maxNAKSize = maxPacketSize - headerSize - 28
+
+	// the default rtt before we get the first ACKACK, in microseconds
+	initialRTT = 100000
+)
+
+var ErrPeerTimeout = errors.New("srt peer timed out")
+
+// lossRange is a run of missing sequence numbers, first and last included
+type lossRange struct {
+	first   uint32
+	last    uint32
+	lastNAK time.Time
+}
+
+type bufferedPacket struct {
+	payload  []byte
+	received time.Time
+}
+
+// Conn is an accepted SRT connection, reading from it returns the payloads in order
+type Conn struct {
+	listener     *Listener
+	peerAddr     *net.UDPAddr
+	socketID     uint32
+	peerSocketID uint32
+	streamID     string
+	latency      time.Duration
+	start        time.Time
+
+	conclusionResponse *handshake
+
+	incoming chan *packet
+	readCh   chan []byte
+	readBuf  []byte
+
+	// receiver state, only touched by the run goroutine
+	nextSeq      uint32 // the next sequence number we deliver to the reader
+	maxSeq       uint32 // the highest sequence number received so far
+	buffer       map[uint32]bufferedPacket
+	lost         []lossRange // in sequence order, the ranges don't overlap
+	ackNumber    uint32
+	lastAckedSeq uint32
+	ackSentAt    map[uint32]time.Time
+	rtt          uint32
+	rttVar       uint32
+	lastReceive  time.Time
+	lastSend     atomic.Int64 // unix nano, control packets are also sent from Close
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	closeErr  error
+}
+
+func newConn(l *Listener, addr *net.UDPAddr, socketID uint32, peerSocketID uint32, initialSeq uint32, streamID string, latency time.Duration) *Conn {
+	now := time.Now()
+
+	c := &Conn{
+		listener:     l,
+		peerAddr:     addr,
+		socketID:     socketID,
+		peerSocketID: peerSocketID,
+		streamID:     streamID,
+		latency:      latency,
+		start:        now,
+		incoming:     make(chan *packet, incomingQueueSize),
+		readCh:       make(chan []byte, readQueueSize),
+		nextSeq:      initialSeq,
+		maxSeq:       (initialSeq - 1) & maxSeqNumber,
+		lastAckedSeq: initialSeq,
+		buffer:       make(map[uint32]bufferedPacket),
+		ackSentAt:    make(map[uint32]time.Time),
+		rtt:          initialRTT,
+		rttVar:       initialRTT / 2,
+		lastReceive:  now,
+		closed:       make(chan struct{}),
+	}
+	c.lastSend.Store(now.UnixNano())
+
+	return c
+}
+
+func (c *Conn) StreamID() string {
+	return c.streamID
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.peerAddr
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+// Read returns the received payloads in order, io.EOF after the peer shut the connection down
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		select {
+		case payload := <-c.readCh:
+			c.readBuf = payload
+		case <-c.closed:
+			// deliver what is left before reporting the close
+			select {
+			case payload := <-c.readCh:
+				c.readBuf = payload
+			default:
+				return 0, c.err()
+			}
+		}
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, nil
+}
+
+// Close shuts the connection down and tells the peer about it
+func (c *Conn) Close() error {
+	c.closeWithError(io.EOF, true)
+	return nil
+}
+
+func (c *Conn) closeWithError(err error, notifyPeer bool) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closeErr = err
+		c.mu.Unlock()
+
+		if notifyPeer {
+			c.sendControl(newControlPacket(controlShutdown, 0, make([]byte, 4)))
+		}
+
+		close(c.closed)
+		c.listener.forget(c)
+	})
+}
+
+func (c *Conn) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closeErr
+}
+
+// called by the listener read loop
+func (c *Conn) push(p *packet) {
+	select {
+	case c.incoming <- p:
+	case <-c.closed:
+	default:
+		// the connection can't keep up, the sender will retransmit
+	}
+}
+
+func (c *Conn) run() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p := <-c.incoming:
+			c.lastReceive = time.Now()
+			if p.isControl {
+				c.handleControl(p)
+			} else {
+				c.handleData(p)
+			}
+		case now := <-ticker.C:
+			if now.Sub(c.lastReceive) > peerIdleTimeout {
+				logger.Infow("srt peer timed out", "streamId", c.streamID, "addr", c.peerAddr.String())
+				c.closeWithError(ErrPeerTimeout, true)
+				return
+			}
+
+			c.deliver()
+			c.dropTooLate(now)
+			c.sendACK(now)
+			c.sendPeriodicNAK(now)
+
+			if now.Sub(time.Unix(0, c.lastSend.Load())) > keepAliveInterval {
+				c.sendControl(newControlPacket(controlKeepAlive, 0, nil))
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *Conn) handleControl(p *packet) {
+	switch p.controlType {
+	case controlShutdown:
+		c.closeWithError(io.EOF, false)
+	case controlACKACK:
+		c.handleACKACK(p.typeSpecific)
+	case controlDropReq:
+		if len(p.payload) >= 8 {
+			first := binary.BigEndian.Uint32(p.payload[0:4]) & maxSeqNumber
+			last := binary.BigEndian.Uint32(p.payload[4:8]) & maxSeqNumber
+			c.dropRange(first, last)
+		}
+	case controlKeepAlive:
+		// lastReceive is already refreshed
+	}
+}
+
+func (c *Conn) handleData(p *packet) {
+	if p.isEncrypted() {
+		// we refused encryption in the handshake so this should never happen
+		return
+	}
+
+	seq := p.seqNumber
+
+	// already delivered or a duplicate
+	if seqCompare(seq, c.nextSeq) < 0 {
+		return
+	}
+	if _, ok := c.buffer[seq]; ok {
+		return
+	}
+
+	// the sender never goes past the flow window, this is a bogus or very stale packet
+	if seqDistance(c.nextSeq, seq) >= receiveWindow {
+		logger.Debugf("srt dropped packet %d outside of the receive window (stream %s)", seq, c.streamID)
+		return
+	}
+
+	now := time.Now()
+	c.removeLoss(seq, seq)
+
+	if seqCompare(seq, c.maxSeq) > 0 {
+		// everything between the last highest and this one is missing
+		first := seqNext(c.maxSeq)
+		if seqCompare(first, c.nextSeq) < 0 {
+			first = c.nextSeq
+		}
+
+		if first != seq {
+			missing := lossRange{first: first, last: (seq - 1) & maxSeqNumber, lastNAK: now}
+			c.lost = append(c.lost, missing)
+			c.sendNAK([]lossRange{missing})
+		}
+
+		c.maxSeq = seq
+	}
+
+	c.buffer[seq] = bufferedPacket{payload: p.payload, received: now}
+	c.deliver()
+}
+
+// hand every in order packet to the reader, without waiting for it: the run loop must keep answering the peer
+// while the read queue is full the packets stay in the buffer, they are not acknowledged and the next tick tries again
+func (c *Conn) deliver() {
+	for {
+		bp, ok := c.buffer[c.nextSeq]
+		if !ok {
+			return
+		}
+
+		select {
+		case c.readCh <- bp.payload:
+		default:
+			return
+		}
+
+		delete(c.buffer, c.nextSeq)
+		c.nextSeq = seqNext(c.nextSeq)
+	}
+}
+
+// the sender drops packets that are too late to be played (TLPKTDROP), we do the same on our side:
+// if the packet after a gap has waited longer than the latency, we give up on the gap
+func (c *Conn) dropTooLate(now time.Time) {
+	if len(c.buffer) == 0 {
+		return
+	}
+
+	if _, ok := c.buffer[c.nextSeq]; ok {
+		return
+	}
+
+	// the buffer is bounded by the receive window, look for the first packet after the gap
+	first, found := uint32(0), false
+	for s := range c.buffer {
+		if !found || seqCompare(s, first) < 0 {
+			first, found = s, true
+		}
+	}
+
+	if now.Sub(c.buffer[first].received) < c.latency {
+		return
+	}
+
+	logger.Debugf("srt dropped %d too late packets (stream %s)", seqDistance(c.nextSeq, first), c.streamID)
+	c.dropRange(c.nextSeq, (first-1)&maxSeqNumber)
+}
+
+// the sender won't send these packets anymore
+func (c *Conn) dropRange(first uint32, last uint32) {
+	if seqCompare(last, first) < 0 {
+		return
+	}
+
+	c.removeLoss(first, last)
+	for s := range c.buffer {
+		if seqCompare(s, first) >= 0 && seqCompare(s, last) <= 0 {
+			delete(c.buffer, s)
+		}
+	}
+
+	if seqCompare(c.nextSeq, first) >= 0 && seqCompare(c.nextSeq, last) <= 0 {
+		c.nextSeq = seqNext(last)
+		if seqCompare(c.maxSeq, last) < 0 {
+			c.maxSeq = last
+		}
+	}
+
+	c.deliver()
+}
+
+func (c *Conn) sendACK(now time.Time) {
+	if c.nextSeq == c.lastAckedSeq {
+		return
+	}
+
+	c.ackNumber++
+	c.lastAckedSeq = c.nextSeq
+	c.ackSentAt[c.ackNumber] = now
+
+	cif := make([]byte, 28)
+	binary.BigEndian.PutUint32(cif[0:4], c.nextSeq)
+	binary.BigEndian.PutUint32(cif[4:8], c.rtt)
+	binary.BigEndian.PutUint32(cif[8:12], c.rttVar)
+	binary.BigEndian.PutUint32(cif[12:16], uint32(readQueueSize-len(c.readCh)))
+	// packet receiving rate, link capacity and receiving rate are optional hints, we leave them empty
+	c.sendControl(newControlPacket(controlACK, c.ackNumber, cif))
+
+	// don't let unanswered acks pile up
+	for number, sentAt := range c.ackSentAt {
+		if now.Sub(sentAt) > peerIdleTimeout {
+			delete(c.ackSentAt, number)
+		}
+	}
+}
+
+func (c *Conn) handleACKACK(ackNumber uint32) {
+	sentAt, ok := c.ackSentAt[ackNumber]
+	if !ok {
+		return
+	}
+	delete(c.ackSentAt, ackNumber)
+
+	sample := uint32(time.Since(sentAt).Microseconds())
+	diff := int64(c.rtt) - int64(sample)
+	if diff < 0 {
+		diff = -diff
+	}
+
+	c.rttVar = (3*c.rttVar + uint32(diff)) / 4
+	c.rtt = (7*c.rtt + sample) / 8
+}
+
+func (c *Conn) sendPeriodicNAK(now time.Time) {
+	if len(c.lost) == 0 {
+		return
+	}
+
+	interval := time.Duration(c.rtt+4*c.rttVar) * time.Microsecond
+	if interval < minNAKInterval {
+		interval = minNAKInterval
+	}
+
+	var missing []lossRange
+	for i := range c.lost {
+		if now.Sub(c.lost[i].lastNAK) < interval {
+			continue
+		}
+
+		c.lost[i].lastNAK = now
+		missing = append(missing, c.lost[i])
+	}
+
+	c.sendNAK(missing)
+}
+
+// removeLoss takes first..last out of the loss list, splitting the ranges it cuts through
+func (c *Conn) removeLoss(first uint32, last uint32) {
+	if len(c.lost) == 0 {
+		return
+	}
+
+	kept := make([]lossRange, 0, len(c.lost)+1)
+	for _, r := range c.lost {
+		if seqCompare(r.last, first) < 0 || seqCompare(r.first, last) > 0 {
+			kept = append(kept, r)
+			continue
+		}
+
+		if seqCompare(r.first, first) < 0 {
+			kept = append(kept, lossRange{first: r.first, last: (first - 1) & maxSeqNumber, lastNAK: r.lastNAK})
+		}
+		if seqCompare(r.last, last) > 0 {
+			kept = append(kept, lossRange{first: seqNext(last), last: r.last, lastNAK: r.lastNAK})
+		}
+	}
+
+	c.lost = kept
+}
+
+func (c *Conn) sendNAK(ranges []lossRange) {
+	for _, cif := range encodeLossList(ranges) {
+		c.sendControl(newControlPacket(controlNAK, 0, cif))
+	}
+}
+
+// encodeLossList compresses the ranges the way NAKs carry them: a single number for one packet,
+// a start with the highest bit set followed by the end otherwise. it is split to fit in datagrams
+func encodeLossList(ranges []lossRange) [][]byte {
+	var cifs [][]byte
+	var cif []byte
+
+	for _, r := range ranges {
+		if len(cif)+8 > maxNAKSize {
+			cifs = append(cifs, cif)
+			cif = nil
+		}
+
+		if r.first == r.last {
+			cif = binary.BigEndian.AppendUint32(cif, r.first)
+		} else {
+			cif = binary.BigEndian.AppendUint32(cif, r.first|0x80000000)
+			cif = binary.BigEndian.AppendUint32(cif, r.last)
+		}
+	}
+
+	if len(cif) > 0 {
+		cifs = append(cifs, cif)
+	}
+
+	return cifs
+}
+
+func (c *Conn) sendControl(p *packet) {
+	p.timestamp = uint32(time.Since(c.start).Microseconds())
+	p.destSocketID = c.peerSocketID
+	c.lastSend.Store(time.Now().UnixNano())
+	c.listener.send(p.marshal(), c.peerAddr)
+}
@@ -0,0 +1,417 @@
+package srt
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sen1or/lets-live/pkg/logger"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn_EncodeLossList(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []lossRange
+		want   []uint32
+	}{
+		{"empty", nil, nil},
+		{"single packet", []lossRange{{first: 5, last: 5}}, []uint32{5}},
+		{"range", []lossRange{{first: 5, last: 9}}, []uint32{5 | 0x80000000, 9}},
+		{
+			"mixed",
+			[]lossRange{{first: 1, last: 1}, {first: 3, last: 4}, {first: 10, last: 10}},
+			[]uint32{1, 3 | 0x80000000, 4, 10},
+		},
+		{"across the wrap", []lossRange{{first: maxSeqNumber, last: 1}}, []uint32{maxSeqNumber | 0x80000000, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint32
+			for _, cif := range encodeLossList(tt.ranges) {
+				got = append(got, decodeWords(cif)...)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConn_EncodeLossListSplit(t *testing.T) {
+	ranges := make([]lossRange, 1000)
+	for i := range ranges {
+		ranges[i] = lossRange{first: uint32(i * 10), last: uint32(i*10 + 1)}
+	}
+
+	cifs := encodeLossList(ranges)
+	assert.Greater(t, len(cifs), 1)
+
+	total := 0
+	for _, cif := range cifs {
+		assert.LessOrEqual(t, len(cif), maxNAKSize)
+		assert.Zero(t, len(cif)%8, "a range must not be split across two naks")
+		total += len(cif)
+	}
+	assert.Equal(t, len(ranges)*8, total)
+}
+
+func TestConn_LossList(t *testing.T) {
+	c := newTestConn(t, 100)
+
+	c.handleData(&packet{seqNumber: 100, payload: []byte("a")})
+	c.handleData(&packet{seqNumber: 105, payload: []byte("f")})
+	assert.Equal(t, [][2]uint32{{101, 104}}, lossRanges(c))
+
+	// a retransmission splits the range
+	c.handleData(&packet{seqNumber: 102, payload: []byte("c")})
+	assert.Equal(t, [][2]uint32{{101, 101}, {103, 104}}, lossRanges(c))
+
+	c.handleData(&packet{seqNumber: 108, payload: []byte("i")})
+	assert.Equal(t, [][2]uint32{{101, 101}, {103, 104}, {106, 107}}, lossRanges(c))
+
+	// the sender gave up on these
+	c.dropRange(101, 104)
+	assert.Equal(t, [][2]uint32{{106, 107}}, lossRanges(c))
+	assert.Equal(t, uint32(106), c.nextSeq)
+	assert.Equal(t, []string{"a", "f"}, readAll(c))
+
+	c.handleData(&packet{seqNumber: 107, payload: []byte("h")})
+	c.handleData(&packet{seqNumber: 106, payload: []byte("g")})
+	assert.Empty(t, c.lost)
+	assert.Equal(t, []string{"g", "h", "i"}, readAll(c))
+}
+
+func TestConn_LossListWraparound(t *testing.T) {
+	c := newTestConn(t, maxSeqNumber-1)
+
+	c.handleData(&packet{seqNumber: maxSeqNumber - 1, payload: []byte("a")})
+	c.handleData(&packet{seqNumber: 2, payload: []byte("e")})
+	assert.Equal(t, [][2]uint32{{maxSeqNumber, 1}}, lossRanges(c))
+
+	c.handleData(&packet{seqNumber: 0, payload: []byte("c")})
+	assert.Equal(t, [][2]uint32{{maxSeqNumber, maxSeqNumber}, {1, 1}}, lossRanges(c))
+
+	c.handleData(&packet{seqNumber: maxSeqNumber, payload: []byte("b")})
+	c.handleData(&packet{seqNumber: 1, payload: []byte("d")})
+	assert.Empty(t, c.lost)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, readAll(c))
+}
+
+func TestConn_ReceiveWindow(t *testing.T) {
+	c := newTestConn(t, 100)
+
+	c.handleData(&packet{seqNumber: 100, payload: []byte("a")})
+
+	// a far ahead sequence number must not create a huge loss list
+	c.handleData(&packet{seqNumber: 100 + 1<<29, payload: []byte("bogus")})
+	c.handleData(&packet{seqNumber: 101 + receiveWindow, payload: []byte("bogus")})
+	assert.Empty(t, c.lost)
+	assert.Empty(t, c.buffer)
+	assert.Equal(t, uint32(100), c.maxSeq)
+
+	// the edge of the window is still accepted
+	c.handleData(&packet{seqNumber: 100 + receiveWindow, payload: []byte("z")})
+	assert.Equal(t, [][2]uint32{{101, 99 + receiveWindow}}, lossRanges(c))
+
+	// a drop request covering most of the sequence space only touches what we have
+	start := time.Now()
+	c.dropRange(101, 100+1<<29)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Empty(t, c.lost)
+}
+
+func TestConn_DropTooLate(t *testing.T) {
+	c := newTestConn(t, 100)
+	c.latency = 10 * time.Millisecond
+
+	c.handleData(&packet{seqNumber: 100, payload: []byte("a")})
+	c.handleData(&packet{seqNumber: 103, payload: []byte("d")})
+	c.handleData(&packet{seqNumber: 104, payload: []byte("e")})
+
+	c.dropTooLate(time.Now())
+	assert.Equal(t, uint32(101), c.nextSeq)
+
+	c.dropTooLate(time.Now().Add(c.latency))
+	assert.Equal(t, uint32(105), c.nextSeq)
+	assert.Empty(t, c.lost)
+	assert.Equal(t, []string{"a", "d", "e"}, readAll(c))
+}
+
+// a caller going through the whole handshake, then publishing with a lost and reordered packet
+func TestConn_Loopback(t *testing.T) {
+	const streamID = "#!::r=live/key"
+	const initialSeq = 1000
+
+	logger.Init(logger.Debug)
+
+	listener, err := Listen("127.0.0.1:0", Config{
+		Latency: 50 * time.Millisecond,
+		Authorize: func(req ConnRequest) RejectReason {
+			if req.StreamID != streamID {
+				return RejectUnauthorized
+			}
+			return RejectNone
+		},
+	})
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	caller := dialTest(t, listener)
+	defer caller.Close()
+
+	// induction, the listener answers with a cookie
+	caller.sendHandshake(t, 0, &handshake{version: 4, hsType: handshakeInduction, socketID: caller.socketID, initialSeq: initialSeq})
+	induction := caller.readHandshake(t)
+	assert.Equal(t, handshakeInduction, induction.hsType)
+	assert.Equal(t, uint16(handshakeMagic), induction.extensionField)
+
+	// a wrong cookie is ignored
+	caller.sendHandshake(t, 0, caller.conclusion(induction.synCookie+1, initialSeq, streamID))
+
+	caller.sendHandshake(t, 0, caller.conclusion(induction.synCookie, initialSeq, streamID))
+	conclusion := caller.readHandshake(t)
+	assert.Equal(t, handshakeConclusion, conclusion.hsType)
+	assert.NotZero(t, conclusion.socketID)
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, streamID, conn.StreamID())
+	assert.Equal(t, 120*time.Millisecond, conn.latency)
+
+	// 1001 is lost, 1003 comes before 1002
+	caller.sendData(t, conclusion.socketID, initialSeq, "a")
+	caller.sendData(t, conclusion.socketID, initialSeq+3, "d")
+	caller.sendData(t, conclusion.socketID, initialSeq+2, "c")
+
+	nak := caller.readControl(t, controlNAK)
+	assert.Equal(t, []uint32{(initialSeq + 1) | 0x80000000, initialSeq + 2}, decodeWords(nak.payload))
+
+	// someone else guessing the socket id can't inject data
+	intruder := dialTest(t, listener)
+	defer intruder.Close()
+	intruder.sendData(t, conclusion.socketID, initialSeq+1, "intruder")
+
+	caller.sendData(t, conclusion.socketID, initialSeq+1, "b")
+
+	received := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+
+	for _, want := range []string{"a", "b", "c", "d"} {
+		select {
+		case payload := <-received:
+			assert.Equal(t, want, payload)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	caller.sendControl(t, conclusion.socketID, newControlPacket(controlShutdown, 0, make([]byte, 4)))
+	select {
+	case _, ok := <-received:
+		assert.False(t, ok)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+	assert.ErrorIs(t, conn.err(), io.EOF)
+}
+
+func TestConn_LoopbackRejected(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	listener, err := Listen("127.0.0.1:0", Config{
+		Authorize: func(req ConnRequest) RejectReason { return RejectForbidden },
+	})
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	caller := dialTest(t, listener)
+	defer caller.Close()
+
+	caller.sendHandshake(t, 0, &handshake{version: 4, hsType: handshakeInduction, socketID: caller.socketID})
+	induction := caller.readHandshake(t)
+
+	caller.sendHandshake(t, 0, caller.conclusion(induction.synCookie, 0, "#!::r=live/other"))
+	assert.Equal(t, handshakeType(RejectForbidden), caller.readHandshake(t).hsType)
+
+	// encryption is refused before the stream id is even looked at
+	encrypting := dialTest(t, listener)
+	defer encrypting.Close()
+
+	encrypting.sendHandshake(t, 0, &handshake{version: 4, hsType: handshakeInduction, socketID: encrypting.socketID})
+	induction = encrypting.readHandshake(t)
+
+	encrypted := encrypting.conclusion(induction.synCookie, 0, "")
+	encrypted.extensionField |= extFlagKMREQ
+	encrypting.sendHandshake(t, 0, encrypted)
+	assert.Equal(t, handshakeType(RejectUnsecure), encrypting.readHandshake(t).hsType)
+}
+
+func newTestConn(t *testing.T, initialSeq uint32) *Conn {
+	logger.Init(logger.Debug)
+
+	listener, err := Listen("127.0.0.1:0", Config{})
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	// the naks go to a socket nobody reads
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	return newConn(listener, sink.LocalAddr().(*net.UDPAddr), 1, 2, initialSeq, "", time.Second)
+}
+
+func lossRanges(c *Conn) [][2]uint32 {
+	var ranges [][2]uint32
+	for _, r := range c.lost {
+		ranges = append(ranges, [2]uint32{r.first, r.last})
+	}
+
+	return ranges
+}
+
+func readAll(c *Conn) []string {
+	var payloads []string
+	for {
+		select {
+		case payload := <-c.readCh:
+			payloads = append(payloads, string(payload))
+		default:
+			return payloads
+		}
+	}
+}
+
+func decodeWords(b []byte) []uint32 {
+	var words []uint32
+	for i := 0; i+4 <= len(b); i += 4 {
+		words = append(words, binary.BigEndian.Uint32(b[i:i+4]))
+	}
+
+	return words
+}
+
+type testCaller struct {
+	*net.UDPConn
+	socketID uint32
+	start    time.Time
+}
+
+var nextCallerSocketID uint32 = 100
+
+func dialTest(t *testing.T, listener *Listener) *testCaller {
+	conn, err := net.DialUDP("udp", nil, listener.Addr().(*net.UDPAddr))
+	assert.NoError(t, err)
+
+	nextCallerSocketID++
+	return &testCaller{UDPConn: conn, socketID: nextCallerSocketID, start: time.Now()}
+}
+
+func (tc *testCaller) conclusion(cookie uint32, initialSeq uint32, streamID string) *handshake {
+	hs := &handshake{
+		version:        5,
+		extensionField: extFlagHSREQ | extFlagCONFIG,
+		initialSeq:     initialSeq,
+		mtu:            1500,
+		flowWindow:     8192,
+		hsType:         handshakeConclusion,
+		socketID:       tc.socketID,
+		synCookie:      cookie,
+		extensions: []handshakeExtension{
+			hsExtension(extHSREQ, flagTSBPDSND|flagTLPKTDROP, 0, 120),
+		},
+	}
+
+	if len(streamID) > 0 {
+		hs.extensions = append(hs.extensions, handshakeExtension{extType: extSID, content: encodeStreamID(streamID)})
+	}
+
+	return hs
+}
+
+func (tc *testCaller) sendControl(t *testing.T, destSocketID uint32, p *packet) {
+	p.destSocketID = destSocketID
+	p.timestamp = uint32(time.Since(tc.start).Microseconds())
+	_, err := tc.Write(p.marshal())
+	assert.NoError(t, err)
+}
+
+func (tc *testCaller) sendHandshake(t *testing.T, destSocketID uint32, hs *handshake) {
+	tc.sendControl(t, destSocketID, newControlPacket(controlHandshake, 0, hs.marshal()))
+}
+
+func (tc *testCaller) sendData(t *testing.T, destSocketID uint32, seq uint32, payload string) {
+	p := &packet{
+		seqNumber:    seq,
+		msgFlags:     0xC0000000, // a whole message
+		timestamp:    uint32(time.Since(tc.start).Microseconds()),
+		destSocketID: destSocketID,
+		payload:      []byte(payload),
+	}
+
+	_, err := tc.Write(p.marshal())
+	assert.NoError(t, err)
+}
+
+// readControl skips everything until a control packet of the given type
+func (tc *testCaller) readControl(t *testing.T, controlType controlType) *packet {
+	t.Helper()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		tc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := tc.Read(buf)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		p, err := parsePacket(buf[:n])
+		assert.NoError(t, err)
+		if p.isControl && p.controlType == controlType {
+			assert.Equal(t, tc.socketID, p.destSocketID)
+			return p
+		}
+	}
+}
+
+func (tc *testCaller) readHandshake(t *testing.T) *handshake {
+	t.Helper()
+
+	hs, err := parseHandshake(tc.readControl(t, controlHandshake).payload)
+	assert.NoError(t, err)
+
+	return hs
+}
+
+// a reader that doesn't keep up must not block the connection, the packets wait in the buffer
+func TestConn_SlowReader(t *testing.T) {
+	c := newTestConn(t, 0)
+
+	for seq := uint32(0); seq < readQueueSize+2; seq++ {
+		c.handleData(&packet{seqNumber: seq, payload: []byte(strconv.Itoa(int(seq)))})
+	}
+	assert.Equal(t, uint32(readQueueSize), c.nextSeq)
+	assert.Len(t, c.buffer, 2)
+
+	// nothing is acknowledged past what the reader can get
+	c.sendACK(time.Now())
+	assert.Equal(t, uint32(readQueueSize), c.lastAckedSeq)
+
+	assert.Len(t, readAll(c), readQueueSize)
+	c.deliver()
+	assert.Equal(t, []string{strconv.Itoa(readQueueSize), strconv.Itoa(readQueueSize + 1)}, readAll(c))
+	assert.Empty(t, c.buffer)
+}
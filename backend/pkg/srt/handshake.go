@@ -0,0 +1,182 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	handshakeCIFSize = 48
+
+	handshakeMagic = 0x4A17
+
+	// the version this implementation tells the peer, 1.4.0
+	srtVersion = 0x010400
+)
+
+type handshakeType uint32
+
+const (
+	handshakeInduction  handshakeType = 0x00000001
+	handshakeConclusion handshakeType = 0xFFFFFFFF
+)
+
+// extension flags of the handshake in a conclusion request
+const (
+	extFlagHSREQ  = 0x1
+	extFlagKMREQ  = 0x2
+	extFlagCONFIG = 0x4
+)
+
+// handshake extension types
+const (
+	extHSREQ = 1
+	extHSRSP = 2
+	extKMREQ = 3
+	extSID   = 5
+)
+
+// srt flags exchanged in HSREQ and HSRSP
+const (
+	flagTSBPDSND    = 0x01
+	flagTSBPDRCV    = 0x02
+	flagCRYPT       = 0x04
+	flagTLPKTDROP   = 0x08
+	flagPERIODICNAK = 0x10
+	flagREXMITFLG   = 0x20
+)
+
+type handshake struct {
+	version        uint32
+	encryption     uint16
+	extensionField uint16
+	initialSeq     uint32
+	mtu            uint32
+	flowWindow     uint32
+	hsType         handshakeType
+	socketID       uint32
+	synCookie      uint32
+	peerIP         [16]byte
+
+	extensions []handshakeExtension
+}
+
+type handshakeExtension struct {
+	extType uint16
+	content []byte
+}
+
+func parseHandshake(cif []byte) (*handshake, error) {
+	if len(cif) < handshakeCIFSize {
+		return nil, fmt.Errorf("handshake too short (%d bytes)", len(cif))
+	}
+
+	hs := &handshake{
+		version:        binary.BigEndian.Uint32(cif[0:4]),
+		encryption:     binary.BigEndian.Uint16(cif[4:6]),
+		extensionField: binary.BigEndian.Uint16(cif[6:8]),
+		initialSeq:     binary.BigEndian.Uint32(cif[8:12]) & maxSeqNumber,
+		mtu:            binary.BigEndian.Uint32(cif[12:16]),
+		flowWindow:     binary.BigEndian.Uint32(cif[16:20]),
+		hsType:         handshakeType(binary.BigEndian.Uint32(cif[20:24])),
+		socketID:       binary.BigEndian.Uint32(cif[24:28]),
+		synCookie:      binary.BigEndian.Uint32(cif[28:32]),
+	}
+	copy(hs.peerIP[:], cif[32:48])
+
+	rest := cif[handshakeCIFSize:]
+	for len(rest) >= 4 {
+		extType := binary.BigEndian.Uint16(rest[0:2])
+		extLength := int(binary.BigEndian.Uint16(rest[2:4])) * 4
+		rest = rest[4:]
+
+		if extLength > len(rest) {
+			return nil, fmt.Errorf("handshake extension %d is truncated", extType)
+		}
+
+		hs.extensions = append(hs.extensions, handshakeExtension{
+			extType: extType,
+			content: rest[:extLength],
+		})
+		rest = rest[extLength:]
+	}
+
+	return hs, nil
+}
+
+func (hs *handshake) marshal() []byte {
+	size := handshakeCIFSize
+	for _, ext := range hs.extensions {
+		size += 4 + len(ext.content)
+	}
+
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b[0:4], hs.version)
+	binary.BigEndian.PutUint16(b[4:6], hs.encryption)
+	binary.BigEndian.PutUint16(b[6:8], hs.extensionField)
+	binary.BigEndian.PutUint32(b[8:12], hs.initialSeq)
+	binary.BigEndian.PutUint32(b[12:16], hs.mtu)
+	binary.BigEndian.PutUint32(b[16:20], hs.flowWindow)
+	binary.BigEndian.PutUint32(b[20:24], uint32(hs.hsType))
+	binary.BigEndian.PutUint32(b[24:28], hs.socketID)
+	binary.BigEndian.PutUint32(b[28:32], hs.synCookie)
+	copy(b[32:48], hs.peerIP[:])
+
+	offset := handshakeCIFSize
+	for _, ext := range hs.extensions {
+		binary.BigEndian.PutUint16(b[offset:offset+2], ext.extType)
+		binary.BigEndian.PutUint16(b[offset+2:offset+4], uint16(len(ext.content)/4))
+		copy(b[offset+4:], ext.content)
+		offset += 4 + len(ext.content)
+	}
+
+	return b
+}
+
+func (hs *handshake) extension(extType uint16) (handshakeExtension, bool) {
+	for _, ext := range hs.extensions {
+		if ext.extType == extType {
+			return ext, true
+		}
+	}
+
+	return handshakeExtension{}, false
+}
+
+// the stream id is sent as 32 bits words in little endian order, padded with zeroes
+func decodeStreamID(content []byte) string {
+	b := make([]byte, len(content))
+	for i := 0; i+4 <= len(content); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = content[i+3], content[i+2], content[i+1], content[i]
+	}
+
+	end := len(b)
+	for end > 0 && b[end-1] == 0 {
+		end--
+	}
+
+	return string(b[:end])
+}
+
+// hsExtension builds the HSREQ/HSRSP content: version, flags, receiver and sender tsbpd delays in milliseconds
+func hsExtension(extType uint16, flags uint32, recvDelay uint16, sendDelay uint16) handshakeExtension {
+	content := make([]byte, 12)
+	binary.BigEndian.PutUint32(content[0:4], srtVersion)
+	binary.BigEndian.PutUint32(content[4:8], flags)
+	binary.BigEndian.PutUint32(content[8:12], uint32(recvDelay)<<16|uint32(sendDelay))
+
+	return handshakeExtension{extType: extType, content: content}
+}
+
+func peerIPField(addr *net.UDPAddr) [16]byte {
+	var field [16]byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		// each 32 bits word is in little endian order
+		field[0], field[1], field[2], field[3] = ip4[3], ip4[2], ip4[1], ip4[0]
+	} else {
+		copy(field[:], addr.IP.To16())
+	}
+
+	return field
+}
@@ -0,0 +1,99 @@
+package srt
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encodeStreamID is what callers do with the stream id: 32 bits little endian words, padded with zeroes
+func encodeStreamID(streamID string) []byte {
+	b := make([]byte, (len(streamID)+3)/4*4)
+	copy(b, streamID)
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+
+	return b
+}
+
+func TestHandshake_MarshalAndParse(t *testing.T) {
+	hs := &handshake{
+		version:        5,
+		encryption:     0,
+		extensionField: extFlagHSREQ | extFlagCONFIG,
+		initialSeq:     1234,
+		mtu:            1500,
+		flowWindow:     8192,
+		hsType:         handshakeConclusion,
+		socketID:       77,
+		synCookie:      0xDEADBEEF,
+		peerIP:         peerIPField(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}),
+		extensions: []handshakeExtension{
+			hsExtension(extHSREQ, flagTSBPDSND, 0, 120),
+			{extType: extSID, content: encodeStreamID("#!::r=live,m=publish")},
+		},
+	}
+
+	parsed, err := parseHandshake(hs.marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, hs, parsed)
+
+	sid, ok := parsed.extension(extSID)
+	assert.True(t, ok)
+	assert.Equal(t, "#!::r=live,m=publish", decodeStreamID(sid.content))
+
+	_, ok = parsed.extension(extKMREQ)
+	assert.False(t, ok)
+}
+
+func TestHandshake_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cif  []byte
+	}{
+		{"too short", make([]byte, handshakeCIFSize-1)},
+		{"truncated extension", append(make([]byte, handshakeCIFSize), 0, extSID, 0, 2, 'a', 'b', 'c', 'd')},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseHandshake(tt.cif)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHandshake_PeerIP(t *testing.T) {
+	field := peerIPField(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 2)})
+	assert.Equal(t, [16]byte{2, 1, 168, 192}, field)
+}
+
+func TestHandshake_StreamID(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"empty", nil, ""},
+		{"one word", []byte{0, 'y', 'e', 'k'}, "key"},
+		{"two words", []byte{'i', 'l', '!', '#', 0, 0, 'e', 'v'}, "#!live"},
+		{"round trip", encodeStreamID("#!::r=live/streamkey"), "#!::r=live/streamkey"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, decodeStreamID(tt.content))
+		})
+	}
+}
+
+func TestHandshake_HSExtension(t *testing.T) {
+	ext := hsExtension(extHSRSP, flagTSBPDRCV, 200, 0)
+	assert.Equal(t, uint16(extHSRSP), ext.extType)
+	assert.Equal(t, uint32(srtVersion), binary.BigEndian.Uint32(ext.content[0:4]))
+	assert.Equal(t, uint32(flagTSBPDRCV), binary.BigEndian.Uint32(ext.content[4:8]))
+	assert.Equal(t, uint32(200<<16), binary.BigEndian.Uint32(ext.content[8:12]))
+}
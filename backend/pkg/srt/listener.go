@@ -0,0 +1,426 @@
+package srt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sen1or/lets-live/pkg/logger"
+	"sync"
+	"time"
+)
+
+// RejectReason is sent back to the caller in the handshake when the connection is refused
+// values from 2000 are access control codes, mirroring the http status codes
+type RejectReason uint32
+
+const (
+	RejectNone         RejectReason = 0
+	RejectUnsecure     RejectReason = 1011
+	RejectBadRequest   RejectReason = 2400
+	RejectUnauthorized RejectReason = 2401
+	RejectForbidden    RejectReason = 2403
+	RejectBadMode      RejectReason = 2405
+	RejectConflict     RejectReason = 2409
+	RejectInternal     RejectReason = 2500
+)
+
+const (
+	defaultLatency = 120 * time.Millisecond
+	maxPacketSize  = 1500
+	acceptBacklog  = 16
+)
+
+var ErrListenerClosed = errors.New("srt listener closed")
+
+// ConnRequest is what we know about the caller before accepting the connection
+type ConnRequest struct {
+	StreamID   string
+	RemoteAddr net.Addr
+}
+
+type Config struct {
+	// the receiver latency, it is negotiated with the caller (the highest wins)
+	Latency time.Duration
+
+	// Authorize is called during the handshake, returning anything but RejectNone refuses the caller
+	Authorize func(req ConnRequest) RejectReason
+}
+
+// Listener accepts SRT callers on a single udp socket, it only supports receiving (the caller publishes)
+// there is no encryption: callers asking for it (KMREQ) are rejected and everything, the stream id included, is cleartext
+type Listener struct {
+	pc     net.PacketConn
+	config Config
+	secret []byte
+
+	mu          sync.Mutex
+	conns       map[uint32]*Conn  // keyed by our socket id
+	pending     map[string]bool   // handshakes being authorized, keyed by caller address and socket id
+	established map[string]*Conn  // keyed by caller address and socket id, used for retransmitted conclusions
+	rejected    map[string][]byte // the last rejection sent to a caller, so retransmitted conclusions get the same answer
+
+	acceptQueue chan *Conn
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func Listen(addr string, config Config) (*Listener, error) {
+	if config.Latency == 0 {
+		config.Latency = defaultLatency
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to generate cookie secret: %s", err)
+	}
+
+	l := &Listener{
+		pc:          pc,
+		config:      config,
+		secret:      secret,
+		conns:       make(map[uint32]*Conn),
+		pending:     make(map[string]bool),
+		established: make(map[string]*Conn),
+		rejected:    make(map[string][]byte),
+		acceptQueue: make(chan *Conn, acceptBacklog),
+		closed:      make(chan struct{}),
+	}
+
+	go l.readLoop()
+
+	return l, nil
+}
+
+// Accept waits for the next authorized caller
+func (l *Listener) Accept() (*Conn, error) {
+	select {
+	case c := <-l.acceptQueue:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.mu.Lock()
+		conns := make([]*Conn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+
+		for _, c := range conns {
+			c.Close()
+		}
+
+		l.pc.Close()
+	})
+
+	return nil
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, maxPacketSize*2)
+
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+
+			logger.Errorf("srt failed to read packet: %s", err)
+			continue
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			logger.Debugf("srt dropped invalid packet from %s: %s", addr, err)
+			continue
+		}
+
+		if p.isControl && p.controlType == controlHandshake {
+			l.handleHandshake(p, udpAddr)
+			continue
+		}
+
+		l.mu.Lock()
+		c, ok := l.conns[p.destSocketID]
+		l.mu.Unlock()
+
+		// the socket ids are guessable, only the caller that did the handshake may feed the connection
+		if !ok || !sameAddr(udpAddr, c.peerAddr) {
+			continue
+		}
+
+		c.push(p)
+	}
+}
+
+func (l *Listener) handleHandshake(p *packet, addr *net.UDPAddr) {
+	hs, err := parseHandshake(p.payload)
+	if err != nil {
+		logger.Debugf("srt invalid handshake from %s: %s", addr, err)
+		return
+	}
+
+	switch hs.hsType {
+	case handshakeInduction:
+		l.sendInductionResponse(hs, addr)
+	case handshakeConclusion:
+		l.handleConclusion(hs, addr)
+	default:
+		logger.Debugf("srt unsupported handshake type %d from %s", hs.hsType, addr)
+	}
+}
+
+func (l *Listener) sendInductionResponse(req *handshake, addr *net.UDPAddr) {
+	res := &handshake{
+		version:        5,
+		encryption:     0,
+		extensionField: handshakeMagic,
+		initialSeq:     req.initialSeq,
+		mtu:            maxPacketSize,
+		flowWindow:     receiveWindow,
+		hsType:         handshakeInduction,
+		socketID:       0,
+		synCookie:      l.cookie(addr, time.Now()),
+		peerIP:         peerIPField(addr),
+	}
+
+	l.sendHandshake(res, req.socketID, addr)
+}
+
+func (l *Listener) handleConclusion(req *handshake, addr *net.UDPAddr) {
+	key := fmt.Sprintf("%s/%d", addr, req.socketID)
+
+	if req.version < 5 {
+		// HSv4 callers are too old, every encoder we care about speaks HSv5
+		l.sendRejection(req, addr, key, RejectReason(1008))
+		return
+	}
+
+	if !l.validCookie(req.synCookie, addr) {
+		logger.Debugf("srt invalid syn cookie from %s", addr)
+		return
+	}
+
+	l.mu.Lock()
+	if c, ok := l.established[key]; ok {
+		l.mu.Unlock()
+		// our conclusion response got lost, send it again
+		l.sendHandshake(c.conclusionResponse, req.socketID, addr)
+		return
+	}
+	if rejection, ok := l.rejected[key]; ok {
+		l.mu.Unlock()
+		l.send(rejection, addr)
+		return
+	}
+	if l.pending[key] {
+		l.mu.Unlock()
+		return
+	}
+	l.pending[key] = true
+	l.mu.Unlock()
+
+	// authorization may call other services, don't block the read loop
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			delete(l.pending, key)
+			l.mu.Unlock()
+		}()
+
+		if req.extensionField&extFlagKMREQ != 0 {
+			// we don't support encryption (yet)
+			l.sendRejection(req, addr, key, RejectUnsecure)
+			return
+		}
+
+		var streamID string
+		if ext, ok := req.extension(extSID); ok {
+			streamID = decodeStreamID(ext.content)
+		}
+
+		if l.config.Authorize != nil {
+			reason := l.config.Authorize(ConnRequest{StreamID: streamID, RemoteAddr: addr})
+			if reason != RejectNone {
+				l.sendRejection(req, addr, key, reason)
+				return
+			}
+		}
+
+		l.accept(req, addr, key, streamID)
+	}()
+}
+
+func (l *Listener) accept(req *handshake, addr *net.UDPAddr, key string, streamID string) {
+	// the caller's sender delay is the latency it wants us to use
+	latency := l.config.Latency
+	if ext, ok := req.extension(extHSREQ); ok && len(ext.content) >= 12 {
+		peerSendDelay := time.Duration(binary.BigEndian.Uint32(ext.content[8:12])&0xFFFF) * time.Millisecond
+		if peerSendDelay > latency {
+			latency = peerSendDelay
+		}
+	}
+
+	mtu := req.mtu
+	if mtu > maxPacketSize || mtu == 0 {
+		mtu = maxPacketSize
+	}
+
+	socketID := l.newSocketID()
+	res := &handshake{
+		version:        5,
+		encryption:     0,
+		extensionField: extFlagHSREQ,
+		initialSeq:     req.initialSeq,
+		mtu:            mtu,
+		flowWindow:     min(req.flowWindow, receiveWindow),
+		hsType:         handshakeConclusion,
+		socketID:       socketID,
+		synCookie:      req.synCookie,
+		peerIP:         peerIPField(addr),
+		extensions: []handshakeExtension{
+			hsExtension(extHSRSP, flagTSBPDSND|flagTSBPDRCV|flagTLPKTDROP|flagPERIODICNAK|flagREXMITFLG, uint16(latency.Milliseconds()), 0),
+		},
+	}
+
+	c := newConn(l, addr, socketID, req.socketID, req.initialSeq, streamID, latency)
+	c.conclusionResponse = res
+
+	l.mu.Lock()
+	l.conns[socketID] = c
+	l.established[key] = c
+	l.mu.Unlock()
+
+	l.sendHandshake(res, req.socketID, addr)
+
+	select {
+	case l.acceptQueue <- c:
+		go c.run()
+	case <-l.closed:
+		c.Close()
+	default:
+		logger.Errorf("srt accept backlog is full, dropping caller %s", addr)
+		c.Close()
+	}
+}
+
+func (l *Listener) sendRejection(req *handshake, addr *net.UDPAddr, key string, reason RejectReason) {
+	res := &handshake{
+		version:        5,
+		initialSeq:     req.initialSeq,
+		mtu:            maxPacketSize,
+		flowWindow:     req.flowWindow,
+		hsType:         handshakeType(reason),
+		synCookie:      req.synCookie,
+		peerIP:         peerIPField(addr),
+		extensionField: 0,
+	}
+
+	p := newControlPacket(controlHandshake, 0, res.marshal())
+	p.destSocketID = req.socketID
+	b := p.marshal()
+
+	l.mu.Lock()
+	l.rejected[key] = b
+	l.mu.Unlock()
+
+	// forget the rejection after a while, the caller may retry with a valid key
+	time.AfterFunc(5*time.Second, func() {
+		l.mu.Lock()
+		delete(l.rejected, key)
+		l.mu.Unlock()
+	})
+
+	logger.Infow("srt caller rejected", "addr", addr.String(), "reason", uint32(reason))
+	l.send(b, addr)
+}
+
+func (l *Listener) sendHandshake(hs *handshake, destSocketID uint32, addr *net.UDPAddr) {
+	p := newControlPacket(controlHandshake, 0, hs.marshal())
+	p.destSocketID = destSocketID
+	l.send(p.marshal(), addr)
+}
+
+func (l *Listener) send(b []byte, addr net.Addr) {
+	if _, err := l.pc.WriteTo(b, addr); err != nil {
+		select {
+		case <-l.closed:
+		default:
+			logger.Debugf("srt failed to send packet to %s: %s", addr, err)
+		}
+	}
+}
+
+// remove the connection from the listener, called when the connection is closed
+func (l *Listener) forget(c *Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.conns, c.socketID)
+	for key, established := range l.established {
+		if established == c {
+			delete(l.established, key)
+		}
+	}
+}
+
+func sameAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+func (l *Listener) newSocketID() uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := make([]byte, 4)
+	for {
+		rand.Read(b)
+		id := binary.BigEndian.Uint32(b) & 0x3FFFFFFF
+		if _, ok := l.conns[id]; id != 0 && !ok {
+			return id
+		}
+	}
+}
+
+// the syn cookie proves the caller went through the induction phase from the same address
+// it is valid for the current and the previous minute
+func (l *Listener) cookie(addr *net.UDPAddr, t time.Time) uint32 {
+	h := sha256.New()
+	h.Write(l.secret)
+	h.Write([]byte(addr.String()))
+	binary.Write(h, binary.BigEndian, t.Unix()/60)
+
+	return binary.BigEndian.Uint32(h.Sum(nil)[:4])
+}
+
+func (l *Listener) validCookie(cookie uint32, addr *net.UDPAddr) bool {
+	now := time.Now()
+	return cookie == l.cookie(addr, now) || cookie == l.cookie(addr, now.Add(-time.Minute))
+}
@@ -0,0 +1,123 @@
+package srt
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	headerSize = 16
+
+	// sequence numbers are 31 bits and wrap around
+	maxSeqNumber       = 0x7FFFFFFF
+	seqNumberThreshold = 0x3FFFFFFF
+)
+
+type controlType uint16
+
+const (
+	controlHandshake controlType = 0x0000
+	controlKeepAlive controlType = 0x0001
+	controlACK       controlType = 0x0002
+	controlNAK       controlType = 0x0003
+	controlShutdown  controlType = 0x0005
+	controlACKACK    controlType = 0x0006
+	controlDropReq   controlType = 0x0007
+)
+
+// packet is either a data packet or a control packet, depending on isControl
+type packet struct {
+	isControl bool
+
+	// data packet
+	seqNumber uint32
+	msgFlags  uint32 // position, order, encryption key, retransmitted flags and message number
+
+	// control packet
+	controlType  controlType
+	subtype      uint16
+	typeSpecific uint32
+
+	timestamp    uint32
+	destSocketID uint32
+	payload      []byte // data payload or control information field
+}
+
+func (p *packet) isEncrypted() bool {
+	// the KK bits
+	return (p.msgFlags>>27)&0x3 != 0
+}
+
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("packet too short (%d bytes)", len(b))
+	}
+
+	p := &packet{}
+	first := binary.BigEndian.Uint32(b[0:4])
+
+	if first&0x80000000 != 0 {
+		p.isControl = true
+		p.controlType = controlType((first >> 16) & 0x7FFF)
+		p.subtype = uint16(first & 0xFFFF)
+		p.typeSpecific = binary.BigEndian.Uint32(b[4:8])
+	} else {
+		p.seqNumber = first & maxSeqNumber
+		p.msgFlags = binary.BigEndian.Uint32(b[4:8])
+	}
+
+	p.timestamp = binary.BigEndian.Uint32(b[8:12])
+	p.destSocketID = binary.BigEndian.Uint32(b[12:16])
+
+	// the read buffer is reused by the listener so we need our own copy
+	p.payload = make([]byte, len(b)-headerSize)
+	copy(p.payload, b[headerSize:])
+
+	return p, nil
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, headerSize+len(p.payload))
+
+	if p.isControl {
+		binary.BigEndian.PutUint32(b[0:4], 0x80000000|uint32(p.controlType)<<16|uint32(p.subtype))
+		binary.BigEndian.PutUint32(b[4:8], p.typeSpecific)
+	} else {
+		binary.BigEndian.PutUint32(b[0:4], p.seqNumber&maxSeqNumber)
+		binary.BigEndian.PutUint32(b[4:8], p.msgFlags)
+	}
+
+	binary.BigEndian.PutUint32(b[8:12], p.timestamp)
+	binary.BigEndian.PutUint32(b[12:16], p.destSocketID)
+	copy(b[headerSize:], p.payload)
+
+	return b
+}
+
+func newControlPacket(t controlType, typeSpecific uint32, cif []byte) *packet {
+	return &packet{
+		isControl:    true,
+		controlType:  t,
+		typeSpecific: typeSpecific,
+		payload:      cif,
+	}
+}
+
+func seqNext(seq uint32) uint32 {
+	return (seq + 1) & maxSeqNumber
+}
+
+// seqCompare returns a negative number if a is before b, zero if equal and positive if after (wrap around aware)
+func seqCompare(a, b uint32) int64 {
+	diff := int64(a) - int64(b)
+	if diff > seqNumberThreshold || diff < -seqNumberThreshold {
+		return -diff
+	}
+
+	return diff
+}
+
+// seqDistance returns how many sequence numbers there are from a to b
+func seqDistance(a, b uint32) uint32 {
+	return (b - a) & maxSeqNumber
+}
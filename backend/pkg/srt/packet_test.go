@@ -0,0 +1,131 @@
+package srt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacket_MarshalAndParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet packet
+	}{
+		{
+			name: "data",
+			packet: packet{
+				seqNumber:    12345,
+				msgFlags:     0xC0000001,
+				timestamp:    1000,
+				destSocketID: 42,
+				payload:      []byte("payload"),
+			},
+		},
+		{
+			name: "data at the highest sequence number",
+			packet: packet{
+				seqNumber:    maxSeqNumber,
+				timestamp:    1,
+				destSocketID: 7,
+				payload:      []byte{},
+			},
+		},
+		{
+			name: "nak",
+			packet: packet{
+				isControl:    true,
+				controlType:  controlNAK,
+				timestamp:    2000,
+				destSocketID: 42,
+				payload:      []byte{0x80, 0, 0, 1, 0, 0, 0, 5},
+			},
+		},
+		{
+			name: "ack with a subtype",
+			packet: packet{
+				isControl:    true,
+				controlType:  controlACK,
+				subtype:      3,
+				typeSpecific: 99,
+				destSocketID: 1,
+				payload:      make([]byte, 28),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parsePacket(tt.packet.marshal())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.packet, *parsed)
+		})
+	}
+}
+
+func TestPacket_Header(t *testing.T) {
+	b := []byte{
+		0x80, 0x02, 0x00, 0x00, // control, ACK
+		0x00, 0x00, 0x00, 0x09, // ack number
+		0x00, 0x00, 0x01, 0x00, // timestamp
+		0x00, 0x00, 0x00, 0x2A, // destination socket id
+		0xAA,
+	}
+
+	p, err := parsePacket(b)
+	assert.NoError(t, err)
+	assert.True(t, p.isControl)
+	assert.Equal(t, controlACK, p.controlType)
+	assert.Equal(t, uint32(9), p.typeSpecific)
+	assert.Equal(t, uint32(256), p.timestamp)
+	assert.Equal(t, uint32(42), p.destSocketID)
+	assert.Equal(t, []byte{0xAA}, p.payload)
+
+	// the payload must not alias the read buffer
+	b[16] = 0
+	assert.Equal(t, []byte{0xAA}, p.payload)
+
+	_, err = parsePacket(b[:headerSize-1])
+	assert.Error(t, err)
+}
+
+func TestPacket_Encrypted(t *testing.T) {
+	assert.False(t, (&packet{msgFlags: 0xC0000001}).isEncrypted())
+	assert.True(t, (&packet{msgFlags: 0x08000000}).isEncrypted())
+	assert.True(t, (&packet{msgFlags: 0x10000000}).isEncrypted())
+}
+
+func TestSeq_Wraparound(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b uint32
+		want int // the sign of seqCompare(a, b)
+	}{
+		{"equal", 10, 10, 0},
+		{"before", 10, 11, -1},
+		{"after", 11, 10, 1},
+		{"zero after the highest", 0, maxSeqNumber, 1},
+		{"highest before zero", maxSeqNumber, 0, -1},
+		{"across the wrap", 5, maxSeqNumber - 5, 1},
+		{"far but within half the space", seqNumberThreshold, 0, 1},
+		{"more than half the space is behind", seqNumberThreshold + 2, 0, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := seqCompare(tt.a, tt.b)
+			switch {
+			case tt.want < 0:
+				assert.Negative(t, got)
+			case tt.want > 0:
+				assert.Positive(t, got)
+			default:
+				assert.Zero(t, got)
+			}
+		})
+	}
+
+	assert.Equal(t, uint32(0), seqNext(maxSeqNumber))
+	assert.Equal(t, uint32(11), seqNext(10))
+	assert.Equal(t, uint32(11), seqDistance(maxSeqNumber-5, 5))
+	assert.Equal(t, uint32(0), seqDistance(5, 5))
+}
@@ -7,10 +7,21 @@ import (
 	"sen1or/lets-live/pkg/logger"
 	cfg "sen1or/lets-live/transcode/config"
 	usergateway "sen1or/lets-live/transcode/gateway/user/http"
+	"sen1or/lets-live/transcode/ingest"
+	"sen1or/lets-live/transcode/llhls"
 	"sen1or/lets-live/transcode/rtmp"
+	"sen1or/lets-live/transcode/session"
+	"sen1or/lets-live/transcode/srt"
+	"sen1or/lets-live/transcode/storage"
 	"sen1or/lets-live/transcode/storage/ipfs"
+	"sen1or/lets-live/transcode/storage/local"
+	"sen1or/lets-live/transcode/storage/s3"
+	"sen1or/lets-live/transcode/transcoder"
 	"sen1or/lets-live/transcode/watcher"
 	"sen1or/lets-live/transcode/webserver"
+	"sen1or/lets-live/transcode/whip"
+	"strings"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 	"sen1or/lets-live/pkg/discovery"
@@ -22,6 +33,12 @@ func main() {
 	logger.Init(logger.LogLevel(logger.Debug))
 	config := cfg.RetrieveConfig()
 
+	if err := validateConfig(*config); err != nil {
+		logger.Errorf("invalid config: %s", err)
+		os.Exit(1)
+	}
+	lowLatency := config.Transcode.LowLatency
+
 	if err := resetWorkingSpace(*config); err != nil {
 		logger.Panicf("failed to reset working space: %s", err)
 	}
@@ -37,23 +54,128 @@ func main() {
 	instanceID := discovery.GenerateInstanceID(config.Service.Name)
 	registry.Register(ctx, serviceHostPort, serviceHealthCheckURL, config.Service.Name, instanceID, config.Registry.Service.Tags)
 
-	allowedSuffixes := [2]string{".ts", ".m3u8"}
-	MyWebServer := webserver.NewWebServer(config.Webserver.Port, allowedSuffixes[:], config.Transcode.PublicHLSPath)
-	MyWebServer.ListenAndServe()
+	sessionManager := session.NewSessionManager()
+	userGateway := usergateway.NewUserGateway(registry)
+	// the live segments and the recordings go to the storage
+	remoteStorage, err := newStorage(*config)
+	if err != nil {
+		logger.Panicf("failed to set up the storage: %s", err)
+	}
+
+	publisher := ingest.NewPublisher(*config, userGateway, sessionManager, remoteStorage)
 
-	if config.IPFS.Enabled {
-		ipfsStorage := ipfs.NewIPFSStorage(context.Background(), config.IPFS.Gateway, &config.IPFS.BootstrapNodeAddr)
-		monitor := watcher.NewIPFSWatcher(config.Transcode.PrivateHLSPath, ipfsStorage, *config)
+	if remoteStorage != nil {
+		monitor := watcher.NewStorageWatcher(config.Transcode.PrivateHLSPath, remoteStorage, *config)
+		publisher.AddObserver(monitor)
 		go monitor.Watch()
 	}
 
-	userGateway := usergateway.NewUserGateway(registry)
+	allowedSuffixes := [7]string{".ts", ".m3u8", ".m4s", ".mp4", ".mpd", ".jpg", ".vtt"}
+	MyWebServer := webserver.NewWebServer(config.Webserver.Port, allowedSuffixes[:], config.Transcode.PublicHLSPath)
 
-	rtmpServer := rtmp.NewRTMPServer(rtmp.RTMPServerConfig{Port: config.RTMP.Port, Registry: &registry, Config: *config}, userGateway)
+	if lowLatency.Enabled {
+		partDuration := time.Duration(lowLatency.PartDuration) * time.Millisecond
+		partsPerSegment, err := transcoder.PartsPerSegment(config.Transcode.FFMpegSetting.HLSTime, partDuration)
+		if err != nil {
+			logger.Panicf("invalid low latency setting: %s", err)
+		}
+		MyWebServer.EnableLowLatency(llhls.Options{PartDuration: partDuration, PartsPerSegment: partsPerSegment})
+	}
+
+	if config.StorageType() == cfg.StorageLocal && len(config.Storage.Local.PublicURL) == 0 {
+		MyWebServer.AddStaticDirectory("/storage/", config.Storage.Local.Path)
+	}
+
+	if config.WHIP.Enabled {
+		whipServer, err := whip.NewWHIPServer(*config, publisher)
+		if err != nil {
+			logger.Panicf("failed to create whip server: %s", err)
+		}
+		MyWebServer.AddRoutes(whipServer.RegisterRoutes)
+	}
+
+	MyWebServer.ListenAndServe()
+
+	if config.Admin.Port > 0 {
+		adminServer := webserver.NewAdminServer(config.Admin.BindAddress, config.Admin.Port, sessionManager)
+		adminServer.ListenAndServe()
+	}
+
+	rtmpServer := rtmp.NewRTMPServer(rtmp.RTMPServerConfig{Port: config.RTMP.Port, Registry: &registry, Config: *config}, publisher)
 	go rtmpServer.Start()
+
+	if config.SRT.Enabled {
+		srtServer := srt.NewSRTServer(*config, publisher)
+		go srtServer.Start()
+	}
 	select {}
 }
 
+// validateConfig rejects the settings ffmpeg can't run with and the features that can't be used together
+func validateConfig(config cfg.Config) error {
+	if err := transcoder.ValidateSetting(config.Transcode.FFMpegSetting); err != nil {
+		return fmt.Errorf("invalid ffmpeg setting: %s", err)
+	}
+
+	if _, err := transcoder.ResolveProfile(config.Transcode.Profiles, config.Transcode.Profile); err != nil {
+		return fmt.Errorf("invalid encoder profile: %s", err)
+	}
+
+	lowLatency := config.Transcode.LowLatency
+	if lowLatency.Enabled {
+		// the parts are only on the disk of the transcode service, the blocking playlist reloads need them as soon as ffmpeg writes them
+		if config.HasStorage() {
+			return fmt.Errorf("low latency hls is served by the webserver, it can't be used with a storage")
+		}
+		if _, err := transcoder.PartsPerSegment(config.Transcode.FFMpegSetting.HLSTime, time.Duration(lowLatency.PartDuration)*time.Millisecond); err != nil {
+			return fmt.Errorf("invalid low latency setting: %s", err)
+		}
+	}
+
+	if config.Transcode.DASH.Enabled {
+		if config.Transcode.FFMpegSetting.SegmentType != transcoder.SegmentTypeFMP4 {
+			return fmt.Errorf("dash requires the %s segment type", transcoder.SegmentTypeFMP4)
+		}
+		if lowLatency.Enabled {
+			return fmt.Errorf("dash can't be used with low latency hls, its segments are served as parts")
+		}
+	}
+
+	if config.Transcode.DVR.Enabled {
+		if !config.HasStorage() {
+			return fmt.Errorf("dvr keeps the segments on the storage, configure one")
+		}
+		if config.Transcode.DVR.Window <= 0 {
+			return fmt.Errorf("invalid dvr window %d, it must be positive (seconds)", config.Transcode.DVR.Window)
+		}
+	}
+
+	if config.Transcode.Recording.Enabled && !config.HasStorage() {
+		return fmt.Errorf("recording needs a storage to upload the vods, configure one")
+	}
+
+	return nil
+}
+
+func newStorage(config cfg.Config) (storage.Storage, error) {
+	switch config.StorageType() {
+	case "":
+		return nil, nil
+	case cfg.StorageIPFS:
+		return ipfs.NewIPFSStorage(context.Background(), config.IPFS, config.LiveWindow()), nil
+	case cfg.StorageLocal:
+		publicURL := config.Storage.Local.PublicURL
+		if len(publicURL) == 0 {
+			publicURL = strings.TrimSuffix(config.Webserver.PublicURL, "/") + "/storage"
+		}
+		return local.NewLocalStorage(config.Storage.Local.Path, publicURL)
+	case cfg.StorageS3:
+		return s3.NewS3Storage(context.Background(), config.Storage.S3)
+	}
+
+	return nil, fmt.Errorf("unknown storage type %s", config.StorageType())
+}
+
 func resetWorkingSpace(config cfg.Config) error {
 	if err := os.RemoveAll(config.Transcode.PublicHLSPath); err != nil {
 		return err
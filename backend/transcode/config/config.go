@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"sen1or/lets-live/pkg/logger"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -37,34 +38,171 @@ type Config struct {
 	RTMP     struct {
 		Port               int    `yaml:"port"`
 		UserServiceAddress string `yaml:"userServiceAddress"`
+		TLS                struct {
+			Enabled  bool   `yaml:"enabled"`
+			Port     int    `yaml:"port"`
+			CertFile string `yaml:"certFile"`
+			KeyFile  string `yaml:"keyFile"`
+		} `yaml:"tls"` // rtmps listener, it runs alongside the plain rtmp one
 	} `yaml:"rtmp"`
+	SRT struct {
+		Enabled bool `yaml:"enabled"`
+		Port    int  `yaml:"port"`
+		Latency int  `yaml:"latency"` // receiver latency in milliseconds
+	} `yaml:"srt"` // callers with a passphrase are rejected, there is no encryption so the stream key in the stream id travels in cleartext
+	WHIP struct {
+		Enabled    bool     `yaml:"enabled"`
+		ICEServers []string `yaml:"iceServers"` // stun/turn urls
+		PublicIPs  []string `yaml:"publicIPs"`  // the ips advertised in ice candidates when the node is behind a nat
+		UDPPortMin int      `yaml:"udpPortMin"`
+		UDPPortMax int      `yaml:"udpPortMax"`
+	} `yaml:"whip"` // browser publishing over webrtc, served by the webserver
+	Ingest struct {
+		DuplicatePublishPolicy string `yaml:"duplicatePublishPolicy"` // what to do when a stream key is already live: "reject" (default) or "kick"
+	} `yaml:"ingest"` // settings shared by every ingest protocol
 	Transcode struct {
-		PublicHLSPath  string `yaml:"publicHLSPath"`
-		PrivateHLSPath string `yaml:"privateHLSPath"`
-		FFMpegSetting  struct {
-			FFMpegPath     string `yaml:"ffmpegPath"`
-			MasterFileName string `yaml:"masterFileName"`
-			HLSTime        int    `yaml:"hlsTime"`
-			CRF            int    `yaml:"crf"`
-			Preset         string `yaml:"preset"`
-			HlsListSize    int    `yaml:"hlsListSize"`
-			HlsMaxSize     int    `yaml:"hlsMaxSize"`
-			Qualities      []struct {
-				Resolution string `yaml:"resolution"`
-				MaxBitrate string `yaml:"maxBitrate"`
-				FPS        int    `yaml:"fps"`
-				BufSize    string `yaml:"bufSize"`
-			} `yaml:"qualities"`
-		} `yaml:"ffmpegSetting"`
+		PublicHLSPath  string                    `yaml:"publicHLSPath"`
+		PrivateHLSPath string                    `yaml:"privateHLSPath"`
+		FFMpegSetting  FFMpegSetting             `yaml:"ffmpegSetting"`
+		Profile        string                    `yaml:"profile"`  // the encoder profile in use, the built in libx264/aac one if empty
+		Profiles       map[string]EncoderProfile `yaml:"profiles"` // encoder profiles by name
+		Restart        struct {
+			MaxAttempts    int `yaml:"maxAttempts"`    // restarts in a row before the publisher is disconnected, default 5
+			InitialBackoff int `yaml:"initialBackoff"` // milliseconds, doubled after each attempt, default 1000
+			MaxBackoff     int `yaml:"maxBackoff"`     // milliseconds, default 30000
+		} `yaml:"restart"` // ffmpeg is restarted if it exits while the publisher is still connected
+		Upload struct {
+			Workers        int `yaml:"workers"`        // playlists handled at the same time across every stream, default 4
+			MaxAttempts    int `yaml:"maxAttempts"`    // tries of a segment upload, default 3
+			InitialBackoff int `yaml:"initialBackoff"` // milliseconds between two tries, doubled after each one, default 500
+		} `yaml:"upload"` // segments are uploaded to the storage in order within a variant, a segment that can't be uploaded is served by the webserver
+		LowLatency struct {
+			Enabled      bool `yaml:"enabled"`
+			PartDuration int  `yaml:"partDuration"` // milliseconds, the hls time must be a multiple of it
+		} `yaml:"lowLatency"` // ll-hls with fmp4 parts, served by the webserver with blocking playlist reload, the parts and segments never leave the transcode service so the startup fails if a storage is configured
+		DASH struct {
+			Enabled bool `yaml:"enabled"`
+		} `yaml:"dash"` // a live mpd next to the master playlist, from the same segments, requires the fmp4 segment type
+		DVR struct {
+			Enabled bool `yaml:"enabled"`
+			Window  int  `yaml:"window"` // seconds viewers can rewind, 7200 for two hours
+		} `yaml:"dvr"` // the public playlists keep the segments already uploaded to the storage longer than the live window, requires a storage
+		Thumbnail struct {
+			Enabled  bool `yaml:"enabled"`
+			Interval int  `yaml:"interval"` // seconds between two captures, default 10, it is also the time covered by a sprite tile
+			Width    int  `yaml:"width"`    // of the thumbnail in pixels, default 320
+		} `yaml:"thumbnail"` // a preview image and a webvtt sprite sheet for the seek bar, published next to the master playlist
+		Recording struct {
+			Enabled bool   `yaml:"enabled"`
+			Path    string `yaml:"path"` // where the segments are kept until the publish ends, it is not cleaned on boot
+		} `yaml:"recording"` // every publish is uploaded to the storage as a vod once it ends and registered in the user service
 	} `yaml:"transcode"`
-	IPFS struct {
-		Enabled           bool   `yaml:"enabled"`
-		Gateway           string `yaml:"gateway"` // the gateway address, it is used to generate the final url to the ipfs file
-		BootstrapNodeAddr string `yaml:"bootstrapNodeAddr"`
-	} `yaml:"ipfs"`
+	Storage struct {
+		Type  string `yaml:"type"` // where the segments are uploaded: "ipfs", "local" or "s3", served by the webserver if empty
+		Local struct {
+			Path      string `yaml:"path"`      // it is not cleaned on boot, the files are named after their content
+			PublicURL string `yaml:"publicURL"` // how viewers reach the path, the webserver serves it at /storage/ if empty
+		} `yaml:"local"`
+		S3 S3Setting `yaml:"s3"`
+	} `yaml:"storage"`
+	IPFS      IPFSSetting `yaml:"ipfs"`
 	Webserver struct {
-		Port int `yaml:"port"`
+		Port      int    `yaml:"port"`
+		PublicURL string `yaml:"publicURL"` // how viewers reach the webserver (http://localhost:8889), for the urls given to the other services
 	} `yaml:"webserver"`
+	Admin struct {
+		BindAddress string `yaml:"bindAddress"` // 127.0.0.1 if empty, never expose it to the viewers
+		Port        int    `yaml:"port"`        // disabled if 0
+	} `yaml:"admin"` // the session list and kick endpoints, without auth so they are kept off the public webserver
+}
+
+type IPFSSetting struct {
+	Enabled           bool     `yaml:"enabled"` // the ipfs storage, same as storage.type: ipfs`
+	Gateway           string   `yaml:"gateway"` // the gateway address, it is used to generate the final url to the ipfs file
+	BootstrapNodeAddr string   `yaml:"bootstrapNodeAddr"`
+	RepoPath          string   `yaml:"repoPath"`      // where the node keeps the blocks and the dht records (leveldb), in memory if empty
+	IdentityPath      string   `yaml:"identityPath"`  // the private key of the node, created if missing, the peer id changes each boot if empty
+	ListenAddrs       []string `yaml:"listenAddrs"`   // multiaddrs, /ip4/0.0.0.0/tcp/4001 if empty
+	AnnounceAddrs     []string `yaml:"announceAddrs"` // the multiaddrs given to the other peers instead of the listen ones (nat, containers)
+	GC                struct {
+		Interval int `yaml:"interval"` // seconds between two passes, default 300
+	} `yaml:"gc"` // the expired content is unpinned, then the blocks no pin links are removed
+	Retention struct {
+		Live int `yaml:"live"` // seconds the segments and thumbnails stay pinned after their upload, default twice the live window
+		VOD  int `yaml:"vod"`  // seconds the recordings stay pinned, forever if 0
+	} `yaml:"retention"`
+}
+
+// S3Setting is an s3 compatible object store (aws, minio, r2...)
+type S3Setting struct {
+	Endpoint  string `yaml:"endpoint"` // host[:port], without the scheme
+	UseSSL    bool   `yaml:"useSSL"`
+	Region    string `yaml:"region"` // us-east-1 if empty
+	Bucket    string `yaml:"bucket"` // created if missing, it must allow anonymous reads unless publicURL points at a cdn in front of it
+	Prefix    string `yaml:"prefix"` // of the object keys
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	PublicURL string `yaml:"publicURL"` // the url of the bucket for the viewers, the path style url of the endpoint if empty
+}
+
+const (
+	StorageIPFS  = "ipfs"
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// StorageType returns the storage the segments are uploaded to, empty if they are served by the webserver
+func (c Config) StorageType() string {
+	if len(c.Storage.Type) == 0 && c.IPFS.Enabled {
+		return StorageIPFS
+	}
+
+	return c.Storage.Type
+}
+
+// HasStorage tells if the segments are uploaded, ffmpeg then writes to the private hls path and the watcher publishes the playlists
+func (c Config) HasStorage() bool {
+	return len(c.StorageType()) > 0
+}
+
+// LiveWindow returns how far back the public playlists go, the dvr window if enabled
+func (c Config) LiveWindow() time.Duration {
+	if c.Transcode.DVR.Enabled {
+		return time.Duration(c.Transcode.DVR.Window) * time.Second
+	}
+
+	ffmpeg := c.Transcode.FFMpegSetting
+	return time.Duration(ffmpeg.HlsListSize*ffmpeg.HLSTime) * time.Second
+}
+
+type FFMpegSetting struct {
+	FFMpegPath     string    `yaml:"ffmpegPath"`
+	MasterFileName string    `yaml:"masterFileName"`
+	HLSTime        int       `yaml:"hlsTime"`
+	CRF            int       `yaml:"crf"`
+	Preset         string    `yaml:"preset"`
+	HlsListSize    int       `yaml:"hlsListSize"`
+	HlsMaxSize     int       `yaml:"hlsMaxSize"`
+	SegmentType    string    `yaml:"segmentType"` // "mpegts" (default) or "fmp4" for cmaf segments (.m4s and an init.mp4), ll-hls always uses fmp4
+	Qualities      []Quality `yaml:"qualities"`
+}
+
+type Quality struct {
+	Resolution string `yaml:"resolution"` // can be empty for the source rendition to keep the source resolution
+	MaxBitrate string `yaml:"maxBitrate"`
+	FPS        int    `yaml:"fps"`
+	BufSize    string `yaml:"bufSize"`
+	Source     bool   `yaml:"source"` // copy the incoming h264 as is when it fits in max bitrate, it is encoded otherwise
+}
+
+// EncoderProfile is the codec setup shared by every quality, empty fields use the built in values
+type EncoderProfile struct {
+	VideoCodec      string `yaml:"videoCodec"` // libx264 or a hardware encoder (h264_nvenc, h264_qsv, h264_vaapi...)
+	X264Params      string `yaml:"x264Params"` // given to -x264-params, libx264 only
+	AudioCodec      string `yaml:"audioCodec"`
+	AudioChannels   int    `yaml:"audioChannels"`
+	AudioSampleRate int    `yaml:"audioSampleRate"`
+	AudioBitrate    string `yaml:"audioBitrate"`
 }
 
 func RetrieveConfig() *Config {
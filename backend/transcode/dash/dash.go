@@ -0,0 +1,528 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/m3u8"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the mpd is derived from the hls output of ffmpeg (fmp4 segments), so hls and dash share the same segments
+// the master playlist gives the renditions, the variant playlists give the segments
+// segments are listed one by one (not with a template) because their remote urls (ipfs) have nothing in common
+// the audio is muxed with the video in every rendition, as in the hls output
+//
+// the segment times are the decode times of the fmp4 (tfdt), which start near 0 when ffmpeg starts
+// EXT-X-PROGRAM-DATE-TIME places them on the wall clock: every ffmpeg run (the first one and each restart) is a period
+// starting at the date of its first segment, with a presentationTimeOffset mapping the media time to the period start
+
+const ManifestName = "manifest.mpd"
+
+// segments of the same ffmpeg run map their media time to the wall clock with the same origin, up to the date precision
+const periodTolerance = 500 * time.Millisecond
+
+// Options describes the hls output the mpd is generated from
+type Options struct {
+	MasterFileName  string
+	SegmentDuration time.Duration
+}
+
+func NewOptions(setting config.FFMpegSetting) Options {
+	return Options{
+		MasterFileName:  setting.MasterFileName,
+		SegmentDuration: time.Duration(setting.HLSTime) * time.Second,
+	}
+}
+
+type mpd struct {
+	XMLName                    xml.Name `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                   string   `xml:"profiles,attr"`
+	Type                       string   `xml:"type,attr"`
+	AvailabilityStartTime      string   `xml:"availabilityStartTime,attr"`
+	PublishTime                string   `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string   `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string   `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string   `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string   `xml:"suggestedPresentationDelay,attr"`
+	Periods                    []period `xml:"Period"`
+}
+
+type period struct {
+	ID            string        `xml:"id,attr"`
+	Start         string        `xml:"start,attr"`
+	AdaptationSet adaptationSet `xml:"AdaptationSet"`
+}
+
+type adaptationSet struct {
+	MimeType         string           `xml:"mimeType,attr"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	StartWithSAP     int              `xml:"startWithSAP,attr"`
+	Representations  []representation `xml:"Representation"`
+}
+
+type representation struct {
+	ID          string      `xml:"id,attr"`
+	Bandwidth   int         `xml:"bandwidth,attr"`
+	Codecs      string      `xml:"codecs,attr,omitempty"`
+	Width       int         `xml:"width,attr,omitempty"`
+	Height      int         `xml:"height,attr,omitempty"`
+	FrameRate   string      `xml:"frameRate,attr,omitempty"`
+	SegmentList segmentList `xml:"SegmentList"`
+}
+
+type segmentList struct {
+	Timescale              uint32          `xml:"timescale,attr"`
+	PresentationTimeOffset uint64          `xml:"presentationTimeOffset,attr"`
+	StartNumber            int             `xml:"startNumber,attr"`
+	Initialization         *initialization `xml:"Initialization,omitempty"`
+	SegmentTimeline        segmentTimeline `xml:"SegmentTimeline"`
+	SegmentURLs            []segmentURL    `xml:"SegmentURL"`
+}
+
+type initialization struct {
+	SourceURL string `xml:"sourceURL,attr"`
+}
+
+type segmentTimeline struct {
+	S []timelineEntry `xml:"S"`
+}
+
+type timelineEntry struct {
+	T uint64 `xml:"t,attr"`
+	D uint64 `xml:"d,attr"`
+}
+
+type segmentURL struct {
+	Media string `xml:"media,attr"`
+}
+
+// a rendition in the master playlist
+type variant struct {
+	uri       string
+	bandwidth int
+	codecs    string
+	width     int
+	height    int
+	frameRate string
+	segments  []segment
+}
+
+type segment struct {
+	uri      string
+	number   int
+	initURI  string
+	duration time.Duration
+	start    time.Time // from EXT-X-PROGRAM-DATE-TIME
+	track    track
+	// decode time in the track timescale
+	decodeTime uint64
+}
+
+// the wall clock time the media time 0 of the segment maps to
+func (s segment) origin() time.Time {
+	return s.start.Add(-mediaDuration(s.decodeTime, s.track.timescale))
+}
+
+type mediaPeriod struct {
+	start  time.Time
+	origin time.Time
+	// presentationTimeOffset by variant uri, kept so the period does not move when its first segments leave the window
+	offsets map[string]uint64
+}
+
+// Generator writes the mpd of a stream, it remembers the periods and the decode times of the segments between updates
+// since ffmpeg deletes the oldest segment files while they can still be listed (remote playlists, dvr window)
+type Generator struct {
+	streamDir  string
+	segmentDir string
+	options    Options
+
+	mu                    sync.Mutex
+	availabilityStartTime time.Time
+	periods               []*mediaPeriod
+	tracks                map[string]cachedTrack
+	decodeTimes           map[string]uint64
+}
+
+type cachedTrack struct {
+	track   track
+	modTime time.Time
+}
+
+// NewGenerator writes the mpd next to the master playlist in streamDir, segmentDir is where ffmpeg writes the fmp4 files
+// (the same directory unless a storage serves the segments)
+func NewGenerator(streamDir string, segmentDir string, options Options) *Generator {
+	return &Generator{
+		streamDir:   streamDir,
+		segmentDir:  segmentDir,
+		options:     options,
+		tracks:      make(map[string]cachedTrack),
+		decodeTimes: make(map[string]uint64),
+	}
+}
+
+// Generate writes the mpd of the stream next to its master playlist
+// it fails with os.ErrNotExist until ffmpeg wrote the playlists
+func (g *Generator) Generate() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	masterData, err := os.ReadFile(filepath.Join(g.streamDir, g.options.MasterFileName))
+	if err != nil {
+		return err
+	}
+
+	master, err := m3u8.ParseMaster(bytes.NewReader(masterData))
+	if err != nil {
+		return fmt.Errorf("invalid master playlist %s: %s", g.options.MasterFileName, err)
+	}
+	if len(master.Variants) == 0 {
+		return fmt.Errorf("no variant in %s", g.options.MasterFileName)
+	}
+
+	listed := make(map[string]bool)
+	variants := make([]variant, 0, len(master.Variants))
+	for _, v := range master.Variants {
+		data, err := os.ReadFile(filepath.Join(g.streamDir, filepath.FromSlash(v.URI)))
+		if err != nil {
+			return err
+		}
+
+		playlist, err := m3u8.ParseMedia(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("invalid variant playlist %s: %s", v.URI, err)
+		}
+
+		// a missing init section is os.ErrNotExist too
+		parsed, err := g.readVariant(v, playlist, listed)
+		if err != nil {
+			return fmt.Errorf("variant %s: %w", v.URI, err)
+		}
+		variants = append(variants, parsed)
+	}
+
+	for key := range g.decodeTimes {
+		if !listed[key] {
+			delete(g.decodeTimes, key)
+		}
+	}
+
+	manifest, err := g.render(variants, time.Now())
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	// write then rename so players never read a partial manifest
+	tmpPath := filepath.Join(g.streamDir, ManifestName+".tmp")
+	if err := os.WriteFile(tmpPath, manifest, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(g.streamDir, ManifestName))
+}
+
+// readVariant places the segments of a variant playlist on the media timeline
+// the segments whose file is gone before its decode time was read are left out
+func (g *Generator) readVariant(v m3u8.Variant, playlist *m3u8.MediaPlaylist, listed map[string]bool) (variant, error) {
+	result := variant{uri: v.URI}
+	for key, value := range m3u8.ParseAttributes(v.Attributes) {
+		switch key {
+		case "BANDWIDTH":
+			result.bandwidth, _ = strconv.Atoi(value)
+		case "CODECS":
+			result.codecs = value
+		case "RESOLUTION":
+			width, height, _ := strings.Cut(value, "x")
+			result.width, _ = strconv.Atoi(width)
+			result.height, _ = strconv.Atoi(height)
+		case "FRAME-RATE":
+			result.frameRate = value
+		}
+	}
+
+	variantDir := filepath.Join(g.segmentDir, filepath.FromSlash(path.Dir(v.URI)))
+
+	var initURI string
+	var programDateTime time.Time
+	for i, s := range playlist.Segments {
+		segmentDuration := time.Duration(s.Duration * float64(time.Second))
+		if s.Map != nil {
+			initURI = s.Map.URI
+		}
+		if len(s.ProgramDateTime) > 0 {
+			t, err := parseDateTime(s.ProgramDateTime)
+			if err != nil {
+				return variant{}, fmt.Errorf("invalid program date time %q", s.ProgramDateTime)
+			}
+			programDateTime = t
+		}
+		start := programDateTime
+
+		// ffmpeg only writes the date before some segments, the next one starts where this one ends
+		if !programDateTime.IsZero() {
+			programDateTime = programDateTime.Add(segmentDuration)
+		}
+
+		if start.IsZero() {
+			return variant{}, fmt.Errorf("segment %s has no program date time", s.URI)
+		}
+		if len(initURI) == 0 {
+			return variant{}, fmt.Errorf("segment %s has no init section", s.URI)
+		}
+
+		t, err := g.readTrack(filepath.Join(variantDir, fileName(initURI)))
+		if err != nil {
+			return variant{}, err
+		}
+
+		segmentPath := filepath.Join(variantDir, fileName(s.URI))
+		decodeTime, ok := g.decodeTimes[segmentPath]
+		if !ok {
+			decodeTime, err = readDecodeTime(segmentPath, t.id)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return variant{}, fmt.Errorf("segment %s: %s", s.URI, err)
+			}
+			g.decodeTimes[segmentPath] = decodeTime
+		}
+		listed[segmentPath] = true
+
+		result.segments = append(result.segments, segment{
+			uri:        s.URI,
+			number:     playlist.MediaSequence + i,
+			initURI:    initURI,
+			duration:   segmentDuration,
+			start:      start,
+			track:      t,
+			decodeTime: decodeTime,
+		})
+	}
+
+	return result, nil
+}
+
+// ffmpeg rewrites the init section when it restarts
+func (g *Generator) readTrack(initPath string) (track, error) {
+	info, err := os.Stat(initPath)
+	if err != nil {
+		return track{}, err
+	}
+
+	if cached, ok := g.tracks[initPath]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.track, nil
+	}
+
+	t, err := readTrack(initPath)
+	if err != nil {
+		return track{}, fmt.Errorf("init section %s: %s", initPath, err)
+	}
+	g.tracks[initPath] = cachedTrack{track: t, modTime: info.ModTime()}
+
+	return t, nil
+}
+
+// periodOf finds the period of the ffmpeg run that wrote the segment
+func (g *Generator) periodOf(s segment) *mediaPeriod {
+	origin := s.origin()
+	for _, p := range g.periods {
+		if diff := origin.Sub(p.origin); diff > -periodTolerance && diff < periodTolerance {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// updatePeriods creates the periods of the new ffmpeg runs and forgets the ones no longer listed
+func (g *Generator) updatePeriods(variants []variant) {
+	used := make(map[*mediaPeriod]bool)
+	created := make(map[*mediaPeriod]bool)
+	for _, v := range variants {
+		for _, s := range v.segments {
+			p := g.periodOf(s)
+			if p == nil {
+				p = &mediaPeriod{start: s.start, origin: s.origin(), offsets: make(map[string]uint64)}
+				g.periods = append(g.periods, p)
+				created[p] = true
+			}
+			// the renditions are read one after the other, a new period starts at the earliest of their segments
+			if created[p] && s.start.Before(p.start) {
+				p.start = s.start
+			}
+			used[p] = true
+		}
+	}
+
+	kept := g.periods[:0]
+	for _, p := range g.periods {
+		if used[p] {
+			kept = append(kept, p)
+		}
+	}
+	g.periods = kept
+	sort.Slice(g.periods, func(i, j int) bool { return g.periods[i].start.Before(g.periods[j].start) })
+
+	if g.availabilityStartTime.IsZero() && len(g.periods) > 0 {
+		g.availabilityStartTime = g.periods[0].start
+	}
+}
+
+func (g *Generator) render(variants []variant, now time.Time) ([]byte, error) {
+	segmentSeconds := g.options.SegmentDuration.Seconds()
+	g.updatePeriods(variants)
+
+	manifest := mpd{
+		Profiles:              "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                  "dynamic",
+		AvailabilityStartTime: g.availabilityStartTime.UTC().Format(time.RFC3339Nano),
+		PublishTime:           now.UTC().Format(time.RFC3339),
+		MinimumUpdatePeriod:   duration(segmentSeconds),
+		MinBufferTime:         duration(segmentSeconds),
+		// the playlists decide how far back viewers can go (the live window or the dvr window)
+		TimeShiftBufferDepth:       duration(math.Max(listedDuration(variants), segmentSeconds)),
+		SuggestedPresentationDelay: duration(segmentSeconds * 3),
+	}
+
+	for _, p := range g.periods {
+		out := period{
+			ID:    strconv.FormatInt(p.start.UnixMilli(), 10),
+			Start: duration(p.start.Sub(g.availabilityStartTime).Seconds()),
+			AdaptationSet: adaptationSet{
+				MimeType:         "video/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+			},
+		}
+
+		for index, v := range variants {
+			var list *segmentList
+			for _, s := range v.segments {
+				if g.periodOf(s) != p {
+					continue
+				}
+
+				timescale := s.track.timescale
+				if list == nil {
+					offset, ok := p.offsets[v.uri]
+					if !ok {
+						offset = presentationTimeOffset(s, p.start)
+						p.offsets[v.uri] = offset
+					}
+
+					list = &segmentList{
+						Timescale:              timescale,
+						PresentationTimeOffset: offset,
+						StartNumber:            s.number,
+						Initialization:         &initialization{SourceURL: resolve(v.uri, s.initURI)},
+					}
+				}
+
+				list.SegmentTimeline.S = append(list.SegmentTimeline.S, timelineEntry{
+					T: s.decodeTime,
+					D: uint64(math.Round(s.duration.Seconds() * float64(timescale))),
+				})
+				list.SegmentURLs = append(list.SegmentURLs, segmentURL{Media: resolve(v.uri, s.uri)})
+			}
+			if list == nil {
+				continue
+			}
+
+			out.AdaptationSet.Representations = append(out.AdaptationSet.Representations, representation{
+				ID:          strconv.Itoa(index),
+				Bandwidth:   v.bandwidth,
+				Codecs:      v.codecs,
+				Width:       v.width,
+				Height:      v.height,
+				FrameRate:   v.frameRate,
+				SegmentList: *list,
+			})
+		}
+
+		manifest.Periods = append(manifest.Periods, out)
+	}
+
+	// nothing listed yet
+	if len(manifest.Periods) == 0 {
+		return nil, nil
+	}
+
+	out, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), out...), nil
+}
+
+// the media time of the segment that is presented at the start of the period
+func presentationTimeOffset(s segment, periodStart time.Time) uint64 {
+	ticks := float64(s.decodeTime) - s.start.Sub(periodStart).Seconds()*float64(s.track.timescale)
+	return uint64(math.Max(0, math.Round(ticks)))
+}
+
+func mediaDuration(ticks uint64, timescale uint32) time.Duration {
+	return time.Duration(float64(ticks) / float64(timescale) * float64(time.Second))
+}
+
+// the name of the file ffmpeg wrote, remote urls carry it in the fileName parameter
+func fileName(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		if name := u.Query().Get("fileName"); len(name) > 0 {
+			return path.Base(name)
+		}
+		return path.Base(u.Path)
+	}
+
+	return path.Base(uri)
+}
+
+// resolve the uri of a variant playlist entry relative to the mpd, remote (ipfs) urls are kept as is
+func resolve(variantURI string, uri string) string {
+	if strings.Contains(uri, "://") || strings.HasPrefix(uri, "/") {
+		return uri
+	}
+
+	return path.Join(path.Dir(variantURI), uri)
+}
+
+// the longest time covered by the segments of a variant, in seconds
+func listedDuration(variants []variant) float64 {
+	var longest time.Duration
+	for _, v := range variants {
+		var total time.Duration
+		for _, s := range v.segments {
+			total += s.duration
+		}
+		longest = max(longest, total)
+	}
+
+	return longest.Seconds()
+}
+
+func duration(seconds float64) string {
+	return "PT" + strconv.FormatFloat(seconds, 'f', -1, 64) + "S"
+}
+
+// ffmpeg writes the offset without a colon (2024-11-30T17:30:24.000+0000)
+func parseDateTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unknown date time format")
+}
@@ -0,0 +1,259 @@
+package dash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// just enough of the iso bmff boxes to place the fmp4 segments of ffmpeg on the media timeline:
+// the video track of the init section (id and timescale) and the decode time of a segment (tfdt)
+
+var errNoTrack = errors.New("no track found")
+
+// track is the track the timeline of a representation follows, the video one if there is one
+type track struct {
+	id        uint32
+	timescale uint32
+}
+
+type box struct {
+	boxType string
+	payload []byte
+}
+
+// readBoxes splits data into boxes, a truncated last box is an error
+func readBoxes(data []byte) ([]box, error) {
+	var boxes []box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated box header")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("truncated %s box header", boxType)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid %s box size %d", boxType, size)
+		}
+
+		boxes = append(boxes, box{boxType: boxType, payload: data[headerSize:size]})
+		data = data[size:]
+	}
+
+	return boxes, nil
+}
+
+func findBox(boxes []box, boxType string) (box, bool) {
+	for _, b := range boxes {
+		if b.boxType == boxType {
+			return b, true
+		}
+	}
+
+	return box{}, false
+}
+
+// childBoxes returns the boxes inside the box found by following the path (moov, trak, mdia...)
+func childBoxes(boxes []box, path ...string) ([]box, error) {
+	for _, boxType := range path {
+		b, ok := findBox(boxes, boxType)
+		if !ok {
+			return nil, fmt.Errorf("missing %s box", boxType)
+		}
+
+		var err error
+		if boxes, err = readBoxes(b.payload); err != nil {
+			return nil, err
+		}
+	}
+
+	return boxes, nil
+}
+
+// readTrack finds the video track of an init section, the first track if there is no video
+func readTrack(initPath string) (track, error) {
+	data, err := os.ReadFile(initPath)
+	if err != nil {
+		return track{}, err
+	}
+
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return track{}, err
+	}
+	moov, err := childBoxes(boxes, "moov")
+	if err != nil {
+		return track{}, err
+	}
+
+	var first *track
+	for _, trak := range moov {
+		if trak.boxType != "trak" {
+			continue
+		}
+
+		t, handler, err := parseTrak(trak.payload)
+		if err != nil {
+			return track{}, err
+		}
+		if handler == "vide" {
+			return t, nil
+		}
+		if first == nil {
+			first = &t
+		}
+	}
+
+	if first == nil {
+		return track{}, errNoTrack
+	}
+
+	return *first, nil
+}
+
+// the track id (tkhd), the timescale (mdhd) and the handler type (hdlr) of a trak box
+func parseTrak(payload []byte) (track, string, error) {
+	boxes, err := readBoxes(payload)
+	if err != nil {
+		return track{}, "", err
+	}
+
+	var t track
+	tkhd, ok := findBox(boxes, "tkhd")
+	if !ok {
+		return track{}, "", fmt.Errorf("missing tkhd box")
+	}
+	// version and flags, then the creation and modification times (64 bits in version 1)
+	idOffset := 12
+	if len(tkhd.payload) > 0 && tkhd.payload[0] == 1 {
+		idOffset = 20
+	}
+	if len(tkhd.payload) < idOffset+4 {
+		return track{}, "", fmt.Errorf("truncated tkhd box")
+	}
+	t.id = binary.BigEndian.Uint32(tkhd.payload[idOffset : idOffset+4])
+
+	mdia, err := childBoxes(boxes, "mdia")
+	if err != nil {
+		return track{}, "", err
+	}
+
+	mdhd, ok := findBox(mdia, "mdhd")
+	if !ok {
+		return track{}, "", fmt.Errorf("missing mdhd box")
+	}
+	timescaleOffset := 12
+	if len(mdhd.payload) > 0 && mdhd.payload[0] == 1 {
+		timescaleOffset = 20
+	}
+	if len(mdhd.payload) < timescaleOffset+4 {
+		return track{}, "", fmt.Errorf("truncated mdhd box")
+	}
+	t.timescale = binary.BigEndian.Uint32(mdhd.payload[timescaleOffset : timescaleOffset+4])
+	if t.timescale == 0 {
+		return track{}, "", fmt.Errorf("invalid timescale 0")
+	}
+
+	var handler string
+	if hdlr, ok := findBox(mdia, "hdlr"); ok && len(hdlr.payload) >= 12 {
+		handler = string(hdlr.payload[8:12])
+	}
+
+	return t, handler, nil
+}
+
+// readDecodeTime returns the decode time of the first sample of the track in the segment (tfdt), in the track timescale
+// only the boxes up to the first moof are read, not the media data
+func readDecodeTime(segmentPath string, trackID uint32) (uint64, error) {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(file, header[:8]); err != nil {
+			return 0, fmt.Errorf("no moof box: %w", err)
+		}
+
+		size := uint64(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := uint64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(file, header[8:16]); err != nil {
+				return 0, err
+			}
+			size = binary.BigEndian.Uint64(header[8:16])
+			headerSize = 16
+		}
+		if size < headerSize {
+			return 0, fmt.Errorf("invalid %s box size %d", boxType, size)
+		}
+
+		if boxType != "moof" {
+			if _, err := file.Seek(int64(size-headerSize), io.SeekCurrent); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		moof := make([]byte, size-headerSize)
+		if _, err := io.ReadFull(file, moof); err != nil {
+			return 0, err
+		}
+
+		return parseMoof(moof, trackID)
+	}
+}
+
+func parseMoof(payload []byte, trackID uint32) (uint64, error) {
+	boxes, err := readBoxes(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, traf := range boxes {
+		if traf.boxType != "traf" {
+			continue
+		}
+
+		children, err := readBoxes(traf.payload)
+		if err != nil {
+			return 0, err
+		}
+
+		tfhd, ok := findBox(children, "tfhd")
+		if !ok || len(tfhd.payload) < 8 || binary.BigEndian.Uint32(tfhd.payload[4:8]) != trackID {
+			continue
+		}
+
+		tfdt, ok := findBox(children, "tfdt")
+		if !ok {
+			return 0, fmt.Errorf("missing tfdt box")
+		}
+		if len(tfdt.payload) >= 12 && tfdt.payload[0] == 1 {
+			return binary.BigEndian.Uint64(tfdt.payload[4:12]), nil
+		}
+		if len(tfdt.payload) >= 8 {
+			return uint64(binary.BigEndian.Uint32(tfdt.payload[4:8])), nil
+		}
+		return 0, fmt.Errorf("truncated tfdt box")
+	}
+
+	return 0, fmt.Errorf("%w: %d", errNoTrack, trackID)
+}
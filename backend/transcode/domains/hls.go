@@ -1,19 +1,39 @@
 package domains
 
-import "path/filepath"
+import (
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/m3u8"
+)
 
 type HLSSegment struct {
 	PublishName        string
 	VariantIndex       int
-	FullLocalPath      string // the full path to the file on disk
-	RelativeRemotePath string // for example "1/stream0.ts", without the first part "http://...."
-	IPFSRemoteId       string // hash id used with ipfs
+	FullLocalPath      string      // the full path to the file on disk
+	RelativeRemotePath string      // for example "1/stream0.ts", without the first part "http://...."
+	RemoteId           string      // the id given by the storage (a cid for ipfs)
+	RemoteURL          string      // the url of the uploaded segment
+	Local              bool        // the upload failed, the segment is served by the webserver next to the public playlist
+	PublicFile         os.FileInfo // the file served by the webserver if Local, another publish may replace it under the same name
 }
 
 // Multiple bitrates
 type HLSVariant struct {
 	VariantIndex uint8
 	Segments     []HLSSegment
+	Init         *HLSSegment // the fmp4 init file, nil for mpeg-ts
+
+	// the dvr window of the public playlist, oldest first, the files are only on the remote storage
+	DVRSegments []DVRSegment
+	// discontinuities that left the dvr window, for EXT-X-DISCONTINUITY-SEQUENCE
+	DVRDiscontinuitySequence int
+}
+
+// DVRSegment is a segment entry of the public playlist
+type DVRSegment struct {
+	Sequence     int
+	m3u8.Segment            // with the remote uris
+	Origin       HLSSegment // the uploaded segment, deleted from the storage once the entry leaves the window
 }
 
 type HLSStream struct {
@@ -23,6 +43,10 @@ type HLSStream struct {
 }
 
 func (v *HLSVariant) GetSegmentByFilename(fileName string) *HLSSegment {
+	if v.Init != nil && filepath.Base(v.Init.FullLocalPath) == fileName {
+		return v.Init
+	}
+
 	for _, segment := range v.Segments {
 		if filepath.Base(segment.FullLocalPath) == fileName {
 			return &segment
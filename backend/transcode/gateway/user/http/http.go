@@ -77,7 +77,8 @@ func (g *UserGateway) GetUserInformation(ctx context.Context, streamAPIKey strin
 	return &userInfo, nil
 }
 
-func (g *UserGateway) UpdateUserLiveStatus(ctx context.Context, userDTO dto.UpdateUserRequestDTO) *ErrorResponse {
+// UpdateUser sends the fields set in userDTO (live status, thumbnail) to the user service
+func (g *UserGateway) UpdateUser(ctx context.Context, userDTO dto.UpdateUserRequestDTO) *ErrorResponse {
 	addr, err := g.registry.ServiceAddress(ctx, "user")
 	if err != nil {
 		return &ErrorResponse{
@@ -121,3 +122,55 @@ func (g *UserGateway) UpdateUserLiveStatus(ctx context.Context, userDTO dto.Upda
 
 	return nil
 }
+
+// CreateVOD registers the recording of a finished broadcast against the user
+func (g *UserGateway) CreateVOD(ctx context.Context, vodDTO dto.CreateVODRequestDTO) *ErrorResponse {
+	addr, err := g.registry.ServiceAddress(ctx, "user")
+	if err != nil {
+		return &ErrorResponse{
+			Message:    err.Error(),
+			StatusCode: http.StatusBadGateway,
+		}
+	}
+
+	url := fmt.Sprintf("http://%s/v1/user/%s/vods", addr, vodDTO.UserID)
+	payloadBuf := new(bytes.Buffer)
+	if err := json.NewEncoder(payloadBuf).Encode(vodDTO); err != nil {
+		return &ErrorResponse{
+			Message:    fmt.Sprintf("failed to encode vod body: %s", err),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, payloadBuf)
+	if err != nil {
+		return &ErrorResponse{
+			Message:    fmt.Sprintf("failed to create request: %s", err),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return &ErrorResponse{
+			Message:    fmt.Sprintf("failed to call request: %s", err),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		resInfo := ErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&resInfo); err != nil {
+			return &ErrorResponse{
+				Message:    fmt.Sprintf("failed to decode error response from user service: %s", err),
+				StatusCode: resp.StatusCode,
+			}
+		}
+
+		return &resInfo
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	usergateway "sen1or/lets-live/transcode/gateway/user/http"
+	"sen1or/lets-live/transcode/recorder"
+	"sen1or/lets-live/transcode/session"
+	"sen1or/lets-live/transcode/storage"
+	"sen1or/lets-live/transcode/thumbnail"
+	"sen1or/lets-live/transcode/transcoder"
+	"sen1or/lets-live/user/dto"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	// reject the newcomer and keep the current publisher
+	DuplicatePublishReject = "reject"
+	// kick the current publisher and let the newcomer take over
+	DuplicatePublishKick = "kick"
+
+	kickWaitTimeout = 5 * time.Second
+)
+
+// the reasons a publish can be refused, each ingest protocol reports them to the encoder its own way
+var (
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	ErrAlreadyLive          = errors.New("stream key is already live")
+	ErrGoLiveFailed         = errors.New("failed to go live")
+)
+
+// StreamObserver is told when a publish starts (before the transcoder), which renditions the transcoder encodes
+// (before ffmpeg writes anything) and when the publish ends (after the transcoder stopped)
+type StreamObserver interface {
+	PublishStarted(publishName string)
+	LadderSelected(publishName string, ladder []config.Quality)
+	PublishEnded(publishName string)
+}
+
+// Publisher is the part shared by every ingest protocol (rtmp, srt, ...):
+// checking the stream key, enforcing the publish policy, tracking the session and running the transcoder
+type Publisher struct {
+	userGateway    *usergateway.UserGateway
+	sessionManager *session.SessionManager
+	config         config.Config
+	// where the recordings are uploaded, nil if there is no storage
+	storage   storage.Storage
+	observers []StreamObserver
+}
+
+func NewPublisher(config config.Config, userGateway *usergateway.UserGateway, sessionManager *session.SessionManager, storage storage.Storage) *Publisher {
+	return &Publisher{
+		userGateway:    userGateway,
+		sessionManager: sessionManager,
+		config:         config,
+		storage:        storage,
+	}
+}
+
+// AddObserver registers an observer of the publishes, it must be called before the ingest servers start
+func (p *Publisher) AddObserver(observer StreamObserver) {
+	p.observers = append(p.observers, observer)
+}
+
+// Publish is a running publish, the ingest protocol writes the received media (flv, mpeg-ts) into it
+type Publish struct {
+	UserID  string
+	Session *session.Session
+
+	recorder    *recorder.Recorder
+	thumbnailer *thumbnail.Thumbnailer
+}
+
+func (p *Publish) Write(b []byte) (int, error) {
+	return p.Session.Transcoder.Write(b)
+}
+
+// SetSource describes the incoming video to the transcoder, every ingest protocol calls it once before writing
+func (p *Publish) SetSource(source transcoder.SourceInfo) {
+	p.Session.Transcoder.SetSource(source)
+}
+
+// SetHeader gives the bytes a restarted transcoder needs before the live data, see Transcoder.SetHeader
+func (p *Publish) SetHeader(header []byte) {
+	p.Session.Transcoder.SetHeader(header)
+}
+
+// SetResumePoint tells where a restarted transcoder can pick up the live data, see Transcoder.SetResumePoint
+func (p *Publish) SetResumePoint(resumePoint func(b []byte) bool) {
+	p.Session.Transcoder.SetResumePoint(resumePoint)
+}
+
+// Authenticate checks if stream api key exists
+// return the user id to be used as publishName
+func (p *Publisher) Authenticate(streamKey string) (string, error) {
+	userInfo, errRes := p.userGateway.GetUserInformation(context.Background(), streamKey)
+	if errRes != nil {
+		logger.Errorf("failed to get user information: %s", errRes.Message)
+		return "", ErrAuthenticationFailed
+	}
+
+	return userInfo.ID.String(), nil
+}
+
+// Begin authenticates the stream key, registers the session, marks the user as online and starts the transcoder
+// the caller must call End once the connection is over
+func (p *Publisher) Begin(streamKey string, conn session.Conn) (*Publish, error) {
+	userId, err := p.Authenticate(streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.enforcePublishPolicy(userId); err != nil {
+		logger.Infow("duplicate publish rejected", "userId", userId)
+		return nil, err
+	}
+
+	transcoder := transcoder.NewTranscoder(p.config)
+	transcoder.OnLadder(func(ladder []config.Quality) {
+		for _, observer := range p.observers {
+			observer.LadderSelected(userId, ladder)
+		}
+	})
+	publishSession := session.NewSession(userId, streamKey, conn, transcoder)
+	if err := p.sessionManager.Add(publishSession); err != nil {
+		logger.Infow("duplicate publish rejected", "userId", userId, "reason", err.Error())
+		return nil, ErrAlreadyLive
+	}
+
+	if err := p.onConnect(userId); err != nil {
+		logger.Errorf("stream connection failed: %s", err)
+		p.sessionManager.Remove(publishSession)
+		return nil, ErrGoLiveFailed
+	}
+
+	for _, observer := range p.observers {
+		observer.PublishStarted(userId)
+	}
+
+	go func() {
+		transcoder.Start(userId)
+		// the transcoder only returns by itself when it gave up restarting ffmpeg, close the publisher connection
+		publishSession.Stop()
+	}()
+
+	publish := &Publish{
+		UserID:  userId,
+		Session: publishSession,
+	}
+
+	if p.config.Transcode.Recording.Enabled && p.storage != nil {
+		publish.recorder = recorder.NewRecorder(p.config, p.storage, userId)
+		go publish.recorder.Start()
+	}
+
+	if p.config.Transcode.Thumbnail.Enabled {
+		publish.thumbnailer = thumbnail.NewThumbnailer(p.config, p.storage, userId, func(url string) {
+			p.onThumbnail(userId, url)
+		})
+		go publish.thumbnailer.Start()
+	}
+
+	return publish, nil
+}
+
+// End stops the transcoder, marks the user as offline and removes the session
+// the recording is uploaded in the background
+func (p *Publisher) End(publish *Publish) {
+	publish.Session.Transcoder.Stop()
+	if publish.thumbnailer != nil {
+		publish.thumbnailer.Stop()
+	}
+
+	// a publish kicked by a newcomer can end after the kick timed out and the newcomer went live,
+	// the user status and the stream state are the newcomer's by then
+	if current, ok := p.sessionManager.Get(publish.UserID); ok && current == publish.Session {
+		for _, observer := range p.observers {
+			observer.PublishEnded(publish.UserID)
+		}
+		p.onDisconnect(publish.UserID)
+	} else {
+		logger.Infow("publish ended after being replaced, leaving the user live", "userId", publish.UserID)
+	}
+	p.sessionManager.Remove(publish.Session)
+
+	if publish.recorder != nil {
+		go p.finishRecording(publish.UserID, publish.recorder)
+	}
+}
+
+// upload the recording and register it as a vod of the user
+func (p *Publisher) finishRecording(userId string, rec *recorder.Recorder) {
+	vod, err := rec.Finish()
+	if err != nil {
+		logger.Errorw("failed to save the recording", "userId", userId, "error", err.Error())
+		return
+	}
+
+	userIdUUID, _ := uuid.FromString(userId)
+	errRes := p.userGateway.CreateVOD(context.Background(), dto.CreateVODRequestDTO{
+		UserID:      userIdUUID,
+		PlaylistURL: vod.PlaylistURL,
+		Duration:    vod.Duration,
+		StartedAt:   vod.StartedAt,
+		EndedAt:     vod.EndedAt,
+	})
+	if errRes != nil {
+		logger.Errorw("failed to register the vod", "userId", userId, "playlistURL", vod.PlaylistURL, "error", errRes.Message)
+		return
+	}
+
+	logger.Infow("vod saved", "userId", userId, "playlistURL", vod.PlaylistURL, "duration", vod.Duration)
+}
+
+// CanPublish reports whether a new publish of the user would be refused by the duplicate publish policy
+// it has no side effect, the policy is enforced for real in Begin
+func (p *Publisher) CanPublish(userId string) error {
+	if _, ok := p.sessionManager.Get(userId); !ok {
+		return nil
+	}
+
+	if p.config.Ingest.DuplicatePublishPolicy == DuplicatePublishKick {
+		return nil
+	}
+
+	return ErrAlreadyLive
+}
+
+// decide what happens if the user is already live on this node, based on the configured policy
+// a nil error means the newcomer is allowed to publish
+func (p *Publisher) enforcePublishPolicy(userId string) error {
+	if _, ok := p.sessionManager.Get(userId); !ok {
+		return nil
+	}
+
+	switch p.config.Ingest.DuplicatePublishPolicy {
+	case DuplicatePublishKick:
+		logger.Infow("duplicate publish, kicking the existing publisher", "userId", userId)
+		if err := p.sessionManager.KickAndWait(userId, kickWaitTimeout); err != nil {
+			logger.Errorf("failed to kick existing publisher: %s", err)
+		}
+		return nil
+	case DuplicatePublishReject, "":
+		return ErrAlreadyLive
+	default:
+		logger.Errorf("unknown duplicate publish policy %s, falling back to %s", p.config.Ingest.DuplicatePublishPolicy, DuplicatePublishReject)
+		return ErrAlreadyLive
+	}
+}
+
+// update the user status to online
+func (p *Publisher) onConnect(userId string) error {
+	userIdUUID, _ := uuid.FromString(userId)
+	updateUserDTO := &dto.UpdateUserRequestDTO{
+		ID:       userIdUUID,
+		IsOnline: func(b bool) *bool { return &b }(true), // wtf
+	}
+
+	errRes := p.userGateway.UpdateUser(context.Background(), *updateUserDTO)
+	if errRes != nil {
+		return fmt.Errorf("failed to get service connection: %s", errRes.Message)
+	}
+
+	return nil
+}
+
+// change the status of user to be not online
+// the thumbnail goes with the stream, its url is reused by the next publish
+func (p *Publisher) onDisconnect(userId string) {
+	userIdUUID, _ := uuid.FromString(userId)
+	updateUserDTO := &dto.UpdateUserRequestDTO{
+		ID:       userIdUUID,
+		IsOnline: func(b bool) *bool { return &b }(false), // wtf
+	}
+	if p.config.Transcode.Thumbnail.Enabled {
+		noThumbnail := ""
+		updateUserDTO.ThumbnailURL = &noThumbnail
+	}
+
+	errRes := p.userGateway.UpdateUser(context.Background(), *updateUserDTO)
+	if errRes != nil {
+		logger.Errorf("failed to get service connection: %s", errRes.Message)
+	}
+}
+
+// save the latest thumbnail of the stream on the user
+func (p *Publisher) onThumbnail(userId string, url string) {
+	userIdUUID, _ := uuid.FromString(userId)
+	updateUserDTO := &dto.UpdateUserRequestDTO{
+		ID:           userIdUUID,
+		ThumbnailURL: &url,
+	}
+
+	errRes := p.userGateway.UpdateUser(context.Background(), *updateUserDTO)
+	if errRes != nil {
+		logger.Errorf("failed to update the user thumbnail: %s", errRes.Message)
+	}
+}
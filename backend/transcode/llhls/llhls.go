@@ -0,0 +1,341 @@
+package llhls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffmpeg can't write ll-hls, in low latency mode it writes every part as a small fmp4 segment (cut by time, not keyframe)
+// this package renders that playlist of parts into a ll-hls playlist: parts are grouped into segments,
+// a segment is not a file, it is served as the concatenation of its parts
+//
+// a restarted ffmpeg appends to the playlist with a discontinuity, it goes on with the part numbers but overwrites the init file
+// and starts its keyframes over: the segment before the restart is cut short, the parts until the next segment boundary are left out
+// and the parts of every run are mapped to the init file they were written with (see PrepareResume)
+
+const (
+	PlaylistName = "stream.m3u8"
+
+	// segments from the end of the playlist that still list their parts, the spec asks for at least 3 target durations
+	partsSegmentsCount = 3
+)
+
+var (
+	partNamePattern    = regexp.MustCompile(`^part([0-9]+)\.m4s$`)
+	segmentNamePattern = regexp.MustCompile(`^seg([0-9]+)\.m4s$`)
+)
+
+// Options describes how ffmpeg cuts the stream, a segment is PartsPerSegment parts long
+type Options struct {
+	PartDuration    time.Duration
+	PartsPerSegment int
+}
+
+// Part is one fmp4 fragment written by ffmpeg
+type Part struct {
+	Number        int
+	URI           string
+	Duration      float64 // seconds
+	Discontinuity bool
+}
+
+// PartPlaylist is the playlist written by ffmpeg, one entry per part
+type PartPlaylist struct {
+	MapURI string
+	Parts  []Part
+	Ended  bool
+}
+
+func PartFileName(number int) string {
+	return fmt.Sprintf("part%d.m4s", number)
+}
+
+func SegmentFileName(number int) string {
+	return fmt.Sprintf("seg%d.m4s", number)
+}
+
+// ParsePartFileName returns the number of a part file name ("part12.m4s" is 12)
+func ParsePartFileName(name string) (int, bool) {
+	return parseNumber(partNamePattern, name)
+}
+
+// ParseSegmentFileName returns the number of a segment file name ("seg3.m4s" is 3)
+func ParseSegmentFileName(name string) (int, bool) {
+	return parseNumber(segmentNamePattern, name)
+}
+
+func parseNumber(pattern *regexp.Regexp, name string) (int, bool) {
+	match := pattern.FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+
+	number, err := strconv.Atoi(match[1])
+	return number, err == nil
+}
+
+// ArchivedMapURI is where the init file of a run ending with the part lastPart is kept once ffmpeg restarted
+func ArchivedMapURI(mapURI string, lastPart int) string {
+	ext := path.Ext(mapURI)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(mapURI, ext), lastPart, ext)
+}
+
+// PrepareResume keeps the init file of the variant in dir before ffmpeg restarts and overwrites it,
+// it returns the number of the first part the restarted ffmpeg writes
+func PrepareResume(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, PlaylistName))
+	if err != nil {
+		return 0, err
+	}
+
+	playlist, err := ParsePartPlaylist(data)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(playlist.Parts) == 0 {
+		return 0, nil
+	}
+
+	last := playlist.Parts[len(playlist.Parts)-1].Number
+	if len(playlist.MapURI) > 0 {
+		init, err := os.ReadFile(filepath.Join(dir, playlist.MapURI))
+		if err != nil {
+			return 0, err
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, ArchivedMapURI(playlist.MapURI, last)), init, 0644); err != nil {
+			return 0, err
+		}
+	}
+
+	return last + 1, nil
+}
+
+// ParsePartPlaylist reads the playlist written by ffmpeg
+func ParsePartPlaylist(data []byte) (*PartPlaylist, error) {
+	playlist := &PartPlaylist{}
+
+	var duration float64
+	var discontinuity bool
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case len(line) == 0:
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			uri, ok := attribute(strings.TrimPrefix(line, "#EXT-X-MAP:"), "URI")
+			if !ok {
+				return nil, fmt.Errorf("map without uri")
+			}
+			playlist.MapURI = uri
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			d, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration %q", value)
+			}
+			duration = d
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case line == "#EXT-X-ENDLIST":
+			playlist.Ended = true
+		case strings.HasPrefix(line, "#"):
+		default:
+			number, ok := ParsePartFileName(line)
+			if !ok {
+				return nil, fmt.Errorf("unexpected part %q", line)
+			}
+
+			playlist.Parts = append(playlist.Parts, Part{
+				Number:        number,
+				URI:           line,
+				Duration:      duration,
+				Discontinuity: discontinuity,
+			})
+			duration = 0
+			discontinuity = false
+		}
+	}
+
+	return playlist, scanner.Err()
+}
+
+// LastPart returns the media sequence number and the part index of the last part in the playlist
+func (p *PartPlaylist) LastPart(o Options) (msn int, part int, ok bool) {
+	if len(p.Parts) == 0 {
+		return 0, 0, false
+	}
+
+	last := p.Parts[len(p.Parts)-1].Number
+	return last / o.PartsPerSegment, last % o.PartsPerSegment, true
+}
+
+// Has reports whether the part (or the whole segment if part is negative) is in the playlist, for blocking reloads
+func (p *PartPlaylist) Has(o Options, msn int, part int) bool {
+	if len(p.Parts) == 0 {
+		return false
+	}
+
+	last := p.Parts[len(p.Parts)-1].Number
+	if part < 0 {
+		return last >= (msn+1)*o.PartsPerSegment-1
+	}
+
+	return last >= msn*o.PartsPerSegment+part
+}
+
+type segment struct {
+	number        int
+	parts         []Part
+	discontinuity bool
+	mapURI        string
+	cut           bool // ffmpeg restarted before the end of the segment
+}
+
+// segments groups the parts, a segment starts on every PartsPerSegment parts
+func (p *PartPlaylist) segments(o Options) []*segment {
+	// the init file of the parts before a discontinuity was archived when ffmpeg restarted
+	mapURIs := make([]string, len(p.Parts))
+	mapURI := p.MapURI
+	for i := len(p.Parts) - 1; i >= 0; i-- {
+		mapURIs[i] = mapURI
+		if p.Parts[i].Discontinuity && len(p.MapURI) > 0 {
+			mapURI = ArchivedMapURI(p.MapURI, p.Parts[i].Number-1)
+		}
+	}
+
+	var segments []*segment
+	var discontinuity bool
+	for i, part := range p.Parts {
+		if part.Discontinuity {
+			if len(segments) > 0 {
+				segments[len(segments)-1].cut = true
+			}
+			discontinuity = true
+		}
+
+		// the parts of the first segment may already be deleted, it starts with the first complete one,
+		// a restarted ffmpeg starts over with the next segment
+		if part.Number%o.PartsPerSegment == 0 {
+			segments = append(segments, &segment{
+				number:        part.Number / o.PartsPerSegment,
+				discontinuity: discontinuity && len(segments) > 0,
+				mapURI:        mapURIs[i],
+			})
+			discontinuity = false
+		} else if len(segments) == 0 || discontinuity {
+			continue
+		}
+
+		current := segments[len(segments)-1]
+		current.parts = append(current.parts, part)
+	}
+
+	return segments
+}
+
+// SegmentParts returns the file names of the parts making the segment, none if the segment is not in the playlist
+func (p *PartPlaylist) SegmentParts(o Options, number int) []string {
+	for _, s := range p.segments(o) {
+		if s.number != number {
+			continue
+		}
+
+		names := make([]string, 0, len(s.parts))
+		for _, part := range s.parts {
+			names = append(names, part.URI)
+		}
+		return names
+	}
+
+	return nil
+}
+
+// Render writes the ll-hls playlist
+func Render(p *PartPlaylist, o Options) []byte {
+	segments := p.segments(o)
+
+	partTarget := o.PartDuration.Seconds()
+	for _, part := range p.Parts {
+		partTarget = math.Max(partTarget, part.Duration)
+	}
+	targetDuration := partTarget * float64(o.PartsPerSegment)
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%s\n", formatFloat(3*partTarget))
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%s\n", formatFloat(partTarget))
+	if len(segments) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].number)
+	}
+
+	var mapURI string
+	for index, s := range segments {
+		if s.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if s.mapURI != mapURI {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", s.mapURI)
+			mapURI = s.mapURI
+		}
+
+		if index >= len(segments)-partsSegmentsCount {
+			for _, part := range s.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%s,URI=\"%s\"", formatFloat(part.Duration), part.URI)
+				// keyframes are forced on segment boundaries
+				if part.Number%o.PartsPerSegment == 0 {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+
+		// the last segment of an ended stream is published as is, it will never be complete, nor will a cut one
+		if len(s.parts) < o.PartsPerSegment && !s.cut && !(p.Ended && index == len(segments)-1) {
+			continue
+		}
+
+		var duration float64
+		for _, part := range s.parts {
+			duration += part.Duration
+		}
+		fmt.Fprintf(&b, "#EXTINF:%s,\n%s\n", formatFloat(duration), SegmentFileName(s.number))
+	}
+
+	if p.Ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if len(p.Parts) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", PartFileName(p.Parts[len(p.Parts)-1].Number+1))
+	}
+
+	return []byte(b.String())
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 3, 64)
+}
+
+// attribute reads a quoted attribute from an attribute list (URI="init.mp4",BYTERANGE=...)
+func attribute(list string, name string) (string, bool) {
+	for _, pair := range strings.Split(list, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if ok && key == name {
+			return strings.Trim(value, "\""), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,467 @@
+package m3u8
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// a small hls playlist model, the tags it does not know are kept as they are so rewriting a playlist only changes the uris
+
+const (
+	headerTag                = "#EXTM3U"
+	targetDurationTag        = "#EXT-X-TARGETDURATION:"
+	mediaSequenceTag         = "#EXT-X-MEDIA-SEQUENCE:"
+	discontinuitySequenceTag = "#EXT-X-DISCONTINUITY-SEQUENCE:"
+	endListTag               = "#EXT-X-ENDLIST"
+	durationTag              = "#EXTINF:"
+	byteRangeTag             = "#EXT-X-BYTERANGE:"
+	discontinuityTag         = "#EXT-X-DISCONTINUITY"
+	mapTag                   = "#EXT-X-MAP:"
+	programDateTimeTag       = "#EXT-X-PROGRAM-DATE-TIME:"
+	streamInfTag             = "#EXT-X-STREAM-INF:"
+)
+
+var ErrInvalidPlaylist = errors.New("invalid playlist")
+
+// the tags that describe the whole media playlist, the other ones belong to the next segment
+var playlistTags = []string{
+	"#EXT-X-VERSION",
+	"#EXT-X-PLAYLIST-TYPE",
+	"#EXT-X-I-FRAMES-ONLY",
+	"#EXT-X-INDEPENDENT-SEGMENTS",
+	"#EXT-X-START",
+	"#EXT-X-ALLOW-CACHE",
+	"#EXT-X-SERVER-CONTROL",
+	"#EXT-X-PART-INF",
+}
+
+type ByteRange struct {
+	Length int64
+	Offset int64 // -1 when the range starts right after the previous one
+}
+
+func (b ByteRange) String() string {
+	if b.Offset < 0 {
+		return strconv.FormatInt(b.Length, 10)
+	}
+
+	return fmt.Sprintf("%d@%d", b.Length, b.Offset)
+}
+
+// Map is the fmp4 init section (EXT-X-MAP)
+type Map struct {
+	URI       string
+	ByteRange *ByteRange
+}
+
+type Segment struct {
+	URI             string
+	Duration        float64 // seconds
+	Title           string
+	ByteRange       *ByteRange
+	Discontinuity   bool
+	Map             *Map   // set on the segments the init section changes at
+	ProgramDateTime string // as written, empty if not set
+	Tags            []string
+}
+
+type MediaPlaylist struct {
+	Header                []string // playlist tags other than the ones below, in order (EXT-X-VERSION...)
+	TargetDuration        int
+	MediaSequence         int
+	DiscontinuitySequence int
+	Segments              []Segment
+	Trailing              []string // tags after the last segment, the parts of the segment being written for ll-hls
+	EndList               bool
+}
+
+type Variant struct {
+	Attributes string   // of EXT-X-STREAM-INF, as written
+	Tags       []string // the other tags before the uri
+	URI        string
+}
+
+type MasterPlaylist struct {
+	Header   []string // every tag that is not a variant (EXT-X-VERSION, EXT-X-MEDIA...)
+	Variants []Variant
+}
+
+// IsMaster tells if the playlist lists variants instead of segments
+func IsMaster(data []byte) bool {
+	return strings.Contains(string(data), streamInfTag)
+}
+
+func scanLines(r io.Reader, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		if first {
+			if line != headerTag {
+				return fmt.Errorf("%w: missing %s", ErrInvalidPlaylist, headerTag)
+			}
+			first = false
+			continue
+		}
+
+		// comments are not tags
+		if strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "#EXT") {
+			continue
+		}
+
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if first {
+		return fmt.Errorf("%w: empty", ErrInvalidPlaylist)
+	}
+
+	return nil
+}
+
+// ParseMedia reads a media playlist, the tags it does not know are kept on the next segment
+func ParseMedia(r io.Reader) (*MediaPlaylist, error) {
+	playlist := &MediaPlaylist{}
+	var segment Segment
+	var inSegment, hasDuration bool
+
+	err := scanLines(r, func(line string) error {
+		var err error
+
+		switch {
+		case strings.HasPrefix(line, targetDurationTag):
+			playlist.TargetDuration, err = strconv.Atoi(strings.TrimPrefix(line, targetDurationTag))
+		case strings.HasPrefix(line, mediaSequenceTag):
+			playlist.MediaSequence, err = strconv.Atoi(strings.TrimPrefix(line, mediaSequenceTag))
+		case strings.HasPrefix(line, discontinuitySequenceTag):
+			playlist.DiscontinuitySequence, err = strconv.Atoi(strings.TrimPrefix(line, discontinuitySequenceTag))
+		case line == endListTag:
+			playlist.EndList = true
+		case !inSegment && isPlaylistTag(line):
+			playlist.Header = append(playlist.Header, line)
+		case strings.HasPrefix(line, durationTag):
+			duration, title, _ := strings.Cut(strings.TrimPrefix(line, durationTag), ",")
+			segment.Duration, err = strconv.ParseFloat(strings.TrimSpace(duration), 64)
+			segment.Title = title
+			inSegment, hasDuration = true, true
+		case strings.HasPrefix(line, byteRangeTag):
+			segment.ByteRange, err = parseByteRange(strings.TrimPrefix(line, byteRangeTag))
+			inSegment = true
+		case line == discontinuityTag:
+			segment.Discontinuity = true
+			inSegment = true
+		case strings.HasPrefix(line, mapTag):
+			segment.Map, err = parseMap(strings.TrimPrefix(line, mapTag))
+			inSegment = true
+		case strings.HasPrefix(line, programDateTimeTag):
+			segment.ProgramDateTime = strings.TrimPrefix(line, programDateTimeTag)
+			inSegment = true
+		case line[0] == '#':
+			segment.Tags = append(segment.Tags, line)
+			inSegment = true
+		default:
+			if !hasDuration {
+				return fmt.Errorf("%w: %s has no duration", ErrInvalidPlaylist, line)
+			}
+
+			segment.URI = line
+			playlist.Segments = append(playlist.Segments, segment)
+			segment = Segment{}
+			inSegment, hasDuration = false, false
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrInvalidPlaylist, line, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hasDuration {
+		return nil, fmt.Errorf("%w: the last segment has no uri", ErrInvalidPlaylist)
+	}
+	if inSegment {
+		playlist.Trailing = segment.tagLines()
+	}
+
+	return playlist, nil
+}
+
+func isPlaylistTag(line string) bool {
+	name, _, _ := strings.Cut(line, ":")
+	for _, tag := range playlistTags {
+		if name == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseMaster reads a master playlist
+func ParseMaster(r io.Reader) (*MasterPlaylist, error) {
+	playlist := &MasterPlaylist{}
+	var variant Variant
+	inVariant := false
+
+	err := scanLines(r, func(line string) error {
+		switch {
+		case strings.HasPrefix(line, streamInfTag):
+			variant.Attributes = strings.TrimPrefix(line, streamInfTag)
+			inVariant = true
+		case line[0] == '#':
+			if inVariant {
+				variant.Tags = append(variant.Tags, line)
+			} else {
+				playlist.Header = append(playlist.Header, line)
+			}
+		default:
+			if !inVariant {
+				return fmt.Errorf("%w: %s has no %s", ErrInvalidPlaylist, line, streamInfTag)
+			}
+
+			variant.URI = line
+			playlist.Variants = append(playlist.Variants, variant)
+			variant = Variant{}
+			inVariant = false
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if inVariant {
+		return nil, fmt.Errorf("%w: the last variant has no uri", ErrInvalidPlaylist)
+	}
+
+	return playlist, nil
+}
+
+func parseByteRange(value string) (*ByteRange, error) {
+	length, offset, hasOffset := strings.Cut(value, "@")
+	byteRange := &ByteRange{Offset: -1}
+
+	var err error
+	if byteRange.Length, err = strconv.ParseInt(length, 10, 64); err != nil {
+		return nil, err
+	}
+	if hasOffset {
+		if byteRange.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	return byteRange, nil
+}
+
+func parseMap(value string) (*Map, error) {
+	attributes := ParseAttributes(value)
+	uri, ok := attributes["URI"]
+	if !ok {
+		return nil, errors.New("missing uri")
+	}
+
+	m := &Map{URI: uri}
+	if byteRange, ok := attributes["BYTERANGE"]; ok {
+		var err error
+		if m.ByteRange, err = parseByteRange(byteRange); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// ParseAttributes reads an attribute list (KEY=value,KEY="quoted, value"), the quotes are removed
+func ParseAttributes(value string) map[string]string {
+	attributes := make(map[string]string)
+	for len(value) > 0 {
+		key, rest, ok := strings.Cut(value, "=")
+		if !ok {
+			break
+		}
+
+		var attribute string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				attribute, rest = rest[1:], ""
+			} else {
+				attribute, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			attribute, rest, _ = strings.Cut(rest, ",")
+		}
+
+		attributes[strings.TrimSpace(key)] = attribute
+		value = rest
+	}
+
+	return attributes
+}
+
+// the tags of the segment in the order they are written, before the uri
+func (s Segment) tagLines() []string {
+	var lines []string
+	if s.Discontinuity {
+		lines = append(lines, discontinuityTag)
+	}
+	if s.Map != nil {
+		line := fmt.Sprintf("%sURI=\"%s\"", mapTag, s.Map.URI)
+		if s.Map.ByteRange != nil {
+			line += fmt.Sprintf(",BYTERANGE=\"%s\"", s.Map.ByteRange)
+		}
+		lines = append(lines, line)
+	}
+	if len(s.ProgramDateTime) > 0 {
+		lines = append(lines, programDateTimeTag+s.ProgramDateTime)
+	}
+
+	return append(lines, s.Tags...)
+}
+
+// Encode writes the playlist
+func (p *MediaPlaylist) Encode() []byte {
+	var b strings.Builder
+	b.WriteString(headerTag + "\n")
+	for _, line := range p.Header {
+		b.WriteString(line + "\n")
+	}
+
+	fmt.Fprintf(&b, "%s%d\n", targetDurationTag, p.TargetDuration)
+	fmt.Fprintf(&b, "%s%d\n", mediaSequenceTag, p.MediaSequence)
+	if p.DiscontinuitySequence > 0 {
+		fmt.Fprintf(&b, "%s%d\n", discontinuitySequenceTag, p.DiscontinuitySequence)
+	}
+
+	for _, segment := range p.Segments {
+		for _, line := range segment.tagLines() {
+			b.WriteString(line + "\n")
+		}
+		fmt.Fprintf(&b, "%s%s,%s\n", durationTag, strconv.FormatFloat(segment.Duration, 'f', 6, 64), segment.Title)
+		if segment.ByteRange != nil {
+			fmt.Fprintf(&b, "%s%s\n", byteRangeTag, segment.ByteRange)
+		}
+		b.WriteString(segment.URI + "\n")
+	}
+
+	for _, line := range p.Trailing {
+		b.WriteString(line + "\n")
+	}
+	if p.EndList {
+		b.WriteString(endListTag + "\n")
+	}
+
+	return []byte(b.String())
+}
+
+// Encode writes the playlist
+func (p *MasterPlaylist) Encode() []byte {
+	var b strings.Builder
+	b.WriteString(headerTag + "\n")
+	for _, line := range p.Header {
+		b.WriteString(line + "\n")
+	}
+
+	for _, variant := range p.Variants {
+		b.WriteString(streamInfTag + variant.Attributes + "\n")
+		for _, line := range variant.Tags {
+			b.WriteString(line + "\n")
+		}
+		b.WriteString(variant.URI + "\n")
+	}
+
+	return []byte(b.String())
+}
+
+// LongestSegment returns the duration of the longest segment rounded up, what the target duration must hold
+func (p *MediaPlaylist) LongestSegment() int {
+	longest := 0
+	for _, segment := range p.Segments {
+		longest = max(longest, int(math.Ceil(segment.Duration)))
+	}
+
+	return longest
+}
+
+// Rewrite replaces the uris of the segments and of the init sections, resolve returns false for an uri it can't rewrite yet
+// a playlist must not list a missing object: the segments before the first one that can be rewritten are dropped
+// (the media and discontinuity sequences move with them), the playlist stops before the next one that can't
+func (p *MediaPlaylist) Rewrite(resolve func(uri string) (string, bool)) {
+	segments := make([]Segment, 0, len(p.Segments))
+	var currentMap *Map // the init section of the segment, nil if it can't be rewritten
+	mapResolved := true
+	// where the range of the next segment starts if it continues the previous one, -1 if it can't
+	nextOffset := int64(-1)
+	var previousURI string
+
+	for _, segment := range p.Segments {
+		offset := nextOffset
+		nextOffset = -1
+		if segment.ByteRange != nil {
+			start := segment.ByteRange.Offset
+			if start < 0 && segment.URI == previousURI {
+				start = offset
+			}
+			if start >= 0 {
+				nextOffset = start + segment.ByteRange.Length
+			}
+		}
+		previousURI = segment.URI
+
+		if segment.Map != nil {
+			uri, ok := resolve(segment.Map.URI)
+			mapResolved = ok
+			currentMap = &Map{URI: uri, ByteRange: segment.Map.ByteRange}
+		}
+
+		uri, ok := resolve(segment.URI)
+		if !ok || !mapResolved {
+			if len(segments) > 0 {
+				// the rest is listed once it can be rewritten
+				p.EndList = false
+				p.Trailing = nil
+				break
+			}
+
+			p.MediaSequence++
+			if segment.Discontinuity {
+				p.DiscontinuitySequence++
+			}
+			continue
+		}
+
+		// a relative range continues the previous segment, which may have been dropped
+		if len(segments) == 0 && segment.ByteRange != nil && segment.ByteRange.Offset < 0 && nextOffset >= 0 {
+			segment.ByteRange = &ByteRange{Length: segment.ByteRange.Length, Offset: nextOffset - segment.ByteRange.Length}
+		}
+
+		segment.URI = uri
+		// the first segment listed carries the init section, a discontinuity before it was counted if it was dropped
+		if segment.Map != nil || len(segments) == 0 {
+			segment.Map = currentMap
+		}
+		segments = append(segments, segment)
+	}
+
+	p.Segments = segments
+}
@@ -0,0 +1,429 @@
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/m3u8"
+	"sen1or/lets-live/transcode/storage"
+	"sen1or/lets-live/transcode/transcoder"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffmpeg deletes the segments that left the live playlists (-hls_flags delete_segments),
+// the recorder keeps a copy of every segment while the publish runs, then uploads them as a vod once it ends
+// the output directory is shared by the publishes of a user, the files written before the recording started are ignored
+
+const vodPlaylistName = "vod.m3u8"
+
+// VOD is the result of a finished recording
+type VOD struct {
+	PlaylistURL string
+	Duration    float64 // seconds, the longest variant
+	StartedAt   time.Time
+	EndedAt     time.Time
+}
+
+type Recorder struct {
+	storage        storage.Storage
+	masterFileName string
+	pollInterval   time.Duration
+	outputDir      string // where ffmpeg writes
+	recordDir      string // where the segments are kept until the upload
+
+	publishName string
+	startedAt   time.Time
+
+	// only touched by Start, then by Finish once Start returned
+	master   *m3u8.MasterPlaylist
+	variants map[string]*recordedVariant // by uri in the master playlist
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+type recordedVariant struct {
+	// the kept init file of the current ffmpeg run, a restarted ffmpeg rewrites the init file under the same name
+	initURI     string
+	initModTime time.Time
+	runs        int
+	segments    []recordedSegment
+	seen        map[string]bool
+	// a segment was lost, the next one starts with a discontinuity
+	gap bool
+}
+
+type recordedSegment struct {
+	uri           string
+	initURI       string // the kept init file of the run the segment belongs to
+	duration      float64
+	discontinuity bool
+}
+
+func NewRecorder(config config.Config, storage storage.Storage, publishName string) *Recorder {
+	startedAt := time.Now()
+
+	return &Recorder{
+		storage:        storage,
+		masterFileName: config.Transcode.FFMpegSetting.MasterFileName,
+		// ffmpeg keeps a few segments after they leave the playlist, polling twice per segment never misses one
+		pollInterval: time.Duration(config.Transcode.FFMpegSetting.HLSTime) * time.Second / 2,
+		outputDir:    transcoder.OutputDir(config, publishName),
+		recordDir:    filepath.Join(config.Transcode.Recording.Path, publishName, strconv.FormatInt(startedAt.Unix(), 10)),
+		publishName:  publishName,
+		startedAt:    startedAt,
+		variants:     make(map[string]*recordedVariant),
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+}
+
+// Start keeps the new segments written by ffmpeg until Finish is called
+func (r *Recorder) Start() {
+	defer close(r.doneCh)
+
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.collect(); err != nil {
+				logger.Errorw("failed to record segments", "publishName", r.publishName, "error", err.Error())
+			}
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+// Finish stops the recording, uploads it to the storage and returns the vod
+// the local copy is removed once everything is uploaded, it is kept if the upload fails
+func (r *Recorder) Finish() (*VOD, error) {
+	close(r.stopCh)
+	<-r.doneCh
+	endedAt := time.Now()
+
+	// the last segments written before ffmpeg stopped
+	if err := r.collect(); err != nil {
+		logger.Errorw("failed to record segments", "publishName", r.publishName, "error", err.Error())
+	}
+
+	if r.master == nil {
+		os.RemoveAll(r.recordDir)
+		return nil, errors.New("nothing recorded")
+	}
+
+	playlistURL, duration, err := r.upload()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(r.recordDir); err != nil {
+		logger.Warnw("failed to remove the local recording", "path", r.recordDir, "error", err.Error())
+	}
+
+	return &VOD{
+		PlaylistURL: playlistURL,
+		Duration:    duration,
+		StartedAt:   r.startedAt,
+		EndedAt:     endedAt,
+	}, nil
+}
+
+// keep the segments listed in the variant playlists that are not kept yet
+func (r *Recorder) collect() error {
+	data, err := r.readFresh(r.masterFileName)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+
+	master, err := m3u8.ParseMaster(bytes.NewReader(data))
+	if err != nil {
+		// ffmpeg is rewriting it, the next poll gets it
+		return nil
+	}
+	r.master = master
+
+	for _, masterVariant := range master.Variants {
+		variantURI := masterVariant.URI
+		data, err := r.readFresh(variantURI)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+
+		playlist, err := m3u8.ParseMedia(bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+
+		variant, ok := r.variants[variantURI]
+		if !ok {
+			variant = &recordedVariant{seen: make(map[string]bool)}
+			r.variants[variantURI] = variant
+		}
+
+		initURI, segments := recordedSegments(playlist)
+		variantDir := path.Dir(variantURI)
+		previousInitURI := variant.initURI
+		newRun := false
+		if len(initURI) > 0 {
+			newRun, err = r.keepInit(variant, variantDir, initURI)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the restarted ffmpeg appends its segments after a discontinuity, the ones before belong to the previous run
+		lastDiscontinuity := -1
+		for i, segment := range segments {
+			if segment.discontinuity {
+				lastDiscontinuity = i
+			}
+		}
+
+		for i, segment := range segments {
+			if variant.seen[segment.uri] {
+				continue
+			}
+
+			segmentPath := path.Join(variantDir, segment.uri)
+			fresh, err := r.isFresh(segmentPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err == nil && !fresh {
+				// left by the previous publish, a segment of this one may get the same name later
+				continue
+			}
+			variant.seen[segment.uri] = true
+
+			if err == nil {
+				err = r.keep(segmentPath)
+			}
+			if err != nil {
+				if os.IsNotExist(err) {
+					logger.Warnw("segment deleted before being recorded", "publishName", r.publishName, "segment", segment.uri)
+					variant.gap = true
+					continue
+				}
+				return err
+			}
+			segment.discontinuity = segment.discontinuity || variant.gap
+			segment.initURI = variant.initURI
+			if newRun && len(previousInitURI) > 0 && i < lastDiscontinuity {
+				segment.initURI = previousInitURI
+			}
+			variant.gap = false
+			variant.segments = append(variant.segments, segment)
+		}
+	}
+
+	return nil
+}
+
+// keepInit keeps the init file written by the current ffmpeg run, under a name of its own from the second run
+// it tells if the init file was rewritten since the last poll
+func (r *Recorder) keepInit(variant *recordedVariant, variantDir string, initURI string) (bool, error) {
+	initPath := path.Join(variantDir, initURI)
+	info, err := os.Stat(filepath.Join(r.outputDir, filepath.FromSlash(initPath)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if info.ModTime().Before(r.startedAt) || info.ModTime().Equal(variant.initModTime) {
+		return false, nil
+	}
+
+	keptURI := initURI
+	if variant.runs > 0 {
+		ext := path.Ext(initURI)
+		keptURI = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(initURI, ext), variant.runs, ext)
+	}
+
+	// not a hard link, the next run overwrites the file in place
+	if err := r.copy(initPath, path.Join(variantDir, keptURI)); err != nil {
+		return false, err
+	}
+
+	variant.initURI = keptURI
+	variant.initModTime = info.ModTime()
+	variant.runs++
+	return true, nil
+}
+
+// isFresh tells if a file of the output directory was written since the recording started
+func (r *Recorder) isFresh(relativePath string) (bool, error) {
+	info, err := os.Stat(filepath.Join(r.outputDir, filepath.FromSlash(relativePath)))
+	if err != nil {
+		return false, err
+	}
+
+	return !info.ModTime().Before(r.startedAt), nil
+}
+
+// readFresh reads a playlist of the output directory, nil if it is missing or was written by a previous publish
+func (r *Recorder) readFresh(relativePath string) ([]byte, error) {
+	fresh, err := r.isFresh(relativePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !fresh {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.outputDir, filepath.FromSlash(relativePath)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+// keep a file of the output directory in the record directory, a hard link if possible
+func (r *Recorder) keep(relativePath string) error {
+	src := filepath.Join(r.outputDir, filepath.FromSlash(relativePath))
+	dst := filepath.Join(r.recordDir, filepath.FromSlash(relativePath))
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Link(src, dst); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	// the record directory may be on another file system
+	return r.copy(relativePath, relativePath)
+}
+
+// copy a file of the output directory to the record directory
+func (r *Recorder) copy(relativePath string, recordedPath string) error {
+	src := filepath.Join(r.outputDir, filepath.FromSlash(relativePath))
+	dst := filepath.Join(r.recordDir, filepath.FromSlash(recordedPath))
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	input, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	_, err = io.Copy(output, input)
+	return err
+}
+
+// write the vod playlists next to the kept segments, then upload the record directory as a whole,
+// the playlists use relative uris so the vod plays from the directory
+func (r *Recorder) upload() (string, float64, error) {
+	var duration float64
+	master := &m3u8.MasterPlaylist{Header: r.master.Header}
+
+	for _, masterVariant := range r.master.Variants {
+		variant, ok := r.variants[masterVariant.URI]
+		if !ok || len(variant.segments) == 0 {
+			continue
+		}
+
+		playlist, variantDuration := renderVODPlaylist(variant.segments)
+		playlistURI := path.Join(path.Dir(masterVariant.URI), vodPlaylistName)
+		if err := os.WriteFile(filepath.Join(r.recordDir, filepath.FromSlash(playlistURI)), playlist, 0644); err != nil {
+			return "", 0, err
+		}
+		duration = math.Max(duration, variantDuration)
+
+		masterVariant.URI = playlistURI
+		master.Variants = append(master.Variants, masterVariant)
+	}
+
+	if len(master.Variants) == 0 {
+		return "", 0, errors.New("nothing recorded")
+	}
+
+	if err := os.WriteFile(filepath.Join(r.recordDir, r.masterFileName), master.Encode(), 0644); err != nil {
+		return "", 0, err
+	}
+
+	id, err := r.storage.AddDirectory(r.recordDir)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to upload %s: %s", r.recordDir, err)
+	}
+
+	return r.storage.PublicURL(id + "/" + r.masterFileName), duration, nil
+}
+
+func renderVODPlaylist(segments []recordedSegment) ([]byte, float64) {
+	var duration, targetDuration float64
+	version := 3
+	for _, segment := range segments {
+		duration += segment.duration
+		targetDuration = math.Max(targetDuration, segment.duration)
+		if len(segment.initURI) > 0 {
+			version = 7
+		}
+	}
+
+	playlist := &m3u8.MediaPlaylist{
+		Header:         []string{fmt.Sprintf("#EXT-X-VERSION:%d", version), "#EXT-X-PLAYLIST-TYPE:VOD"},
+		TargetDuration: int(math.Ceil(targetDuration)),
+		Segments:       make([]m3u8.Segment, 0, len(segments)),
+		EndList:        true,
+	}
+
+	// each ffmpeg run has its own init file, the map changes after the discontinuity
+	var initURI string
+	for _, segment := range segments {
+		vodSegment := m3u8.Segment{URI: segment.uri, Duration: segment.duration, Discontinuity: segment.discontinuity}
+		if len(segment.initURI) > 0 && segment.initURI != initURI {
+			vodSegment.Map = &m3u8.Map{URI: segment.initURI}
+			initURI = segment.initURI
+		}
+		playlist.Segments = append(playlist.Segments, vodSegment)
+	}
+
+	return playlist.Encode(), duration
+}
+
+// the init section and the segments of a live variant playlist
+func recordedSegments(playlist *m3u8.MediaPlaylist) (string, []recordedSegment) {
+	var initURI string
+	segments := make([]recordedSegment, 0, len(playlist.Segments))
+
+	for _, segment := range playlist.Segments {
+		if segment.Map != nil {
+			initURI = segment.Map.URI
+		}
+		segments = append(segments, recordedSegment{uri: segment.URI, duration: segment.Duration, discontinuity: segment.Discontinuity})
+	}
+
+	return initURI, segments
+}
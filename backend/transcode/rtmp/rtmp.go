@@ -1,20 +1,21 @@
 package rtmp
 
 import (
-	"context"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sen1or/lets-live/pkg/discovery"
 	"sen1or/lets-live/pkg/logger"
 	"sen1or/lets-live/transcode/config"
-	usergateway "sen1or/lets-live/transcode/gateway/user/http"
-	"sen1or/lets-live/transcode/transcoder"
-	"sen1or/lets-live/user/dto"
+	"sen1or/lets-live/transcode/ingest"
+	"slices"
 	"strconv"
 	"strings"
 
-	"github.com/gofrs/uuid/v5"
+	"github.com/nareix/joy5/av"
 	"github.com/nareix/joy5/format/flv"
 	"github.com/nareix/joy5/format/flv/flvio"
 	"github.com/nareix/joy5/format/rtmp"
@@ -27,18 +28,18 @@ type RTMPServerConfig struct {
 }
 
 type RTMPServer struct {
-	Port        int
-	Registry    *discovery.Registry
-	userGateway *usergateway.UserGateway
-	config      config.Config
+	Port      int
+	Registry  *discovery.Registry
+	publisher *ingest.Publisher
+	config    config.Config
 }
 
-func NewRTMPServer(config RTMPServerConfig, userGateway *usergateway.UserGateway) *RTMPServer {
+func NewRTMPServer(config RTMPServerConfig, publisher *ingest.Publisher) *RTMPServer {
 	return &RTMPServer{
-		Port:        config.Port,
-		Registry:    config.Registry,
-		config:      config.Config,
-		userGateway: userGateway,
+		Port:      config.Port,
+		Registry:  config.Registry,
+		config:    config.Config,
+		publisher: publisher,
 	}
 }
 
@@ -56,7 +57,7 @@ func (s *RTMPServer) Start() {
 	if err != nil {
 		logger.Panicf("rtmp failed to listen: %s", err)
 	}
-	logger.Infow("rtmp server started")
+	logger.Infow("rtmp server started", "port", s.Port)
 
 	server.LogEvent = func(c *rtmp.Conn, nc net.Conn, e int) {
 		es := rtmp.EventString[e]
@@ -65,6 +66,36 @@ func (s *RTMPServer) Start() {
 
 	server.HandleConn = s.HandleConnection
 
+	if s.config.RTMP.TLS.Enabled {
+		tlsListener, err := s.listenTLS()
+		if err != nil {
+			logger.Panicf("rtmps failed to listen: %s", err)
+		}
+		logger.Infow("rtmps server started", "port", s.config.RTMP.TLS.Port)
+
+		go serve(server, tlsListener)
+	}
+
+	serve(server, listener)
+}
+
+func (s *RTMPServer) listenTLS() (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.RTMP.TLS.CertFile, s.config.RTMP.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rtmps certificate: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return tls.Listen("tcp", ":"+strconv.Itoa(s.config.RTMP.TLS.Port), tlsConfig)
+}
+
+// accept connections from the listener and hand them to the rtmp server
+// plain and tls connections end up in the same HandleConnection
+func serve(server *rtmp.Server, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 
@@ -77,8 +108,9 @@ func (s *RTMPServer) Start() {
 	}
 }
 
-// TODO: check if on disconnect do we need to manually close nc
 func (s *RTMPServer) HandleConnection(c *rtmp.Conn, nc net.Conn) {
+	defer nc.Close()
+
 	c.LogTagEvent = func(isRead bool, t flvio.Tag) {
 		if t.Type == flvio.TAG_AMF0 {
 			logger.Infof("RTMP log tag: %+v", t.DebugFields())
@@ -88,69 +120,93 @@ func (s *RTMPServer) HandleConnection(c *rtmp.Conn, nc net.Conn) {
 	streamingKeyComponents := strings.Split(c.URL.Path, "/")
 	streamingKey := streamingKeyComponents[len(streamingKeyComponents)-1]
 
-	userId, err := s.onConnect(streamingKey)
+	publish, err := s.publisher.Begin(streamingKey, nc)
 	if err != nil {
 		logger.Errorf("stream connection failed: %s", err)
-		nc.Close()
+		rejectConnection(c, err)
 		return
 	}
+	defer s.publisher.End(publish)
 
-	pipeOut, pipeIn := io.Pipe()
-
-	go func() {
-		transcoder := transcoder.NewTranscoder(pipeOut, s.config)
-		transcoder.Start(userId)
-	}()
+	// every packet is muxed into a buffer and written at once, a restarted transcoder always starts on a tag boundary
+	var packetBuf bytes.Buffer
+	w := flv.NewMuxer(&packetBuf)
+	header := newStreamHeader()
 
-	w := flv.NewMuxer(pipeIn)
+	packets, source, err := probeSource(c)
+	publish.SetSource(source)
+	if err == nil {
+		logger.Infow("rtmp source", "userId", publish.UserID, "codec", source.VideoCodec, "width", source.Width, "height", source.Height, "fps", source.FPS, "bitrate", source.VideoBitrate)
+	}
 
 	for {
-		pkt, err := c.ReadPacket()
-		if err == io.EOF {
-			s.onDisconnect(userId)
+		var pkt av.Packet
+		if len(packets) > 0 {
+			pkt, packets = packets[0], packets[1:]
+		} else if pkt, err = c.ReadPacket(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Errorf("failed to read rtmp package: %s", err)
+			}
 			return
 		}
 
+		if header.Update(pkt) {
+			publish.SetHeader(header.Bytes())
+		}
+
+		packetBuf.Reset()
 		if err := w.WritePacket(pkt); err != nil {
+			logger.Errorf("failed to mux rtmp package: %s", err)
+			return
+		}
+
+		if _, err := publish.Write(packetBuf.Bytes()); err != nil {
 			logger.Errorf("failed to write rtmp package: %s", err)
-			s.onDisconnect(userId)
 			return
 		}
 	}
 }
 
-// check if stream api key exists
-// then update the user status to online
-// return the user id to be used as publishName
-func (s *RTMPServer) onConnect(streamingKey string) (string, error) {
-	userInfo, errRes := s.userGateway.GetUserInformation(context.Background(), streamingKey)
-	if errRes != nil {
-		return "", fmt.Errorf("failed to get user information: %s", errRes.Message)
-	}
+// streamHeader keeps the flv header, the metadata and the codec configs of the stream
+// a restarted transcoder reads it first, as it would have at the start of the stream
+type streamHeader struct {
+	packets map[int]av.Packet
+}
 
-	updateUserDTO := &dto.UpdateUserRequestDTO{
-		ID:       userInfo.ID,
-		IsOnline: func(b bool) *bool { return &b }(true), // wtf
-	}
+func newStreamHeader() *streamHeader {
+	return &streamHeader{packets: make(map[int]av.Packet)}
+}
 
-	errRes = s.userGateway.UpdateUserLiveStatus(context.Background(), *updateUserDTO)
-	if errRes != nil {
-		return "", fmt.Errorf("failed to get service connection: %s", errRes.Message)
+var headerPacketTypes = []int{av.Metadata, av.H264DecoderConfig, av.AACDecoderConfig}
+
+// Update keeps the packet if it is part of the header, it reports whether the header changed
+func (h *streamHeader) Update(pkt av.Packet) bool {
+	if !slices.Contains(headerPacketTypes, pkt.Type) {
+		return false
 	}
 
-	return userInfo.ID.String(), nil
+	h.packets[pkt.Type] = pkt
+	return true
 }
 
-// change the status of user to be not online
-func (s *RTMPServer) onDisconnect(userId string) {
-	userIdUUID, _ := uuid.FromString(userId)
-	updateUserDTO := &dto.UpdateUserRequestDTO{
-		ID:       userIdUUID,
-		IsOnline: func(b bool) *bool { return &b }(false), // wtf
+func (h *streamHeader) Bytes() []byte {
+	var buf bytes.Buffer
+	w := flv.NewMuxer(&buf)
+	w.WriteFileHeader()
+
+	for _, packetType := range headerPacketTypes {
+		if pkt, ok := h.packets[packetType]; ok {
+			w.WritePacket(pkt)
+		}
 	}
 
-	errRes := s.userGateway.UpdateUserLiveStatus(context.Background(), *updateUserDTO)
-	if errRes != nil {
-		logger.Errorf("failed to get service connection: %s", errRes.Message)
+	return buf.Bytes()
+}
+
+// send the publish failure (with the reason) back to the encoder before the connection is closed
+func rejectConnection(c *rtmp.Conn, reason error) {
+	c.PubPlayErr = reason
+	if err := c.Prepare(rtmp.StageCommandDone, rtmp.PrepareWriting); err != nil {
+		logger.Debugf("failed to send publish error to encoder: %s", err)
 	}
 }
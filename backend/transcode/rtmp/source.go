@@ -0,0 +1,82 @@
+package rtmp
+
+import (
+	"sen1or/lets-live/transcode/transcoder"
+
+	"github.com/nareix/joy5/av"
+	"github.com/nareix/joy5/format/flv/flvio"
+	"github.com/nareix/joy5/format/rtmp"
+)
+
+// encoders send the metadata and the codec configs before the media, don't wait forever if they don't
+const maxProbePackets = 32
+
+// probeSource reads the packets coming before the first media packet to describe the source
+// the packets read are returned so they can still be sent to the transcoder
+func probeSource(c *rtmp.Conn) ([]av.Packet, transcoder.SourceInfo, error) {
+	var source transcoder.SourceInfo
+	var packets []av.Packet
+
+	for len(packets) < maxProbePackets {
+		pkt, err := c.ReadPacket()
+		if err != nil {
+			return packets, source, err
+		}
+		packets = append(packets, pkt)
+
+		switch pkt.Type {
+		case av.Metadata:
+			applyMetadata(&source, pkt.Data)
+		case av.H264DecoderConfig:
+			source.VideoCodec = "h264"
+			if pkt.H264 != nil && pkt.H264.W > 0 {
+				source.Width = pkt.H264.W
+				source.Height = pkt.H264.H
+			}
+		case av.H264, av.AAC:
+			return packets, source, nil
+		}
+	}
+
+	return packets, source, nil
+}
+
+// read the onMetaData values set by the encoder (obs sends all of them)
+func applyMetadata(source *transcoder.SourceInfo, data []byte) {
+	values, err := flvio.ParseAMFVals(data, false)
+	if err != nil {
+		return
+	}
+
+	for _, value := range values {
+		var metadata flvio.AMFMap
+		switch v := value.(type) {
+		case flvio.AMFMap:
+			metadata = v
+		case flvio.AMFECMAArray:
+			metadata = flvio.AMFMap(v)
+		default:
+			continue
+		}
+
+		if width, ok := metadata.GetFloat64("width"); ok {
+			source.Width = int(width)
+		}
+		if height, ok := metadata.GetFloat64("height"); ok {
+			source.Height = int(height)
+		}
+		if fps, ok := metadata.GetFloat64("framerate"); ok {
+			source.FPS = fps
+		}
+		if bitrate, ok := metadata.GetFloat64("videodatarate"); ok {
+			source.VideoBitrate = int(bitrate)
+		}
+		// 7 is avc in the flv codec ids, some encoders send "avc1" instead
+		if codec, ok := metadata.GetFloat64("videocodecid"); ok && codec == flvio.VIDEO_H264 {
+			source.VideoCodec = "h264"
+		}
+		if codec, ok := metadata.GetString("videocodecid"); ok && codec == "avc1" {
+			source.VideoCodec = "h264"
+		}
+	}
+}
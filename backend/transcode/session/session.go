@@ -0,0 +1,185 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/transcoder"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Conn is the publisher connection, whatever ingest protocol it comes from
+type Conn interface {
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+// Session is a single live publish handled by this node
+type Session struct {
+	UserID     string
+	StreamKey  string
+	StartedAt  time.Time
+	Conn       Conn
+	Transcoder *transcoder.Transcoder
+
+	stopOnce sync.Once
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// SessionInfo is the view of a session exposed to the outside (no stream key, connection or process handles)
+type SessionInfo struct {
+	UserID     string    `json:"userId"`
+	StartedAt  time.Time `json:"startedAt"`
+	RemoteAddr string    `json:"remoteAddr"`
+
+	Stats *transcoder.Stats `json:"stats,omitempty"`
+}
+
+func NewSession(userId string, streamKey string, conn Conn, transcoder *transcoder.Transcoder) *Session {
+	return &Session{
+		UserID:     userId,
+		StreamKey:  streamKey,
+		StartedAt:  time.Now(),
+		Conn:       conn,
+		Transcoder: transcoder,
+		done:       make(chan struct{}),
+	}
+}
+
+// Stop closes the publisher connection and kills the transcoder, it is safe to call multiple times
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() {
+		if s.Conn != nil {
+			s.Conn.Close()
+		}
+
+		if s.Transcoder != nil {
+			s.Transcoder.Stop()
+		}
+	})
+}
+
+// Done is closed once the session is fully cleaned up and removed from the manager
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) Info() SessionInfo {
+	info := SessionInfo{
+		UserID:    s.UserID,
+		StartedAt: s.StartedAt,
+	}
+
+	if s.Conn != nil && s.Conn.RemoteAddr() != nil {
+		info.RemoteAddr = s.Conn.RemoteAddr().String()
+	}
+
+	if s.Transcoder != nil {
+		stats := s.Transcoder.Stats()
+		info.Stats = &stats
+	}
+
+	return info
+}
+
+// SessionManager keeps track of every live publish on this node, keyed by the user id (the publish name)
+type SessionManager struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (m *SessionManager) Add(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[s.UserID]; ok {
+		return fmt.Errorf("session for user %s already exists", s.UserID)
+	}
+
+	m.sessions[s.UserID] = s
+	logger.Infow("session added", "userId", s.UserID)
+
+	return nil
+}
+
+// Remove stops the session and drops it from the registry
+// it only removes the entry if it is still the same session, so a late cleanup can't remove a newer one
+func (m *SessionManager) Remove(s *Session) {
+	m.mu.Lock()
+	if current, ok := m.sessions[s.UserID]; ok && current == s {
+		delete(m.sessions, s.UserID)
+	}
+	m.mu.Unlock()
+
+	s.Stop()
+	s.doneOnce.Do(func() { close(s.done) })
+	logger.Infow("session removed", "userId", s.UserID, "duration", time.Since(s.StartedAt).String())
+}
+
+func (m *SessionManager) Get(userId string) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.sessions[userId]
+	return s, ok
+}
+
+func (m *SessionManager) List() []SessionInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]SessionInfo, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		infos = append(infos, s.Info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+
+	return infos
+}
+
+// Kick forcibly ends the live session of the user
+// the rtmp handler will notice the closed connection and do the rest of the cleanup (including Remove)
+func (m *SessionManager) Kick(userId string) error {
+	s, ok := m.Get(userId)
+	if !ok {
+		return fmt.Errorf("no live session for user %s", userId)
+	}
+
+	logger.Infow("kicking session", "userId", userId)
+	s.Stop()
+
+	return nil
+}
+
+// KickAndWait kicks the session and waits until its handler has finished cleaning up
+func (m *SessionManager) KickAndWait(userId string, timeout time.Duration) error {
+	s, ok := m.Get(userId)
+	if !ok {
+		return nil
+	}
+
+	if err := m.Kick(userId); err != nil {
+		return err
+	}
+
+	select {
+	case <-s.Done():
+		return nil
+	case <-time.After(timeout):
+		// the handler is stuck somewhere, drop the entry so the new publisher can take over
+		m.Remove(s)
+		return fmt.Errorf("timed out waiting for session of user %s to end", userId)
+	}
+}
@@ -0,0 +1,128 @@
+package srt
+
+import (
+	"errors"
+	"io"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/pkg/srt"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/ingest"
+	"sen1or/lets-live/transcode/transcoder"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const readBufferSize = 1316 * 16
+
+type SRTServer struct {
+	Port      int
+	publisher *ingest.Publisher
+	config    config.Config
+}
+
+func NewSRTServer(config config.Config, publisher *ingest.Publisher) *SRTServer {
+	return &SRTServer{
+		Port:      config.SRT.Port,
+		publisher: publisher,
+		config:    config,
+	}
+}
+
+func (s *SRTServer) Start() {
+	listener, err := srt.Listen(":"+strconv.Itoa(s.Port), srt.Config{
+		Latency:   time.Duration(s.config.SRT.Latency) * time.Millisecond,
+		Authorize: s.authorize,
+	})
+	if err != nil {
+		logger.Panicf("srt failed to listen: %s", err)
+	}
+	logger.Infow("srt server started", "port", s.Port)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, srt.ErrListenerClosed) {
+				return
+			}
+
+			logger.Errorf("srt failed to accept: %s", err)
+			continue
+		}
+
+		go s.HandleConnection(conn)
+	}
+}
+
+// check the stream key during the handshake so refused callers get a proper rejection code
+func (s *SRTServer) authorize(req srt.ConnRequest) srt.RejectReason {
+	streamKey, mode := parseStreamID(req.StreamID)
+	if len(streamKey) == 0 {
+		return srt.RejectBadRequest
+	}
+	// the streams are only ingested here, the viewers play them over hls
+	if len(mode) > 0 && mode != "publish" {
+		logger.Infow("srt caller refused, only publishing is supported", "mode", mode)
+		return srt.RejectBadMode
+	}
+
+	userId, err := s.publisher.Authenticate(streamKey)
+	if err != nil {
+		logger.Errorf("srt stream connection failed: %s", err)
+		return srt.RejectUnauthorized
+	}
+
+	if err := s.publisher.CanPublish(userId); err != nil {
+		logger.Infow("srt duplicate publish rejected", "userId", userId)
+		return srt.RejectConflict
+	}
+
+	return srt.RejectNone
+}
+
+func (s *SRTServer) HandleConnection(conn *srt.Conn) {
+	defer conn.Close()
+
+	streamKey, _ := parseStreamID(conn.StreamID())
+
+	publish, err := s.publisher.Begin(streamKey, conn)
+	if err != nil {
+		logger.Errorf("srt stream connection failed: %s", err)
+		return
+	}
+	defer s.publisher.End(publish)
+
+	// the mpeg-ts is not inspected, ffmpeg finds out the codecs by itself
+	publish.SetSource(transcoder.SourceInfo{})
+
+	// srt carries mpeg-ts which ffmpeg reads as is
+	buf := make([]byte, readBufferSize)
+	if _, err := io.CopyBuffer(publish, conn, buf); err != nil && !errors.Is(err, io.EOF) {
+		logger.Errorf("srt stream ended with error: %s", err)
+	}
+}
+
+// the stream id is either the raw stream key or uses the access control syntax: "#!::r=<streamKey>,m=publish"
+// see https://github.com/Haivision/srt/blob/master/docs/features/access-control.md
+// the mode (m) is empty if the stream id doesn't give it, a raw stream key is always a publish
+func parseStreamID(streamID string) (string, string) {
+	if !strings.HasPrefix(streamID, "#!::") {
+		return streamID, ""
+	}
+
+	var streamKey, mode string
+	for _, pair := range strings.Split(strings.TrimPrefix(streamID, "#!::"), ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "r":
+			streamKey = value
+		case "m":
+			mode = value
+		}
+	}
+
+	return streamKey, mode
+}
@@ -0,0 +1,41 @@
+package srt
+
+import (
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/pkg/srt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStreamID(t *testing.T) {
+	tests := []struct {
+		streamID  string
+		streamKey string
+		mode      string
+	}{
+		{streamID: "key", streamKey: "key"},
+		{streamID: "#!::r=key", streamKey: "key"},
+		{streamID: "#!::r=key,m=publish", streamKey: "key", mode: "publish"},
+		{streamID: "#!::m=request,r=key", streamKey: "key", mode: "request"},
+		{streamID: "#!::m=publish", mode: "publish"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.streamID, func(t *testing.T) {
+			streamKey, mode := parseStreamID(tt.streamID)
+			assert.Equal(t, tt.streamKey, streamKey)
+			assert.Equal(t, tt.mode, mode)
+		})
+	}
+}
+
+// a caller asking to play the stream is refused before the stream key is checked
+func TestAuthorize_RejectsOtherModes(t *testing.T) {
+	logger.Init(logger.Debug)
+	server := &SRTServer{}
+
+	assert.Equal(t, srt.RejectBadMode, server.authorize(srt.ConnRequest{StreamID: "#!::r=key,m=request"}))
+	assert.Equal(t, srt.RejectBadMode, server.authorize(srt.ConnRequest{StreamID: "#!::r=key,m=bidirectional"}))
+	assert.Equal(t, srt.RejectBadRequest, server.authorize(srt.ConnRequest{StreamID: "#!::m=publish"}))
+}
@@ -5,35 +5,65 @@ import (
 	"fmt"
 	"os"
 	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 )
 
+const defaultGCInterval = 5 * time.Minute
+
 type CustomStorage struct {
 	ipfsNode          *Peer
 	bootstrapNodeAddr *string
 	gateway           string
+	repoPath          string
+	hostOptions       HostOptions
+	gcInterval        time.Duration
+	retention         RetentionPolicy
 	ctx               context.Context
 }
 
-// If we don't want to connect to bootstrap node, enter a nil value for bootstrapNodeAddr
-func NewIPFSStorage(ctx context.Context, gateway string, bootstrapNodeAddr *string) *CustomStorage {
-	if bootstrapNodeAddr != nil && len(*bootstrapNodeAddr) == 0 {
+// the files (segments, thumbnails) are pinned as live content and retained twice the live window by default,
+// a viewer may be behind the live edge, the directories are pinned as recordings
+// the files a live stream lists until its end (init files, sprite sheets) are held, their retention starts when they are released
+func NewIPFSStorage(ctx context.Context, setting config.IPFSSetting, liveWindow time.Duration) *CustomStorage {
+	if len(setting.BootstrapNodeAddr) == 0 {
 		logger.Panicw("missing bootstrap node address")
 	}
 
 	storage := &CustomStorage{
-		bootstrapNodeAddr: bootstrapNodeAddr,
+		bootstrapNodeAddr: &setting.BootstrapNodeAddr,
 		ctx:               ctx,
-		gateway:           gateway,
+		gateway:           setting.Gateway,
+		repoPath:          setting.RepoPath,
+		hostOptions: HostOptions{
+			IdentityPath:  setting.IdentityPath,
+			ListenAddrs:   setting.ListenAddrs,
+			AnnounceAddrs: setting.AnnounceAddrs,
+		},
+		gcInterval: time.Duration(setting.GC.Interval) * time.Second,
+		retention: RetentionPolicy{
+			Live: time.Duration(setting.Retention.Live) * time.Second,
+			VOD:  time.Duration(setting.Retention.VOD) * time.Second,
+		},
+	}
+
+	if storage.gcInterval <= 0 {
+		storage.gcInterval = defaultGCInterval
+	}
+	if storage.retention.Live <= 0 {
+		storage.retention.Live = 2 * liveWindow
 	}
 
 	if err := storage.SetupNode(); err != nil {
 		logger.Panicf("error setting up node: %s", err)
 	}
 
+	go storage.collectGarbage()
+
 	return storage
 }
 
@@ -44,23 +74,122 @@ func (s *CustomStorage) AddFile(filePath string) (string, error) {
 		return "", fmt.Errorf("failed to get file: %s", err)
 	}
 
-	fileCid, err := s.ipfsNode.AddFile(s.ctx, file)
+	defer file.Close()
+
+	unlocker := s.ipfsNode.PinLock(s.ctx)
+	defer unlocker.Unlock(s.ctx)
+
+	fileNode, err := s.ipfsNode.AddFile(s.ctx, file)
 	if err != nil {
 		return "", fmt.Errorf("failed to add file into ipfs: %s", err)
 	}
 
-	return fmt.Sprintf("%s/ipfs/%s", s.gateway, fileCid.String()), nil
+	if err := s.ipfsNode.Pin(s.ctx, fileNode.Cid(), PinLive); err != nil {
+		return "", fmt.Errorf("failed to pin file: %s", err)
+	}
+
+	return fileNode.Cid().String(), nil
+}
+
+func (s *CustomStorage) AddDirectory(directoryPath string) (string, error) {
+	unlocker := s.ipfsNode.PinLock(s.ctx)
+	defer unlocker.Unlock(s.ctx)
+
+	dirNode, err := s.ipfsNode.AddDirectory(s.ctx, directoryPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to add directory into ipfs: %s", err)
+	}
+
+	if err := s.ipfsNode.Pin(s.ctx, dirNode.Cid(), PinVOD); err != nil {
+		return "", fmt.Errorf("failed to pin directory: %s", err)
+	}
+
+	return dirNode.Cid().String(), nil
+}
+
+// Delete unpins the file (or directory), its blocks are removed by the next gc unless another pin links them
+// the other nodes may still have them
+func (s *CustomStorage) Delete(id string) error {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return fmt.Errorf("invalid cid %s: %s", id, err)
+	}
+
+	return s.ipfsNode.Unpin(s.ctx, c)
+}
+
+// Hold keeps the file from expiring while a live stream uses it (an init file, a sprite sheet), see Peer.Hold
+func (s *CustomStorage) Hold(id string) error {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return fmt.Errorf("invalid cid %s: %s", id, err)
+	}
+
+	s.ipfsNode.Hold(c)
+	return nil
 }
 
-func (s *CustomStorage) HasBlock(cidString string) (bool, error) {
-	c, _ := cid.Decode(cidString)
-	return s.ipfsNode.HasBlock(context.Background(), c)
+// Release lets the file expire with the retention of the live content, counted from now
+func (s *CustomStorage) Release(id string) error {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return fmt.Errorf("invalid cid %s: %s", id, err)
+	}
+
+	return s.ipfsNode.Release(s.ctx, c)
+}
+
+func (s *CustomStorage) Exists(id string) (bool, error) {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return false, fmt.Errorf("invalid cid %s: %s", id, err)
+	}
+
+	// the blocks of a deleted file stay until the next gc
+	return s.ipfsNode.IsPinned(s.ctx, c)
+}
+
+// PublicURL returns the gateway url, a path inside a directory is kept (<cid>/index.m3u8)
+func (s *CustomStorage) PublicURL(id string) string {
+	return fmt.Sprintf("%s/ipfs/%s", s.gateway, id)
+}
+
+// unpin the content retained long enough then remove the blocks no pin links, the node does not grow with the streams
+func (s *CustomStorage) collectGarbage() {
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := s.ipfsNode.UnpinExpired(s.ctx, s.retention, time.Now())
+			if err != nil {
+				logger.Errorw("failed to unpin the expired content", "error", err.Error())
+				continue
+			}
+
+			removed, err := s.ipfsNode.GC(s.ctx)
+			if err != nil {
+				logger.Errorw("failed to collect the ipfs garbage", "error", err.Error())
+				continue
+			}
+			logger.Debugw("ipfs garbage collected", "unpinned", len(expired), "removedBlocks", removed)
+		case <-s.ctx.Done():
+			return
+		}
+	}
 }
 
 func (s *CustomStorage) SetupNode() error {
 	// create node
 	ds := NewInMemoryDatastore()
-	host, dht, err := NewLibp2pHost(s.ctx, ds)
+	if len(s.repoPath) > 0 {
+		var err error
+		if ds, err = NewLevelDBDatastore(s.repoPath); err != nil {
+			return err
+		}
+	}
+	host, dht, err := NewLibp2pHost(s.ctx, ds, s.hostOptions)
 	if err != nil {
 		return err
 	}
@@ -70,9 +199,11 @@ func (s *CustomStorage) SetupNode() error {
 		return err
 	}
 
+	// the announced addresses if configured, the peers reach us with them
 	hostAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/p2p/%s", node.host.ID().String()))
-	addr := node.host.Addrs()[0]
-	logger.Infof("running as normal with addr: %s", addr.Encapsulate(hostAddr))
+	for _, addr := range node.host.Addrs() {
+		logger.Infof("running as normal with addr: %s", addr.Encapsulate(hostAddr))
+	}
 
 	if s.bootstrapNodeAddr != nil {
 		logger.Infof("trying to connect with bootstrap node")
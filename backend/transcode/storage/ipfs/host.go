@@ -3,16 +3,16 @@ package ipfs
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"io"
-	"math/rand"
 	"os"
 	"time"
 
 	ipns "github.com/ipfs/boxo/ipns"
 	datastore "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
+	leveldb "github.com/ipfs/go-ds-leveldb"
 	libp2p "github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
@@ -31,21 +31,52 @@ func NewInMemoryDatastore() datastore.Batching {
 	return dssync.MutexWrap(datastore.NewMapDatastore())
 }
 
+// NewLevelDBDatastore provides a datastore persisted in the directory, the blocks and the dht records survive a restart
+func NewLevelDBDatastore(path string) (datastore.Batching, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the datastore directory: %s", err)
+	}
+
+	ds, err := leveldb.NewDatastore(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the datastore: %s", err)
+	}
+
+	return ds, nil
+}
+
 var connMgr, _ = connmgr.NewConnManager(100, 400, connmgr.WithGracePeriod(time.Minute))
 
+var defaultListenAddrs = []string{"/ip4/0.0.0.0/tcp/4001"}
+
+type HostOptions struct {
+	IdentityPath  string   // the saved key of the node, a new one is made each boot if empty
+	ListenAddrs   []string // multiaddrs, /ip4/0.0.0.0/tcp/4001 if empty
+	AnnounceAddrs []string // the multiaddrs given to the other peers instead of the listen ones, when behind a nat or in a container
+}
+
 func NewLibp2pHost(
 	ctx context.Context,
-	ds datastore.Batching) (host.Host, *dualdht.DHT, error) {
+	ds datastore.Batching,
+	options HostOptions) (host.Host, *dualdht.DHT, error) {
 	var ddht *dualdht.DHT
 	var err error
 
-	// if node is bootstrap node, use a static priv key to persist node identity to ease the node connections
-	priv, err := generatePrivKey()
+	// a persisted key keeps the peer id, the bootstrap node and the gateways keep peering with us
+	priv, err := LoadOrCreateIdentity(options.IdentityPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the identity: %s", err)
+	}
+
+	if len(options.ListenAddrs) == 0 {
+		options.ListenAddrs = defaultListenAddrs
+	}
+	listenAddrs, err := parseMultiaddrs(options.ListenAddrs)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 
-	listenAddr, err := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/4001")
+	announceAddrs, err := parseMultiaddrs(options.AnnounceAddrs)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -66,7 +97,7 @@ func NewLibp2pHost(
 	opts := []libp2p.Option{
 		libp2p.Identity(priv),
 		libp2p.PrivateNetwork(psk),
-		libp2p.ListenAddrs(listenAddr),
+		libp2p.ListenAddrs(listenAddrs...),
 		libp2p.ConnectionManager(connMgr),
 		//libp2p.Security(libp2ptls.ID, libp2ptls.New),
 		//libp2p.Security(noise.ID, noise.New),
@@ -80,6 +111,12 @@ func NewLibp2pHost(
 		//libp2p.EnableNATService(),
 	}
 
+	if len(announceAddrs) > 0 {
+		opts = append(opts, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return announceAddrs
+		}))
+	}
+
 	h, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, nil, err
@@ -90,10 +127,9 @@ func NewLibp2pHost(
 
 func generatePrivKey() (crypto.PrivKey, error) {
 	var finalPriv crypto.PrivKey
-	var r io.Reader
 
-	r = rand.New(rand.NewSource(time.Now().Unix()))
-	finalPriv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	// the key may be saved, it must not be predictable
+	finalPriv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/ipfs/boxo/bitswap"
@@ -39,9 +42,13 @@ type Peer struct {
 
 	ipld.DAGService // become a DAG service
 	exch            exchange.Interface
-	bstore          blockstore.Blockstore
+	bstore          blockstore.GCBlockstore
 	bserv           blockservice.BlockService
 	reprovider      provider.System
+
+	// the content a live stream still uses, by cid, see Hold
+	heldMu sync.Mutex
+	held   map[string]int
 }
 
 func (p *Peer) GetHost() host.Host {
@@ -59,10 +66,11 @@ func NewIPFSNode(
 		host:  host,
 		dht:   dht,
 		store: datastore,
+		held:  make(map[string]int),
 	}
 
-	// get the default blockstore implementation
-	p.bstore = blockstore.NewBlockstore(p.store)
+	// get the default blockstore implementation, with the locks shared by the adds and the gc
+	p.bstore = blockstore.NewGCBlockstore(blockstore.NewBlockstore(p.store), blockstore.NewGCLocker())
 
 	err := p.setupBlockService()
 	if err != nil {
@@ -107,6 +115,8 @@ func (p *Peer) onClose() {
 	<-p.ctx.Done()
 	p.reprovider.Close()
 	p.bserv.Close()
+	// flush an on disk datastore
+	p.store.Close()
 }
 
 func (p *Peer) Session(ctx context.Context) ipld.NodeGetter {
@@ -176,3 +186,47 @@ func (p *Peer) Exchange() exchange.Interface {
 func (p *Peer) BlockService() blockservice.BlockService {
 	return p.bserv
 }
+
+// AddDirectory adds the files of the directory, recursively, as a UnixFS directory
+func (p *Peer) AddDirectory(ctx context.Context, directoryPath string) (ipld.Node, error) {
+	entries, err := os.ReadDir(directoryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := ufsio.NewDirectory(p)
+	for _, entry := range entries {
+		entryPath := filepath.Join(directoryPath, entry.Name())
+
+		var node ipld.Node
+		if entry.IsDir() {
+			node, err = p.AddDirectory(ctx, entryPath)
+		} else {
+			node, err = p.addFilePath(ctx, entryPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := dir.AddChild(ctx, entry.Name(), node); err != nil {
+			return nil, err
+		}
+	}
+
+	node, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	return node, p.Add(ctx, node)
+}
+
+func (p *Peer) addFilePath(ctx context.Context, filePath string) (ipld.Node, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return p.AddFile(ctx, file)
+}
@@ -0,0 +1,242 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// PinKind tells what the pinned content is, the retention depends on it
+type PinKind string
+
+const (
+	PinLive PinKind = "live" // the segments and thumbnails of a live stream
+	PinVOD  PinKind = "vod"  // a recording
+)
+
+// RetentionPolicy is how long the content stays pinned by kind, zero keeps it until it is unpinned
+type RetentionPolicy struct {
+	Live time.Duration
+	VOD  time.Duration
+}
+
+func (p RetentionPolicy) retention(kind PinKind) time.Duration {
+	switch kind {
+	case PinLive:
+		return p.Live
+	case PinVOD:
+		return p.VOD
+	}
+
+	return 0
+}
+
+type Pin struct {
+	Root     cid.Cid
+	Kind     PinKind
+	PinnedAt time.Time
+}
+
+// the pins are kept in the datastore next to the blocks, the retention is applied when they are collected
+// so a new policy applies to the content already pinned
+var pinsPrefix = datastore.NewKey("/local/pins")
+
+type pinRecord struct {
+	Kind     PinKind `json:"kind"`
+	PinnedAt int64   `json:"pinnedAt"` // unix seconds
+}
+
+// PinLock keeps the gc from running until unlocked, the adds followed by a pin hold it
+func (p *Peer) PinLock(ctx context.Context) blockstore.Unlocker {
+	return p.bstore.PinLock(ctx)
+}
+
+// Pin protects the dag of root from the gc, pinning it again restarts its retention
+// the caller holds the pin lock from the add to the pin, the gc never sees the blocks unpinned
+func (p *Peer) Pin(ctx context.Context, root cid.Cid, kind PinKind) error {
+	value, err := json.Marshal(pinRecord{Kind: kind, PinnedAt: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+
+	return p.store.Put(ctx, pinKey(root), value)
+}
+
+func (p *Peer) Unpin(ctx context.Context, root cid.Cid) error {
+	p.heldMu.Lock()
+	delete(p.held, root.String())
+	p.heldMu.Unlock()
+
+	return p.store.Delete(ctx, pinKey(root))
+}
+
+// Hold keeps the pinned root out of the retention until it is released as many times, a live stream still lists it
+// the holds are not saved, they end with the process like the streams
+func (p *Peer) Hold(root cid.Cid) {
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+
+	p.held[root.String()]++
+}
+
+// Release ends a hold, the retention of the content starts over once nothing holds it
+func (p *Peer) Release(ctx context.Context, root cid.Cid) error {
+	p.heldMu.Lock()
+	key := root.String()
+	if p.held[key] == 0 {
+		p.heldMu.Unlock()
+		return nil
+	}
+	p.held[key]--
+	remaining := p.held[key]
+	if remaining == 0 {
+		delete(p.held, key)
+	}
+	p.heldMu.Unlock()
+
+	if remaining > 0 {
+		return nil
+	}
+
+	// unpinned while held
+	pinned, err := p.IsPinned(ctx, root)
+	if err != nil || !pinned {
+		return err
+	}
+
+	return p.Pin(ctx, root, PinLive)
+}
+
+func (p *Peer) isHeld(root cid.Cid) bool {
+	p.heldMu.Lock()
+	defer p.heldMu.Unlock()
+
+	return p.held[root.String()] > 0
+}
+
+func (p *Peer) IsPinned(ctx context.Context, root cid.Cid) (bool, error) {
+	return p.store.Has(ctx, pinKey(root))
+}
+
+func (p *Peer) Pins(ctx context.Context) ([]Pin, error) {
+	results, err := p.store.Query(ctx, query.Query{Prefix: pinsPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var pins []Pin
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		root, err := cid.Decode(datastore.NewKey(result.Key).BaseNamespace())
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin %s: %s", result.Key, err)
+		}
+
+		var record pinRecord
+		if err := json.Unmarshal(result.Value, &record); err != nil {
+			return nil, fmt.Errorf("invalid pin %s: %s", result.Key, err)
+		}
+
+		pins = append(pins, Pin{Root: root, Kind: record.Kind, PinnedAt: time.Unix(record.PinnedAt, 0)})
+	}
+
+	return pins, nil
+}
+
+// UnpinExpired removes the pins retained longer than the policy allows and returns them, the held ones are kept
+func (p *Peer) UnpinExpired(ctx context.Context, policy RetentionPolicy, now time.Time) ([]Pin, error) {
+	pins, err := p.Pins(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []Pin
+	for _, pin := range pins {
+		retention := policy.retention(pin.Kind)
+		if retention <= 0 || pin.PinnedAt.Add(retention).After(now) || p.isHeld(pin.Root) {
+			continue
+		}
+
+		if err := p.Unpin(ctx, pin.Root); err != nil {
+			return expired, err
+		}
+		expired = append(expired, pin)
+	}
+
+	return expired, nil
+}
+
+// GC deletes the local blocks that are not reachable from a pin and returns how many were deleted
+// the adds wait for it to finish, the blocks fetched from the other nodes are deleted too
+func (p *Peer) GC(ctx context.Context) (int, error) {
+	unlocker := p.bstore.GCLock(ctx)
+	defer unlocker.Unlock(ctx)
+
+	pins, err := p.Pins(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the blockstore keys blocks by multihash, the same block may be linked with another cid version
+	offline := merkledag.NewDAGService(blockservice.New(p.bstore, nil))
+	marked := make(map[string]struct{})
+	visit := func(c cid.Cid) bool {
+		if _, ok := marked[string(c.Hash())]; ok {
+			return false
+		}
+		marked[string(c.Hash())] = struct{}{}
+		return true
+	}
+
+	// a missing block (never fetched, or deleted by hand) has no links to follow, the walk goes on with its siblings
+	getLinks := func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		links, err := merkledag.GetLinksDirect(offline)(ctx, c)
+		if ipld.IsNotFound(err) {
+			return nil, nil
+		}
+		return links, err
+	}
+
+	for _, pin := range pins {
+		if err := merkledag.Walk(ctx, getLinks, pin.Root, visit); err != nil {
+			return 0, err
+		}
+	}
+
+	keys, err := p.bstore.AllKeysChan(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var sweep []cid.Cid
+	for c := range keys {
+		if _, ok := marked[string(c.Hash())]; !ok {
+			sweep = append(sweep, c)
+		}
+	}
+
+	for i, c := range sweep {
+		if err := p.bstore.DeleteBlock(ctx, c); err != nil {
+			return i, err
+		}
+	}
+
+	return len(sweep), nil
+}
+
+func pinKey(root cid.Cid) datastore.Key {
+	return pinsPrefix.ChildString(root.String())
+}
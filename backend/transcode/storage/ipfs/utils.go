@@ -1,9 +1,14 @@
 package ipfs
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/ipfs/boxo/files"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-multiaddr"
 )
 
 func getUnixfsNode(path string) (files.Node, error) {
@@ -19,3 +24,67 @@ func getUnixfsNode(path string) (files.Node, error) {
 
 	return f, nil
 }
+
+// LoadOrCreateIdentity returns the key saved at the path, a new one is created and saved if there is none
+// the peer id stays the same across restarts, a new key is made each boot if the path is empty
+func LoadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	if len(path) == 0 {
+		return generatePrivKey()
+	}
+
+	priv, err := LoadPrivateKey(path)
+	if err == nil {
+		return priv, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	priv, err = generatePrivKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the identity directory: %s", err)
+	}
+
+	return priv, SavePrivateKey(priv, path)
+}
+
+func SavePrivateKey(privKey crypto.PrivKey, filename string) error {
+	data, err := crypto.MarshalPrivateKey(privKey)
+	if err != nil {
+		return fmt.Errorf("error marshaling private key: %w", err)
+	}
+
+	// only the node reads its key
+	return os.WriteFile(filename, data, 0600)
+}
+
+func LoadPrivateKey(filename string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key file: %w", err)
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling private key: %w", err)
+	}
+
+	return key, nil
+}
+
+func parseMultiaddrs(addrs []string) ([]multiaddr.Multiaddr, error) {
+	var parsed []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %s", addr, err)
+		}
+		parsed = append(parsed, maddr)
+	}
+
+	return parsed, nil
+}
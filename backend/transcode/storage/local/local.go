@@ -0,0 +1,166 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sen1or/lets-live/transcode/storage"
+	"strings"
+)
+
+// LocalStorage keeps the files in a directory served over http, for the deployments without ipfs or an object store
+type LocalStorage struct {
+	directory string
+	publicURL string
+}
+
+func NewLocalStorage(directory string, publicURL string) (*LocalStorage, error) {
+	if len(directory) == 0 {
+		return nil, fmt.Errorf("missing storage directory")
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %s", err)
+	}
+
+	return &LocalStorage{
+		directory: directory,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+	}, nil
+}
+
+func (s *LocalStorage) AddFile(filePath string) (string, error) {
+	name, err := storage.ObjectName(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// the same content is already stored
+	destination := filepath.Join(s.directory, name)
+	if _, err := os.Stat(destination); err == nil {
+		return name, nil
+	}
+
+	if err := copyFile(filePath, destination); err != nil {
+		return "", fmt.Errorf("failed to add file into storage: %s", err)
+	}
+
+	return name, nil
+}
+
+func (s *LocalStorage) AddDirectory(directoryPath string) (string, error) {
+	name, err := storage.DirectoryName(directoryPath)
+	if err != nil {
+		return "", err
+	}
+
+	destination := filepath.Join(s.directory, name)
+	if _, err := os.Stat(destination); err == nil {
+		return name, nil
+	}
+
+	// copied aside then renamed, the directory is complete once it exists
+	tmpDir, err := os.MkdirTemp(s.directory, ".upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to add directory into storage: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = filepath.WalkDir(directoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(directoryPath, filePath)
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(tmpDir, relativePath)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return copyFile(filePath, dst)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to add directory into storage: %s", err)
+	}
+
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpDir, destination); err != nil {
+		return "", fmt.Errorf("failed to add directory into storage: %s", err)
+	}
+
+	return name, nil
+}
+
+func (s *LocalStorage) Delete(id string) error {
+	objectPath, err := s.objectPath(id)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(objectPath)
+}
+
+func (s *LocalStorage) Exists(id string) (bool, error) {
+	objectPath, err := s.objectPath(id)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(objectPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *LocalStorage) PublicURL(id string) string {
+	return s.publicURL + "/" + id
+}
+
+// the path of an object, the id must stay inside the directory
+func (s *LocalStorage) objectPath(id string) (string, error) {
+	cleaned := path.Clean("/" + id)
+	if cleaned == "/" || cleaned != "/"+id {
+		return "", fmt.Errorf("invalid id %s", id)
+	}
+
+	return filepath.Join(s.directory, filepath.FromSlash(cleaned)), nil
+}
+
+// copy through a temporary file so a file is never served half written
+func copyFile(src string, dst string) error {
+	input, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(output.Name())
+
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(output.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(output.Name(), dst)
+}
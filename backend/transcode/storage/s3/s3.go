@@ -0,0 +1,168 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/storage"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultRegion = "us-east-1"
+
+// S3Storage uploads the files to an s3 compatible object store
+type S3Storage struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	publicURL string
+	ctx       context.Context
+}
+
+func NewS3Storage(ctx context.Context, setting config.S3Setting) (*S3Storage, error) {
+	if len(setting.Endpoint) == 0 || len(setting.Bucket) == 0 {
+		return nil, fmt.Errorf("missing s3 endpoint or bucket")
+	}
+
+	region := setting.Region
+	if len(region) == 0 {
+		region = defaultRegion
+	}
+
+	client, err := minio.New(setting.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(setting.AccessKey, setting.SecretKey, ""),
+		Secure: setting.UseSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %s", err)
+	}
+
+	exists, err := client.BucketExists(ctx, setting.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %s", setting.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, setting.Bucket, minio.MakeBucketOptions{Region: region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %s", setting.Bucket, err)
+		}
+	}
+
+	publicURL := setting.PublicURL
+	if len(publicURL) == 0 {
+		publicURL = client.EndpointURL().String() + "/" + setting.Bucket
+	}
+
+	return &S3Storage{
+		client:    client,
+		bucket:    setting.Bucket,
+		prefix:    strings.Trim(setting.Prefix, "/"),
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		ctx:       ctx,
+	}, nil
+}
+
+func (s *S3Storage) AddFile(filePath string) (string, error) {
+	name, err := storage.ObjectName(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	key := path.Join(s.prefix, name)
+	if err := s.put(key, filePath); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// AddDirectory uploads the files under a common key prefix, s3 has no directories
+func (s *S3Storage) AddDirectory(directoryPath string) (string, error) {
+	name, err := storage.DirectoryName(directoryPath)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := path.Join(s.prefix, name)
+	err = filepath.WalkDir(directoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(directoryPath, filePath)
+		if err != nil {
+			return err
+		}
+
+		return s.put(path.Join(prefix, filepath.ToSlash(relativePath)), filePath)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return prefix, nil
+}
+
+func (s *S3Storage) put(key string, filePath string) error {
+	_, err := s.client.FPutObject(s.ctx, s.bucket, key, filePath, minio.PutObjectOptions{
+		ContentType: storage.ContentType(filePath),
+		// the objects are named after their content, they never change
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add file into s3: %s", err)
+	}
+
+	return nil
+}
+
+// Delete removes the object, or every object under it when the id is a directory
+func (s *S3Storage) Delete(id string) error {
+	if err := s.client.RemoveObject(s.ctx, s.bucket, id, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s: %s", id, err)
+	}
+
+	for object := range s.client.ListObjects(s.ctx, s.bucket, minio.ListObjectsOptions{Prefix: id + "/", Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list %s: %s", id, object.Err)
+		}
+
+		if err := s.client.RemoveObject(s.ctx, s.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("failed to delete %s: %s", object.Key, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Storage) Exists(id string) (bool, error) {
+	_, err := s.client.StatObject(s.ctx, s.bucket, id, minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return false, fmt.Errorf("failed to stat %s: %s", id, err)
+	}
+
+	// a directory
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: id + "/", MaxKeys: 1}) {
+		if object.Err != nil {
+			return false, fmt.Errorf("failed to list %s: %s", id, object.Err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (s *S3Storage) PublicURL(id string) string {
+	return s.publicURL + "/" + id
+}
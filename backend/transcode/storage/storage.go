@@ -1,9 +1,99 @@
 package storage
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// the ids are what the storage names the objects with, a cid for ipfs, a key for the others
 type Storage interface {
-	// Save the file and return its final remote path
+	// Save the file and return its id
 	AddFile(filePath string) (string, error)
 
-	// Return the hash
-	// AddDirectory(directoryName string) (string, error)
+	// Save the files of the directory, recursively, and return the id of the directory
+	// the id of a file inside is the directory id followed by its relative path (<id>/0/stream0.ts)
+	AddDirectory(directoryPath string) (string, error)
+
+	// Delete the object, a directory is deleted with its files
+	Delete(id string) error
+
+	Exists(id string) (bool, error)
+
+	// Return the url viewers fetch the object with
+	PublicURL(id string) string
+}
+
+// Holder is implemented by the storages that expire the files by themselves (ipfs), the files uploaded once
+// and listed for the whole stream (the init files, the full sprite sheets) are held until the stream ends
+type Holder interface {
+	Hold(id string) error
+	Release(id string) error
+}
+
+// the content types of the uploaded files, the players need them
+var contentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".mpd":  "application/dash+xml",
+	".jpg":  "image/jpeg",
+	".vtt":  "text/vtt",
+}
+
+func ContentType(filePath string) string {
+	if contentType, ok := contentTypes[filepath.Ext(filePath)]; ok {
+		return contentType
+	}
+
+	return "application/octet-stream"
+}
+
+// DirectoryName names a directory after the relative paths and the content of its files, see ObjectName
+func DirectoryName(directoryPath string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(directoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(directoryPath, filePath)
+		if err != nil {
+			return err
+		}
+		name, err := ObjectName(filePath)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(hash, "%s %s\n", filepath.ToSlash(relativePath), name)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read directory: %s", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ObjectName names a file after its content like ipfs does, the segments of every stream share their names (stream0.ts...)
+// and an object never changes, it can be cached forever
+func ObjectName(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file: %s", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read file: %s", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)) + filepath.Ext(filePath), nil
 }
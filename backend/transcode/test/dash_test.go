@@ -0,0 +1,264 @@
+package test
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/dash"
+	"sen1or/lets-live/transcode/transcoder"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const dashMaster = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-STREAM-INF:BANDWIDTH=2340800,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2"
+0/stream.m3u8
+
+#EXT-X-STREAM-INF:BANDWIDTH=1020800,RESOLUTION=640x360,CODECS="avc1.64001e,mp4a.40.2"
+1/stream.m3u8
+`
+
+func dashVariant(segmentURI func(name string) string) string {
+	return `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:4
+#EXT-X-MAP:URI="` + segmentURI("init.mp4") + `"
+#EXT-X-PROGRAM-DATE-TIME:2024-11-30T17:30:24.000+0000
+#EXTINF:2.000000,
+` + segmentURI("stream4.m4s") + `
+#EXTINF:2.000000,
+` + segmentURI("stream5.m4s") + `
+`
+}
+
+const dashTimescale = 90000
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	out := binary.BigEndian.AppendUint32(nil, uint32(size))
+	out = append(out, boxType...)
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// a full box payload: version, flags and the 32 bit fields
+func fullBox(version byte, fields ...uint32) []byte {
+	out := []byte{version, 0, 0, 0}
+	for _, field := range fields {
+		out = binary.BigEndian.AppendUint32(out, field)
+	}
+	return out
+}
+
+func mp4Track(trackID uint32, timescale uint32, handler string) []byte {
+	return mp4Box("trak",
+		mp4Box("tkhd", fullBox(0, 0, 0, trackID, 0, 0)),
+		mp4Box("mdia",
+			mp4Box("mdhd", fullBox(0, 0, 0, timescale, 0)),
+			mp4Box("hdlr", fullBox(0, 0), []byte(handler), make([]byte, 12)),
+		),
+	)
+}
+
+// the video is the second track, like a stream whose audio came first
+func mp4Init() []byte {
+	return append(mp4Box("ftyp", []byte("iso5"), make([]byte, 4)),
+		mp4Box("moov", mp4Box("mvhd", fullBox(0, 0, 0, 1000, 0)), mp4Track(1, 48000, "soun"), mp4Track(2, dashTimescale, "vide"))...)
+}
+
+// a segment of both tracks, the audio has its own decode time
+func mp4Segment(decodeTime uint64) []byte {
+	moof := mp4Box("moof",
+		mp4Box("mfhd", fullBox(0, 1)),
+		mp4Box("traf", mp4Box("tfhd", fullBox(0, 1)), mp4Box("tfdt", fullBox(0, 12345))),
+		mp4Box("traf", mp4Box("tfhd", fullBox(0, 2)), mp4Box("tfdt", append([]byte{1, 0, 0, 0}, binary.BigEndian.AppendUint64(nil, decodeTime)...))),
+	)
+	return append(append(mp4Box("styp", []byte("msdh"), make([]byte, 4)), moof...), mp4Box("mdat", []byte("media"))...)
+}
+
+type testMPD struct {
+	Type                  string `xml:"type,attr"`
+	AvailabilityStartTime string `xml:"availabilityStartTime,attr"`
+	Periods               []struct {
+		ID              string `xml:"id,attr"`
+		Start           string `xml:"start,attr"`
+		Representations []struct {
+			ID          string `xml:"id,attr"`
+			Bandwidth   int    `xml:"bandwidth,attr"`
+			Codecs      string `xml:"codecs,attr"`
+			Width       int    `xml:"width,attr"`
+			Height      int    `xml:"height,attr"`
+			SegmentList struct {
+				Timescale              int    `xml:"timescale,attr"`
+				PresentationTimeOffset uint64 `xml:"presentationTimeOffset,attr"`
+				StartNumber            int    `xml:"startNumber,attr"`
+				Initialization         struct {
+					SourceURL string `xml:"sourceURL,attr"`
+				} `xml:"Initialization"`
+				Timeline []struct {
+					T uint64 `xml:"t,attr"`
+					D uint64 `xml:"d,attr"`
+				} `xml:"SegmentTimeline>S"`
+				SegmentURLs []struct {
+					Media string `xml:"media,attr"`
+				} `xml:"SegmentURL"`
+			} `xml:"SegmentList"`
+		} `xml:"AdaptationSet>Representation"`
+	} `xml:"Period"`
+}
+
+// writeDashStream writes the playlists in dir and the fmp4 files in segmentDir, the segments 4 and 5 start 8 and 10 seconds
+// after ffmpeg started
+func writeDashStream(t *testing.T, dir string, segmentDir string, segmentURI func(name string) string) {
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(dashMaster), 0644))
+	for _, variant := range []string{"0", "1"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, variant), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, variant, "stream.m3u8"), []byte(dashVariant(segmentURI)), 0644))
+
+		assert.NoError(t, os.MkdirAll(filepath.Join(segmentDir, variant), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(segmentDir, variant, "init.mp4"), mp4Init(), 0644))
+		assert.NoError(t, os.WriteFile(filepath.Join(segmentDir, variant, "stream4.m4s"), mp4Segment(8*dashTimescale), 0644))
+		assert.NoError(t, os.WriteFile(filepath.Join(segmentDir, variant, "stream5.m4s"), mp4Segment(10*dashTimescale), 0644))
+	}
+}
+
+func readMPD(t *testing.T, dir string) testMPD {
+	data, err := os.ReadFile(filepath.Join(dir, dash.ManifestName))
+	assert.NoError(t, err)
+
+	var manifest testMPD
+	assert.NoError(t, xml.Unmarshal(data, &manifest))
+	return manifest
+}
+
+var dashOptions = dash.Options{MasterFileName: "index.m3u8", SegmentDuration: 2 * time.Second}
+
+func TestDASHGenerate(t *testing.T) {
+	dir := t.TempDir()
+	writeDashStream(t, dir, dir, func(name string) string { return name })
+	assert.NoError(t, dash.NewGenerator(dir, dir, dashOptions).Generate())
+
+	manifest := readMPD(t, dir)
+	assert.Equal(t, "dynamic", manifest.Type)
+	assert.Equal(t, "2024-11-30T17:30:24Z", manifest.AvailabilityStartTime)
+	assert.Len(t, manifest.Periods, 1)
+	assert.Equal(t, "PT0S", manifest.Periods[0].Start)
+
+	representations := manifest.Periods[0].Representations
+	assert.Len(t, representations, 2)
+
+	first := representations[0]
+	assert.Equal(t, "0", first.ID)
+	assert.Equal(t, 2340800, first.Bandwidth)
+	assert.Equal(t, "avc1.64001f,mp4a.40.2", first.Codecs)
+	assert.Equal(t, 1280, first.Width)
+	assert.Equal(t, 720, first.Height)
+	assert.Equal(t, 4, first.SegmentList.StartNumber)
+	assert.Equal(t, "0/init.mp4", first.SegmentList.Initialization.SourceURL)
+
+	// the times are the decode times of the video track, the first segment is presented at the period start
+	assert.Equal(t, dashTimescale, first.SegmentList.Timescale)
+	assert.Equal(t, uint64(8*dashTimescale), first.SegmentList.PresentationTimeOffset)
+	assert.Len(t, first.SegmentList.Timeline, 2)
+	assert.Equal(t, uint64(8*dashTimescale), first.SegmentList.Timeline[0].T)
+	assert.Equal(t, uint64(2*dashTimescale), first.SegmentList.Timeline[0].D)
+	assert.Equal(t, uint64(10*dashTimescale), first.SegmentList.Timeline[1].T)
+
+	assert.Len(t, first.SegmentList.SegmentURLs, 2)
+	assert.Equal(t, "0/stream4.m4s", first.SegmentList.SegmentURLs[0].Media)
+	assert.Equal(t, "1/stream5.m4s", representations[1].SegmentList.SegmentURLs[1].Media)
+}
+
+func TestDASHGenerate_RemoteSegments(t *testing.T) {
+	// the playlists rewritten by the watcher point to the gateway, ffmpeg wrote the files in the private directory
+	remote := func(name string) string { return "http://localhost:8080/ipfs/cid?fileName=" + name }
+	dir, segmentDir := t.TempDir(), t.TempDir()
+	writeDashStream(t, dir, segmentDir, remote)
+	generator := dash.NewGenerator(dir, segmentDir, dashOptions)
+	assert.NoError(t, generator.Generate())
+
+	representation := readMPD(t, dir).Periods[0].Representations[0]
+	assert.Equal(t, remote("init.mp4"), representation.SegmentList.Initialization.SourceURL)
+	assert.Equal(t, remote("stream4.m4s"), representation.SegmentList.SegmentURLs[0].Media)
+	assert.Equal(t, uint64(8*dashTimescale), representation.SegmentList.Timeline[0].T)
+
+	// ffmpeg deleted the oldest file, it is still listed with the decode time read before
+	assert.NoError(t, os.Remove(filepath.Join(segmentDir, "0", "stream4.m4s")))
+	assert.NoError(t, generator.Generate())
+
+	representation = readMPD(t, dir).Periods[0].Representations[0]
+	assert.Len(t, representation.SegmentList.Timeline, 2)
+	assert.Equal(t, uint64(8*dashTimescale), representation.SegmentList.Timeline[0].T)
+}
+
+func TestDASHGenerate_Restart(t *testing.T) {
+	dir := t.TempDir()
+	writeDashStream(t, dir, dir, func(name string) string { return name })
+	generator := dash.NewGenerator(dir, dir, dashOptions)
+	assert.NoError(t, generator.Generate())
+
+	// ffmpeg restarted 4 seconds after the last segment, its decode times start over
+	for _, variant := range []string{"0", "1"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, variant, "stream6.m4s"), mp4Segment(0), 0644))
+		playlist := dashVariant(func(name string) string { return name }) + `#EXT-X-DISCONTINUITY
+#EXT-X-PROGRAM-DATE-TIME:2024-11-30T17:30:32.000+0000
+#EXTINF:2.000000,
+stream6.m4s
+`
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, variant, "stream.m3u8"), []byte(playlist), 0644))
+	}
+	assert.NoError(t, generator.Generate())
+
+	manifest := readMPD(t, dir)
+	assert.Equal(t, "2024-11-30T17:30:24Z", manifest.AvailabilityStartTime)
+	assert.Len(t, manifest.Periods, 2)
+	assert.Equal(t, "PT0S", manifest.Periods[0].Start)
+	assert.Len(t, manifest.Periods[0].Representations[0].SegmentList.Timeline, 2)
+
+	restarted := manifest.Periods[1]
+	assert.Equal(t, "PT8S", restarted.Start)
+	assert.Equal(t, strconv.FormatInt(time.Date(2024, 11, 30, 17, 30, 32, 0, time.UTC).UnixMilli(), 10), restarted.ID)
+	assert.Len(t, restarted.Representations, 2)
+	list := restarted.Representations[0].SegmentList
+	assert.Equal(t, uint64(0), list.PresentationTimeOffset)
+	assert.Equal(t, 6, list.StartNumber)
+	assert.Len(t, list.Timeline, 1)
+	assert.Equal(t, uint64(0), list.Timeline[0].T)
+}
+
+func TestDASHGenerate_MissingPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	err := dash.NewGenerator(dir, dir, dashOptions).Generate()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBuildArgs_ProgramDateTime(t *testing.T) {
+	setting := config.FFMpegSetting{
+		FFMpegPath:     "ffmpeg",
+		MasterFileName: "index.m3u8",
+		HLSTime:        2,
+		CRF:            23,
+		Preset:         "veryfast",
+		HlsListSize:    5,
+		HlsMaxSize:     10,
+		SegmentType:    transcoder.SegmentTypeFMP4,
+		Qualities:      []config.Quality{{Resolution: "1280x720", MaxBitrate: "2500k", FPS: 30, BufSize: "5000k"}},
+	}
+
+	args, err := transcoder.NewArgsBuilder(setting, "out").ProgramDateTime(true).Build()
+	assert.NoError(t, err)
+	assert.Contains(t, args, "delete_segments+program_date_time+temp_file")
+}
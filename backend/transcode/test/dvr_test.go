@@ -0,0 +1,84 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/domains"
+	"sen1or/lets-live/transcode/watcher"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the local playlist written by ffmpeg, with a live window of 2 segments
+func liveWindowPlaylist(first int, last int, discontinuityAt int) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for i := first; i <= last; i++ {
+		if i == discontinuityAt {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:2.000000,\nstream%d.ts\n", i)
+	}
+
+	return b.String()
+}
+
+func uploadSegment(variant *domains.HLSVariant, dir string, number int) {
+	variant.Segments = append(variant.Segments, domains.HLSSegment{
+		FullLocalPath: filepath.Join(dir, fmt.Sprintf("stream%d.ts", number)),
+		RemoteURL:     fmt.Sprintf("http://gateway/ipfs/cid%d", number),
+	})
+}
+
+func TestDVRPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	playlistPath := filepath.Join(dir, "stream.m3u8")
+	variant := &domains.HLSVariant{}
+
+	// the window holds 3 segments of 2 seconds, the live playlist only 2
+	window := 6 * time.Second
+	for last := 1; last <= 4; last++ {
+		uploadSegment(variant, dir, last-1)
+		uploadSegment(variant, dir, last)
+		assert.NoError(t, os.WriteFile(playlistPath, []byte(liveWindowPlaylist(last-1, last, 3)), 0644))
+
+		_, err := watcher.GenerateDVRPlaylist(playlistPath, variant, window)
+		assert.NoError(t, err)
+	}
+
+	// segment 5 is in the local playlist but not uploaded yet
+	assert.NoError(t, os.WriteFile(playlistPath, []byte(liveWindowPlaylist(4, 5, -1)), 0644))
+	playlist, err := watcher.GenerateDVRPlaylist(playlistPath, variant, window)
+	assert.NoError(t, err)
+
+	expected := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:2
+#EXTINF:2.000000,
+http://gateway/ipfs/cid2?fileName=stream2.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:2.000000,
+http://gateway/ipfs/cid3?fileName=stream3.ts
+#EXTINF:2.000000,
+http://gateway/ipfs/cid4?fileName=stream4.ts
+`
+	assert.Equal(t, expected, playlist)
+
+	// the discontinuity leaves the window
+	for last := 5; last <= 7; last++ {
+		uploadSegment(variant, dir, last)
+		assert.NoError(t, os.WriteFile(playlistPath, []byte(liveWindowPlaylist(last-1, last, -1)), 0644))
+		playlist, err = watcher.GenerateDVRPlaylist(playlistPath, variant, window)
+		assert.NoError(t, err)
+	}
+
+	assert.Contains(t, playlist, "#EXT-X-MEDIA-SEQUENCE:5\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n")
+	assert.NotContains(t, playlist, "#EXT-X-DISCONTINUITY\n")
+	assert.Len(t, variant.DVRSegments, 3)
+}
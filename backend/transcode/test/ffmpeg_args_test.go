@@ -0,0 +1,213 @@
+package test
+
+import (
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/transcoder"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validSetting() config.FFMpegSetting {
+	return config.FFMpegSetting{
+		FFMpegPath:     "/usr/bin/ffmpeg",
+		MasterFileName: "index.m3u8",
+		HLSTime:        2,
+		CRF:            23,
+		Preset:         "veryfast",
+		HlsListSize:    5,
+		HlsMaxSize:     8,
+		Qualities: []config.Quality{
+			{Resolution: "1920x1080", MaxBitrate: "6000k", FPS: 30, BufSize: "12000k"},
+			{Resolution: "1280x720", MaxBitrate: "3000k", FPS: 30, BufSize: "6000k"},
+		},
+	}
+}
+
+func TestBuildArgs_Success(t *testing.T) {
+	args, err := transcoder.NewArgsBuilder(validSetting(), "/var/hls/private dir/user-1").Build()
+	assert.NoError(t, err)
+
+	expected := []string{
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "level+info",
+		"-progress", "pipe:3",
+		"-re",
+		"-i", "pipe:0",
+		"-preset", "veryfast",
+		"-sc_threshold", "0",
+		"-c:v", "libx264",
+		"-pix_fmt", "yuv420p",
+		"-crf", "23",
+		"-map", "v:0", "-s:0", "1920x1080", "-r:0", "30", "-maxrate:0", "6000k", "-bufsize:0", "12000k", "-g:0", "60", "-keyint_min:0", "2",
+		"-map", "v:0", "-s:1", "1280x720", "-r:1", "30", "-maxrate:1", "3000k", "-bufsize:1", "6000k", "-g:1", "60", "-keyint_min:1", "2",
+		"-map", "a:0",
+		"-map", "a:0",
+		"-c:a", "aac",
+		"-b:a", "128k",
+		"-ac", "1",
+		"-ar", "44100",
+		"-f", "hls",
+		"-hls_time", "2",
+		"-hls_delete_threshold", "3",
+		"-hls_list_size", "5",
+		"-hls_flags", "delete_segments+temp_file",
+		"-master_pl_name", "index.m3u8",
+		"-var_stream_map", "v:0,a:0 v:1,a:1",
+		"/var/hls/private dir/user-1/%v/stream.m3u8",
+	}
+
+	assert.Equal(t, expected, args)
+}
+
+func TestBuildArgs_ValidationFailure(t *testing.T) {
+	tests := map[string]func(s *config.FFMpegSetting){
+		"no qualities":        func(s *config.FFMpegSetting) { s.Qualities = nil },
+		"invalid preset":      func(s *config.FFMpegSetting) { s.Preset = "fast; rm -rf /" },
+		"invalid crf":         func(s *config.FFMpegSetting) { s.CRF = 60 },
+		"invalid hls time":    func(s *config.FFMpegSetting) { s.HLSTime = 0 },
+		"max size below list": func(s *config.FFMpegSetting) { s.HlsMaxSize = 2 },
+		"master file in path": func(s *config.FFMpegSetting) { s.MasterFileName = "../index.m3u8" },
+		"invalid resolution":  func(s *config.FFMpegSetting) { s.Qualities[1].Resolution = "720p" },
+		"invalid fps":         func(s *config.FFMpegSetting) { s.Qualities[0].FPS = 0 },
+		"invalid max bitrate": func(s *config.FFMpegSetting) { s.Qualities[0].MaxBitrate = "3000k $(id)" },
+		"invalid buffer size": func(s *config.FFMpegSetting) { s.Qualities[1].BufSize = "" },
+		"missing ffmpeg path": func(s *config.FFMpegSetting) { s.FFMpegPath = "" },
+	}
+
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			setting := validSetting()
+			mutate(&setting)
+
+			args, err := transcoder.NewArgsBuilder(setting, "/tmp/out").Build()
+			assert.Error(t, err)
+			assert.Nil(t, args)
+		})
+	}
+}
+
+func TestBuildArgs_Resume(t *testing.T) {
+	args, err := transcoder.NewArgsBuilder(validSetting(), "/var/hls/user-1").Resume(true).Build()
+	assert.NoError(t, err)
+
+	assert.Contains(t, args, "delete_segments+append_list+discont_start+temp_file")
+}
+
+func TestBuildArgs_Profile(t *testing.T) {
+	profile, err := transcoder.ResolveProfile(map[string]config.EncoderProfile{
+		"nvidia": {VideoCodec: "h264_nvenc", AudioChannels: 2, AudioSampleRate: 48000, AudioBitrate: "160k"},
+	}, "nvidia")
+	assert.NoError(t, err)
+
+	args, err := transcoder.NewArgsBuilder(validSetting(), "/var/hls/user-1").Profile(profile).Build()
+	assert.NoError(t, err)
+
+	assert.Contains(t, args, "h264_nvenc")
+	assert.NotContains(t, args, "-crf")
+	assert.NotContains(t, args, "-sc_threshold")
+	assert.Subset(t, args, []string{"-c:a", "aac", "-b:a", "160k", "-ac", "2", "-ar", "48000"})
+}
+
+func TestResolveProfile_Failure(t *testing.T) {
+	_, err := transcoder.ResolveProfile(nil, "missing")
+	assert.Error(t, err)
+
+	_, err = transcoder.ResolveProfile(map[string]config.EncoderProfile{
+		"bad": {VideoCodec: "h264_nvenc", X264Params: "keyint=60"},
+	}, "bad")
+	assert.Error(t, err)
+}
+
+func TestBuildArgs_SourceRendition(t *testing.T) {
+	setting := validSetting()
+	setting.Qualities[0] = config.Quality{MaxBitrate: "6000k", FPS: 30, BufSize: "12000k", Source: true}
+
+	tests := map[string]struct {
+		source transcoder.SourceInfo
+		copied bool
+	}{
+		"h264 within max bitrate": {transcoder.SourceInfo{VideoCodec: "h264", VideoBitrate: 4500}, true},
+		"h264 above max bitrate":  {transcoder.SourceInfo{VideoCodec: "h264", VideoBitrate: 8000}, false},
+		"unknown bitrate":         {transcoder.SourceInfo{VideoCodec: "h264"}, false},
+		"not h264":                {transcoder.SourceInfo{VideoCodec: "vp8", VideoBitrate: 2000}, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			args, err := transcoder.NewArgsBuilder(setting, "/var/hls/user-1").Source(test.source).Build()
+			assert.NoError(t, err)
+
+			if test.copied {
+				assert.Subset(t, args, []string{"-c:0", "copy"})
+				assert.NotContains(t, args, "-maxrate:0")
+			} else {
+				assert.NotContains(t, args, "copy")
+				assert.Contains(t, args, "-maxrate:0")
+				// no resolution keeps the source one
+				assert.NotContains(t, args, "-s:0")
+			}
+		})
+	}
+}
+
+func TestSelectLadder(t *testing.T) {
+	qualities := []config.Quality{
+		{Resolution: "1920x1080", MaxBitrate: "6000k", FPS: 60, BufSize: "12000k"},
+		{Resolution: "1280x720", MaxBitrate: "3000k", FPS: 30, BufSize: "6000k"},
+		{Resolution: "854x480", MaxBitrate: "1500k", FPS: 30, BufSize: "3000k"},
+	}
+
+	tests := map[string]struct {
+		source   transcoder.SourceInfo
+		expected []string
+	}{
+		"unknown source":        {transcoder.SourceInfo{}, []string{"1920x1080", "1280x720", "854x480"}},
+		"480p source":           {transcoder.SourceInfo{Width: 854, Height: 480, FPS: 30}, []string{"854x480"}},
+		"1080p at 29.97 fps":    {transcoder.SourceInfo{Width: 1920, Height: 1080, FPS: 29.97}, []string{"1280x720", "854x480"}},
+		"portrait 720p source":  {transcoder.SourceInfo{Width: 720, Height: 1280, FPS: 30}, []string{"1280x720", "854x480"}},
+		"below the lowest rung": {transcoder.SourceInfo{Width: 640, Height: 360, FPS: 30}, []string{"854x480"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ladder := transcoder.SelectLadder(qualities, test.source)
+
+			resolutions := make([]string, 0, len(ladder))
+			for _, quality := range ladder {
+				resolutions = append(resolutions, quality.Resolution)
+			}
+			assert.Equal(t, test.expected, resolutions)
+		})
+	}
+}
+
+func TestBuildArgs_LadderFromSource(t *testing.T) {
+	builder := transcoder.NewArgsBuilder(validSetting(), "/var/hls/user-1").
+		Source(transcoder.SourceInfo{VideoCodec: "h264", Width: 1280, Height: 720, FPS: 30})
+	args, err := builder.Build()
+	assert.NoError(t, err)
+
+	assert.NotContains(t, args, "1920x1080")
+	assert.Subset(t, args, []string{"-s:0", "1280x720", "-var_stream_map", "v:0,a:0"})
+
+	// the renditions the arguments encode, for the watcher
+	assert.Len(t, builder.Ladder(), 1)
+	assert.Equal(t, "1280x720", builder.Ladder()[0].Resolution)
+}
+
+func TestBuildArgs_FMP4Segments(t *testing.T) {
+	setting := validSetting()
+	setting.SegmentType = transcoder.SegmentTypeFMP4
+
+	args, err := transcoder.NewArgsBuilder(setting, "/var/hls/user-1").Build()
+	assert.NoError(t, err)
+
+	assert.Subset(t, args, []string{"-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4"})
+	assert.Contains(t, args, "/var/hls/user-1/%v/stream%d.m4s")
+
+	setting.SegmentType = "webm"
+	_, err = transcoder.NewArgsBuilder(setting, "/var/hls/user-1").Build()
+	assert.Error(t, err)
+}
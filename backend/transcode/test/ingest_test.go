@@ -0,0 +1,187 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	usergateway "sen1or/lets-live/transcode/gateway/user/http"
+	"sen1or/lets-live/transcode/ingest"
+	"sen1or/lets-live/transcode/session"
+	"sen1or/lets-live/user/dto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUserService answers the stream key lookups with a single user and keeps the updates it receives
+type fakeUserService struct {
+	userId uuid.UUID
+
+	mu      sync.Mutex
+	updates []dto.UpdateUserRequestDTO
+}
+
+func (s *fakeUserService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/user":
+		json.NewEncoder(w).Encode(dto.GetUserResponseDTO{ID: s.userId})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/user/"):
+		var update dto.UpdateUserRequestDTO
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		s.updates = append(s.updates, update)
+		s.mu.Unlock()
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// the online statuses sent so far
+func (s *fakeUserService) onlineUpdates() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var statuses []bool
+	for _, update := range s.updates {
+		if update.IsOnline != nil {
+			statuses = append(statuses, *update.IsOnline)
+		}
+	}
+	return statuses
+}
+
+// fakeRegistry resolves every service to the same address
+type fakeRegistry struct {
+	addr string
+}
+
+func (r fakeRegistry) Register(ctx context.Context, hostPort string, serviceHealthCheckURL string, serviceName string, instanceID string, tags []string) error {
+	return nil
+}
+
+func (r fakeRegistry) Deregister(ctx context.Context, serviceName string, instanceID string) error {
+	return nil
+}
+
+func (r fakeRegistry) ServiceAddresses(ctx context.Context, serviceName string) ([]string, error) {
+	return []string{r.addr}, nil
+}
+
+func (r fakeRegistry) ServiceAddress(ctx context.Context, serviceName string) (string, error) {
+	return r.addr, nil
+}
+
+// stuckConn ignores Close, like a handler blocked somewhere that does not notice the kick
+type stuckConn struct{}
+
+func (stuckConn) Close() error         { return nil }
+func (stuckConn) RemoteAddr() net.Addr { return nil }
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) PublishStarted(publishName string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, "started")
+}
+
+func (o *recordingObserver) LadderSelected(publishName string, ladder []config.Quality) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, "ladder")
+}
+
+func (o *recordingObserver) PublishEnded(publishName string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, "ended")
+}
+
+func (o *recordingObserver) Events() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.events...)
+}
+
+func TestPublisher_KickedPublishEndingLateKeepsTheNewcomerLive(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	users := &fakeUserService{userId: uuid.Must(uuid.NewV4())}
+	server := httptest.NewServer(users)
+	defer server.Close()
+
+	_, cfg := fakeFFMpeg(t, "exec cat > /dev/null")
+	cfg.Ingest.DuplicatePublishPolicy = ingest.DuplicatePublishKick
+
+	sessionManager := session.NewSessionManager()
+	publisher := ingest.NewPublisher(cfg, usergateway.NewUserGateway(fakeRegistry{addr: server.Listener.Addr().String()}), sessionManager, nil)
+	observer := &recordingObserver{}
+	publisher.AddObserver(observer)
+
+	stale, err := publisher.Begin("key", stuckConn{})
+	require.NoError(t, err)
+
+	// the first handler never ends by itself, the newcomer takes over once the kick timed out
+	startedAt := time.Now()
+	newcomer, err := publisher.Begin("key", stuckConn{})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(startedAt), 5*time.Second)
+
+	current, ok := sessionManager.Get(users.userId.String())
+	require.True(t, ok)
+	assert.Same(t, newcomer.Session, current)
+
+	// then the stale handler returns
+	publisher.End(stale)
+	assert.Equal(t, []bool{true, true}, users.onlineUpdates())
+	assert.Equal(t, []string{"started", "started"}, observer.Events())
+	current, ok = sessionManager.Get(users.userId.String())
+	require.True(t, ok)
+	assert.Same(t, newcomer.Session, current)
+
+	publisher.End(newcomer)
+	assert.Equal(t, []bool{true, true, false}, users.onlineUpdates())
+	assert.Equal(t, []string{"started", "started", "ended"}, observer.Events())
+	_, ok = sessionManager.Get(users.userId.String())
+	assert.False(t, ok)
+}
+
+func TestPublisher_EndClearsTheThumbnail(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	users := &fakeUserService{userId: uuid.Must(uuid.NewV4())}
+	server := httptest.NewServer(users)
+	defer server.Close()
+
+	_, cfg := fakeFFMpeg(t, "exec cat > /dev/null")
+	cfg.Transcode.Thumbnail.Enabled = true
+
+	publisher := ingest.NewPublisher(cfg, usergateway.NewUserGateway(fakeRegistry{addr: server.Listener.Addr().String()}), session.NewSessionManager(), nil)
+	publish, err := publisher.Begin("key", stuckConn{})
+	require.NoError(t, err)
+	publisher.End(publish)
+
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	last := users.updates[len(users.updates)-1]
+	require.NotNil(t, last.IsOnline)
+	assert.False(t, *last.IsOnline)
+	require.NotNil(t, last.ThumbnailURL)
+	assert.Empty(t, *last.ThumbnailURL)
+}
@@ -0,0 +1,199 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/storage/ipfs"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeer_RetentionPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, err := ipfs.NewLevelDBDatastore(filepath.Join(t.TempDir(), "datastore"))
+	assert.NoError(t, err)
+
+	host, err := libp2p.New(libp2p.NoListenAddrs)
+	assert.NoError(t, err)
+	defer host.Close()
+
+	// no dht, the blocks stay on this node
+	node, err := ipfs.NewIPFSNode(ctx, ds, host, routinghelpers.Null{})
+	assert.NoError(t, err)
+
+	expired, err := node.AddFile(ctx, bytes.NewReader([]byte("old segment")))
+	assert.NoError(t, err)
+	assert.NoError(t, node.Pin(ctx, expired.Cid(), ipfs.PinLive))
+
+	vod, err := node.AddFile(ctx, bytes.NewReader([]byte("vod playlist")))
+	assert.NoError(t, err)
+	assert.NoError(t, node.Pin(ctx, vod.Cid(), ipfs.PinVOD))
+
+	// added without a pin
+	_, err = node.AddFile(ctx, bytes.NewReader([]byte("unpinned")))
+	assert.NoError(t, err)
+
+	// the recordings are kept forever
+	policy := ipfs.RetentionPolicy{Live: time.Minute}
+	unpinned, err := node.UnpinExpired(ctx, policy, time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, unpinned)
+
+	unpinned, err = node.UnpinExpired(ctx, policy, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, unpinned, 1)
+	assert.Equal(t, ipfs.PinLive, unpinned[0].Kind)
+
+	live, err := node.AddFile(ctx, bytes.NewReader([]byte("live segment")))
+	assert.NoError(t, err)
+	assert.NoError(t, node.Pin(ctx, live.Cid(), ipfs.PinLive))
+
+	removed, err := node.GC(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	has, err := node.HasBlock(ctx, expired.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	has, err = node.HasBlock(ctx, live.Cid())
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	has, err = node.HasBlock(ctx, vod.Cid())
+	assert.NoError(t, err)
+	assert.True(t, has)
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity", "peer.key")
+
+	created, err := ipfs.LoadOrCreateIdentity(path)
+	assert.NoError(t, err)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the same peer id after a restart
+	loaded, err := ipfs.LoadOrCreateIdentity(path)
+	assert.NoError(t, err)
+	assert.True(t, created.Equals(loaded))
+
+	createdID, err := peer.IDFromPrivateKey(created)
+	assert.NoError(t, err)
+	loadedID, err := peer.IDFromPrivateKey(loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, createdID, loadedID)
+
+	// a corrupted key is not replaced
+	assert.NoError(t, os.WriteFile(path, []byte("garbage"), 0600))
+	_, err = ipfs.LoadOrCreateIdentity(path)
+	assert.Error(t, err)
+}
+
+func TestPeer_GCKeepsThePinnedBlocksAfterAMissingOne(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host, err := libp2p.New(libp2p.NoListenAddrs)
+	assert.NoError(t, err)
+	defer host.Close()
+
+	node, err := ipfs.NewIPFSNode(ctx, ipfs.NewInMemoryDatastore(), host, routinghelpers.Null{})
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.ts"), []byte("first segment"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.ts"), []byte("second segment"), 0644))
+	root, err := node.AddDirectory(ctx, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, node.Pin(ctx, root.Cid(), ipfs.PinVOD))
+
+	// the first link of the directory is gone, the walk must not stop there
+	links := root.Links()
+	assert.Len(t, links, 2)
+	assert.Equal(t, "a.ts", links[0].Name)
+	assert.NoError(t, node.BlockStore().DeleteBlock(ctx, links[0].Cid))
+
+	_, err = node.AddFile(ctx, bytes.NewReader([]byte("unpinned")))
+	assert.NoError(t, err)
+
+	removed, err := node.GC(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	has, err := node.HasBlock(ctx, links[1].Cid)
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	has, err = node.HasBlock(ctx, root.Cid())
+	assert.NoError(t, err)
+	assert.True(t, has)
+}
+
+// the init file of a live fmp4 stream is uploaded once, it must outlive the retention while the stream is publishing
+func TestPeer_HeldContentOutlivesTheRetention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host, err := libp2p.New(libp2p.NoListenAddrs)
+	assert.NoError(t, err)
+	defer host.Close()
+
+	node, err := ipfs.NewIPFSNode(ctx, ipfs.NewInMemoryDatastore(), host, routinghelpers.Null{})
+	assert.NoError(t, err)
+
+	init, err := node.AddFile(ctx, bytes.NewReader([]byte("init section")))
+	assert.NoError(t, err)
+	assert.NoError(t, node.Pin(ctx, init.Cid(), ipfs.PinLive))
+	// two streams share it
+	node.Hold(init.Cid())
+	node.Hold(init.Cid())
+
+	policy := ipfs.RetentionPolicy{Live: time.Minute}
+	unpinned, err := node.UnpinExpired(ctx, policy, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, unpinned)
+
+	removed, err := node.GC(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, removed)
+
+	has, err := node.HasBlock(ctx, init.Cid())
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	// the first stream ended, the other one still lists it
+	assert.NoError(t, node.Release(ctx, init.Cid()))
+	unpinned, err = node.UnpinExpired(ctx, policy, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, unpinned)
+
+	// the retention starts when the last stream ends
+	assert.NoError(t, node.Release(ctx, init.Cid()))
+	unpinned, err = node.UnpinExpired(ctx, policy, time.Now().Add(30*time.Second))
+	assert.NoError(t, err)
+	assert.Empty(t, unpinned)
+
+	unpinned, err = node.UnpinExpired(ctx, policy, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, unpinned, 1)
+
+	removed, err = node.GC(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	has, err = node.HasBlock(ctx, init.Cid())
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
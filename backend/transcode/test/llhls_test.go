@@ -0,0 +1,189 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/llhls"
+	"sen1or/lets-live/transcode/transcoder"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var llhlsOptions = llhls.Options{PartDuration: 500 * time.Millisecond, PartsPerSegment: 2}
+
+// a playlist of parts as written by ffmpeg in low latency mode
+func partPlaylist(first int, last int, ended bool) []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:1\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	b.WriteString("#EXT-X-MAP:URI=\"init_0.mp4\"\n")
+	for i := first; i <= last; i++ {
+		fmt.Fprintf(&b, "#EXTINF:0.500000,\npart%d.m4s\n", i)
+	}
+	if ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return []byte(b.String())
+}
+
+func TestLLHLSRender(t *testing.T) {
+	// part 3 is the end of segment 1 whose first part is deleted, the playlist starts at segment 2
+	playlist, err := llhls.ParsePartPlaylist(partPlaylist(3, 8, false))
+	assert.NoError(t, err)
+
+	expected := `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:1
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500
+#EXT-X-PART-INF:PART-TARGET=0.500
+#EXT-X-MEDIA-SEQUENCE:2
+#EXT-X-MAP:URI="init_0.mp4"
+#EXT-X-PART:DURATION=0.500,URI="part4.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.500,URI="part5.m4s"
+#EXTINF:1.000,
+seg2.m4s
+#EXT-X-PART:DURATION=0.500,URI="part6.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.500,URI="part7.m4s"
+#EXTINF:1.000,
+seg3.m4s
+#EXT-X-PART:DURATION=0.500,URI="part8.m4s",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part9.m4s"
+`
+
+	assert.Equal(t, expected, string(llhls.Render(playlist, llhlsOptions)))
+}
+
+func TestLLHLSRender_OnlyRecentSegmentsListParts(t *testing.T) {
+	playlist, err := llhls.ParsePartPlaylist(partPlaylist(0, 9, true))
+	assert.NoError(t, err)
+
+	rendered := string(llhls.Render(playlist, llhlsOptions))
+
+	assert.NotContains(t, rendered, `URI="part3.m4s"`)
+	assert.Contains(t, rendered, `URI="part4.m4s"`)
+	assert.Contains(t, rendered, "seg0.m4s")
+	assert.True(t, strings.HasSuffix(rendered, "seg4.m4s\n#EXT-X-ENDLIST\n"))
+	assert.NotContains(t, rendered, "PRELOAD-HINT")
+}
+
+func TestLLHLSBlockingReload(t *testing.T) {
+	playlist, err := llhls.ParsePartPlaylist(partPlaylist(0, 8, false))
+	assert.NoError(t, err)
+
+	assert.True(t, playlist.Has(llhlsOptions, 3, -1))
+	assert.True(t, playlist.Has(llhlsOptions, 4, 0))
+	assert.False(t, playlist.Has(llhlsOptions, 4, 1))
+	assert.False(t, playlist.Has(llhlsOptions, 4, -1))
+
+	msn, part, ok := playlist.LastPart(llhlsOptions)
+	assert.True(t, ok)
+	assert.Equal(t, 4, msn)
+	assert.Equal(t, 0, part)
+}
+
+func TestBuildArgs_LowLatency(t *testing.T) {
+	args, err := transcoder.NewArgsBuilder(validSetting(), "/var/hls/user-1").LowLatency(500 * time.Millisecond).Build()
+	assert.NoError(t, err)
+
+	assert.Subset(t, args, []string{"-hls_segment_type", "fmp4", "-hls_time", "0.5", "-hls_list_size", "20", "-hls_delete_threshold", "12"})
+	assert.Contains(t, args, "/var/hls/user-1/%v/part%d.m4s")
+	assert.Contains(t, args, "delete_segments+split_by_time+temp_file")
+
+	_, err = transcoder.NewArgsBuilder(validSetting(), "/var/hls/user-1").LowLatency(300 * time.Millisecond).Build()
+	assert.Error(t, err)
+}
+
+// ffmpeg restarted after the part 4, in the middle of the segment 2
+const restartedPartPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init_0.mp4"
+#EXTINF:0.500000,
+part0.m4s
+#EXTINF:0.500000,
+part1.m4s
+#EXTINF:0.500000,
+part2.m4s
+#EXTINF:0.500000,
+part3.m4s
+#EXTINF:0.500000,
+part4.m4s
+#EXT-X-DISCONTINUITY
+#EXTINF:0.500000,
+part5.m4s
+#EXTINF:0.500000,
+part6.m4s
+#EXTINF:0.500000,
+part7.m4s
+#EXTINF:0.500000,
+part8.m4s
+`
+
+func TestLLHLSRender_Restart(t *testing.T) {
+	playlist, err := llhls.ParsePartPlaylist([]byte(restartedPartPlaylist))
+	assert.NoError(t, err)
+
+	// the segment 2 is cut short, the part 5 is left out and the next run starts with the segment 3, with its own init file
+	expected := `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:1
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500
+#EXT-X-PART-INF:PART-TARGET=0.500
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init_0-4.mp4"
+#EXTINF:1.000,
+seg0.m4s
+#EXTINF:1.000,
+seg1.m4s
+#EXT-X-PART:DURATION=0.500,URI="part4.m4s",INDEPENDENT=YES
+#EXTINF:0.500,
+seg2.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init_0.mp4"
+#EXT-X-PART:DURATION=0.500,URI="part6.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.500,URI="part7.m4s"
+#EXTINF:1.000,
+seg3.m4s
+#EXT-X-PART:DURATION=0.500,URI="part8.m4s",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part9.m4s"
+`
+	assert.Equal(t, expected, string(llhls.Render(playlist, llhlsOptions)))
+
+	assert.Equal(t, []string{"part4.m4s"}, playlist.SegmentParts(llhlsOptions, 2))
+	assert.Equal(t, []string{"part6.m4s", "part7.m4s"}, playlist.SegmentParts(llhlsOptions, 3))
+	assert.Empty(t, playlist.SegmentParts(llhlsOptions, 5))
+}
+
+func TestLLHLSPrepareResume(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, llhls.PlaylistName), string(partPlaylist(3, 8, false)))
+	writeFile(t, filepath.Join(dir, "init_0.mp4"), "first run")
+
+	next, err := llhls.PrepareResume(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, next)
+
+	archived, err := os.ReadFile(filepath.Join(dir, "init_0-8.mp4"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first run", string(archived))
+
+	_, err = llhls.PrepareResume(t.TempDir())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBuildArgs_LowLatencyResume(t *testing.T) {
+	// the part 5 is the second one of its segment, the next boundary is 1.5s later
+	args, err := transcoder.NewArgsBuilder(validSetting(), "/var/hls/user-1").LowLatency(500 * time.Millisecond).Resume(true).FirstPart(5).Build()
+	assert.NoError(t, err)
+	assert.Subset(t, args, []string{"-force_key_frames", "expr:gte(t,n_forced*2-0.5)"})
+
+	args, err = transcoder.NewArgsBuilder(validSetting(), "/var/hls/user-1").LowLatency(500 * time.Millisecond).Resume(true).FirstPart(8).Build()
+	assert.NoError(t, err)
+	assert.Subset(t, args, []string{"-force_key_frames", "expr:gte(t,n_forced*2)"})
+}
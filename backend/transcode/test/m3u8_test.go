@@ -0,0 +1,79 @@
+package test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/m3u8"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files")
+
+// every playlist of testdata/m3u8 is rewritten and compared with its .golden file
+// the uris starting with "deleted" or "pending" are not uploaded, the other ones get a remote url
+func TestM3U8_Golden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "m3u8", "*.m3u8"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, inputs)
+
+	resolve := func(uri string) (string, bool) {
+		if strings.HasPrefix(uri, "deleted") || strings.HasPrefix(uri, "pending") {
+			return "", false
+		}
+		return "https://gateway/ipfs/" + uri, true
+	}
+
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			data, err := os.ReadFile(input)
+			assert.NoError(t, err)
+
+			var output []byte
+			if m3u8.IsMaster(data) {
+				playlist, err := m3u8.ParseMaster(bytes.NewReader(data))
+				assert.NoError(t, err)
+				output = playlist.Encode()
+			} else {
+				playlist, err := m3u8.ParseMedia(bytes.NewReader(data))
+				assert.NoError(t, err)
+				playlist.Rewrite(resolve)
+				output = playlist.Encode()
+			}
+
+			goldenPath := strings.TrimSuffix(input, ".m3u8") + ".golden"
+			if *updateGolden {
+				assert.NoError(t, os.WriteFile(goldenPath, output, 0644))
+			}
+
+			golden, err := os.ReadFile(goldenPath)
+			assert.NoError(t, err)
+			assert.Equal(t, string(golden), string(output))
+		})
+	}
+}
+
+func TestM3U8_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":          "",
+		"no header":      "#EXT-X-VERSION:3\n#EXTINF:2.0,\nstream0.ts\n",
+		"no duration":    "#EXTM3U\n#EXT-X-TARGETDURATION:2\nstream0.ts\n",
+		"no uri":         "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\n",
+		"bad duration":   "#EXTM3U\n#EXTINF:two,\nstream0.ts\n",
+		"bad byte range": "#EXTM3U\n#EXTINF:2.0,\n#EXT-X-BYTERANGE:a@b\nstream0.ts\n",
+	}
+
+	for name, playlist := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := m3u8.ParseMedia(strings.NewReader(playlist))
+			assert.ErrorIs(t, err, m3u8.ErrInvalidPlaylist)
+		})
+	}
+
+	_, err := m3u8.ParseMaster(strings.NewReader("#EXTM3U\n0/stream.m3u8\n"))
+	assert.ErrorIs(t, err, m3u8.ErrInvalidPlaylist)
+}
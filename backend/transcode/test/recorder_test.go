@@ -0,0 +1,257 @@
+package test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/recorder"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStorage keeps a copy of the uploaded files by id, the id of a file is remote/<file name>, of a directory remote/dir
+// and the public url is the id
+type fakeStorage struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (s *fakeStorage) AddFile(filePath string) (string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := "remote/" + filepath.Base(filePath)
+	s.files[id] = string(data)
+	return id, nil
+}
+
+func (s *fakeStorage) AddDirectory(directoryPath string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := "remote/dir"
+	err := filepath.WalkDir(directoryPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		relativePath, _ := filepath.Rel(directoryPath, filePath)
+		s.files[id+"/"+filepath.ToSlash(relativePath)] = string(data)
+		return nil
+	})
+
+	return id, err
+}
+
+func (s *fakeStorage) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.files {
+		if key == id || strings.HasPrefix(key, id+"/") {
+			delete(s.files, key)
+		}
+	}
+	return nil
+}
+
+func (s *fakeStorage) Exists(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.files[id]
+	return ok, nil
+}
+
+func (s *fakeStorage) PublicURL(id string) string {
+	return id
+}
+
+// the file times come from a coarse clock, it can be a few milliseconds behind time.Now
+func waitFileClock() {
+	time.Sleep(20 * time.Millisecond)
+}
+
+func writeFile(t *testing.T, filePath string, data string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+	assert.NoError(t, os.WriteFile(filePath, []byte(data), 0644))
+}
+
+func TestRecorder_KeepsDeletedSegments(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	var cfg config.Config
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.Recording.Path = t.TempDir()
+	cfg.Transcode.FFMpegSetting.MasterFileName = "index.m3u8"
+	cfg.Transcode.FFMpegSetting.HLSTime = 1
+
+	storage := &fakeStorage{files: make(map[string]string)}
+	rec := recorder.NewRecorder(cfg, storage, "user")
+	go rec.Start()
+	waitFileClock()
+
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n0/stream.m3u8\n")
+	writeFile(t, filepath.Join(outputDir, "0", "stream0.ts"), "segment0")
+	writeFile(t, filepath.Join(outputDir, "0", "stream1.ts"), "segment1")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1.000000,\nstream0.ts\n#EXTINF:1.000000,\nstream1.ts\n")
+
+	// let the recorder see the first segments, then ffmpeg deletes them and restarts
+	time.Sleep(700 * time.Millisecond)
+	assert.NoError(t, os.Remove(filepath.Join(outputDir, "0", "stream0.ts")))
+	assert.NoError(t, os.Remove(filepath.Join(outputDir, "0", "stream1.ts")))
+	writeFile(t, filepath.Join(outputDir, "0", "stream2.ts"), "segment2")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:2\n#EXT-X-DISCONTINUITY\n#EXTINF:0.500000,\nstream2.ts\n")
+
+	vod, err := rec.Finish()
+	assert.NoError(t, err)
+	assert.Equal(t, "remote/dir/index.m3u8", vod.PlaylistURL)
+	assert.Equal(t, 2.5, vod.Duration)
+
+	// the recording is uploaded as one directory
+	assert.Equal(t, "segment0", storage.files["remote/dir/0/stream0.ts"])
+	assert.Equal(t, "segment2", storage.files["remote/dir/0/stream2.ts"])
+
+	expectedVariant := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:1.000000,
+stream0.ts
+#EXTINF:1.000000,
+stream1.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:0.500000,
+stream2.ts
+#EXT-X-ENDLIST
+`
+	assert.Equal(t, expectedVariant, storage.files["remote/dir/0/vod.m3u8"])
+	assert.True(t, strings.HasSuffix(storage.files["remote/dir/index.m3u8"], "#EXT-X-STREAM-INF:BANDWIDTH=800000\n0/vod.m3u8\n"))
+
+	// the local copy is gone once uploaded
+	entries, err := os.ReadDir(filepath.Join(cfg.Transcode.Recording.Path, "user"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// a restarted ffmpeg rewrites the init file, the segments of each run play with the init file of their run
+func TestRecorder_KeepsTheInitFileOfEachRun(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	var cfg config.Config
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.Recording.Path = t.TempDir()
+	cfg.Transcode.FFMpegSetting.MasterFileName = "index.m3u8"
+	cfg.Transcode.FFMpegSetting.HLSTime = 1
+
+	storage := &fakeStorage{files: make(map[string]string)}
+	rec := recorder.NewRecorder(cfg, storage, "user")
+	go rec.Start()
+	waitFileClock()
+
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n0/stream.m3u8\n")
+	writeFile(t, filepath.Join(outputDir, "0", "init.mp4"), "init0")
+	writeFile(t, filepath.Join(outputDir, "0", "stream0.m4s"), "segment0")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:1.000000,\nstream0.m4s\n")
+
+	// the last segment of the first run is listed in the same poll as the new init file
+	time.Sleep(700 * time.Millisecond)
+	writeFile(t, filepath.Join(outputDir, "0", "stream1.m4s"), "segment1")
+	writeFile(t, filepath.Join(outputDir, "0", "init.mp4"), "init1")
+	writeFile(t, filepath.Join(outputDir, "0", "stream2.m4s"), "segment2")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:1.000000,\nstream0.m4s\n#EXTINF:1.000000,\nstream1.m4s\n#EXT-X-DISCONTINUITY\n#EXTINF:1.000000,\nstream2.m4s\n")
+
+	_, err := rec.Finish()
+	assert.NoError(t, err)
+	assert.Equal(t, "init0", storage.files["remote/dir/0/init.mp4"])
+	assert.Equal(t, "init1", storage.files["remote/dir/0/init-1.mp4"])
+
+	expectedVariant := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:1.000000,
+stream0.m4s
+#EXTINF:1.000000,
+stream1.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init-1.mp4"
+#EXTINF:1.000000,
+stream2.m4s
+#EXT-X-ENDLIST
+`
+	assert.Equal(t, expectedVariant, storage.files["remote/dir/0/vod.m3u8"])
+}
+
+// the previous publish of the user left its files in the output directory, only the new ones are recorded
+func TestRecorder_IgnoresPreviousPublish(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	var cfg config.Config
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.Recording.Path = t.TempDir()
+	cfg.Transcode.FFMpegSetting.MasterFileName = "index.m3u8"
+	cfg.Transcode.FFMpegSetting.HLSTime = 1
+
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n0/stream.m3u8\n")
+	writeFile(t, filepath.Join(outputDir, "0", "stream0.ts"), "old0")
+	writeFile(t, filepath.Join(outputDir, "0", "stream1.ts"), "old1")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1.000000,\nstream0.ts\n#EXTINF:1.000000,\nstream1.ts\n")
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"index.m3u8", "0/stream0.ts", "0/stream1.ts", "0/stream.m3u8"} {
+		assert.NoError(t, os.Chtimes(filepath.Join(outputDir, name), past, past))
+	}
+
+	storage := &fakeStorage{files: make(map[string]string)}
+	rec := recorder.NewRecorder(cfg, storage, "user")
+	go rec.Start()
+
+	// the recorder polls the stale files a few times before ffmpeg writes anything
+	time.Sleep(700 * time.Millisecond)
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n0/stream.m3u8\n")
+	writeFile(t, filepath.Join(outputDir, "0", "stream0.ts"), "new0")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1.000000,\nstream0.ts\n#EXTINF:1.000000,\nstream1.ts\n")
+
+	vod, err := rec.Finish()
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, vod.Duration)
+	assert.Equal(t, "new0", storage.files["remote/dir/0/stream0.ts"])
+	assert.NotContains(t, storage.files, "remote/dir/0/stream1.ts")
+}
+
+func TestRecorder_NothingRecorded(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	var cfg config.Config
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.Recording.Path = t.TempDir()
+	cfg.Transcode.FFMpegSetting.MasterFileName = "index.m3u8"
+	cfg.Transcode.FFMpegSetting.HLSTime = 1
+
+	rec := recorder.NewRecorder(cfg, &fakeStorage{files: make(map[string]string)}, "user")
+	go rec.Start()
+
+	_, err := rec.Finish()
+	assert.Error(t, err)
+}
@@ -0,0 +1,309 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/watcher"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// write then rename, like ffmpeg with the temp_file flag
+func renameIntoPlace(t *testing.T, filePath string, data string) {
+	writeFile(t, filePath+".tmp", data)
+	assert.NoError(t, os.Rename(filePath+".tmp", filePath))
+}
+
+func TestStorageWatcher_UploadsListedSegments(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	var cfg config.Config
+	cfg.Transcode.PrivateHLSPath = t.TempDir()
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.FFMpegSetting.MasterFileName = "index.m3u8"
+	cfg.Transcode.FFMpegSetting.HlsMaxSize = 10
+	// the eleventh rendition lives in the folder "10"
+	cfg.Transcode.FFMpegSetting.Qualities = make([]config.Quality, 11)
+
+	monitor := watcher.NewStorageWatcher(cfg.Transcode.PrivateHLSPath, &fakeStorage{files: make(map[string]string)}, cfg)
+	monitor.PublishStarted("user")
+	go monitor.Watch()
+
+	variantDir := filepath.Join(cfg.Transcode.PrivateHLSPath, "user", "10")
+	writeFile(t, filepath.Join(variantDir, "stream0.ts"), "segment0")
+	// written but not listed yet, it may still be incomplete
+	writeFile(t, filepath.Join(variantDir, "stream1.ts"), "segm")
+	renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nstream0.ts\n")
+
+	publicPlaylist := filepath.Join(cfg.Transcode.PublicHLSPath, "user", "10", "stream.m3u8")
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(publicPlaylist)
+		return err == nil && string(data) == "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nremote/stream0.ts?fileName=stream0.ts\n"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	writeFile(t, filepath.Join(variantDir, "stream1.ts"), "segment1")
+	renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nstream0.ts\n#EXTINF:2.000000,\nstream1.ts\n")
+
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(publicPlaylist)
+		return err == nil && string(data) == "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nremote/stream0.ts?fileName=stream0.ts\n#EXTINF:2.000000,\nremote/stream1.ts?fileName=stream1.ts\n"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the master playlist is published as is
+	renameIntoPlace(t, filepath.Join(cfg.Transcode.PrivateHLSPath, "user", "index.m3u8"), "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\n10/stream.m3u8\n")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(cfg.Transcode.PublicHLSPath, "user", "index.m3u8"))
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// flakyStorage fails the first uploads
+type flakyStorage struct {
+	fakeStorage
+	failures atomic.Int32
+}
+
+func (s *flakyStorage) AddFile(filePath string) (string, error) {
+	if s.failures.Add(-1) >= 0 {
+		return "", errors.New("gateway unavailable")
+	}
+
+	return s.fakeStorage.AddFile(filePath)
+}
+
+func uploadConfig(t *testing.T) config.Config {
+	var cfg config.Config
+	cfg.Transcode.PrivateHLSPath = t.TempDir()
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.FFMpegSetting.MasterFileName = "index.m3u8"
+	cfg.Transcode.FFMpegSetting.HlsMaxSize = 1
+	cfg.Transcode.FFMpegSetting.Qualities = make([]config.Quality, 1)
+	cfg.Transcode.Upload.MaxAttempts = 2
+	cfg.Transcode.Upload.InitialBackoff = 1
+
+	return cfg
+}
+
+func TestStorageWatcher_RetriesUploads(t *testing.T) {
+	logger.Init(logger.Debug)
+	cfg := uploadConfig(t)
+
+	storage := &flakyStorage{fakeStorage: fakeStorage{files: make(map[string]string)}}
+	storage.failures.Store(1)
+	monitor := watcher.NewStorageWatcher(cfg.Transcode.PrivateHLSPath, storage, cfg)
+	monitor.PublishStarted("user")
+	go monitor.Watch()
+
+	variantDir := filepath.Join(cfg.Transcode.PrivateHLSPath, "user", "0")
+	writeFile(t, filepath.Join(variantDir, "stream0.ts"), "segment0")
+	renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nstream0.ts\n")
+
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(cfg.Transcode.PublicHLSPath, "user", "0", "stream.m3u8"))
+		return err == nil && strings.Contains(string(data), "remote/stream0.ts?fileName=stream0.ts\n")
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestStorageWatcher_ServesFailedUploadsLocally(t *testing.T) {
+	logger.Init(logger.Debug)
+	cfg := uploadConfig(t)
+
+	storage := &flakyStorage{fakeStorage: fakeStorage{files: make(map[string]string)}}
+	storage.failures.Store(2)
+	monitor := watcher.NewStorageWatcher(cfg.Transcode.PrivateHLSPath, storage, cfg)
+	monitor.PublishStarted("user")
+	go monitor.Watch()
+
+	variantDir := filepath.Join(cfg.Transcode.PrivateHLSPath, "user", "0")
+	publicDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user", "0")
+	writeFile(t, filepath.Join(variantDir, "stream0.ts"), "segment0")
+	renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nstream0.ts\n")
+
+	// the playlist points at the copy next to it
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(publicDir, "stream.m3u8"))
+		return err == nil && string(data) == "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nstream0.ts\n"
+	}, 2*time.Second, 10*time.Millisecond)
+	data, err := os.ReadFile(filepath.Join(publicDir, "stream0.ts"))
+	assert.NoError(t, err)
+	assert.Equal(t, "segment0", string(data))
+
+	// the copy is deleted once the segment leaves the store
+	writeFile(t, filepath.Join(variantDir, "stream1.ts"), "segment1")
+	renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:2.000000,\nstream1.ts\n")
+
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(publicDir, "stream.m3u8"))
+		return err == nil && strings.Contains(string(data), "remote/stream1.ts")
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoFileExists(t, filepath.Join(publicDir, "stream0.ts"))
+}
+
+func TestStorageWatcher_KeepsTheLocalSegmentsOfTheNextPublish(t *testing.T) {
+	logger.Init(logger.Debug)
+	cfg := uploadConfig(t)
+	cfg.Transcode.FFMpegSetting.HLSTime = 1
+	cfg.Transcode.FFMpegSetting.HlsListSize = 1
+
+	storage := &flakyStorage{fakeStorage: fakeStorage{files: make(map[string]string)}}
+	storage.failures.Store(100)
+	monitor := watcher.NewStorageWatcher(cfg.Transcode.PrivateHLSPath, storage, cfg)
+	go monitor.Watch()
+
+	publish := func(publishName string, data string) {
+		monitor.PublishStarted(publishName)
+		variantDir := filepath.Join(cfg.Transcode.PrivateHLSPath, publishName, "0")
+		writeFile(t, filepath.Join(variantDir, "stream0.ts"), data)
+		renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1.000000,\nstream0.ts\n")
+		assert.Eventually(t, func() bool {
+			data, err := os.ReadFile(filepath.Join(cfg.Transcode.PublicHLSPath, publishName, "0", "stream.m3u8"))
+			return err == nil && strings.Contains(string(data), "stream0.ts")
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	publish("user", "first publish")
+	publish("other", "first publish")
+	monitor.PublishEnded("user")
+	monitor.PublishEnded("other")
+
+	// the user reconnects before the viewers of the first publish are gone, ffmpeg starts over at stream0.ts
+	time.Sleep(100 * time.Millisecond)
+	publish("user", "second publish")
+
+	otherSegment := filepath.Join(cfg.Transcode.PublicHLSPath, "other", "0", "stream0.ts")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(otherSegment)
+		return errors.Is(err, os.ErrNotExist)
+	}, 3*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	data, err := os.ReadFile(filepath.Join(cfg.Transcode.PublicHLSPath, "user", "0", "stream0.ts"))
+	assert.NoError(t, err)
+	assert.Equal(t, "second publish", string(data))
+}
+
+func (s *fakeStorage) has(id string) bool {
+	exists, _ := s.Exists(id)
+	return exists
+}
+
+func TestStorageWatcher_DeletesEvictedSegments(t *testing.T) {
+	logger.Init(logger.Debug)
+	cfg := uploadConfig(t)
+
+	storage := &fakeStorage{files: make(map[string]string)}
+	monitor := watcher.NewStorageWatcher(cfg.Transcode.PrivateHLSPath, storage, cfg)
+	monitor.PublishStarted("user")
+	go monitor.Watch()
+
+	variantDir := filepath.Join(cfg.Transcode.PrivateHLSPath, "user", "0")
+	writeFile(t, filepath.Join(variantDir, "stream0.ts"), "segment0")
+	renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\nstream0.ts\n")
+	assert.Eventually(t, func() bool { return storage.has("remote/stream0.ts") }, 2*time.Second, 10*time.Millisecond)
+
+	writeFile(t, filepath.Join(variantDir, "stream1.ts"), "segment1")
+	renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:2.000000,\nstream1.ts\n")
+
+	// the store keeps a single segment, the first one left every playlist
+	assert.Eventually(t, func() bool { return !storage.has("remote/stream0.ts") }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, storage.has("remote/stream1.ts"))
+}
+
+func TestStorageWatcher_DeletesSegmentsLeavingTheDVRWindow(t *testing.T) {
+	logger.Init(logger.Debug)
+	cfg := uploadConfig(t)
+	cfg.Transcode.DVR.Enabled = true
+	cfg.Transcode.DVR.Window = 4
+
+	storage := &fakeStorage{files: make(map[string]string)}
+	monitor := watcher.NewStorageWatcher(cfg.Transcode.PrivateHLSPath, storage, cfg)
+	monitor.PublishStarted("user")
+	go monitor.Watch()
+
+	variantDir := filepath.Join(cfg.Transcode.PrivateHLSPath, "user", "0")
+	publicPlaylist := filepath.Join(cfg.Transcode.PublicHLSPath, "user", "0", "stream.m3u8")
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("stream%d.ts", i)
+		writeFile(t, filepath.Join(variantDir, name), "segment"+strconv.Itoa(i))
+		renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXTINF:2.000000,\n%s\n", i, name))
+
+		assert.Eventually(t, func() bool {
+			data, err := os.ReadFile(publicPlaylist)
+			return err == nil && strings.Contains(string(data), "remote/"+name)
+		}, 2*time.Second, 10*time.Millisecond)
+
+		if i == 1 {
+			// evicted from the store but still in the dvr window
+			assert.True(t, storage.has("remote/stream0.ts"))
+		}
+	}
+
+	// the window holds two segments of 2 seconds
+	assert.Eventually(t, func() bool { return !storage.has("remote/stream0.ts") }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, storage.has("remote/stream1.ts"))
+	assert.True(t, storage.has("remote/stream2.ts"))
+}
+
+// holdingStorage expires the files by itself, it tells what is held
+type holdingStorage struct {
+	fakeStorage
+	held map[string]int
+}
+
+func (s *holdingStorage) Hold(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.held[id]++
+	return nil
+}
+
+func (s *holdingStorage) Release(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.held[id]--
+	return nil
+}
+
+func (s *holdingStorage) holds(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.held[id]
+}
+
+func TestStorageWatcher_HoldsTheInitFileUntilThePublishEnds(t *testing.T) {
+	logger.Init(logger.Debug)
+	cfg := uploadConfig(t)
+
+	storage := &holdingStorage{fakeStorage: fakeStorage{files: make(map[string]string)}, held: make(map[string]int)}
+	monitor := watcher.NewStorageWatcher(cfg.Transcode.PrivateHLSPath, storage, cfg)
+	monitor.PublishStarted("user")
+	go monitor.Watch()
+
+	variantDir := filepath.Join(cfg.Transcode.PrivateHLSPath, "user", "0")
+	writeFile(t, filepath.Join(variantDir, "init.mp4"), "init")
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("stream%d.m4s", i)
+		writeFile(t, filepath.Join(variantDir, name), "segment"+strconv.Itoa(i))
+		renameIntoPlace(t, filepath.Join(variantDir, "stream.m3u8"), fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2.000000,\n%s\n", i, name))
+		assert.Eventually(t, func() bool { return storage.has("remote/" + name) }, 2*time.Second, 10*time.Millisecond)
+	}
+
+	// uploaded once, held once, the segments are not held
+	assert.Equal(t, 1, storage.holds("remote/init.mp4"))
+	assert.Zero(t, storage.holds("remote/stream2.m4s"))
+
+	monitor.PublishEnded("user")
+	assert.Zero(t, storage.holds("remote/init.mp4"))
+}
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/storage/local"
+	"sen1or/lets-live/transcode/storage/s3"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStorage_AddFile(t *testing.T) {
+	source := t.TempDir()
+	writeFile(t, filepath.Join(source, "0", "stream0.ts"), "segment0")
+	writeFile(t, filepath.Join(source, "1", "stream0.ts"), "other segment0")
+
+	directory := t.TempDir()
+	storage, err := local.NewLocalStorage(directory, "http://localhost:8889/storage/")
+	assert.NoError(t, err)
+
+	id, err := storage.AddFile(filepath.Join(source, "0", "stream0.ts"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(id, ".ts"))
+	assert.Equal(t, "http://localhost:8889/storage/"+id, storage.PublicURL(id))
+
+	data, err := os.ReadFile(filepath.Join(directory, id))
+	assert.NoError(t, err)
+	assert.Equal(t, "segment0", string(data))
+
+	// the files are named after their content, not their path
+	otherId, err := storage.AddFile(filepath.Join(source, "1", "stream0.ts"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, otherId)
+
+	sameId, err := storage.AddFile(filepath.Join(source, "0", "stream0.ts"))
+	assert.NoError(t, err)
+	assert.Equal(t, id, sameId)
+
+	_, err = storage.AddFile(filepath.Join(source, "missing.ts"))
+	assert.Error(t, err)
+}
+
+func TestLocalStorage_AddDirectory(t *testing.T) {
+	source := t.TempDir()
+	writeFile(t, filepath.Join(source, "index.m3u8"), "master")
+	writeFile(t, filepath.Join(source, "0", "stream0.ts"), "segment0")
+
+	storage, err := local.NewLocalStorage(t.TempDir(), "http://localhost:8889/storage")
+	assert.NoError(t, err)
+
+	id, err := storage.AddDirectory(source)
+	assert.NoError(t, err)
+
+	exists, err := storage.Exists(id + "/0/stream0.ts")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "http://localhost:8889/storage/"+id+"/index.m3u8", storage.PublicURL(id+"/index.m3u8"))
+
+	// a directory is deleted with its files
+	assert.NoError(t, storage.Delete(id))
+	exists, err = storage.Exists(id + "/0/stream0.ts")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// the ids never leave the storage directory
+	_, err = storage.Exists("../" + id)
+	assert.Error(t, err)
+	assert.Error(t, storage.Delete(""))
+}
+
+// fakeS3 is a path style object store stand-in, it does not check the signatures
+type fakeS3 struct {
+	mu           sync.Mutex
+	buckets      map[string]bool
+	objects      map[string][]byte
+	contentTypes map[string]string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case len(key) == 0 && r.Method == http.MethodHead:
+		if !s.buckets[bucket] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(key) == 0 && r.Method == http.MethodPut:
+		s.buckets[bucket] = true
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data = decodeAWSChunked(data)
+		}
+		s.objects[bucket+"/"+key] = data
+		s.contentTypes[bucket+"/"+key] = r.Header.Get("Content-Type")
+		w.Header().Set("ETag", "\"etag\"")
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// the chunks of a streaming signed upload: <hex size>;chunk-signature=...\r\n<data>\r\n, up to an empty one
+func decodeAWSChunked(body []byte) []byte {
+	var data []byte
+	rest := string(body)
+	for {
+		header, after, ok := strings.Cut(rest, "\r\n")
+		if !ok {
+			return data
+		}
+
+		hexSize, _, _ := strings.Cut(header, ";")
+		size, err := strconv.ParseInt(hexSize, 16, 64)
+		if err != nil || size == 0 || int(size) > len(after) {
+			return data
+		}
+
+		data = append(data, after[:size]...)
+		rest = strings.TrimPrefix(after[size:], "\r\n")
+	}
+}
+
+func TestS3Storage_AddFile(t *testing.T) {
+	fake := &fakeS3{buckets: make(map[string]bool), objects: make(map[string][]byte), contentTypes: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	storage, err := s3.NewS3Storage(context.Background(), config.S3Setting{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "live",
+		Prefix:    "/segments/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	assert.NoError(t, err)
+	assert.True(t, fake.buckets["live"])
+
+	source := t.TempDir()
+	writeFile(t, filepath.Join(source, "0", "init.mp4"), "init")
+
+	writeFile(t, filepath.Join(source, "1", "stream0.ts"), "segment0")
+
+	key, err := storage.AddFile(filepath.Join(source, "0", "init.mp4"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, "segments/"))
+	assert.Equal(t, server.URL+"/live/"+key, storage.PublicURL(key))
+
+	prefix, err := storage.AddDirectory(source)
+	assert.NoError(t, err)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.Equal(t, "init", string(fake.objects["live/"+key]))
+	assert.Equal(t, "video/mp4", fake.contentTypes["live/"+key])
+	assert.Equal(t, "segment0", string(fake.objects["live/"+prefix+"/1/stream0.ts"]))
+}
+
+func TestConfig_StorageType(t *testing.T) {
+	var cfg config.Config
+	assert.False(t, cfg.HasStorage())
+
+	// the older configs only enable ipfs
+	cfg.IPFS.Enabled = true
+	assert.Equal(t, config.StorageIPFS, cfg.StorageType())
+
+	cfg.Storage.Type = config.StorageS3
+	assert.Equal(t, config.StorageS3, cfg.StorageType())
+	assert.True(t, cfg.HasStorage())
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"fmt"
+	"sen1or/lets-live/transcode/domains"
+	"sen1or/lets-live/transcode/watcher"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeSegment(publishName string, variantIndex int, name string) domains.HLSSegment {
+	return domains.HLSSegment{
+		PublishName:   publishName,
+		VariantIndex:  variantIndex,
+		FullLocalPath: fmt.Sprintf("/private/%s/%d/%s", publishName, variantIndex, name),
+		RemoteURL:     "http://gateway/ipfs/" + name,
+	}
+}
+
+func segmentNames(store *watcher.StreamStore, publishName string, variantIndex int) []string {
+	var names []string
+	store.UpdateVariant(publishName, variantIndex, func(variant *domains.HLSVariant) error {
+		for _, segment := range variant.Segments {
+			names = append(names, segment.RemoteURL[len("http://gateway/ipfs/"):])
+		}
+		return nil
+	})
+
+	return names
+}
+
+func TestStreamStore_Eviction(t *testing.T) {
+	store := watcher.NewStreamStore(3)
+	store.Create("user", 2)
+
+	assert.NoError(t, store.AddSegment(storeSegment("user", 0, "init_0.mp4")))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, store.AddSegment(storeSegment("user", 0, fmt.Sprintf("stream%d.m4s", i))))
+	}
+
+	assert.Equal(t, []string{"stream2.m4s", "stream3.m4s", "stream4.m4s"}, segmentNames(store, "user", 0))
+	assert.Empty(t, segmentNames(store, "user", 1))
+
+	// the init file is never evicted
+	store.UpdateVariant("user", 0, func(variant *domains.HLSVariant) error {
+		assert.NotNil(t, variant.GetSegmentByFilename("init_0.mp4"))
+		assert.Nil(t, variant.GetSegmentByFilename("stream1.m4s"))
+		return nil
+	})
+}
+
+func TestStreamStore_Lifecycle(t *testing.T) {
+	store := watcher.NewStreamStore(3)
+
+	err := store.AddSegment(storeSegment("user", 0, "stream0.ts"))
+	assert.ErrorIs(t, err, watcher.ErrUnknownStream)
+
+	store.Create("user", 1)
+	assert.NoError(t, store.AddSegment(storeSegment("user", 0, "stream0.ts")))
+	assert.Error(t, store.AddSegment(storeSegment("user", 1, "stream0.ts")))
+
+	// a new publish starts from scratch
+	store.Create("user", 1)
+	assert.Empty(t, segmentNames(store, "user", 0))
+
+	store.Remove("user")
+	assert.False(t, store.Has("user"))
+	assert.ErrorIs(t, store.AddSegment(storeSegment("user", 0, "stream1.ts")), watcher.ErrUnknownStream)
+}
+
+// run with -race
+func TestStreamStore_ConcurrentStreams(t *testing.T) {
+	store := watcher.NewStreamStore(5)
+
+	var wg sync.WaitGroup
+	for s := 0; s < 8; s++ {
+		publishName := fmt.Sprintf("user%d", s)
+		store.Create(publishName, 2)
+
+		// the watcher adds segments while playlists are generated for the same stream
+		for v := 0; v < 2; v++ {
+			wg.Add(2)
+			go func(variantIndex int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					assert.NoError(t, store.AddSegment(storeSegment(publishName, variantIndex, fmt.Sprintf("stream%d.ts", i))))
+				}
+			}(v)
+			go func(variantIndex int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					segmentNames(store, publishName, variantIndex)
+				}
+			}(v)
+		}
+	}
+
+	// streams ending while the others are live
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			store.Create("ending", 1)
+			store.AddSegment(storeSegment("ending", 0, "stream0.ts"))
+			store.Remove("ending")
+		}
+	}()
+
+	wg.Wait()
+
+	assert.Equal(t, 8, store.Len())
+	for s := 0; s < 8; s++ {
+		for v := 0; v < 2; v++ {
+			assert.Len(t, segmentNames(store, fmt.Sprintf("user%d", s), v), 5)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package test
+
+import (
+	"sen1or/lets-live/transcode/thumbnail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderSprites(t *testing.T) {
+	// 27 tiles fill the first sheet (5x5) and start the second one
+	vtt := string(thumbnail.RenderSprites(27, 10*time.Second, []string{"sprite0.jpg", "http://gateway/ipfs/cid?fileName=sprite1.jpg"}))
+
+	assert.True(t, strings.HasPrefix(vtt, "WEBVTT\n\n00:00:00.000 --> 00:00:10.000\nsprite0.jpg#xywh=0,0,160,90\n"))
+	assert.Contains(t, vtt, "00:00:10.000 --> 00:00:20.000\nsprite0.jpg#xywh=160,0,160,90\n")
+	assert.Contains(t, vtt, "00:04:00.000 --> 00:04:10.000\nsprite0.jpg#xywh=640,360,160,90\n")
+	assert.True(t, strings.HasSuffix(vtt, "00:04:20.000 --> 00:04:30.000\nhttp://gateway/ipfs/cid?fileName=sprite1.jpg#xywh=160,0,160,90\n"))
+}
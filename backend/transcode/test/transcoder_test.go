@@ -0,0 +1,126 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/transcoder"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFFMpeg writes a shell script standing for ffmpeg, every run appends a line to the runs file of its directory
+// and gets its number in $n
+func fakeFFMpeg(t *testing.T, script string) (string, config.Config) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ffmpeg")
+	content := "#!/bin/sh\ndir=$(dirname \"$0\")\necho run >> \"$dir/runs\"\nn=$(wc -l < \"$dir/runs\" | tr -d ' ')\n" + script + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0755))
+
+	var cfg config.Config
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.FFMpegSetting = validSetting()
+	cfg.Transcode.FFMpegSetting.FFMpegPath = path
+
+	return dir, cfg
+}
+
+func countRuns(dir string) int {
+	data, _ := os.ReadFile(filepath.Join(dir, "runs"))
+	return strings.Count(string(data), "\n")
+}
+
+func TestTranscoder_RestartsWithBackoffThenGivesUp(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	dir, cfg := fakeFFMpeg(t, "echo '[error] cannot open output' >&2\nexit 1")
+	cfg.Transcode.Restart.MaxAttempts = 2
+	cfg.Transcode.Restart.InitialBackoff = 100
+	cfg.Transcode.Restart.MaxBackoff = 150
+
+	supervisor := transcoder.NewTranscoder(cfg)
+	supervisor.SetSource(transcoder.SourceInfo{})
+
+	startedAt := time.Now()
+	done := make(chan struct{})
+	go func() {
+		supervisor.Start("user")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transcoder did not give up")
+	}
+
+	// the first run then one restart per attempt, after 100ms then 150ms (the backoff doubles up to the max)
+	assert.Equal(t, 3, countRuns(dir))
+	assert.GreaterOrEqual(t, time.Since(startedAt), 250*time.Millisecond)
+
+	_, err := supervisor.Write([]byte("data"))
+	assert.ErrorIs(t, err, transcoder.ErrTranscoderStopped)
+}
+
+func TestTranscoder_TellsTheLadderOnce(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	// every ffmpeg exits right away
+	dir, cfg := fakeFFMpeg(t, "exit 1")
+	cfg.Transcode.Restart.MaxAttempts = 2
+	cfg.Transcode.Restart.InitialBackoff = 10
+
+	var ladders [][]config.Quality
+	supervisor := transcoder.NewTranscoder(cfg)
+	supervisor.OnLadder(func(ladder []config.Quality) { ladders = append(ladders, ladder) })
+	supervisor.SetSource(transcoder.SourceInfo{Width: 1280, Height: 720, FPS: 30})
+	supervisor.Start("user")
+
+	assert.Equal(t, 3, countRuns(dir))
+	require.Len(t, ladders, 1)
+	require.Len(t, ladders[0], 1)
+	assert.Equal(t, "1280x720", ladders[0][0].Resolution)
+}
+
+func TestTranscoder_ReplaysTheHeaderAndResumesAtTheResumePoint(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	// the first ffmpeg dies after reading 10 bytes, the next ones keep what they read
+	dir, cfg := fakeFFMpeg(t, "if [ \"$n\" = 1 ]; then exec head -c 10 > \"$dir/stdin$n\"; fi\nexec cat > \"$dir/stdin$n\"")
+	cfg.Transcode.Restart.InitialBackoff = 10
+
+	supervisor := transcoder.NewTranscoder(cfg)
+	supervisor.SetSource(transcoder.SourceInfo{})
+	supervisor.SetHeader([]byte("HEADER;"))
+	supervisor.SetResumePoint(func(b []byte) bool { return bytes.HasPrefix(b, []byte("CLUSTER")) })
+	go supervisor.Start("user")
+	defer supervisor.Stop()
+
+	// the first ffmpeg reads the stream from the start, the header is part of it
+	_, err := supervisor.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+
+	// a block in the middle of a cluster, then the next cluster
+	assert.Eventually(t, func() bool {
+		supervisor.Write([]byte("BLOCK;"))
+		supervisor.Write([]byte("CLUSTER;"))
+
+		data, _ := os.ReadFile(filepath.Join(dir, "stdin2"))
+		return len(data) >= len("HEADER;CLUSTER;")
+	}, 5*time.Second, 20*time.Millisecond)
+
+	first, err := os.ReadFile(filepath.Join(dir, "stdin1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(first))
+
+	// the restarted ffmpeg never reads a block out of its cluster
+	second, err := os.ReadFile(filepath.Join(dir, "stdin2"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(second), "HEADER;CLUSTER;"), "unexpected input %q", second)
+}
@@ -0,0 +1,450 @@
+package thumbnail
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/llhls"
+	"sen1or/lets-live/transcode/m3u8"
+	"sen1or/lets-live/transcode/storage"
+	"sen1or/lets-live/transcode/transcoder"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every interval a frame of the newest segment is extracted by ffmpeg, as the thumbnail and as a tile of the sprite sheet
+// the sprite sheets are described by a webvtt file so players can show previews on the seek bar
+
+const (
+	ThumbnailName = "thumbnail.jpg"
+	SpritesName   = "thumbnails.vtt"
+
+	defaultInterval = 10 * time.Second
+	defaultWidth    = 320
+
+	TileWidth   = 160
+	TileHeight  = 90
+	TileColumns = 5
+	TileRows    = 5
+
+	captureTimeout = 10 * time.Second
+)
+
+func SpriteFileName(number int) string {
+	return fmt.Sprintf("sprite%d.jpg", number)
+}
+
+type Thumbnailer struct {
+	ffmpegPath     string
+	masterFileName string
+	interval       time.Duration
+	width          int
+	outputDir      string // where ffmpeg writes the segments
+	publicDir      string // where the thumbnails are published, next to the master playlist
+	publicURL      string // the url of publicDir
+	storage        storage.Storage
+	onThumbnail    func(url string)
+
+	// ll-hls mode, the playlist lists parts and only the first part of a segment starts with a keyframe
+	partsPerSegment int
+
+	publishName string
+	startedAt   time.Time
+	lastSegment string
+	lastURL     string
+	// the storage id of the thumbnail, a new capture replaces it
+	thumbnailID string
+
+	// the sprite sheet being filled, and the url of every sheet
+	sprite     *image.RGBA
+	tiles      int
+	spriteURLs []string
+	// the storage ids of the sheets, they are held until the publish ends
+	spriteIDs []string
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewThumbnailer creates the thumbnailer of a publish, onThumbnail is called with the url of the thumbnail when it changes
+// the thumbnails are also uploaded to storage if it is not nil
+func NewThumbnailer(config config.Config, storage storage.Storage, publishName string, onThumbnail func(url string)) *Thumbnailer {
+	interval := time.Duration(config.Transcode.Thumbnail.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	width := config.Transcode.Thumbnail.Width
+	if width <= 0 {
+		width = defaultWidth
+	}
+
+	var partsPerSegment int
+	if config.Transcode.LowLatency.Enabled {
+		// checked at startup
+		partsPerSegment, _ = transcoder.PartsPerSegment(config.Transcode.FFMpegSetting.HLSTime, time.Duration(config.Transcode.LowLatency.PartDuration)*time.Millisecond)
+	}
+
+	return &Thumbnailer{
+		ffmpegPath:      config.Transcode.FFMpegSetting.FFMpegPath,
+		masterFileName:  config.Transcode.FFMpegSetting.MasterFileName,
+		interval:        interval,
+		width:           width,
+		outputDir:       transcoder.OutputDir(config, publishName),
+		publicDir:       filepath.Join(config.Transcode.PublicHLSPath, publishName),
+		publicURL:       strings.TrimSuffix(config.Webserver.PublicURL, "/") + "/static/" + publishName,
+		storage:         storage,
+		onThumbnail:     onThumbnail,
+		partsPerSegment: partsPerSegment,
+		publishName:     publishName,
+		startedAt:       time.Now(),
+		stopCh:          make(chan struct{}),
+	}
+}
+
+// Start captures a thumbnail every interval until Stop is called
+func (t *Thumbnailer) Start() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.capture(); err != nil {
+				logger.Warnw("failed to capture thumbnail", "publishName", t.publishName, "error", err.Error())
+			}
+		case <-t.stopCh:
+			// the thumbnail goes with the stream, the sheets stay listed by the webvtt file
+			if len(t.thumbnailID) > 0 {
+				t.delete(t.thumbnailID)
+			}
+			t.releaseSprites()
+			return
+		}
+	}
+}
+
+func (t *Thumbnailer) Stop() {
+	t.stopOnce.Do(func() { close(t.stopCh) })
+}
+
+func (t *Thumbnailer) capture() error {
+	initPath, segmentPath, ok := t.newestSegment()
+	if !ok || segmentPath == t.lastSegment {
+		return nil
+	}
+
+	input := segmentPath
+	if len(initPath) > 0 {
+		// a fmp4 segment can't be decoded without its init file
+		joined, err := joinFiles(initPath, segmentPath)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(joined)
+		input = joined
+	}
+
+	if err := os.MkdirAll(t.publicDir, 0755); err != nil {
+		return err
+	}
+
+	thumbnailPath := filepath.Join(t.publicDir, ThumbnailName)
+	tilePath := filepath.Join(t.publicDir, "tile.tmp.jpg")
+	defer os.Remove(tilePath)
+	if err := t.extract(input, thumbnailPath+".tmp.jpg", tilePath); err != nil {
+		return err
+	}
+	if err := os.Rename(thumbnailPath+".tmp.jpg", thumbnailPath); err != nil {
+		return err
+	}
+	t.lastSegment = segmentPath
+
+	if err := t.addTile(tilePath); err != nil {
+		return err
+	}
+
+	thumbnailURL := t.publicURL + "/" + ThumbnailName
+	var thumbnailID string
+	if t.storage != nil {
+		id, err := t.storage.AddFile(thumbnailPath)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %s", thumbnailPath, err)
+		}
+		thumbnailID = id
+		thumbnailURL = t.publicFileURL(id, thumbnailPath)
+	}
+
+	if thumbnailURL != t.lastURL {
+		t.lastURL = thumbnailURL
+		t.onThumbnail(thumbnailURL)
+	}
+
+	// the user points at the new one now
+	if len(t.thumbnailID) > 0 && t.thumbnailID != thumbnailID {
+		t.delete(t.thumbnailID)
+	}
+	t.thumbnailID = thumbnailID
+
+	return nil
+}
+
+// the newest segment of the first variant, and its init file for fmp4
+// the playlists left by the previous publish are ignored until ffmpeg rewrites them
+func (t *Thumbnailer) newestSegment() (string, string, bool) {
+	masterFile, err := os.Open(filepath.Join(t.outputDir, t.masterFileName))
+	if err != nil {
+		return "", "", false
+	}
+	master, err := m3u8.ParseMaster(masterFile)
+	masterFile.Close()
+	if err != nil || len(master.Variants) == 0 {
+		return "", "", false
+	}
+
+	variantURI := master.Variants[0].URI
+	variantFile, err := os.Open(filepath.Join(t.outputDir, filepath.FromSlash(variantURI)))
+	if err != nil {
+		return "", "", false
+	}
+	defer variantFile.Close()
+
+	stat, err := variantFile.Stat()
+	if err != nil || stat.ModTime().Before(t.startedAt) {
+		return "", "", false
+	}
+
+	playlist, err := m3u8.ParseMedia(variantFile)
+	if err != nil || len(playlist.Segments) == 0 {
+		return "", "", false
+	}
+
+	newest := len(playlist.Segments) - 1
+	if t.partsPerSegment > 0 {
+		// the newest part starting a segment, the others don't start with a keyframe
+		for newest >= 0 {
+			number, ok := llhls.ParsePartFileName(playlist.Segments[newest].URI)
+			if ok && number%t.partsPerSegment == 0 {
+				break
+			}
+			newest--
+		}
+		if newest < 0 {
+			return "", "", false
+		}
+	}
+
+	// the map of a segment is the last one listed before it
+	var initURI string
+	for _, segment := range playlist.Segments[:newest+1] {
+		if segment.Map != nil {
+			initURI = segment.Map.URI
+		}
+	}
+
+	variantDir := filepath.Join(t.outputDir, filepath.FromSlash(path.Dir(variantURI)))
+	var initPath string
+	if len(initURI) > 0 {
+		initPath = filepath.Join(variantDir, filepath.FromSlash(initURI))
+	}
+
+	return initPath, filepath.Join(variantDir, filepath.FromSlash(playlist.Segments[newest].URI)), true
+}
+
+// extract the first frame of the input as the thumbnail and as a sprite tile
+func (t *Thumbnailer) extract(input string, thumbnailPath string, tilePath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), captureTimeout)
+	defer cancel()
+
+	tileFilter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2", TileWidth, TileHeight, TileWidth, TileHeight)
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-y",
+		"-i", input,
+		"-map", "0:v:0", "-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:-2", t.width), "-q:v", "4", thumbnailPath,
+		"-map", "0:v:0", "-frames:v", "1", "-vf", tileFilter, "-q:v", "5", tilePath,
+	}
+
+	output, err := exec.CommandContext(ctx, t.ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// draw the tile into the current sprite sheet, publish the sheet and the webvtt file
+func (t *Thumbnailer) addTile(tilePath string) error {
+	file, err := os.Open(tilePath)
+	if err != nil {
+		return err
+	}
+	tile, err := jpeg.Decode(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("invalid tile: %s", err)
+	}
+
+	position := t.tiles % (TileColumns * TileRows)
+	if position == 0 {
+		t.sprite = image.NewRGBA(image.Rect(0, 0, TileWidth*TileColumns, TileHeight*TileRows))
+		t.spriteURLs = append(t.spriteURLs, "")
+	}
+	x, y := (position%TileColumns)*TileWidth, (position/TileColumns)*TileHeight
+	draw.Draw(t.sprite, image.Rect(x, y, x+TileWidth, y+TileHeight), tile, tile.Bounds().Min, draw.Src)
+	t.tiles++
+
+	sheet := len(t.spriteURLs) - 1
+	spritePath := filepath.Join(t.publicDir, SpriteFileName(sheet))
+	if err := writeAtomic(spritePath, func(w io.Writer) error {
+		return jpeg.Encode(w, t.sprite, &jpeg.Options{Quality: 75})
+	}); err != nil {
+		return err
+	}
+
+	// the webvtt file is next to the sheets, a relative url is enough without remote storage
+	t.spriteURLs[sheet] = SpriteFileName(sheet)
+	if t.storage != nil {
+		id, err := t.storage.AddFile(spritePath)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %s", spritePath, err)
+		}
+		t.spriteURLs[sheet] = t.publicFileURL(id, spritePath)
+
+		// the sheets are listed by the webvtt file until the end, the sheet being filled changes with every tile
+		t.hold(id)
+		if sheet < len(t.spriteIDs) {
+			if previous := t.spriteIDs[sheet]; previous != id {
+				t.delete(previous)
+			} else {
+				t.release(previous)
+			}
+			t.spriteIDs[sheet] = id
+		} else {
+			t.spriteIDs = append(t.spriteIDs, id)
+		}
+	}
+
+	vtt := RenderSprites(t.tiles, t.interval, t.spriteURLs)
+	return writeAtomic(filepath.Join(t.publicDir, SpritesName), func(w io.Writer) error {
+		_, err := w.Write(vtt)
+		return err
+	})
+}
+
+// delete a replaced upload, the storage would grow with every capture otherwise
+func (t *Thumbnailer) delete(id string) {
+	if err := t.storage.Delete(id); err != nil {
+		logger.Warnw("failed to delete replaced thumbnail from the storage", "publishName", t.publishName, "id", id, "error", err.Error())
+	}
+}
+
+func (t *Thumbnailer) publicFileURL(id string, filePath string) string {
+	return fmt.Sprintf("%s?fileName=%s", t.storage.PublicURL(id), filepath.Base(filePath))
+}
+
+// hold keeps an uploaded sheet from expiring on the storages that expire the files by themselves
+func (t *Thumbnailer) hold(id string) {
+	if holder, ok := t.storage.(storage.Holder); ok {
+		if err := holder.Hold(id); err != nil {
+			logger.Warnw("failed to hold sprite sheet on the storage", "publishName", t.publishName, "id", id, "error", err.Error())
+		}
+	}
+}
+
+func (t *Thumbnailer) release(id string) {
+	if holder, ok := t.storage.(storage.Holder); ok {
+		if err := holder.Release(id); err != nil {
+			logger.Warnw("failed to release sprite sheet on the storage", "publishName", t.publishName, "id", id, "error", err.Error())
+		}
+	}
+}
+
+// the sheets expire with the segments once the publish ended
+func (t *Thumbnailer) releaseSprites() {
+	for _, id := range t.spriteIDs {
+		t.release(id)
+	}
+	t.spriteIDs = nil
+}
+
+// RenderSprites writes the webvtt file of the sprite sheets, tile n covers the n-th interval since the stream started
+func RenderSprites(tiles int, interval time.Duration, spriteURLs []string) []byte {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+
+	perSheet := TileColumns * TileRows
+	for i := 0; i < tiles; i++ {
+		start := time.Duration(i) * interval
+		position := i % perSheet
+		x, y := (position%TileColumns)*TileWidth, (position/TileColumns)*TileHeight
+
+		fmt.Fprintf(&b, "\n%s --> %s\n", vttTime(start), vttTime(start+interval))
+		fmt.Fprintf(&b, "%s#xywh=%d,%d,%d,%d\n", spriteURLs[i/perSheet], x, y, TileWidth, TileHeight)
+	}
+
+	return []byte(b.String())
+}
+
+func vttTime(d time.Duration) string {
+	milliseconds := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, milliseconds%1000)
+}
+
+// concatenate the files into a temporary file
+func joinFiles(paths ...string) (string, error) {
+	output, err := os.CreateTemp("", "thumbnail-*"+filepath.Ext(paths[len(paths)-1]))
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	for _, p := range paths {
+		input, err := os.Open(p)
+		if err != nil {
+			os.Remove(output.Name())
+			return "", err
+		}
+
+		_, err = io.Copy(output, input)
+		input.Close()
+		if err != nil {
+			os.Remove(output.Name())
+			return "", err
+		}
+	}
+
+	return output.Name(), nil
+}
+
+// write then rename so the webserver never serves a partial file
+func writeAtomic(filePath string, write func(w io.Writer) error) error {
+	tmpPath := filePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filePath)
+}
@@ -0,0 +1,270 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/transcode/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, filePath string, data string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+	require.NoError(t, os.WriteFile(filePath, []byte(data), 0644))
+}
+
+func writeJPEG(t *testing.T, filePath string, width int, height int) {
+	file, err := os.Create(filePath)
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, jpeg.Encode(file, image.NewRGBA(image.Rect(0, 0, width, height)), nil))
+}
+
+func testConfig(t *testing.T) config.Config {
+	var cfg config.Config
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.FFMpegSetting.MasterFileName = "index.m3u8"
+	cfg.Webserver.PublicURL = "http://localhost:8889/"
+	return cfg
+}
+
+// a fake ffmpeg that writes a tile sized jpeg to every jpg output
+func fakeFFMpeg(t *testing.T) string {
+	dir := t.TempDir()
+	frame := filepath.Join(dir, "frame.jpg")
+	writeJPEG(t, frame, TileWidth, TileHeight)
+
+	ffmpegPath := filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do case \"$arg\" in *.jpg) cp \"" + frame + "\" \"$arg\";; esac; done\n"
+	require.NoError(t, os.WriteFile(ffmpegPath, []byte(script), 0755))
+	return ffmpegPath
+}
+
+const master = "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\n0/stream.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=500000\n1/stream.m3u8\n"
+
+func TestNewestSegment(t *testing.T) {
+	cfg := testConfig(t)
+	thumbnailer := NewThumbnailer(cfg, nil, "user", nil)
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+
+	_, _, ok := thumbnailer.newestSegment()
+	assert.False(t, ok, "no playlist yet")
+
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), master)
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init_0.mp4\"\n#EXTINF:2.000000,\nstream0.m4s\n#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init_1.mp4\",BYTERANGE=\"800@0\"\n#EXTINF:2.000000,\nstream1.m4s\n")
+
+	initPath, segmentPath, ok := thumbnailer.newestSegment()
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(outputDir, "0", "init_1.mp4"), initPath)
+	assert.Equal(t, filepath.Join(outputDir, "0", "stream1.m4s"), segmentPath)
+
+	// mpegts segments have no init file
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\nstream3.ts\n")
+	initPath, segmentPath, ok = thumbnailer.newestSegment()
+	assert.True(t, ok)
+	assert.Empty(t, initPath)
+	assert.Equal(t, filepath.Join(outputDir, "0", "stream3.ts"), segmentPath)
+}
+
+func TestNewestSegment_IgnoresThePreviousPublish(t *testing.T) {
+	cfg := testConfig(t)
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), master)
+	variantPath := filepath.Join(outputDir, "0", "stream.m3u8")
+	writeFile(t, variantPath, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\nstream9.ts\n#EXT-X-ENDLIST\n")
+	require.NoError(t, os.Chtimes(variantPath, time.Now().Add(-time.Minute), time.Now().Add(-time.Minute)))
+
+	thumbnailer := NewThumbnailer(cfg, nil, "user", nil)
+	_, _, ok := thumbnailer.newestSegment()
+	assert.False(t, ok)
+
+	// ffmpeg of the new publish rewrites it
+	writeFile(t, variantPath, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\nstream0.ts\n")
+	_, segmentPath, ok := thumbnailer.newestSegment()
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(outputDir, "0", "stream0.ts"), segmentPath)
+}
+
+func TestAddTile(t *testing.T) {
+	cfg := testConfig(t)
+	thumbnailer := NewThumbnailer(cfg, nil, "user", nil)
+	require.NoError(t, os.MkdirAll(thumbnailer.publicDir, 0755))
+
+	tilePath := filepath.Join(t.TempDir(), "tile.jpg")
+	writeJPEG(t, tilePath, TileWidth, TileHeight)
+
+	// a full sheet then the first tile of the next one
+	for i := 0; i < TileColumns*TileRows+1; i++ {
+		require.NoError(t, thumbnailer.addTile(tilePath))
+	}
+
+	for _, name := range []string{SpriteFileName(0), SpriteFileName(1)} {
+		file, err := os.Open(filepath.Join(thumbnailer.publicDir, name))
+		require.NoError(t, err)
+		sprite, err := jpeg.DecodeConfig(file)
+		file.Close()
+		require.NoError(t, err)
+		assert.Equal(t, TileWidth*TileColumns, sprite.Width)
+		assert.Equal(t, TileHeight*TileRows, sprite.Height)
+	}
+
+	vtt, err := os.ReadFile(filepath.Join(thumbnailer.publicDir, SpritesName))
+	require.NoError(t, err)
+	assert.Equal(t, string(RenderSprites(26, defaultInterval, []string{"sprite0.jpg", "sprite1.jpg"})), string(vtt))
+
+	_, err = os.Stat(filepath.Join(thumbnailer.publicDir, SpritesName+".tmp"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// not a jpeg
+	writeFile(t, tilePath, "hello")
+	assert.Error(t, thumbnailer.addTile(tilePath))
+}
+
+func TestCapture(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Transcode.FFMpegSetting.FFMpegPath = fakeFFMpeg(t)
+
+	var urls []string
+	thumbnailer := NewThumbnailer(cfg, nil, "user", func(url string) { urls = append(urls, url) })
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+
+	// nothing to capture yet
+	assert.NoError(t, thumbnailer.capture())
+	assert.Empty(t, urls)
+
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), master)
+	writeFile(t, filepath.Join(outputDir, "0", "init_0.mp4"), "init")
+	writeFile(t, filepath.Join(outputDir, "0", "stream0.m4s"), "segment")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init_0.mp4\"\n#EXTINF:2.000000,\nstream0.m4s\n")
+
+	assert.NoError(t, thumbnailer.capture())
+	assert.Equal(t, []string{"http://localhost:8889/static/user/thumbnail.jpg"}, urls)
+	assert.FileExists(t, filepath.Join(outputDir, ThumbnailName))
+	assert.FileExists(t, filepath.Join(outputDir, SpriteFileName(0)))
+
+	// the same segment is not captured twice, a new one is but the url does not change
+	assert.NoError(t, thumbnailer.capture())
+	writeFile(t, filepath.Join(outputDir, "0", "stream1.m4s"), "segment")
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init_0.mp4\"\n#EXTINF:2.000000,\nstream0.m4s\n#EXTINF:2.000000,\nstream1.m4s\n")
+	assert.NoError(t, thumbnailer.capture())
+	assert.Len(t, urls, 1)
+
+	vtt, err := os.ReadFile(filepath.Join(outputDir, SpritesName))
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(vtt), "#xywh="))
+}
+
+// holdingStorage names every upload after its number, it tells what is held and what was deleted
+type holdingStorage struct {
+	uploads int
+	held    map[string]int
+	deleted []string
+}
+
+func (s *holdingStorage) AddFile(filePath string) (string, error) {
+	s.uploads++
+	return fmt.Sprintf("%s-%d", filepath.Base(filePath), s.uploads), nil
+}
+
+func (s *holdingStorage) AddDirectory(directoryPath string) (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (s *holdingStorage) Delete(id string) error {
+	delete(s.held, id)
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+func (s *holdingStorage) Exists(id string) (bool, error) { return true, nil }
+func (s *holdingStorage) PublicURL(id string) string     { return "http://gateway/" + id }
+func (s *holdingStorage) Hold(id string) error           { s.held[id]++; return nil }
+func (s *holdingStorage) Release(id string) error        { s.held[id]--; return nil }
+
+func TestAddTile_HoldsTheSheetsUntilTheEnd(t *testing.T) {
+	cfg := testConfig(t)
+	storage := &holdingStorage{held: make(map[string]int)}
+	thumbnailer := NewThumbnailer(cfg, storage, "user", nil)
+	require.NoError(t, os.MkdirAll(thumbnailer.publicDir, 0755))
+
+	tilePath := filepath.Join(t.TempDir(), "tile.jpg")
+	writeJPEG(t, tilePath, TileWidth, TileHeight)
+	for i := 0; i < TileColumns*TileRows+1; i++ {
+		require.NoError(t, thumbnailer.addTile(tilePath))
+	}
+
+	// the last upload of each sheet is held, the replaced ones are deleted
+	assert.Equal(t, map[string]int{"sprite0.jpg-25": 1, "sprite1.jpg-26": 1}, storage.held)
+	assert.Len(t, storage.deleted, 24)
+	assert.Equal(t, "sprite0.jpg-1", storage.deleted[0])
+	assert.Equal(t, "sprite0.jpg-24", storage.deleted[23])
+
+	thumbnailer.releaseSprites()
+	for id, count := range storage.held {
+		assert.Zero(t, count, id)
+	}
+}
+
+func TestCapture_DeletesTheReplacedThumbnails(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Transcode.FFMpegSetting.FFMpegPath = fakeFFMpeg(t)
+
+	var urls []string
+	storage := &holdingStorage{held: make(map[string]int)}
+	thumbnailer := NewThumbnailer(cfg, storage, "user", func(url string) { urls = append(urls, url) })
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), master)
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("stream%d.ts", i)
+		writeFile(t, filepath.Join(outputDir, "0", name), "segment")
+		writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\n"+name+"\n")
+		require.NoError(t, thumbnailer.capture())
+	}
+
+	// a thumbnail then a sheet are uploaded by every capture
+	assert.Equal(t, []string{"http://gateway/thumbnail.jpg-2?fileName=thumbnail.jpg", "http://gateway/thumbnail.jpg-4?fileName=thumbnail.jpg"}, urls)
+	assert.Equal(t, []string{"sprite0.jpg-1", "thumbnail.jpg-2"}, storage.deleted)
+
+	// the thumbnail goes with the stream, the sheets are released
+	thumbnailer.Stop()
+	thumbnailer.Start()
+	assert.Equal(t, []string{"sprite0.jpg-1", "thumbnail.jpg-2", "thumbnail.jpg-4"}, storage.deleted)
+	assert.Equal(t, map[string]int{"sprite0.jpg-3": 0}, storage.held)
+}
+
+func TestNewestSegment_LowLatency(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Transcode.FFMpegSetting.HLSTime = 2
+	cfg.Transcode.LowLatency.Enabled = true
+	cfg.Transcode.LowLatency.PartDuration = 500
+	thumbnailer := NewThumbnailer(cfg, nil, "user", nil)
+	outputDir := filepath.Join(cfg.Transcode.PublicHLSPath, "user")
+
+	writeFile(t, filepath.Join(outputDir, "index.m3u8"), master)
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MAP:URI=\"init_0.mp4\"\n")
+	for i := 1; i <= 6; i++ {
+		fmt.Fprintf(&playlist, "#EXTINF:0.500000,\npart%d.m4s\n", i)
+	}
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), playlist.String())
+
+	// 4 parts a segment, the part 4 starts with a keyframe, the parts 5 and 6 don't
+	initPath, segmentPath, ok := thumbnailer.newestSegment()
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(outputDir, "0", "init_0.mp4"), initPath)
+	assert.Equal(t, filepath.Join(outputDir, "0", "part4.m4s"), segmentPath)
+
+	// no segment started yet
+	writeFile(t, filepath.Join(outputDir, "0", "stream.m3u8"), "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:0.500000,\npart5.m4s\n")
+	_, _, ok = thumbnailer.newestSegment()
+	assert.False(t, ok)
+}
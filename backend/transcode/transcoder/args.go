@@ -0,0 +1,457 @@
+package transcoder
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sen1or/lets-live/transcode/config"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVideoCodec = "libx264"
+
+	SegmentTypeMPEGTS = "mpegts"
+	SegmentTypeFMP4   = "fmp4"
+)
+
+var (
+	resolutionPattern = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+	bitratePattern    = regexp.MustCompile(`^[1-9][0-9]*[kKmM]?$`)
+	codecPattern      = regexp.MustCompile(`^[a-z0-9_]+$`)
+	x264ParamsPattern = regexp.MustCompile(`^[a-z0-9_-]+=[A-Za-z0-9_.,+-]+(:[a-z0-9_-]+=[A-Za-z0-9_.,+-]+)*$`)
+
+	x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+	// DefaultEncoderProfile is used when no profile is configured, and fills the empty fields of the configured one
+	DefaultEncoderProfile = config.EncoderProfile{
+		VideoCodec:      defaultVideoCodec,
+		AudioCodec:      "aac",
+		AudioChannels:   1,
+		AudioSampleRate: 44100,
+		AudioBitrate:    "128k",
+	}
+)
+
+// ArgsBuilder builds the ffmpeg arguments from the config
+// the result is given to exec.Command as is, there is no shell in between
+type ArgsBuilder struct {
+	setting   config.FFMpegSetting
+	profile   config.EncoderProfile
+	source    SourceInfo
+	outputDir string
+	resume    bool
+
+	partDuration time.Duration // low latency mode if not zero
+	firstPart    int
+
+	programDateTime bool
+
+	// the renditions of the last Build
+	ladder []config.Quality
+}
+
+func NewArgsBuilder(setting config.FFMpegSetting, outputDir string) *ArgsBuilder {
+	return &ArgsBuilder{
+		setting:   setting,
+		profile:   DefaultEncoderProfile,
+		outputDir: outputDir,
+	}
+}
+
+// Profile sets the encoder profile, see ResolveProfile
+func (b *ArgsBuilder) Profile(profile config.EncoderProfile) *ArgsBuilder {
+	b.profile = profile
+	return b
+}
+
+// Source sets what is known about the incoming video, it decides if the source rendition can be copied
+func (b *ArgsBuilder) Source(source SourceInfo) *ArgsBuilder {
+	b.source = source
+	return b
+}
+
+// Resume makes ffmpeg continue the existing playlists instead of starting new ones, with a discontinuity before the new segments
+func (b *ArgsBuilder) Resume(resume bool) *ArgsBuilder {
+	b.resume = resume
+	return b
+}
+
+// LowLatency switches to ll-hls: fmp4 parts of the given duration (cut by time) and keyframes on segment boundaries
+// the playlist written by ffmpeg lists the parts, see the llhls package
+func (b *ArgsBuilder) LowLatency(partDuration time.Duration) *ArgsBuilder {
+	b.partDuration = partDuration
+	return b
+}
+
+// FirstPart is the number of the first part ffmpeg writes, a resumed ffmpeg goes on with the numbers of the playlist
+// and its keyframes are forced on the next segment boundary
+func (b *ArgsBuilder) FirstPart(number int) *ArgsBuilder {
+	b.firstPart = number
+	return b
+}
+
+// ProgramDateTime dates every segment in the variant playlists, the dash manifest places the segments with it
+func (b *ArgsBuilder) ProgramDateTime(enabled bool) *ArgsBuilder {
+	b.programDateTime = enabled
+	return b
+}
+
+// Build validates the setting and returns the ffmpeg arguments (without the ffmpeg path)
+func (b *ArgsBuilder) Build() ([]string, error) {
+	if err := ValidateSetting(b.setting); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateProfile(b.profile); err != nil {
+		return nil, err
+	}
+
+	if b.partDuration != 0 {
+		if _, err := PartsPerSegment(b.setting.HLSTime, b.partDuration); err != nil {
+			return nil, err
+		}
+	}
+
+	s := b.setting
+	s.Qualities = SelectLadder(s.Qualities, b.source)
+	b.ladder = s.Qualities
+	p := b.profile
+	args := []string{
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "level+info",
+		"-progress", "pipe:3",
+		"-re",
+		"-i", "pipe:0",
+	}
+
+	// the rate control options below are x264 ones, hardware encoders keep their defaults
+	if p.VideoCodec == defaultVideoCodec {
+		args = append(args,
+			"-preset", s.Preset,
+			"-sc_threshold", "0",
+			"-c:v", p.VideoCodec,
+			"-pix_fmt", "yuv420p",
+			"-crf", strconv.Itoa(s.CRF),
+		)
+		if len(p.X264Params) > 0 {
+			args = append(args, "-x264-params", p.X264Params)
+		}
+	} else {
+		args = append(args,
+			"-c:v", p.VideoCodec,
+			"-pix_fmt", "yuv420p",
+		)
+	}
+
+	hlsFlags := "delete_segments"
+	if b.programDateTime {
+		hlsFlags += "+program_date_time"
+	}
+	if b.resume {
+		hlsFlags += "+append_list+discont_start"
+	}
+
+	streamMaps := make([]string, 0, len(s.Qualities))
+	for index, quality := range s.Qualities {
+		i := strconv.Itoa(index)
+		args = append(args, "-map", "v:0")
+		streamMaps = append(streamMaps, fmt.Sprintf("v:%d,a:%d", index, index))
+
+		if quality.Source && b.partDuration == 0 && b.canCopySource(quality) {
+			args = append(args, "-c:"+i, "copy")
+			continue
+		}
+
+		if len(quality.Resolution) > 0 {
+			args = append(args, "-s:"+i, quality.Resolution)
+		}
+		args = append(args,
+			"-r:"+i, strconv.Itoa(quality.FPS),
+			"-maxrate:"+i, quality.MaxBitrate,
+			"-bufsize:"+i, quality.BufSize,
+			"-g:"+i, strconv.Itoa(quality.FPS*s.HLSTime),
+			"-keyint_min:"+i, strconv.Itoa(s.HLSTime),
+		)
+	}
+
+	for range s.Qualities {
+		args = append(args, "-map", "a:0")
+	}
+
+	args = append(args,
+		"-c:a", p.AudioCodec,
+		"-b:a", p.AudioBitrate,
+		"-ac", strconv.Itoa(p.AudioChannels),
+		"-ar", strconv.Itoa(p.AudioSampleRate),
+		"-f", "hls",
+	)
+
+	if b.partDuration != 0 {
+		args = append(args, b.lowLatencyArgs(hlsFlags)...)
+	} else {
+		if s.SegmentType == SegmentTypeFMP4 {
+			args = append(args, b.fmp4Args("stream%d.m4s")...)
+		}
+
+		args = append(args,
+			"-hls_time", strconv.Itoa(s.HLSTime),
+			"-hls_delete_threshold", strconv.Itoa(s.HlsMaxSize-s.HlsListSize),
+			"-hls_list_size", strconv.Itoa(s.HlsListSize),
+			// the playlists are renamed into place, the watcher reads them as soon as they appear
+			"-hls_flags", hlsFlags+"+temp_file",
+		)
+	}
+
+	args = append(args,
+		"-master_pl_name", s.MasterFileName,
+		"-var_stream_map", strings.Join(streamMaps, " "),
+		filepath.Join(b.outputDir, "%v", "stream.m3u8"),
+	)
+
+	return args, nil
+}
+
+// every ffmpeg "segment" is a part, the list sizes are counted in parts
+func (b *ArgsBuilder) lowLatencyArgs(hlsFlags string) []string {
+	s := b.setting
+	partsPerSegment, _ := PartsPerSegment(s.HLSTime, b.partDuration)
+
+	keyframes := fmt.Sprintf("expr:gte(t,n_forced*%d)", s.HLSTime)
+	// the first keyframe starts the run, the next one is the boundary of the segment ffmpeg starts in
+	if offset := b.firstPart % partsPerSegment; offset != 0 {
+		shift := time.Duration(offset) * b.partDuration
+		keyframes = fmt.Sprintf("expr:gte(t,n_forced*%d-%s)", s.HLSTime, strconv.FormatFloat(shift.Seconds(), 'f', -1, 64))
+	}
+
+	args := []string{"-force_key_frames", keyframes}
+	args = append(args, b.fmp4Args("part%d.m4s")...)
+
+	return append(args,
+		"-hls_time", strconv.FormatFloat(b.partDuration.Seconds(), 'f', -1, 64),
+		"-hls_delete_threshold", strconv.Itoa((s.HlsMaxSize-s.HlsListSize)*partsPerSegment),
+		"-hls_list_size", strconv.Itoa(s.HlsListSize*partsPerSegment),
+		"-hls_flags", hlsFlags+"+split_by_time+temp_file",
+	)
+}
+
+// cmaf segments, ffmpeg writes one init file per variant next to the segments (init_0.mp4, init_1.mp4...)
+func (b *ArgsBuilder) fmp4Args(segmentName string) []string {
+	return []string{
+		"-hls_segment_type", SegmentTypeFMP4,
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", filepath.Join(b.outputDir, "%v", segmentName),
+	}
+}
+
+// PartsPerSegment returns how many ll-hls parts make a segment of hlsTime seconds
+func PartsPerSegment(hlsTime int, partDuration time.Duration) (int, error) {
+	segmentDuration := time.Duration(hlsTime) * time.Second
+	if partDuration <= 0 || partDuration > segmentDuration || segmentDuration%partDuration != 0 {
+		return 0, fmt.Errorf("the hls time (%ds) must be a multiple of the part duration (%s)", hlsTime, partDuration)
+	}
+
+	return int(segmentDuration / partDuration), nil
+}
+
+// Ladder returns the renditions the arguments of the last Build encode, the configured qualities that fit the source
+func (b *ArgsBuilder) Ladder() []config.Quality {
+	return b.ladder
+}
+
+// SelectLadder drops the qualities above the source resolution or frame rate, there is no point in upscaling
+// the source rendition is always kept, and the lowest quality if every other one is dropped
+// with an unknown source the ladder is kept as is
+func SelectLadder(qualities []config.Quality, source SourceInfo) []config.Quality {
+	ladder := make([]config.Quality, 0, len(qualities))
+	lowest := -1
+
+	for index, quality := range qualities {
+		if quality.Source {
+			ladder = append(ladder, quality)
+			continue
+		}
+
+		if lowest == -1 || shortSide(quality.Resolution) < shortSide(qualities[lowest].Resolution) {
+			lowest = index
+		}
+
+		// compare the short sides so a portrait source is not mistaken for a small one
+		if source.Width > 0 && source.Height > 0 && shortSide(quality.Resolution) > min(source.Width, source.Height) {
+			continue
+		}
+
+		// 29.97 fps is a 30 fps source
+		if source.FPS > 0 && float64(quality.FPS) > math.Round(source.FPS) {
+			continue
+		}
+
+		ladder = append(ladder, quality)
+	}
+
+	if len(ladder) == 0 && lowest != -1 {
+		ladder = append(ladder, qualities[lowest])
+	}
+
+	return ladder
+}
+
+// shortSide returns the smaller dimension of a validated resolution ("1280x720" is 720)
+func shortSide(resolution string) int {
+	width, height, _ := strings.Cut(resolution, "x")
+	w, _ := strconv.Atoi(width)
+	h, _ := strconv.Atoi(height)
+
+	return min(w, h)
+}
+
+// the source is copied only if players can take it as is: h264 with a known bitrate under the rendition max bitrate
+// the segments then follow the source keyframes, so they are only as regular as the encoder of the creator
+func (b *ArgsBuilder) canCopySource(quality config.Quality) bool {
+	if b.source.VideoCodec != "h264" || b.source.VideoBitrate <= 0 {
+		return false
+	}
+
+	return b.source.VideoBitrate <= kbits(quality.MaxBitrate)
+}
+
+// kbits converts a validated bitrate ("3000k", "6M", "800000") to kbits/s
+func kbits(bitrate string) int {
+	value, _ := strconv.Atoi(strings.TrimRight(bitrate, "kKmM"))
+
+	switch bitrate[len(bitrate)-1] {
+	case 'k', 'K':
+		return value
+	case 'm', 'M':
+		return value * 1000
+	default:
+		return value / 1000
+	}
+}
+
+// ResolveProfile returns the named profile with its empty fields taken from DefaultEncoderProfile
+// an empty name is the default profile
+func ResolveProfile(profiles map[string]config.EncoderProfile, name string) (config.EncoderProfile, error) {
+	if len(name) == 0 {
+		return DefaultEncoderProfile, nil
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		return config.EncoderProfile{}, fmt.Errorf("unknown encoder profile %q", name)
+	}
+
+	if len(profile.VideoCodec) == 0 {
+		profile.VideoCodec = DefaultEncoderProfile.VideoCodec
+	}
+	if len(profile.AudioCodec) == 0 {
+		profile.AudioCodec = DefaultEncoderProfile.AudioCodec
+	}
+	if profile.AudioChannels == 0 {
+		profile.AudioChannels = DefaultEncoderProfile.AudioChannels
+	}
+	if profile.AudioSampleRate == 0 {
+		profile.AudioSampleRate = DefaultEncoderProfile.AudioSampleRate
+	}
+	if len(profile.AudioBitrate) == 0 {
+		profile.AudioBitrate = DefaultEncoderProfile.AudioBitrate
+	}
+
+	return profile, ValidateProfile(profile)
+}
+
+// ValidateProfile checks every value of the profile that ends up in the ffmpeg arguments
+func ValidateProfile(p config.EncoderProfile) error {
+	if !codecPattern.MatchString(p.VideoCodec) {
+		return fmt.Errorf("invalid video codec %q", p.VideoCodec)
+	}
+
+	if len(p.X264Params) > 0 {
+		if p.VideoCodec != defaultVideoCodec {
+			return fmt.Errorf("x264 params are only supported with %s", defaultVideoCodec)
+		}
+
+		if !x264ParamsPattern.MatchString(p.X264Params) {
+			return fmt.Errorf("invalid x264 params %q", p.X264Params)
+		}
+	}
+
+	if !codecPattern.MatchString(p.AudioCodec) {
+		return fmt.Errorf("invalid audio codec %q", p.AudioCodec)
+	}
+
+	if p.AudioChannels <= 0 || p.AudioChannels > 8 {
+		return fmt.Errorf("audio channels must be between 1 and 8, got %d", p.AudioChannels)
+	}
+
+	if p.AudioSampleRate <= 0 {
+		return fmt.Errorf("audio sample rate must be positive, got %d", p.AudioSampleRate)
+	}
+
+	if !bitratePattern.MatchString(p.AudioBitrate) {
+		return fmt.Errorf("invalid audio bitrate %q", p.AudioBitrate)
+	}
+
+	return nil
+}
+
+// ValidateSetting checks every value that ends up in the ffmpeg arguments
+func ValidateSetting(s config.FFMpegSetting) error {
+	if len(s.FFMpegPath) == 0 {
+		return fmt.Errorf("missing ffmpeg path")
+	}
+
+	if len(s.Qualities) == 0 {
+		return fmt.Errorf("at least one quality is required")
+	}
+
+	if !slices.Contains(x264Presets, s.Preset) {
+		return fmt.Errorf("invalid preset %q", s.Preset)
+	}
+
+	if s.CRF < 0 || s.CRF > 51 {
+		return fmt.Errorf("crf must be between 0 and 51, got %d", s.CRF)
+	}
+
+	if s.HLSTime <= 0 {
+		return fmt.Errorf("hls time must be positive, got %d", s.HLSTime)
+	}
+
+	if s.HlsListSize <= 0 || s.HlsMaxSize < s.HlsListSize {
+		return fmt.Errorf("invalid hls list size (%d) and max size (%d)", s.HlsListSize, s.HlsMaxSize)
+	}
+
+	if len(s.SegmentType) > 0 && s.SegmentType != SegmentTypeMPEGTS && s.SegmentType != SegmentTypeFMP4 {
+		return fmt.Errorf("invalid segment type %q", s.SegmentType)
+	}
+
+	if len(s.MasterFileName) == 0 || filepath.Base(s.MasterFileName) != s.MasterFileName || filepath.Ext(s.MasterFileName) != ".m3u8" {
+		return fmt.Errorf("invalid master file name %q", s.MasterFileName)
+	}
+
+	for index, quality := range s.Qualities {
+		// the source rendition keeps the source resolution when it has none
+		if !(quality.Source && len(quality.Resolution) == 0) && !resolutionPattern.MatchString(quality.Resolution) {
+			return fmt.Errorf("quality %d: invalid resolution %q", index, quality.Resolution)
+		}
+
+		if quality.FPS <= 0 {
+			return fmt.Errorf("quality %d: fps must be positive, got %d", index, quality.FPS)
+		}
+
+		if !bitratePattern.MatchString(quality.MaxBitrate) {
+			return fmt.Errorf("quality %d: invalid max bitrate %q", index, quality.MaxBitrate)
+		}
+
+		if !bitratePattern.MatchString(quality.BufSize) {
+			return fmt.Errorf("quality %d: invalid buffer size %q", index, quality.BufSize)
+		}
+	}
+
+	return nil
+}
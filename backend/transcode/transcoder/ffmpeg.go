@@ -1,95 +1,431 @@
 package transcoder
 
 import (
-	"fmt"
+	"errors"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"sen1or/lets-live/pkg/logger"
 	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/dash"
+	"sen1or/lets-live/transcode/llhls"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	defaultMaxRestartAttempts = 5
+	defaultInitialBackoff     = time.Second
+	defaultMaxBackoff         = 30 * time.Second
+
+	// if ffmpeg ran at least this long before exiting, it is not a crash loop and the attempts start over
+	stableRunDuration = time.Minute
+
+	// how long the first ffmpeg waits for the ingest protocol to describe the source
+	sourceWaitTimeout = 5 * time.Second
+)
+
+var ErrTranscoderStopped = errors.New("transcoder stopped")
+
+// Transcoder runs ffmpeg for a publish and restarts it if it exits while the publisher is still connected
+// the ingest protocol writes the media into it, the writes are dropped while ffmpeg is restarting
 type Transcoder struct {
-	stdin       *io.PipeReader
+	config config.Config
+
+	mu          sync.Mutex
 	commandExec *exec.Cmd
-	config      config.Config
+	stopped     bool
+	stopCh      chan struct{}
+	// closed once the first ffmpeg is running, nothing is dropped before that
+	readyCh   chan struct{}
+	readyOnce sync.Once
+
+	source     SourceInfo
+	sourceCh   chan struct{}
+	sourceOnce sync.Once
+
+	// told the renditions before the first ffmpeg starts
+	onLadder   func(ladder []config.Quality)
+	ladderOnce sync.Once
+
+	// writeMu keeps writes in order and makes sure the header is the first thing a restarted ffmpeg reads
+	writeMu     sync.Mutex
+	stdin       io.WriteCloser
+	header      []byte
+	resumePoint func(b []byte) bool
+	// set when ffmpeg restarted, the writes are dropped until the resume point
+	resuming bool
+
+	statsMu sync.RWMutex
+	stats   Stats
 }
 
-func NewTranscoder(pipeOut *io.PipeReader, config config.Config) *Transcoder {
+func NewTranscoder(config config.Config) *Transcoder {
 	return &Transcoder{
-		stdin:  pipeOut,
-		config: config,
+		config:   config,
+		stopCh:   make(chan struct{}),
+		readyCh:  make(chan struct{}),
+		sourceCh: make(chan struct{}),
 	}
 }
 
+// Write sends the media to the running ffmpeg
+// it only fails once the transcoder is stopped, while ffmpeg is down the data is dropped
+func (t *Transcoder) Write(b []byte) (int, error) {
+	select {
+	case <-t.readyCh:
+	case <-t.stopCh:
+		return 0, ErrTranscoderStopped
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	if t.isStopped() {
+		return 0, ErrTranscoderStopped
+	}
+
+	if t.stdin == nil {
+		return len(b), nil
+	}
+
+	if t.resuming {
+		if !t.resumePoint(b) {
+			return len(b), nil
+		}
+		t.resuming = false
+	}
+
+	if _, err := t.stdin.Write(b); err != nil {
+		// ffmpeg is gone, the supervisor will restart it
+		t.stdin = nil
+	}
+
+	return len(b), nil
+}
+
+// SetHeader sets what a restarted ffmpeg must read before the live data to understand the stream (flv or webm header, codec configs)
+// it is not written to the first ffmpeg, the ingest protocol sends it as part of the stream
+func (t *Transcoder) SetHeader(header []byte) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	t.header = header
+}
+
+// SetResumePoint tells which write a restarted ffmpeg can read right after the header, the ones before are dropped
+// without it the writes resume wherever the stream is, which is fine when every write stands on its own (flv tags, ts packets)
+// but not when the container has a structure around them (webm blocks belong to a cluster)
+func (t *Transcoder) SetResumePoint(resumePoint func(b []byte) bool) {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	t.resumePoint = resumePoint
+}
+
+// SetSource describes the incoming video, only the first call is kept
+// every ingest protocol must call it, even with an empty SourceInfo, or the first ffmpeg is delayed
+func (t *Transcoder) SetSource(source SourceInfo) {
+	t.sourceOnce.Do(func() {
+		t.mu.Lock()
+		t.source = source
+		t.mu.Unlock()
+
+		close(t.sourceCh)
+	})
+}
+
+// OnLadder sets the function told which renditions ffmpeg encodes, the configured qualities that fit the source
+// it is called once, before the first ffmpeg starts, and must be set before Start
+func (t *Transcoder) OnLadder(fn func(ladder []config.Quality)) {
+	t.onLadder = fn
+}
+
+// Source returns the source set by the ingest protocol
+func (t *Transcoder) Source() SourceInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.source
+}
+
+// Start runs ffmpeg until the transcoder is stopped, restarting it with an exponential backoff when it exits
+// it returns early if ffmpeg keeps failing, the caller should then end the publish
 func (t *Transcoder) Start(publishName string) {
-	// if there is no remote (or external storage), just export files directly to public folder and serves
-	var outputDir = filepath.Join(t.config.Transcode.PublicHLSPath, publishName)
-	if t.config.IPFS.Enabled {
-		outputDir = filepath.Join(t.config.Transcode.PrivateHLSPath, publishName)
-	}
-
-	var videoMaps = make([]string, 0)
-	var audioMaps = make([]string, 0)
-	var streamMaps = make([]string, 0)
-
-	for index, quality := range t.config.Transcode.FFMpegSetting.Qualities {
-		var g = quality.FPS * t.config.Transcode.FFMpegSetting.HLSTime
-		var keyint_min = t.config.Transcode.FFMpegSetting.HLSTime
-
-		videoMaps = append(videoMaps, fmt.Sprintf("-map v:0 -s:%v %s -r:%v %v -maxrate:%v %s -bufsize:%v %s -g:%v %v -keyint_min:%v %v", index, quality.Resolution, index, quality.FPS, index, quality.MaxBitrate, index, quality.BufSize, index, g, index, keyint_min))
-		audioMaps = append(audioMaps, "-map a:0")
-		streamMaps = append(streamMaps, fmt.Sprintf("v:%v,a:%v", index, index))
-	}
-
-	var ffmpegFlags = []string{
-		"-hide_banner",
-		"-re",
-		"-i pipe:0",
-		fmt.Sprintf("-preset %s", t.config.Transcode.FFMpegSetting.Preset),
-		"-sc_threshold 0",
-		"-c:v libx264",
-		"-pix_fmt yuv420p",
-		fmt.Sprintf("-crf %v", t.config.Transcode.FFMpegSetting.CRF),
-		strings.Join(videoMaps, " "),
-		strings.Join(audioMaps, " "),
-		"-c:a aac",
-		"-b:a 128k",
-		"-ac 1",
-		"-ar 44100",
-		"-f hls",
-		fmt.Sprintf("-hls_time %v", t.config.Transcode.FFMpegSetting.HLSTime),
-		fmt.Sprintf("-hls_delete_threshold %v", t.config.Transcode.FFMpegSetting.HlsMaxSize-t.config.Transcode.FFMpegSetting.HlsListSize),
-		fmt.Sprintf("-hls_list_size %v", t.config.Transcode.FFMpegSetting.HlsListSize),
-		"-hls_flags delete_segments",
-		fmt.Sprintf("-master_pl_name %s", t.config.Transcode.FFMpegSetting.MasterFileName),
-		fmt.Sprintf(`-var_stream_map "%s"`, strings.Join(streamMaps, " ")),
-		filepath.Join(outputDir, "/%v/stream.m3u8"),
-	}
-
-	ffmpegFlagsString := strings.Join(ffmpegFlags, " ")
-	ffmpegCommand := t.config.Transcode.FFMpegSetting.FFMpegPath + " " + ffmpegFlagsString
-
-	t.commandExec = exec.Command("sh", "-c", ffmpegCommand)
-	t.commandExec.Stdin = t.stdin
-
-	// TODO: logs out error
-	// stderr, err := execCommand.StderrPipe()
-
-	if err := t.commandExec.Start(); err != nil {
-		logger.Errorf("error while starting ffmpeg command: %s", err)
-	}
-
-	err := t.commandExec.Wait()
+	restart := t.config.Transcode.Restart
+	maxAttempts := restart.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxRestartAttempts
+	}
+	initialBackoff := time.Duration(restart.InitialBackoff) * time.Millisecond
+	if initialBackoff <= 0 {
+		initialBackoff = defaultInitialBackoff
+	}
+	maxBackoff := time.Duration(restart.MaxBackoff) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	select {
+	case <-t.sourceCh:
+	case <-time.After(sourceWaitTimeout):
+		logger.Warnw("no source information from the ingest, transcoding without it", "publishName", publishName)
+	case <-t.stopCh:
+		return
+	}
+
+	// with a storage the watcher writes the manifest from the rewritten playlists
+	if t.config.Transcode.DASH.Enabled && !t.config.HasStorage() {
+		go t.updateManifest(publishName)
+	}
+
+	attempt := 0
+	backoff := initialBackoff
+	for {
+		startedAt := time.Now()
+		if err := t.run(publishName, attempt > 0); err != nil {
+			logger.Errorw("failed to run ffmpeg", "publishName", publishName, "error", err.Error())
+		}
+
+		if t.isStopped() {
+			return
+		}
+
+		if time.Since(startedAt) >= stableRunDuration {
+			attempt = 0
+			backoff = initialBackoff
+		}
+
+		attempt++
+		if attempt > maxAttempts {
+			logger.Errorw("ffmpeg keeps failing, giving up", "publishName", publishName, "attempts", maxAttempts)
+			t.Stop()
+			return
+		}
+
+		logger.Warnw("ffmpeg exited unexpectedly, restarting", "publishName", publishName, "attempt", attempt, "backoff", backoff.String())
+
+		select {
+		case <-time.After(backoff):
+		case <-t.stopCh:
+			return
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// run starts one ffmpeg process and waits for it to exit
+// a restarted ffmpeg appends to the existing playlists with a discontinuity
+func (t *Transcoder) run(publishName string, resume bool) error {
+	outputDir := OutputDir(t.config, publishName)
+
+	profile, err := ResolveProfile(t.config.Transcode.Profiles, t.config.Transcode.Profile)
+	if err != nil {
+		return err
+	}
+
+	var firstPart int
+	if resume && t.partDuration() != 0 {
+		firstPart = prepareLowLatencyResume(outputDir, publishName, len(t.config.Transcode.FFMpegSetting.Qualities))
+	}
+
+	builder := NewArgsBuilder(t.config.Transcode.FFMpegSetting, outputDir).
+		Profile(profile).
+		Source(t.Source()).
+		Resume(resume).
+		LowLatency(t.partDuration()).
+		FirstPart(firstPart).
+		ProgramDateTime(t.config.Transcode.DASH.Enabled)
+	args, err := builder.Build()
 	if err != nil {
-		logger.Errorf("ffmpeg failed: %s", err)
+		return err
 	}
+
+	// the source does not change between the runs, neither does the ladder
+	if !resume {
+		ladder := builder.Ladder()
+		if configured := len(t.config.Transcode.FFMpegSetting.Qualities); len(ladder) < configured {
+			logger.Infow("qualities above the source dropped", "publishName", publishName, "kept", len(ladder), "configured", configured)
+		}
+	}
+
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return nil
+	}
+
+	// under the lock, a publish that ends concurrently is told after it
+	if t.onLadder != nil {
+		t.ladderOnce.Do(func() { t.onLadder(builder.Ladder()) })
+	}
+
+	commandExec := exec.Command(t.config.Transcode.FFMpegSetting.FFMpegPath, args...)
+
+	stdin, err := commandExec.StdinPipe()
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+
+	stderr, err := commandExec.StderrPipe()
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+
+	// -progress writes to the fd 3 of ffmpeg, the first extra file
+	progressReader, progressWriter, err := os.Pipe()
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	defer progressReader.Close()
+	commandExec.ExtraFiles = []*os.File{progressWriter}
+
+	err = commandExec.Start()
+	// the child has its own copy, ours must be closed for the reader to see EOF
+	progressWriter.Close()
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	t.commandExec = commandExec
+	t.mu.Unlock()
+
+	t.writeMu.Lock()
+	if resume && len(t.header) > 0 {
+		if _, err := stdin.Write(t.header); err != nil {
+			logger.Errorw("failed to write stream header to ffmpeg", "publishName", publishName, "error", err.Error())
+		}
+	}
+	t.stdin = stdin
+	t.resuming = resume && t.resumePoint != nil
+	t.writeMu.Unlock()
+	t.readyOnce.Do(func() { close(t.readyCh) })
+
+	go t.readProgress(progressReader, publishName)
+
+	// stderr has to be fully read before calling Wait
+	stderrTail := t.logStderr(stderr, publishName)
+
+	err = commandExec.Wait()
+
+	t.writeMu.Lock()
+	if t.stdin == stdin {
+		t.stdin = nil
+	}
+	t.writeMu.Unlock()
+
+	if !t.isStopped() {
+		exitErr := "exited"
+		if err != nil {
+			exitErr = err.Error()
+		}
+		logger.Errorw("ffmpeg failed", "publishName", publishName, "error", exitErr, "output", strings.Join(stderrTail, "\n"))
+	}
+
+	return nil
+}
+
+// prepareLowLatencyResume keeps the init files of the variants before the restarted ffmpeg overwrites them,
+// it returns the number of the part ffmpeg goes on with (the variants are cut at the same times, the first one tells)
+func prepareLowLatencyResume(outputDir string, publishName string, variants int) int {
+	var firstPart int
+	for index := 0; index < variants; index++ {
+		next, err := llhls.PrepareResume(filepath.Join(outputDir, strconv.Itoa(index)))
+		if err != nil {
+			// the qualities above the source are not written
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Errorw("failed to prepare the ll-hls variant for the restart", "publishName", publishName, "variant", index, "error", err.Error())
+			}
+			continue
+		}
+
+		if index == 0 {
+			firstPart = next
+		}
+	}
+
+	return firstPart
+}
+
+// updateManifest keeps the dash manifest in sync with the playlists written by ffmpeg until the transcoder stops
+func (t *Transcoder) updateManifest(publishName string) {
+	options := dash.NewOptions(t.config.Transcode.FFMpegSetting)
+	streamDir := filepath.Join(t.config.Transcode.PublicHLSPath, publishName)
+	generator := dash.NewGenerator(streamDir, streamDir, options)
+
+	// ffmpeg rewrites the playlists once per segment
+	ticker := time.NewTicker(options.SegmentDuration / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := generator.Generate(); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Errorw("failed to generate dash manifest", "publishName", publishName, "error", err.Error())
+			}
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+// OutputDir is where ffmpeg writes the playlists and segments of a publish
+func OutputDir(config config.Config, publishName string) string {
+	// if there is no remote (or external storage), just export files directly to public folder and serves
+	if config.HasStorage() {
+		return filepath.Join(config.Transcode.PrivateHLSPath, publishName)
+	}
+
+	return filepath.Join(config.Transcode.PublicHLSPath, publishName)
+}
+
+func (t *Transcoder) partDuration() time.Duration {
+	if !t.config.Transcode.LowLatency.Enabled {
+		return 0
+	}
+
+	return time.Duration(t.config.Transcode.LowLatency.PartDuration) * time.Millisecond
+}
+
+// Stats returns the last progress reported by ffmpeg
+func (t *Transcoder) Stats() Stats {
+	t.statsMu.RLock()
+	defer t.statsMu.RUnlock()
+
+	return t.stats
 }
 
+// Stop kills the ffmpeg process and stops the restarts, if the transcoder is not started yet it will never start
 func (t *Transcoder) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	close(t.stopCh)
+
+	if t.commandExec == nil || t.commandExec.Process == nil {
+		return
+	}
+
 	err := t.commandExec.Process.Kill()
-	if err != nil {
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
 		logger.Errorf("transcoder error while being killed: %s", err)
 	}
 }
+
+func (t *Transcoder) isStopped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stopped
+}
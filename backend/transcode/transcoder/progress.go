@@ -0,0 +1,150 @@
+package transcoder
+
+import (
+	"bufio"
+	"io"
+	"sen1or/lets-live/pkg/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// below this speed ffmpeg can't keep up with the incoming stream
+	behindRealTimeSpeed = 0.95
+	// how many progress reports in a row must be behind before we warn, ffmpeg reports every 0.5s
+	behindRealTimeReports = 10
+
+	stderrTailSize = 10
+)
+
+var ffmpegLogLevels = map[string]bool{
+	"panic": true, "fatal": true, "error": true, "warning": true,
+	"info": true, "verbose": true, "debug": true, "trace": true,
+}
+
+// Stats is the latest progress reported by ffmpeg through -progress
+type Stats struct {
+	Frame          int64         `json:"frame"`
+	FPS            float64       `json:"fps"`
+	Bitrate        float64       `json:"bitrate"` // kbits/s
+	Speed          float64       `json:"speed"`   // 1 means real time
+	DupFrames      int64         `json:"dupFrames"`
+	DropFrames     int64         `json:"dropFrames"`
+	OutTime        time.Duration `json:"outTime"`
+	BehindRealTime bool          `json:"behindRealTime"`
+	UpdatedAt      time.Time     `json:"updatedAt"`
+}
+
+// readProgress parses the key=value blocks written by ffmpeg, each block ends with a "progress" key
+func (t *Transcoder) readProgress(r io.Reader, publishName string) {
+	var current Stats
+	var behindCount int
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "frame":
+			current.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			current.FPS, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			current.Bitrate, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+		case "speed":
+			current.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "dup_frames":
+			current.DupFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "drop_frames":
+			current.DropFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				current.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "progress":
+			if current.Speed > 0 && current.Speed < behindRealTimeSpeed {
+				behindCount++
+			} else {
+				behindCount = 0
+			}
+
+			wasBehind := t.Stats().BehindRealTime
+			current.BehindRealTime = behindCount >= behindRealTimeReports
+			current.UpdatedAt = time.Now()
+
+			if current.BehindRealTime && !wasBehind {
+				logger.Warnw("transcoder is falling behind real time", "publishName", publishName, "speed", current.Speed, "fps", current.FPS, "dropFrames", current.DropFrames)
+			} else if !current.BehindRealTime && wasBehind {
+				logger.Infow("transcoder caught up with real time", "publishName", publishName, "speed", current.Speed)
+			}
+
+			t.statsMu.Lock()
+			t.stats = current
+			t.statsMu.Unlock()
+		}
+	}
+}
+
+// logStderr forwards ffmpeg logs (started with -loglevel level+...) to our logger
+// the last lines are kept to explain why ffmpeg exited
+func (t *Transcoder) logStderr(r io.Reader, publishName string) []string {
+	tail := make([]string, 0, stderrTailSize)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		if len(tail) == stderrTailSize {
+			tail = tail[1:]
+		}
+		tail = append(tail, line)
+
+		level, message := parseLogLine(line)
+		switch level {
+		case "panic", "fatal", "error":
+			logger.Errorw("ffmpeg: "+message, "publishName", publishName)
+		case "warning":
+			logger.Warnw("ffmpeg: "+message, "publishName", publishName)
+		case "verbose", "debug", "trace":
+			logger.Debugw("ffmpeg: "+message, "publishName", publishName)
+		default:
+			logger.Infow("ffmpeg: "+message, "publishName", publishName)
+		}
+	}
+
+	return tail
+}
+
+// parseLogLine splits a line of ffmpeg started with -loglevel level+...: the contexts of the message come first,
+// then its level, ex: "[hls @ 0x55d] [warning] message", the message keeps the contexts
+// a line without level (a continuation, or a banner) is info
+func parseLogLine(line string) (string, string) {
+	rest := line
+	for strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "] ")
+		if end == -1 {
+			break
+		}
+
+		tag := rest[1:end]
+		after := rest[end+2:]
+		if ffmpegLogLevels[tag] {
+			return tag, line[:len(line)-len(rest)] + after
+		}
+
+		// only the contexts ("[name @ 0x...]") come before the level
+		if !strings.Contains(tag, " @ ") {
+			break
+		}
+		rest = after
+	}
+
+	return "info", line
+}
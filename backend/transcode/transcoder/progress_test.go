@@ -0,0 +1,92 @@
+package transcoder
+
+import (
+	"fmt"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func progressBlock(speed string) string {
+	return "frame=120\nfps=30.00\nbitrate=2500.5kbits/s\ndup_frames=1\ndrop_frames=2\nout_time_us=4000000\nspeed=" + speed + "\nprogress=continue\n"
+}
+
+func TestReadProgress(t *testing.T) {
+	logger.Init(logger.Debug)
+	transcoder := NewTranscoder(config.Config{})
+
+	transcoder.readProgress(strings.NewReader(progressBlock("1.01x")), "user")
+
+	stats := transcoder.Stats()
+	assert.Equal(t, int64(120), stats.Frame)
+	assert.Equal(t, 30.0, stats.FPS)
+	assert.Equal(t, 2500.5, stats.Bitrate)
+	assert.Equal(t, 1.01, stats.Speed)
+	assert.Equal(t, int64(1), stats.DupFrames)
+	assert.Equal(t, int64(2), stats.DropFrames)
+	assert.Equal(t, 4*time.Second, stats.OutTime)
+	assert.False(t, stats.BehindRealTime)
+	assert.False(t, stats.UpdatedAt.IsZero())
+}
+
+func TestReadProgress_BehindRealTime(t *testing.T) {
+	logger.Init(logger.Debug)
+	transcoder := NewTranscoder(config.Config{})
+
+	// one report short of being behind
+	slow := strings.Repeat(progressBlock("0.5x"), behindRealTimeReports-1)
+	transcoder.readProgress(strings.NewReader(slow), "user")
+	assert.False(t, transcoder.Stats().BehindRealTime)
+
+	// the count starts over with every reader, a report at real time resets it
+	transcoder.readProgress(strings.NewReader(slow+progressBlock("1x")+slow), "user")
+	assert.False(t, transcoder.Stats().BehindRealTime)
+
+	transcoder.readProgress(strings.NewReader(slow+progressBlock("0.9x")), "user")
+	assert.True(t, transcoder.Stats().BehindRealTime)
+
+	transcoder.readProgress(strings.NewReader(progressBlock("1x")), "user")
+	assert.False(t, transcoder.Stats().BehindRealTime)
+}
+
+func TestLogStderr_KeepsTheTail(t *testing.T) {
+	logger.Init(logger.Debug)
+	transcoder := NewTranscoder(config.Config{})
+
+	var b strings.Builder
+	for i := 0; i < stderrTailSize+5; i++ {
+		fmt.Fprintf(&b, "[info] line %d\n\n", i)
+	}
+
+	tail := transcoder.logStderr(strings.NewReader(b.String()), "user")
+	assert.Len(t, tail, stderrTailSize)
+	assert.Equal(t, "[info] line 5", tail[0])
+	assert.Equal(t, fmt.Sprintf("[info] line %d", stderrTailSize+4), tail[len(tail)-1])
+}
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		wantLevel   string
+		wantMessage string
+	}{
+		{line: "[warning] Past duration too large", wantLevel: "warning", wantMessage: "Past duration too large"},
+		{line: "[hls @ 0x55d] [error] Failed to open file", wantLevel: "error", wantMessage: "[hls @ 0x55d] Failed to open file"},
+		{line: "[out#0/hls @ 0x1] [mpegts @ 0x2] [verbose] muxer", wantLevel: "verbose", wantMessage: "[out#0/hls @ 0x1] [mpegts @ 0x2] muxer"},
+		// the brackets of the message are not the level
+		{line: "[hls @ 0x55d] [info] Opening 'stream[1] ' for writing", wantLevel: "info", wantMessage: "[hls @ 0x55d] Opening 'stream[1] ' for writing"},
+		{line: "[debug] skipped [error] frame", wantLevel: "debug", wantMessage: "skipped [error] frame"},
+		{line: "[stream] [error] no context", wantLevel: "info", wantMessage: "[stream] [error] no context"},
+		{line: "  Stream #0:0: Video: h264", wantLevel: "info", wantMessage: "  Stream #0:0: Video: h264"},
+	}
+
+	for _, tt := range tests {
+		level, message := parseLogLine(tt.line)
+		assert.Equal(t, tt.wantLevel, level, tt.line)
+		assert.Equal(t, tt.wantMessage, message, tt.line)
+	}
+}
@@ -0,0 +1,10 @@
+package transcoder
+
+// SourceInfo is what the ingest protocol knows about the incoming video, zero values are unknown
+type SourceInfo struct {
+	VideoCodec   string  `json:"videoCodec"` // "h264", "vp8"...
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	FPS          float64 `json:"fps"`
+	VideoBitrate int     `json:"videoBitrate"` // kbits/s
+}
@@ -0,0 +1,103 @@
+package watcher
+
+import (
+	"sen1or/lets-live/transcode/domains"
+	"sen1or/lets-live/transcode/m3u8"
+	"time"
+)
+
+// in dvr mode the public playlist is not a rewrite of the local one (its window is the hls list size),
+// every uploaded segment goes into the dvr window of the variant and stays listed until it is older than the window
+
+// GenerateDVRPlaylist adds the new uploaded segments of the local playlist to the dvr window of the variant
+// and renders the public playlist
+func GenerateDVRPlaylist(playlistPath string, variant *domains.HLSVariant, window time.Duration) (string, error) {
+	local, err := readMediaPlaylist(playlistPath)
+	if err != nil {
+		return "", err
+	}
+
+	lastSequence := -1
+	if len(variant.DVRSegments) > 0 {
+		lastSequence = variant.DVRSegments[len(variant.DVRSegments)-1].Sequence
+	}
+
+	resolve := remoteResolver(*variant)
+	var currentMap *m3u8.Map
+	for index, segment := range local.Segments {
+		if segment.Map != nil {
+			currentMap = segment.Map
+		}
+
+		sequence := local.MediaSequence + index
+		if sequence <= lastSequence {
+			continue
+		}
+
+		// the segment is not uploaded yet, it (and the ones after) are added with the next playlist
+		origin := variant.GetSegmentByFilename(segment.URI)
+		uri, ok := resolve(segment.URI)
+		if !ok || origin == nil {
+			break
+		}
+
+		segment.URI = uri
+		// the first segment of the window carries the init section
+		if segment.Map != nil || (len(variant.DVRSegments) == 0 && currentMap != nil) {
+			mapURI, ok := resolve(currentMap.URI)
+			if !ok {
+				break
+			}
+			segment.Map = &m3u8.Map{URI: mapURI, ByteRange: currentMap.ByteRange}
+		}
+
+		variant.DVRSegments = append(variant.DVRSegments, domains.DVRSegment{
+			Sequence: sequence,
+			Segment:  segment,
+			Origin:   *origin,
+		})
+	}
+
+	trimDVRWindow(variant, window)
+
+	playlist := &m3u8.MediaPlaylist{
+		Header:                local.Header,
+		TargetDuration:        local.TargetDuration,
+		MediaSequence:         local.MediaSequence,
+		DiscontinuitySequence: variant.DVRDiscontinuitySequence,
+		EndList:               local.EndList,
+	}
+	for _, segment := range variant.DVRSegments {
+		playlist.Segments = append(playlist.Segments, segment.Segment)
+	}
+	if len(variant.DVRSegments) > 0 {
+		playlist.MediaSequence = variant.DVRSegments[0].Sequence
+	}
+	// the target duration must hold the longest segment of the whole window, not only the live one
+	playlist.TargetDuration = max(playlist.TargetDuration, playlist.LongestSegment())
+
+	return string(playlist.Encode()), nil
+}
+
+// drop the oldest segments until the window holds at most the configured duration
+func trimDVRWindow(variant *domains.HLSVariant, window time.Duration) {
+	var total float64
+	for _, segment := range variant.DVRSegments {
+		total += segment.Duration
+	}
+
+	for len(variant.DVRSegments) > 1 && total-variant.DVRSegments[0].Duration >= window.Seconds() {
+		oldest := variant.DVRSegments[0]
+		if oldest.Discontinuity {
+			variant.DVRDiscontinuitySequence++
+		}
+
+		total -= oldest.Duration
+		variant.DVRSegments = variant.DVRSegments[1:]
+
+		// the init section moves to the new first segment
+		if oldest.Map != nil && variant.DVRSegments[0].Map == nil {
+			variant.DVRSegments[0].Map = oldest.Map
+		}
+	}
+}
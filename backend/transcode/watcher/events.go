@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"strconv"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ffmpeg writes the playlists to a temporary file then renames it (temp_file flag), and a segment is only listed once it is
+// fully written, so a playlist event is the signal the new segments are complete, the segments events are not needed
+
+const masterVariantIndex = -1
+
+// playlistEvent is a playlist (re)written by ffmpeg, the variant index is masterVariantIndex for the master playlist
+type playlistEvent struct {
+	publishName  string
+	variantIndex int
+	path         string
+}
+
+// parsePlaylistPath finds the stream of a playlist from its path, <root>/<publish>/<master> or <root>/<publish>/<variant>/<playlist>
+func parsePlaylistPath(root string, filePath string) (playlistEvent, bool) {
+	if filepath.Ext(filePath) != ".m3u8" {
+		return playlistEvent{}, false
+	}
+
+	relativePath, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return playlistEvent{}, false
+	}
+
+	components := strings.Split(filepath.ToSlash(relativePath), "/")
+	switch len(components) {
+	case 2:
+		return playlistEvent{publishName: components[0], variantIndex: masterVariantIndex, path: filePath}, true
+	case 3:
+		variantIndex, err := strconv.Atoi(components[1])
+		if err != nil || variantIndex < 0 {
+			return playlistEvent{}, false
+		}
+
+		return playlistEvent{publishName: components[0], variantIndex: variantIndex, path: filePath}, true
+	}
+
+	return playlistEvent{}, false
+}
+
+// watchPlaylists sends the playlist events under root until the watcher fails to start
+// inotify is not recursive, the publish and variant folders are added as they are created
+func watchPlaylists(root string, events chan<- playlistEvent) error {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsWatcher.Close()
+
+	if err := addDirectory(fsWatcher, root, root, events); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := addDirectory(fsWatcher, root, event.Name, events); err != nil {
+						logger.Errorw("failed to watch folder", "path", event.Name, "error", err.Error())
+					}
+					continue
+				}
+			}
+
+			if playlist, ok := parsePlaylistPath(root, event.Name); ok {
+				events <- playlist
+			}
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Errorf("something failed while running watcher: %s", err)
+		}
+	}
+}
+
+// addDirectory watches the folder and its sub folders, the playlists written before the watch was added are sent right away
+func addDirectory(fsWatcher *fsnotify.Watcher, root string, dir string, events chan<- playlistEvent) error {
+	if err := fsWatcher.Add(dir); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := addDirectory(fsWatcher, root, entryPath, events); err != nil {
+				return err
+			}
+		} else if playlist, ok := parsePlaylistPath(root, entryPath); ok {
+			events <- playlist
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package watcher
+
+import (
+	"strconv"
+	"sync"
+)
+
+// playlistQueue hands the playlist events to the workers, the events of a variant are never handled at the same time
+// and a playlist rewritten while its previous event is waiting replaces it, the newest playlist lists every segment to upload
+type playlistQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string]playlistEvent // the newest event of a key, not handled yet
+	running map[string]bool
+	ready   []string // keys with a pending event and no running worker, oldest first
+}
+
+func newPlaylistQueue() *playlistQueue {
+	q := &playlistQueue{
+		pending: make(map[string]playlistEvent),
+		running: make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+func (e playlistEvent) key() string {
+	return e.publishName + "/" + strconv.Itoa(e.variantIndex)
+}
+
+func (q *playlistQueue) push(event playlistEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := event.key()
+	_, waiting := q.pending[key]
+	q.pending[key] = event
+	if waiting || q.running[key] {
+		return
+	}
+
+	q.ready = append(q.ready, key)
+	q.cond.Signal()
+}
+
+// pop blocks until an event can be handled, done must be called once it is
+func (q *playlistQueue) pop() playlistEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.ready) == 0 {
+		q.cond.Wait()
+	}
+
+	key := q.ready[0]
+	q.ready = q.ready[1:]
+	event := q.pending[key]
+	delete(q.pending, key)
+	q.running[key] = true
+
+	return event
+}
+
+func (q *playlistQueue) done(event playlistEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := event.key()
+	delete(q.running, key)
+	if _, waiting := q.pending[key]; waiting {
+		q.ready = append(q.ready, key)
+		q.cond.Signal()
+	}
+}
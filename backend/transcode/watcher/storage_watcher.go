@@ -0,0 +1,392 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/dash"
+	"sen1or/lets-live/transcode/domains"
+	"sen1or/lets-live/transcode/storage"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StorageWatcher uploads the segments written by ffmpeg to the configured storage (ipfs, local or s3)
+// and publishes the playlists rewritten with the storage urls, a segment that can't be uploaded is served by the webserver
+type StorageWatcher struct {
+	monitorPath string
+	storage     storage.Storage
+	config      config.Config
+	streams     *StreamStore
+
+	// the dash manifest of each live publish
+	manifestsMu sync.Mutex
+	manifests   map[string]*dash.Generator
+
+	workers        int
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+const (
+	defaultUploadWorkers        = 4
+	defaultUploadMaxAttempts    = 3
+	defaultUploadInitialBackoff = 500 * time.Millisecond
+)
+
+func NewStorageWatcher(monitorPath string, remoteStorage storage.Storage, config config.Config) *StorageWatcher {
+	upload := config.Transcode.Upload
+	w := &StorageWatcher{
+		monitorPath:    monitorPath,
+		storage:        remoteStorage,
+		config:         config,
+		streams:        NewStreamStore(config.Transcode.FFMpegSetting.HlsMaxSize),
+		manifests:      make(map[string]*dash.Generator),
+		workers:        upload.Workers,
+		maxAttempts:    upload.MaxAttempts,
+		initialBackoff: time.Duration(upload.InitialBackoff) * time.Millisecond,
+	}
+	if w.workers <= 0 {
+		w.workers = defaultUploadWorkers
+	}
+	if w.maxAttempts <= 0 {
+		w.maxAttempts = defaultUploadMaxAttempts
+	}
+	if w.initialBackoff <= 0 {
+		w.initialBackoff = defaultUploadInitialBackoff
+	}
+
+	// the segments are deleted once they leave the playlists, the dvr window is longer than the store and trims its own
+	w.streams.OnEvict(func(segment domains.HLSSegment) {
+		if !config.Transcode.DVR.Enabled {
+			w.deleteSegment(segment)
+		}
+	})
+
+	return w
+}
+
+// PublishStarted resets the state of the stream, it must be called before ffmpeg writes anything
+// the stream has a variant per configured quality until LadderSelected tells which ones ffmpeg encodes
+func (w *StorageWatcher) PublishStarted(publishName string) {
+	w.streams.Create(publishName, len(w.config.Transcode.FFMpegSetting.Qualities))
+
+	publicPath := filepath.Join(w.config.Transcode.PublicHLSPath, publishName)
+	if err := os.MkdirAll(publicPath, os.ModePerm); err != nil {
+		logger.Errorw("failed to create publish folder", "path", publicPath, "error", err.Error())
+	}
+
+	if w.config.Transcode.DASH.Enabled {
+		w.manifestsMu.Lock()
+		w.manifests[publishName] = dash.NewGenerator(publicPath, filepath.Join(w.monitorPath, publishName), dash.NewOptions(w.config.Transcode.FFMpegSetting))
+		w.manifestsMu.Unlock()
+	}
+}
+
+// LadderSelected sizes the stream for the renditions ffmpeg encodes, it is called before ffmpeg writes anything
+func (w *StorageWatcher) LadderSelected(publishName string, ladder []config.Quality) {
+	w.streams.Create(publishName, len(ladder))
+}
+
+// PublishEnded drops the state of the stream, the files written after that are ignored
+// the segments still listed are deleted once the viewers can't reach them anymore
+func (w *StorageWatcher) PublishEnded(publishName string) {
+	w.manifestsMu.Lock()
+	delete(w.manifests, publishName)
+	w.manifestsMu.Unlock()
+
+	stream := w.streams.Remove(publishName)
+	if stream == nil {
+		return
+	}
+
+	// the init files expire with the segments from now on
+	for _, variant := range stream.Variants {
+		if variant.Init != nil {
+			w.release(*variant.Init)
+		}
+	}
+
+	time.AfterFunc(w.config.LiveWindow(), func() {
+		for _, segment := range listedSegments(stream) {
+			w.deleteSegment(segment)
+		}
+	})
+}
+
+// Watch handles the playlists with a pool of workers, the variants are handled in parallel but a variant by one worker at a time
+// the segments of a variant playlist are uploaded, in order, before it is rewritten
+func (w *StorageWatcher) Watch() {
+	events := make(chan playlistEvent, 64)
+	queue := newPlaylistQueue()
+
+	go func() {
+		for event := range events {
+			queue.push(event)
+		}
+	}()
+
+	for i := 0; i < w.workers; i++ {
+		go func() {
+			for {
+				event := queue.pop()
+				w.handlePlaylist(event)
+				queue.done(event)
+			}
+		}()
+	}
+
+	if err := watchPlaylists(w.monitorPath, events); err != nil {
+		logger.Panicw("error while setting up watcher", "error", err.Error())
+	}
+}
+
+func (w *StorageWatcher) handlePlaylist(event playlistEvent) {
+	if event.variantIndex == masterVariantIndex {
+		if event.path != filepath.Join(w.monitorPath, event.publishName, w.config.Transcode.FFMpegSetting.MasterFileName) {
+			return
+		}
+
+		if err := copy(event.path, filepath.Join(w.config.Transcode.PublicHLSPath, event.publishName, w.config.Transcode.FFMpegSetting.MasterFileName)); err != nil {
+			logger.Errorw("failed to copy master file", "error", err.Error())
+		}
+		return
+	}
+
+	if err := w.uploadListedSegments(event); errors.Is(err, ErrUnknownStream) {
+		// written after the publish ended
+		return
+	} else if err != nil {
+		logger.Errorw("failed to upload segments", "path", event.path, "error", err.Error())
+		return
+	}
+
+	var newPlaylist string
+	var dropped []domains.DVRSegment
+	err := w.streams.UpdateVariant(event.publishName, event.variantIndex, func(variant *domains.HLSVariant) error {
+		var err error
+		if w.config.Transcode.DVR.Enabled {
+			window := variant.DVRSegments
+			newPlaylist, err = GenerateDVRPlaylist(event.path, variant, time.Duration(w.config.Transcode.DVR.Window)*time.Second)
+			for _, segment := range window {
+				if len(variant.DVRSegments) == 0 || segment.Sequence < variant.DVRSegments[0].Sequence {
+					dropped = append(dropped, segment)
+				}
+			}
+		} else {
+			newPlaylist, err = generateRemotePlaylist(event.path, *variant)
+		}
+		return err
+	})
+	if errors.Is(err, ErrUnknownStream) {
+		return
+	} else if err != nil {
+		logger.Errorw("error generating remote playlist", "path", event.path, "error", err.Error())
+		return
+	}
+
+	publicDir := filepath.Join(w.config.Transcode.PublicHLSPath, event.publishName, strconv.Itoa(event.variantIndex))
+	if err := writePlaylist(newPlaylist, filepath.Join(publicDir, filepath.Base(event.path))); err != nil {
+		logger.Errorw("failed to write remote playlist", "path", filepath.Join(publicDir, filepath.Base(event.path)), "error", err.Error())
+		return
+	}
+
+	for _, segment := range dropped {
+		w.deleteSegment(segment.Origin)
+	}
+
+	// the mpd lists the same storage urls as the rewritten playlists
+	w.manifestsMu.Lock()
+	generator := w.manifests[event.publishName]
+	w.manifestsMu.Unlock()
+	if generator != nil {
+		if err := generator.Generate(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Errorw("failed to generate dash manifest", "publishName", event.publishName, "error", err.Error())
+		}
+	}
+}
+
+// uploadListedSegments uploads the files of the playlist that are not uploaded yet, in playlist order
+func (w *StorageWatcher) uploadListedSegments(event playlistEvent) error {
+	fileNames, err := listedFiles(event.path)
+	if err != nil {
+		return err
+	}
+
+	variantDir := filepath.Dir(event.path)
+	for _, fileName := range fileNames {
+		uploaded := false
+		err := w.streams.UpdateVariant(event.publishName, event.variantIndex, func(variant *domains.HLSVariant) error {
+			uploaded = variant.GetSegmentByFilename(fileName) != nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if uploaded {
+			continue
+		}
+
+		localPath := filepath.Join(variantDir, fileName)
+		if _, err := os.Stat(localPath); errors.Is(err, os.ErrNotExist) {
+			// deleted by ffmpeg before we caught up, the playlist lists it as missing until it leaves the window
+			logger.Warnw("listed segment is already deleted", "path", localPath)
+			continue
+		}
+
+		segment := domains.HLSSegment{
+			PublishName:        event.publishName,
+			VariantIndex:       event.variantIndex,
+			FullLocalPath:      localPath,
+			RelativeRemotePath: filepath.Join(strconv.Itoa(event.variantIndex), fileName),
+		}
+
+		segment.RemoteId, err = w.upload(segment.FullLocalPath)
+		if err == nil {
+			segment.RemoteURL = w.storage.PublicURL(segment.RemoteId)
+			// the init file is uploaded once and listed until the end of the stream
+			if filepath.Ext(fileName) == ".mp4" {
+				w.hold(segment)
+			}
+		} else {
+			// the playlist must not point at a missing object, the webserver serves the segment instead
+			logger.Errorw("failed to upload segment, serving it locally", "path", segment.FullLocalPath, "error", err.Error())
+			if err := linkOrCopy(segment.FullLocalPath, w.publicSegmentPath(segment)); err != nil {
+				return fmt.Errorf("failed to serve %s locally: %s", segment.FullLocalPath, err)
+			}
+			segment.Local = true
+			segment.PublicFile, _ = os.Stat(w.publicSegmentPath(segment))
+		}
+
+		if err := w.streams.AddSegment(segment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upload tries the storage with an exponential backoff between the attempts
+func (w *StorageWatcher) upload(filePath string) (string, error) {
+	// if there is no remote storage method available, the segments are served locally
+	if w.storage == nil {
+		return "", fmt.Errorf("no storage")
+	}
+
+	backoff := w.initialBackoff
+	for attempt := 1; ; attempt++ {
+		remoteId, err := w.storage.AddFile(filePath)
+		if err == nil {
+			logger.Infof("saved segment with id: %s", remoteId)
+			return remoteId, nil
+		}
+
+		if attempt >= w.maxAttempts {
+			return "", fmt.Errorf("gave up after %d attempts: %s", attempt, err)
+		}
+
+		logger.Warnw("failed to upload segment, retrying", "path", filePath, "attempt", attempt, "backoff", backoff.String(), "error", err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// deleteSegment removes a segment no playlist lists anymore, from the public folder if it is served locally
+// the init files are never deleted, the storages name the objects after their content and every stream shares them
+func (w *StorageWatcher) deleteSegment(segment domains.HLSSegment) {
+	if segment.Local {
+		publicPath := w.publicSegmentPath(segment)
+		// the publish ended and the user published again, the file is a segment of the new publish
+		if current, err := os.Stat(publicPath); err != nil || !sameFile(segment.PublicFile, current) {
+			return
+		}
+		os.Remove(publicPath)
+		return
+	}
+
+	if w.storage == nil || len(segment.RemoteId) == 0 {
+		return
+	}
+
+	go func() {
+		if err := w.storage.Delete(segment.RemoteId); err != nil {
+			logger.Warnw("failed to delete segment from the storage", "id", segment.RemoteId, "error", err.Error())
+		}
+	}()
+}
+
+// hold keeps an uploaded file from expiring on the storages that expire the files by themselves
+func (w *StorageWatcher) hold(segment domains.HLSSegment) {
+	if holder, ok := w.storage.(storage.Holder); ok {
+		if err := holder.Hold(segment.RemoteId); err != nil {
+			logger.Warnw("failed to hold file on the storage", "id", segment.RemoteId, "error", err.Error())
+		}
+	}
+}
+
+func (w *StorageWatcher) release(segment domains.HLSSegment) {
+	if segment.Local || len(segment.RemoteId) == 0 {
+		return
+	}
+
+	if holder, ok := w.storage.(storage.Holder); ok {
+		if err := holder.Release(segment.RemoteId); err != nil {
+			logger.Warnw("failed to release file on the storage", "id", segment.RemoteId, "error", err.Error())
+		}
+	}
+}
+
+// sameFile tells if the file was not replaced since it was linked, the inode of a removed file may be reused
+func sameFile(linked os.FileInfo, current os.FileInfo) bool {
+	return linked != nil && os.SameFile(linked, current) && linked.ModTime().Equal(current.ModTime())
+}
+
+// listedSegments returns the segments of the stream that may still be in a playlist, once each
+func listedSegments(stream *domains.HLSStream) []domains.HLSSegment {
+	seen := make(map[string]bool)
+	var segments []domains.HLSSegment
+	add := func(segment domains.HLSSegment) {
+		if !seen[segment.FullLocalPath] {
+			seen[segment.FullLocalPath] = true
+			segments = append(segments, segment)
+		}
+	}
+
+	for _, variant := range stream.Variants {
+		for _, segment := range variant.DVRSegments {
+			add(segment.Origin)
+		}
+		for _, segment := range variant.Segments {
+			add(segment)
+		}
+	}
+
+	return segments
+}
+
+// the path of a segment next to its public playlist
+func (w *StorageWatcher) publicSegmentPath(segment domains.HLSSegment) string {
+	return filepath.Join(w.config.Transcode.PublicHLSPath, segment.PublishName, strconv.Itoa(segment.VariantIndex), filepath.Base(segment.FullLocalPath))
+}
+
+// listedFiles returns the init files and the segments of a playlist, in playlist order
+func listedFiles(playlistPath string) ([]string, error) {
+	playlist, err := readMediaPlaylist(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileNames []string
+	for _, segment := range playlist.Segments {
+		if segment.Map != nil {
+			fileNames = append(fileNames, segment.Map.URI)
+		}
+		fileNames = append(fileNames, segment.URI)
+	}
+
+	return fileNames, nil
+}
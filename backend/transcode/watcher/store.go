@@ -0,0 +1,131 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sen1or/lets-live/transcode/domains"
+	"sync"
+)
+
+var ErrUnknownStream = errors.New("unknown stream")
+
+// StreamStore keeps the uploaded segments of the live streams, keyed by publish name, it is safe for concurrent use
+// a stream is created when its publish starts and removed when it ends, segments of unknown streams are refused
+type StreamStore struct {
+	mu      sync.Mutex
+	streams map[string]*domains.HLSStream
+	// segments kept per variant, older ones are deleted by ffmpeg and can't be in a playlist anymore
+	maxSegments int
+	onEvict     func(segment domains.HLSSegment)
+}
+
+func NewStreamStore(maxSegments int) *StreamStore {
+	return &StreamStore{
+		streams:     make(map[string]*domains.HLSStream),
+		maxSegments: maxSegments,
+	}
+}
+
+// Create starts a new stream, the state of a previous publish with the same name is dropped
+func (s *StreamStore) Create(publishName string, variantCount int) {
+	variants := make([]domains.HLSVariant, variantCount)
+	for index := range variants {
+		variants[index] = domains.HLSVariant{
+			VariantIndex: uint8(index),
+			Segments:     make([]domains.HLSSegment, 0),
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streams[publishName] = &domains.HLSStream{
+		PublishName: publishName,
+		Variants:    variants,
+	}
+}
+
+// Remove drops the stream and returns it, nil if it is unknown
+func (s *StreamStore) Remove(publishName string) *domains.HLSStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream := s.streams[publishName]
+	delete(s.streams, publishName)
+	return stream
+}
+
+func (s *StreamStore) Has(publishName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.streams[publishName]
+	return ok
+}
+
+// Len returns the number of streams
+func (s *StreamStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+// OnEvict sets the function called with the segments evicted by AddSegment, outside of the lock
+func (s *StreamStore) OnEvict(fn func(segment domains.HLSSegment)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onEvict = fn
+}
+
+// AddSegment records an uploaded segment, the oldest segments of the variant are evicted past the max segments
+// the fmp4 init file is kept apart, it is never evicted
+func (s *StreamStore) AddSegment(segment domains.HLSSegment) error {
+	var evicted []domains.HLSSegment
+	var onEvict func(segment domains.HLSSegment)
+
+	err := s.UpdateVariant(segment.PublishName, segment.VariantIndex, func(variant *domains.HLSVariant) error {
+		if filepath.Ext(segment.FullLocalPath) == ".mp4" {
+			variant.Init = &segment
+			return nil
+		}
+
+		variant.Segments = append(variant.Segments, segment)
+		if s.maxSegments > 0 && len(variant.Segments) > s.maxSegments {
+			cut := len(variant.Segments) - s.maxSegments
+			evicted = variant.Segments[:cut]
+			// copy so the evicted segments can be garbage collected
+			variant.Segments = append([]domains.HLSSegment(nil), variant.Segments[cut:]...)
+		}
+
+		onEvict = s.onEvict
+		return nil
+	})
+
+	if onEvict != nil {
+		for _, segment := range evicted {
+			onEvict(segment)
+		}
+	}
+
+	return err
+}
+
+// UpdateVariant runs fn with the variant while holding the lock, fn must not keep the pointer
+func (s *StreamStore) UpdateVariant(publishName string, variantIndex int, fn func(variant *domains.HLSVariant) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[publishName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownStream, publishName)
+	}
+
+	if variantIndex < 0 || variantIndex >= len(stream.Variants) {
+		return fmt.Errorf("invalid variant index %d for stream %s", variantIndex, publishName)
+	}
+
+	return fn(&stream.Variants[variantIndex])
+}
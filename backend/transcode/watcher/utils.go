@@ -1,39 +1,61 @@
 package watcher
 
 import (
-	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sen1or/lets-live/transcode/domains"
+	"sen1or/lets-live/transcode/m3u8"
 )
 
 // rewrite the local playlist to point to remote resources
 func generateRemotePlaylist(playlistPath string, variant domains.HLSVariant) (string, error) {
+	playlist, err := readMediaPlaylist(playlistPath)
+	if err != nil {
+		return "", err
+	}
+
+	playlist.Rewrite(remoteResolver(variant))
+	return string(playlist.Encode()), nil
+}
+
+func readMediaPlaylist(playlistPath string) (*m3u8.MediaPlaylist, error) {
 	file, err := os.Open(playlistPath)
 	if err != nil {
-		return "", fmt.Errorf("can't open playlist %s: %s", playlistPath, err)
+		return nil, fmt.Errorf("can't open playlist %s: %s", playlistPath, err)
 	}
 	defer file.Close()
 
-	var newPlaylist string = ""
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line[0] != '#' {
-			segment := variant.GetSegmentByFilename(line)
-			if segment == nil || segment.FullLocalPath == "" {
-				line = ""
-			} else {
-				// adding fileName allow players to know the file is .ts instead of just file cid
-				line = fmt.Sprintf("%s?fileName=%s", segment.IPFSRemoteId, filepath.Base(segment.FullLocalPath))
-			}
-		}
-
-		newPlaylist = newPlaylist + line + "\n"
+	playlist, err := m3u8.ParseMedia(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read playlist %s: %s", playlistPath, err)
+	}
+
+	return playlist, nil
+}
+
+// remoteResolver rewrites the uris of the variant playlist, the segments not uploaded yet can't be
+func remoteResolver(variant domains.HLSVariant) func(uri string) (string, bool) {
+	return func(uri string) (string, bool) {
+		remoteURI := remoteSegmentURI(uri, variant)
+		return remoteURI, len(remoteURI) > 0
+	}
+}
+
+// the remote uri of a local segment, empty if it is not uploaded yet
+func remoteSegmentURI(fileName string, variant domains.HLSVariant) string {
+	segment := variant.GetSegmentByFilename(fileName)
+	if segment == nil || segment.FullLocalPath == "" {
+		return ""
 	}
 
-	return newPlaylist, nil
+	// relative to the public playlist
+	if segment.Local {
+		return filepath.Base(segment.FullLocalPath)
+	}
+
+	// adding fileName allow players (and the gateway) to know the file type (.ts, .m4s, .mp4) instead of just file cid
+	return fmt.Sprintf("%s?fileName=%s", segment.RemoteURL, filepath.Base(segment.FullLocalPath))
 }
 
 func copy(src, dst string) error {
@@ -50,23 +72,35 @@ func copy(src, dst string) error {
 	return nil
 }
 
-// write the playlist (memory) into file destination
+// hard link the file, ffmpeg deletes its segments, or copy it when the folders are on different file systems
+func linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	return copy(src, dst)
+}
+
+// write the playlist (memory) into file destination, through a temporary file so it is never served half written
 func writePlaylist(data string, filePath string) error {
 	parentDir := filepath.Dir(filePath)
 	if err := os.MkdirAll(parentDir, os.ModePerm); err != nil {
 		return fmt.Errorf("failed to create parent folder %s: %s", parentDir, err)
 	}
 
-	f, err := os.Create(filePath)
-	defer f.Close()
-
-	if err != nil {
-		return fmt.Errorf("failed to create file %s: %s", filePath, err)
-
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(data), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to write data into %s: %s", tmpPath, err)
 	}
-	_, err = f.WriteString(data)
-	if err != nil {
-		return fmt.Errorf("failed to write data into %s: %s", filePath, err)
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %s", filePath, err)
 	}
 
 	return nil
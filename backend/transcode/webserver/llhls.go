@@ -0,0 +1,204 @@
+package webserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/llhls"
+	"strconv"
+	"time"
+)
+
+const (
+	// how often the files written by ffmpeg are checked while a request is blocked
+	blockingPollInterval = 50 * time.Millisecond
+	// a blocked request must be answered before the write timeout of the server
+	maxBlockingDuration = 8 * time.Second
+)
+
+// EnableLowLatency serves the variant playlists as ll-hls, it must be called before ListenAndServe
+func (ws *WebServer) EnableLowLatency(options llhls.Options) {
+	ws.lowLatency = &options
+}
+
+// the longest a playlist or a preload hinted part request waits, the spec asks for 3 target durations
+func (ws *WebServer) blockingTimeout() time.Duration {
+	return min(3*time.Duration(ws.lowLatency.PartsPerSegment)*ws.lowLatency.PartDuration, maxBlockingDuration)
+}
+
+// serveLowLatency handles the ll-hls resources (playlists, parts, segments) and gives everything else to next
+func (ws *WebServer) serveLowLatency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath := path.Clean("/" + r.URL.Path)
+		name := path.Base(requestPath)
+		dir := filepath.Join(ws.BaseDirectory, filepath.FromSlash(path.Dir(requestPath)))
+
+		if name == llhls.PlaylistName {
+			ws.servePartPlaylist(w, r, dir)
+			return
+		}
+
+		if number, ok := llhls.ParseSegmentFileName(name); ok {
+			ws.serveSegment(w, dir, number)
+			return
+		}
+
+		if _, ok := llhls.ParsePartFileName(name); ok {
+			// the preload hinted part is requested before ffmpeg writes it
+			if !waitForFile(r, filepath.Join(dir, name), time.Now().Add(ws.blockingTimeout())) {
+				http.Error(w, "part not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve the ll-hls playlist, a request with _HLS_msn (and _HLS_part) waits until the playlist has it
+func (ws *WebServer) servePartPlaylist(w http.ResponseWriter, r *http.Request, dir string) {
+	msn, part, blocking, err := blockingRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deadline := time.Now().Add(ws.blockingTimeout())
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, llhls.PlaylistName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "playlist not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "can't read the playlist", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		playlist, err := llhls.ParsePartPlaylist(data)
+		if err != nil {
+			logger.Errorf("webserver: invalid part playlist in %s: %s", dir, err)
+			http.Error(w, "invalid playlist", http.StatusInternalServerError)
+			return
+		}
+
+		if !blocking || playlist.Ended || playlist.Has(*ws.lowLatency, msn, part) {
+			w.Header().Set("Content-Type", contentTypes[".m3u8"])
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(llhls.Render(playlist, *ws.lowLatency))
+			return
+		}
+
+		// the spec allows refusing requests too far in the future
+		if lastMsn, _, ok := playlist.LastPart(*ws.lowLatency); ok && msn > lastMsn+2 {
+			http.Error(w, "media sequence number too far in the future", http.StatusBadRequest)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			http.Error(w, "playlist update timed out", http.StatusServiceUnavailable)
+			return
+		}
+
+		select {
+		case <-time.After(blockingPollInterval):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// a segment is the concatenation of its parts as listed in the playlist, the last segment of an ended stream may miss some
+func (ws *WebServer) serveSegment(w http.ResponseWriter, dir string, number int) {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var names []string
+	if data, err := os.ReadFile(filepath.Join(dir, llhls.PlaylistName)); err == nil {
+		if playlist, err := llhls.ParsePartPlaylist(data); err == nil {
+			names = playlist.SegmentParts(*ws.lowLatency, number)
+		}
+	}
+
+	var size int64
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			break
+		}
+		files = append(files, file)
+
+		stat, err := file.Stat()
+		if err != nil {
+			http.Error(w, "can't get the file information!", http.StatusInternalServerError)
+			return
+		}
+		size += stat.Size()
+	}
+
+	if len(files) == 0 {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+
+	readers := make([]io.Reader, 0, len(files))
+	for _, file := range files {
+		readers = append(readers, file)
+	}
+
+	w.Header().Set("Content-Type", contentTypes[".m4s"])
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, io.MultiReader(readers...))
+}
+
+// read the blocking reload parameters, part is -1 if only the segment is asked
+func blockingRequest(query url.Values) (msn int, part int, blocking bool, err error) {
+	if !query.Has("_HLS_msn") {
+		if query.Has("_HLS_part") {
+			return 0, 0, false, errors.New("_HLS_part requires _HLS_msn")
+		}
+		return 0, -1, false, nil
+	}
+
+	msn, err = strconv.Atoi(query.Get("_HLS_msn"))
+	if err != nil || msn < 0 {
+		return 0, 0, false, errors.New("invalid _HLS_msn")
+	}
+
+	part = -1
+	if query.Has("_HLS_part") {
+		part, err = strconv.Atoi(query.Get("_HLS_part"))
+		if err != nil || part < 0 {
+			return 0, 0, false, errors.New("invalid _HLS_part")
+		}
+	}
+
+	return msn, part, true, nil
+}
+
+func waitForFile(r *http.Request, filePath string, deadline time.Time) bool {
+	for {
+		if _, err := os.Stat(filePath); err == nil {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		select {
+		case <-time.After(blockingPollInterval):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/session"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminServer serves the session endpoints, it listens apart from the public webserver so viewers can't reach them
+type AdminServer struct {
+	BindAddress    string
+	ListenPort     int
+	sessionManager *session.SessionManager
+}
+
+func NewAdminServer(bindAddress string, listenPort int, sessionManager *session.SessionManager) *AdminServer {
+	if len(bindAddress) == 0 {
+		bindAddress = "127.0.0.1"
+	}
+
+	return &AdminServer{
+		BindAddress:    bindAddress,
+		ListenPort:     listenPort,
+		sessionManager: sessionManager,
+	}
+}
+
+func (as *AdminServer) ListenAndServe() {
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/sessions", as.listSessions).Methods(http.MethodGet)
+	router.HandleFunc("/v1/sessions/{userId}", as.kickSession).Methods(http.MethodDelete)
+
+	server := &http.Server{
+		Addr:         fmt.Sprintf("%s:%d", as.BindAddress, as.ListenPort),
+		Handler:      router,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go (func() {
+		if err := server.ListenAndServe(); err != nil {
+			logger.Errorf("failed to start admin server: %s", err.Error())
+		}
+	})()
+
+	logger.Infow("admin server started", "address", server.Addr)
+}
+
+// list all the live sessions on this node
+func (as *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(as.sessionManager.List())
+}
+
+// forcibly end the live session of a user
+func (as *AdminServer) kickSession(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	if err := as.sessionManager.Kick(userId); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
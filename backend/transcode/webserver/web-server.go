@@ -2,11 +2,11 @@ package webserver
 
 import (
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/llhls"
 	"slices"
 	"strconv"
 	"strings"
@@ -15,10 +15,27 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// WriteTimeout is how long a handler has to answer, counted from the end of the request headers
+const WriteTimeout = 10 * time.Second
+
 type WebServer struct {
-	ListenPort      int
-	AllowedSuffixes []string
-	BaseDirectory   string
+	ListenPort        int
+	AllowedSuffixes   []string
+	BaseDirectory     string
+	routeHandlers     []func(router *mux.Router)
+	staticDirectories map[string]string // other directories served as is, by url prefix
+	lowLatency        *llhls.Options    // nil if the ll-hls mode is disabled
+}
+
+// the content types of the files written by the transcoder, go doesn't know most of them
+var contentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".mpd":  "application/dash+xml",
+	".jpg":  "image/jpeg",
+	".vtt":  "text/vtt",
 }
 
 func NewWebServer(listenPort int, allowedSuffixes []string, baseDirectory string) *WebServer {
@@ -73,33 +90,55 @@ func (ws *WebServer) serveFile(rw http.ResponseWriter, rq *http.Request) {
 		return
 	}
 
-	switch fileExtension {
-	case ".ts":
-		rw.Header().Set("Content-Type", "video/mp2t")
-	case ".m3u8":
-		rw.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-	default:
-		log.Fatal("File extension not supported!")
+	contentType, ok := contentTypes[fileExtension]
+	if !ok {
+		http.Error(rw, "file not supported!", http.StatusForbidden)
+		return
 	}
+	rw.Header().Set("Content-Type", contentType)
 
 	rw.Header().Set("Content-Length", strconv.FormatInt(fileStat.Size(), 10))
 	io.Copy(rw, file)
 }
 
+// AddRoutes lets other components (whip, ...) serve their endpoints on the webserver, it must be called before ListenAndServe
+func (ws *WebServer) AddRoutes(register func(router *mux.Router)) {
+	ws.routeHandlers = append(ws.routeHandlers, register)
+}
+
+// AddStaticDirectory serves the files of directory under prefix (/storage/), it must be called before ListenAndServe
+func (ws *WebServer) AddStaticDirectory(prefix string, directory string) {
+	if ws.staticDirectories == nil {
+		ws.staticDirectories = make(map[string]string)
+	}
+	ws.staticDirectories[prefix] = directory
+}
+
 func (ws *WebServer) ListenAndServe() {
 	router := mux.NewRouter()
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(ws.BaseDirectory))))
+	var staticHandler http.Handler = withContentType(http.FileServer(http.Dir(ws.BaseDirectory)))
+	if ws.lowLatency != nil {
+		staticHandler = ws.serveLowLatency(staticHandler)
+	}
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticHandler))
+	for prefix, directory := range ws.staticDirectories {
+		router.PathPrefix(prefix).Handler(http.StripPrefix(prefix, withContentType(http.FileServer(http.Dir(directory)))))
+	}
 	router.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	for _, register := range ws.routeHandlers {
+		register(router)
+	}
+
 	router.Use(corsMiddleware)
 
 	server := &http.Server{
 		Addr:         ":" + strconv.Itoa(ws.ListenPort),
 		Handler:      router,
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: WriteTimeout,
 	}
 
 	go (func() {
@@ -111,11 +150,23 @@ func (ws *WebServer) ListenAndServe() {
 	logger.Infow("web server started", "port", ws.ListenPort)
 }
 
+// set the content type from the extension before the file server guesses it
+func withContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType, ok := contentTypes[filepath.Ext(r.URL.Path)]; ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "Location")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
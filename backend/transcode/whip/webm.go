@@ -0,0 +1,342 @@
+package whip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// a minimal live webm (matroska) muxer: one vp8 track and one opus track, unknown sized segment and clusters
+// it is only meant to be read by ffmpeg from a pipe, so there is no seeking information
+
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+	idSegment            = 0x18538067
+	idInfo               = 0x1549A966
+	idTimecodeScale      = 0x2AD7B1
+	idMuxingApp          = 0x4D80
+	idWritingApp         = 0x5741
+	idTracks             = 0x1654AE6B
+	idTrackEntry         = 0xAE
+	idTrackNumber        = 0xD7
+	idTrackUID           = 0x73C5
+	idTrackType          = 0x83
+	idCodecID            = 0x86
+	idCodecPrivate       = 0x63A2
+	idVideo              = 0xE0
+	idPixelWidth         = 0xB0
+	idPixelHeight        = 0xBA
+	idAudio              = 0xE1
+	idSamplingFrequency  = 0xB5
+	idChannels           = 0x9F
+	idCluster            = 0x1F43B675
+	idTimecode           = 0xE7
+	idSimpleBlock        = 0xA3
+
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+
+	videoTrackNumber = 1
+	audioTrackNumber = 2
+
+	// the relative timecode of a block is an int16, start a new cluster before it overflows
+	maxClusterDuration = 30 * time.Second
+)
+
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// headerSetter is implemented by the publish, a restarted transcoder needs the webm header before the clusters
+type headerSetter interface {
+	SetHeader(header []byte)
+}
+
+// resumePointSetter is implemented by the publish, a restarted transcoder must start on a cluster (a block out of a cluster
+// is invalid) and, with video, on a keyframe
+type resumePointSetter interface {
+	SetResumePoint(resumePoint func(b []byte) bool)
+}
+
+type webmWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	hasVideo bool
+	hasAudio bool
+
+	headerWritten bool
+	start         time.Time
+	clusterStart  time.Duration
+	clusterOpen   bool
+}
+
+func newWebmWriter(w io.Writer, hasVideo bool, hasAudio bool) *webmWriter {
+	m := &webmWriter{
+		w:        w,
+		hasVideo: hasVideo,
+		hasAudio: hasAudio,
+	}
+
+	if setter, ok := w.(resumePointSetter); ok {
+		setter.SetResumePoint(m.isResumePoint)
+	}
+
+	return m
+}
+
+// isResumePoint tells if a write opens a cluster with a video keyframe (any cluster without video)
+// it reads what writeBlock writes: the cluster, its timecode then the first block, all with 8 bytes sizes
+func (m *webmWriter) isResumePoint(b []byte) bool {
+	cluster := append(encodeID(idCluster), unknownSize...)
+	if !bytes.HasPrefix(b, cluster) {
+		return false
+	}
+	if !m.hasVideo {
+		return true
+	}
+
+	b = b[len(cluster):]
+	if len(b) < 9 || b[0] != idTimecode {
+		return false
+	}
+	timecodeSize := binary.BigEndian.Uint64(b[1:9]) &^ (0x01 << 56)
+	if uint64(len(b)-9) < timecodeSize {
+		return false
+	}
+
+	// the block: id, size, track number, relative timecode then the flags
+	block := b[9+timecodeSize:]
+	if len(block) < 13 || block[0] != idSimpleBlock {
+		return false
+	}
+
+	return block[9]&0x7F == videoTrackNumber && block[12]&0x80 != 0
+}
+
+// WriteVideo writes a vp8 frame, nothing is written until the first keyframe (it carries the resolution)
+func (m *webmWriter) WriteVideo(frame []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keyframe := len(frame) > 0 && frame[0]&0x01 == 0
+
+	if !m.headerWritten {
+		if !keyframe {
+			return nil
+		}
+
+		width, height, err := vp8Resolution(frame)
+		if err != nil {
+			return err
+		}
+
+		if err := m.writeHeader(width, height); err != nil {
+			return err
+		}
+	}
+
+	return m.writeBlock(videoTrackNumber, frame, keyframe)
+}
+
+// WriteAudio writes an opus packet, it is dropped while waiting for the first video keyframe
+func (m *webmWriter) WriteAudio(packet []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.headerWritten {
+		if m.hasVideo {
+			return nil
+		}
+
+		if err := m.writeHeader(0, 0); err != nil {
+			return err
+		}
+	}
+
+	return m.writeBlock(audioTrackNumber, packet, true)
+}
+
+func (m *webmWriter) writeHeader(width int, height int) error {
+	header := element(idEBML,
+		uintElement(idEBMLVersion, 1),
+		uintElement(idEBMLReadVersion, 1),
+		uintElement(idEBMLMaxIDLength, 4),
+		uintElement(idEBMLMaxSizeLength, 8),
+		stringElement(idDocType, "webm"),
+		uintElement(idDocTypeVersion, 4),
+		uintElement(idDocTypeReadVersion, 2),
+	)
+
+	// the segment size is unknown, its children follow directly
+	header = append(header, encodeID(idSegment)...)
+	header = append(header, unknownSize...)
+
+	header = append(header, element(idInfo,
+		uintElement(idTimecodeScale, uint64(time.Millisecond)),
+		stringElement(idMuxingApp, "lets-live"),
+		stringElement(idWritingApp, "lets-live"),
+	)...)
+
+	var tracks [][]byte
+	if m.hasVideo {
+		tracks = append(tracks, element(idTrackEntry,
+			uintElement(idTrackNumber, videoTrackNumber),
+			uintElement(idTrackUID, videoTrackNumber),
+			uintElement(idTrackType, trackTypeVideo),
+			stringElement(idCodecID, "V_VP8"),
+			element(idVideo,
+				uintElement(idPixelWidth, uint64(width)),
+				uintElement(idPixelHeight, uint64(height)),
+			),
+		))
+	}
+	if m.hasAudio {
+		tracks = append(tracks, element(idTrackEntry,
+			uintElement(idTrackNumber, audioTrackNumber),
+			uintElement(idTrackUID, audioTrackNumber),
+			uintElement(idTrackType, trackTypeAudio),
+			stringElement(idCodecID, "A_OPUS"),
+			binaryElement(idCodecPrivate, opusHead(2, 48000)),
+			element(idAudio,
+				floatElement(idSamplingFrequency, 48000),
+				uintElement(idChannels, 2),
+			),
+		))
+	}
+	header = append(header, element(idTracks, tracks...)...)
+
+	if _, err := m.w.Write(header); err != nil {
+		return err
+	}
+
+	if setter, ok := m.w.(headerSetter); ok {
+		setter.SetHeader(header)
+	}
+
+	m.headerWritten = true
+	m.start = time.Now()
+
+	return nil
+}
+
+// blocks use the arrival time, browsers send audio and video from the same clock so it is good enough
+func (m *webmWriter) writeBlock(trackNumber int, data []byte, keyframe bool) error {
+	timecode := time.Since(m.start)
+
+	// video clusters start on keyframes so ffmpeg can cut segments there
+	newCluster := !m.clusterOpen ||
+		timecode-m.clusterStart >= maxClusterDuration ||
+		(keyframe && trackNumber == videoTrackNumber)
+
+	// the cluster and its first block are written at once, a restarted transcoder never starts between them
+	var out []byte
+	if newCluster {
+		out = append(encodeID(idCluster), unknownSize...)
+		out = append(out, uintElement(idTimecode, uint64(timecode.Milliseconds()))...)
+
+		m.clusterStart = timecode
+		m.clusterOpen = true
+	}
+
+	block := make([]byte, 0, 4+len(data))
+	block = append(block, 0x80|byte(trackNumber))
+	block = binary.BigEndian.AppendUint16(block, uint16(int16((timecode - m.clusterStart).Milliseconds())))
+	if keyframe {
+		block = append(block, 0x80)
+	} else {
+		block = append(block, 0x00)
+	}
+	block = append(block, data...)
+
+	out = append(out, binaryElement(idSimpleBlock, block)...)
+
+	_, err := m.w.Write(out)
+	return err
+}
+
+// the vp8 keyframe header: 3 bytes frame tag, the 9d 01 2a start code then 14 bits width and height
+func vp8Resolution(frame []byte) (int, int, error) {
+	if len(frame) < 10 || frame[3] != 0x9D || frame[4] != 0x01 || frame[5] != 0x2A {
+		return 0, 0, fmt.Errorf("invalid vp8 keyframe")
+	}
+
+	width := int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3FFF)
+	height := int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3FFF)
+
+	return width, height, nil
+}
+
+func opusHead(channels byte, sampleRate uint32) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, channels)
+	head = binary.LittleEndian.AppendUint16(head, 0) // pre skip
+	head = binary.LittleEndian.AppendUint32(head, sampleRate)
+	head = binary.LittleEndian.AppendUint16(head, 0) // output gain
+	head = append(head, 0)                           // channel mapping family
+
+	return head
+}
+
+func encodeID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// sizes are always written on 8 bytes, it wastes a few bytes but keeps things simple
+func encodeSize(size uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, size|0x01<<56)
+
+	return b
+}
+
+func element(id uint32, children ...[]byte) []byte {
+	var content []byte
+	for _, child := range children {
+		content = append(content, child...)
+	}
+
+	return binaryElement(id, content)
+}
+
+func binaryElement(id uint32, content []byte) []byte {
+	b := encodeID(id)
+	b = append(b, encodeSize(uint64(len(content)))...)
+
+	return append(b, content...)
+}
+
+func uintElement(id uint32, value uint64) []byte {
+	content := binary.BigEndian.AppendUint64(nil, value)
+	for len(content) > 1 && content[0] == 0 {
+		content = content[1:]
+	}
+
+	return binaryElement(id, content)
+}
+
+func floatElement(id uint32, value float64) []byte {
+	return binaryElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func stringElement(id uint32, value string) []byte {
+	return binaryElement(id, []byte(value))
+}
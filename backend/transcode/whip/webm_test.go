@@ -0,0 +1,312 @@
+package whip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ebmlElement is an element read back from the muxer output, the unknown sized ones (segment, cluster) have no data,
+// their children are the elements after them
+type ebmlElement struct {
+	id      uint32
+	data    []byte
+	unknown bool
+}
+
+func readVint(b []byte) (value uint64, length int, ok bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+
+	length = 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(b) < length {
+		return 0, 0, false
+	}
+
+	value = uint64(b[0] & (0xFF >> length))
+	for _, c := range b[1:length] {
+		value = value<<8 | uint64(c)
+	}
+	return value, length, true
+}
+
+func readElements(t *testing.T, b []byte) []ebmlElement {
+	var elements []ebmlElement
+	for len(b) > 0 {
+		// the id keeps its length marker
+		_, idLength, ok := readVint(b)
+		require.True(t, ok, "invalid element id")
+		var id uint32
+		for _, c := range b[:idLength] {
+			id = id<<8 | uint32(c)
+		}
+		b = b[idLength:]
+
+		require.NotEmpty(t, b, "missing element size")
+		if bytes.HasPrefix(b, unknownSize) {
+			elements = append(elements, ebmlElement{id: id, unknown: true})
+			b = b[len(unknownSize):]
+			continue
+		}
+
+		size, sizeLength, ok := readVint(b)
+		require.True(t, ok, "invalid element size")
+		b = b[sizeLength:]
+		require.GreaterOrEqual(t, uint64(len(b)), size, "truncated element %x", id)
+
+		elements = append(elements, ebmlElement{id: id, data: b[:size]})
+		b = b[size:]
+	}
+
+	return elements
+}
+
+func child(t *testing.T, parent ebmlElement, id uint32) ebmlElement {
+	for _, element := range readElements(t, parent.data) {
+		if element.id == id {
+			return element
+		}
+	}
+
+	t.Fatalf("no element %x in %x", id, parent.id)
+	return ebmlElement{}
+}
+
+func (e ebmlElement) uint() uint64 {
+	var value uint64
+	for _, c := range e.data {
+		value = value<<8 | uint64(c)
+	}
+	return value
+}
+
+type simpleBlock struct {
+	track    int
+	timecode int16
+	keyframe bool
+	data     []byte
+}
+
+func (e ebmlElement) block(t *testing.T) simpleBlock {
+	require.GreaterOrEqual(t, len(e.data), 4)
+	return simpleBlock{
+		track:    int(e.data[0] & 0x7F),
+		timecode: int16(binary.BigEndian.Uint16(e.data[1:3])),
+		keyframe: e.data[3]&0x80 != 0,
+		data:     e.data[4:],
+	}
+}
+
+// recordingWriter keeps what the muxer wrote, write by write, and what it gave to the transcoder
+type recordingWriter struct {
+	bytes.Buffer
+	writes      [][]byte
+	header      []byte
+	resumePoint func(b []byte) bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), b...))
+	return w.Buffer.Write(b)
+}
+
+func (w *recordingWriter) SetHeader(header []byte) {
+	w.header = header
+}
+
+func (w *recordingWriter) SetResumePoint(resumePoint func(b []byte) bool) {
+	w.resumePoint = resumePoint
+}
+
+func vp8Keyframe(width int, height int) []byte {
+	frame := []byte{0x10, 0x02, 0x00, 0x9D, 0x01, 0x2A}
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(width))
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(height))
+	return append(frame, 0xAA, 0xBB)
+}
+
+var vp8Interframe = []byte{0x11, 0x02, 0x00, 0xCC}
+
+func TestWebmWriter_Header(t *testing.T) {
+	out := &recordingWriter{}
+	muxer := newWebmWriter(out, true, true)
+
+	// nothing is written before the first keyframe
+	assert.NoError(t, muxer.WriteAudio([]byte{0x01}))
+	assert.NoError(t, muxer.WriteVideo(vp8Interframe))
+	assert.Zero(t, out.Len())
+
+	assert.NoError(t, muxer.WriteVideo(vp8Keyframe(1280, 720)))
+	assert.True(t, bytes.HasPrefix(out.Bytes(), out.header), "the header given to the transcoder is what was written first")
+
+	elements := readElements(t, out.Bytes())
+	require.Len(t, elements, 7)
+
+	ebml := elements[0]
+	assert.Equal(t, uint32(idEBML), ebml.id)
+	assert.Equal(t, "webm", string(child(t, ebml, idDocType).data))
+	assert.Equal(t, uint64(8), child(t, ebml, idEBMLMaxSizeLength).uint())
+
+	assert.Equal(t, ebmlElement{id: idSegment, unknown: true}, elements[1])
+
+	assert.Equal(t, uint32(idInfo), elements[2].id)
+	assert.Equal(t, uint64(time.Millisecond), child(t, elements[2], idTimecodeScale).uint())
+
+	assert.Equal(t, uint32(idTracks), elements[3].id)
+	tracks := readElements(t, elements[3].data)
+	require.Len(t, tracks, 2)
+
+	video := tracks[0]
+	assert.Equal(t, uint64(videoTrackNumber), child(t, video, idTrackNumber).uint())
+	assert.Equal(t, uint64(trackTypeVideo), child(t, video, idTrackType).uint())
+	assert.Equal(t, "V_VP8", string(child(t, video, idCodecID).data))
+	assert.Equal(t, uint64(1280), child(t, child(t, video, idVideo), idPixelWidth).uint())
+	assert.Equal(t, uint64(720), child(t, child(t, video, idVideo), idPixelHeight).uint())
+
+	audio := tracks[1]
+	assert.Equal(t, uint64(audioTrackNumber), child(t, audio, idTrackNumber).uint())
+	assert.Equal(t, "A_OPUS", string(child(t, audio, idCodecID).data))
+	assert.True(t, bytes.HasPrefix(child(t, audio, idCodecPrivate).data, []byte("OpusHead")))
+	samplingFrequency := child(t, child(t, audio, idAudio), idSamplingFrequency).data
+	assert.Equal(t, 48000.0, math.Float64frombits(binary.BigEndian.Uint64(samplingFrequency)))
+
+	// the keyframe opens the first cluster
+	assert.Equal(t, ebmlElement{id: idCluster, unknown: true}, elements[4])
+	assert.Equal(t, uint32(idTimecode), elements[5].id)
+	block := elements[6].block(t)
+	assert.Equal(t, videoTrackNumber, block.track)
+	assert.True(t, block.keyframe)
+	assert.Equal(t, vp8Keyframe(1280, 720), block.data)
+}
+
+func TestWebmWriter_Clusters(t *testing.T) {
+	out := &recordingWriter{}
+	muxer := newWebmWriter(out, true, true)
+
+	assert.NoError(t, muxer.WriteVideo(vp8Keyframe(640, 360)))
+	headerLength := len(out.header)
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, muxer.WriteAudio([]byte{0x01}))
+	assert.NoError(t, muxer.WriteVideo(vp8Interframe))
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, muxer.WriteVideo(vp8Keyframe(640, 360)))
+
+	// a block must not overflow the int16 relative timecode, the cluster is cut even without a keyframe
+	muxer.start = muxer.start.Add(-maxClusterDuration)
+	assert.NoError(t, muxer.WriteAudio([]byte{0x02}))
+
+	elements := readElements(t, out.Bytes()[headerLength:])
+	ids := make([]uint32, 0, len(elements))
+	for _, element := range elements {
+		ids = append(ids, element.id)
+	}
+	assert.Equal(t, []uint32{
+		idCluster, idTimecode, idSimpleBlock, idSimpleBlock, idSimpleBlock,
+		idCluster, idTimecode, idSimpleBlock,
+		idCluster, idTimecode, idSimpleBlock,
+	}, ids)
+
+	first := elements[1].uint()
+	assert.Less(t, first, uint64(10))
+
+	audio := elements[3].block(t)
+	assert.Equal(t, audioTrackNumber, audio.track)
+	assert.True(t, audio.keyframe)
+	assert.GreaterOrEqual(t, audio.timecode, int16(20))
+
+	interframe := elements[4].block(t)
+	assert.Equal(t, videoTrackNumber, interframe.track)
+	assert.False(t, interframe.keyframe)
+	assert.GreaterOrEqual(t, interframe.timecode, audio.timecode)
+
+	// the second keyframe starts a cluster, its block is at the cluster timecode
+	second := elements[6].uint()
+	assert.GreaterOrEqual(t, second, first+40)
+	keyframe := elements[7].block(t)
+	assert.True(t, keyframe.keyframe)
+	assert.Equal(t, int16(0), keyframe.timecode)
+
+	third := elements[9].uint()
+	assert.GreaterOrEqual(t, third, second+uint64(maxClusterDuration.Milliseconds()))
+	assert.Equal(t, audioTrackNumber, elements[10].block(t).track)
+}
+
+func TestWebmWriter_AudioOnly(t *testing.T) {
+	out := &recordingWriter{}
+	muxer := newWebmWriter(out, false, true)
+
+	assert.NoError(t, muxer.WriteAudio([]byte{0x01}))
+
+	elements := readElements(t, out.Bytes())
+	require.Len(t, elements, 7)
+	tracks := readElements(t, elements[3].data)
+	require.Len(t, tracks, 1)
+	assert.Equal(t, "A_OPUS", string(child(t, tracks[0], idCodecID).data))
+
+	assert.Equal(t, uint32(idCluster), elements[4].id)
+	assert.Equal(t, audioTrackNumber, elements[6].block(t).track)
+}
+
+// a restarted transcoder reads the header then starts at the next write that is a resume point
+func TestWebmWriter_ResumePoint(t *testing.T) {
+	out := &recordingWriter{}
+	muxer := newWebmWriter(out, true, true)
+	require.NotNil(t, out.resumePoint)
+
+	assert.NoError(t, muxer.WriteVideo(vp8Keyframe(640, 360)))
+	assert.NoError(t, muxer.WriteAudio([]byte{0x01}))
+	assert.NoError(t, muxer.WriteVideo(vp8Interframe))
+	assert.NoError(t, muxer.WriteVideo(vp8Keyframe(640, 360)))
+	// a cluster cut for its length, it starts with audio
+	muxer.start = muxer.start.Add(-maxClusterDuration)
+	assert.NoError(t, muxer.WriteAudio([]byte{0x02}))
+
+	require.Len(t, out.writes, 6)
+	resumable := make([]bool, 0, len(out.writes))
+	for _, b := range out.writes[1:] {
+		resumable = append(resumable, out.resumePoint(b))
+	}
+	assert.Equal(t, []bool{true, false, false, true, false}, resumable)
+	assert.False(t, out.resumePoint(out.header))
+
+	// without video any cluster will do
+	audioOut := &recordingWriter{}
+	audioMuxer := newWebmWriter(audioOut, false, true)
+	assert.NoError(t, audioMuxer.WriteAudio([]byte{0x01}))
+	assert.NoError(t, audioMuxer.WriteAudio([]byte{0x02}))
+	audioMuxer.start = audioMuxer.start.Add(-maxClusterDuration)
+	assert.NoError(t, audioMuxer.WriteAudio([]byte{0x03}))
+
+	require.Len(t, audioOut.writes, 4)
+	assert.True(t, audioOut.resumePoint(audioOut.writes[1]))
+	assert.False(t, audioOut.resumePoint(audioOut.writes[2]))
+	assert.True(t, audioOut.resumePoint(audioOut.writes[3]))
+}
+
+func TestVP8Resolution(t *testing.T) {
+	width, height, err := vp8Resolution(vp8Keyframe(1920, 1080))
+	assert.NoError(t, err)
+	assert.Equal(t, 1920, width)
+	assert.Equal(t, 1080, height)
+
+	// the two upper bits are the scaling
+	frame := vp8Keyframe(1920, 1080)
+	frame[7] |= 0xC0
+	width, _, err = vp8Resolution(frame)
+	assert.NoError(t, err)
+	assert.Equal(t, 1920, width)
+
+	_, _, err = vp8Resolution([]byte{0x10, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	assert.Error(t, err)
+	_, _, err = vp8Resolution(vp8Interframe)
+	assert.Error(t, err)
+}
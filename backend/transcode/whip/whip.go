@@ -0,0 +1,380 @@
+package whip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	"sen1or/lets-live/transcode/ingest"
+	"sen1or/lets-live/transcode/transcoder"
+	"sen1or/lets-live/transcode/webserver"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/mux"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+const (
+	maxOfferSize = 64 * 1024
+
+	// ask the browser for a keyframe regularly, a viewer (ffmpeg) joining late needs one to start decoding
+	pliInterval = 3 * time.Second
+
+	// gathering waits for the stun/turn servers, an unreachable one must not hold the request forever
+	gatherTimeout = 5 * time.Second
+	// the answer is written before the write timeout of the webserver, the publish may have waited for a kick already
+	answerMargin = 2 * time.Second
+)
+
+// WHIPServer implements the WebRTC-HTTP ingestion protocol (https://www.ietf.org/rfc/rfc9725.html)
+// the browser posts its sdp offer with the stream key as bearer token, the received media is muxed into webm for the transcoder
+type WHIPServer struct {
+	publisher *ingest.Publisher
+	api       *webrtc.API
+	config    config.Config
+
+	mu       sync.Mutex
+	sessions map[string]*whipSession // keyed by the resource id
+}
+
+type whipSession struct {
+	id         string
+	pc         *webrtc.PeerConnection
+	remoteAddr net.Addr
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Close and RemoteAddr let the session manager kick the publisher like any other connection
+func (s *whipSession) Close() error {
+	return s.pc.Close()
+}
+
+func (s *whipSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func NewWHIPServer(config config.Config, publisher *ingest.Publisher) (*WHIPServer, error) {
+	api, err := newWebRTCAPI(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WHIPServer{
+		publisher: publisher,
+		api:       api,
+		config:    config,
+		sessions:  make(map[string]*whipSession),
+	}, nil
+}
+
+// only vp8 and opus are offered, it is what every browser can send and what the webm muxer supports
+func newWebRTCAPI(config config.Config) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+
+	videoRTCPFeedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback},
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, fmt.Errorf("failed to register vp8: %s", err)
+	}
+
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register opus: %s", err)
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %s", err)
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+	if len(config.WHIP.PublicIPs) > 0 {
+		settingEngine.SetNAT1To1IPs(config.WHIP.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	if config.WHIP.UDPPortMin > 0 && config.WHIP.UDPPortMax > 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(uint16(config.WHIP.UDPPortMin), uint16(config.WHIP.UDPPortMax)); err != nil {
+			return nil, fmt.Errorf("invalid udp port range: %s", err)
+		}
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(settingEngine),
+	), nil
+}
+
+// RegisterRoutes adds the whip endpoint and the session resources to the router
+func (s *WHIPServer) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/whip", s.createSession).Methods(http.MethodPost)
+	router.HandleFunc("/v1/whip/{resourceId}", s.deleteSession).Methods(http.MethodDelete)
+}
+
+func (s *WHIPServer) createSession(w http.ResponseWriter, r *http.Request) {
+	writeDeadline := time.Now().Add(webserver.WriteTimeout - answerMargin)
+
+	streamKey, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(streamKey) == 0 {
+		http.Error(w, "missing stream key", http.StatusUnauthorized)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "content type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	hasVideo, hasAudio, err := offeredMedia(offer)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid offer: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{ICEServers: s.iceServers()})
+	if err != nil {
+		logger.Errorf("whip failed to create peer connection: %s", err)
+		http.Error(w, "failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	session := &whipSession{
+		id:         uuid.Must(uuid.NewV4()).String(),
+		pc:         pc,
+		remoteAddr: remoteAddr(r),
+		done:       make(chan struct{}),
+	}
+
+	publish, err := s.publisher.Begin(streamKey, session)
+	if err != nil {
+		pc.Close()
+		logger.Errorf("whip stream connection failed: %s", err)
+		http.Error(w, err.Error(), publishErrorStatus(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatherTimeout)
+	ctx, cancelDeadline := context.WithDeadline(ctx, writeDeadline)
+	answer, err := s.negotiate(ctx, pc, string(offer))
+	cancelDeadline()
+	cancel()
+	if err != nil {
+		pc.Close()
+		s.publisher.End(publish)
+		logger.Errorf("whip negotiation failed: %s", err)
+		http.Error(w, "failed to negotiate session", http.StatusBadRequest)
+		return
+	}
+
+	// vp8 is never copied, the resolution is only known from the first keyframe
+	publish.SetSource(transcoder.SourceInfo{VideoCodec: "vp8"})
+
+	s.run(session, publish, newWebmWriter(publish, hasVideo, hasAudio))
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/v1/whip/"+session.id)
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write([]byte(answer))
+	if err == nil {
+		err = http.NewResponseController(w).Flush()
+	}
+	if err != nil {
+		// the client can't connect without the answer, nothing will ever be published
+		logger.Errorw("whip failed to write the answer, ending the publish", "userId", publish.UserID, "error", err.Error())
+		session.Close()
+	}
+}
+
+func (s *WHIPServer) deleteSession(w http.ResponseWriter, r *http.Request) {
+	resourceId := mux.Vars(r)["resourceId"]
+
+	s.mu.Lock()
+	session, ok := s.sessions[resourceId]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	session.Close()
+	w.WriteHeader(http.StatusOK)
+}
+
+// the answer is returned with every candidate in it, whip clients don't have to support trickle ice
+// it gives up when the context is done before the gathering completes (the client left or a stun/turn server is unreachable)
+func (s *WHIPServer) negotiate(ctx context.Context, pc *webrtc.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		return "", fmt.Errorf("ice gathering not complete: %w", ctx.Err())
+	}
+
+	return pc.LocalDescription().SDP, nil
+}
+
+// wire the peer connection to the publish: tracks are muxed into it, the publish ends with the connection
+func (s *WHIPServer) run(session *whipSession, publish *ingest.Publish, writer *webmWriter) {
+	s.mu.Lock()
+	s.sessions[session.id] = session
+	s.mu.Unlock()
+
+	end := func() {
+		session.closeOnce.Do(func() {
+			close(session.done)
+			session.pc.Close()
+			s.publisher.End(publish)
+
+			s.mu.Lock()
+			delete(s.sessions, session.id)
+			s.mu.Unlock()
+		})
+	}
+
+	session.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Infow("whip connection state changed", "userId", publish.UserID, "state", state.String())
+
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			go end()
+		}
+	})
+
+	session.pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		switch track.Kind() {
+		case webrtc.RTPCodecTypeVideo:
+			go requestKeyframes(session, track)
+			readTrack(session, track, samplebuilder.New(256, &codecs.VP8Packet{}, track.Codec().ClockRate), writer.WriteVideo)
+		case webrtc.RTPCodecTypeAudio:
+			readTrack(session, track, samplebuilder.New(16, &codecs.OpusPacket{}, track.Codec().ClockRate), writer.WriteAudio)
+		}
+
+		// the track ended or the transcoder is gone, either way the publish is over
+		go end()
+	})
+}
+
+func readTrack(session *whipSession, track *webrtc.TrackRemote, builder *samplebuilder.SampleBuilder, write func([]byte) error) {
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Errorf("whip failed to read %s track: %s", track.Kind().String(), err)
+			}
+			return
+		}
+
+		builder.Push(packet)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if err := write(sample.Data); err != nil {
+				logger.Errorf("whip failed to write %s sample: %s", track.Kind().String(), err)
+				return
+			}
+		}
+	}
+}
+
+func requestKeyframes(session *whipSession, track *webrtc.TrackRemote) {
+	ticker := time.NewTicker(pliInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := session.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+			logger.Debugf("whip failed to send pli: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-session.done:
+			return
+		}
+	}
+}
+
+func (s *WHIPServer) iceServers() []webrtc.ICEServer {
+	if len(s.config.WHIP.ICEServers) == 0 {
+		return nil
+	}
+
+	return []webrtc.ICEServer{{URLs: s.config.WHIP.ICEServers}}
+}
+
+// check which kind of media the browser wants to send, the webm header has to declare the tracks up front
+func offeredMedia(offer []byte) (hasVideo bool, hasAudio bool, err error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal(offer); err != nil {
+		return false, false, err
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		switch media.MediaName.Media {
+		case "video":
+			hasVideo = true
+		case "audio":
+			hasAudio = true
+		}
+	}
+
+	if !hasVideo && !hasAudio {
+		return false, false, fmt.Errorf("no audio or video in offer")
+	}
+
+	return hasVideo, hasAudio, nil
+}
+
+func publishErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ingest.ErrAuthenticationFailed):
+		return http.StatusUnauthorized
+	case errors.Is(err, ingest.ErrAlreadyLive):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return addr
+}
@@ -0,0 +1,254 @@
+package whip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sen1or/lets-live/pkg/logger"
+	"sen1or/lets-live/transcode/config"
+	usergateway "sen1or/lets-live/transcode/gateway/user/http"
+	"sen1or/lets-live/transcode/ingest"
+	"sen1or/lets-live/transcode/session"
+	"sen1or/lets-live/transcode/webserver"
+	"sen1or/lets-live/user/dto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// browserOffer is the offer of a peer connection sending the given kinds of media, with its candidates gathered
+func browserOffer(t *testing.T, kinds ...webrtc.RTPCodecType) (*webrtc.PeerConnection, string) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	for _, kind := range kinds {
+		_, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		require.NoError(t, err)
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	require.NoError(t, err)
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	require.NoError(t, pc.SetLocalDescription(offer))
+	<-gatherComplete
+
+	return pc, pc.LocalDescription().SDP
+}
+
+func TestOfferedMedia(t *testing.T) {
+	_, audioVideo := browserOffer(t, webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo)
+	_, audioOnly := browserOffer(t, webrtc.RTPCodecTypeAudio)
+	_, dataOnly := browserOffer(t)
+
+	tests := []struct {
+		name      string
+		offer     string
+		wantVideo bool
+		wantAudio bool
+		wantErr   bool
+	}{
+		{name: "audio and video", offer: audioVideo, wantVideo: true, wantAudio: true},
+		{name: "audio only", offer: audioOnly, wantAudio: true},
+		{name: "no media", offer: dataOnly, wantErr: true},
+		{name: "not sdp", offer: "hello", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hasVideo, hasAudio, err := offeredMedia([]byte(tt.offer))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantVideo, hasVideo)
+			assert.Equal(t, tt.wantAudio, hasAudio)
+		})
+	}
+}
+
+// the requests refused before the stream key is checked
+func TestCreateSession_InvalidRequests(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	server, err := NewWHIPServer(config.Config{}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		authorization string
+		contentType   string
+		body          string
+		wantStatus    int
+	}{
+		{name: "no stream key", contentType: "application/sdp", body: "v=0", wantStatus: http.StatusUnauthorized},
+		{name: "not a bearer token", authorization: "Basic abc", contentType: "application/sdp", body: "v=0", wantStatus: http.StatusUnauthorized},
+		{name: "not sdp", authorization: "Bearer key", contentType: "application/json", body: "{}", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "invalid offer", authorization: "Bearer key", contentType: "application/sdp", body: "hello", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/v1/whip", strings.NewReader(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+			if len(tt.authorization) > 0 {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+
+			recorder := httptest.NewRecorder()
+			server.createSession(recorder, request)
+			assert.Equal(t, tt.wantStatus, recorder.Code)
+		})
+	}
+}
+
+func TestDeleteSession_Unknown(t *testing.T) {
+	server, err := NewWHIPServer(config.Config{}, nil)
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	server.deleteSession(recorder, httptest.NewRequest(http.MethodDelete, "/v1/whip/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestNegotiate(t *testing.T) {
+	server, err := NewWHIPServer(config.Config{}, nil)
+	require.NoError(t, err)
+
+	browser, offer := browserOffer(t, webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo)
+
+	pc, err := server.api.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatherTimeout)
+	defer cancel()
+	answer, err := server.negotiate(ctx, pc, offer)
+	require.NoError(t, err)
+
+	// the candidates are in the answer, the browser does not trickle
+	assert.Contains(t, answer, "a=candidate:")
+	assert.Contains(t, answer, "VP8/90000")
+	assert.Contains(t, answer, "opus/48000")
+	assert.NoError(t, browser.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}))
+}
+
+func TestNegotiate_GivesUpWhenTheContextIsDone(t *testing.T) {
+	var cfg config.Config
+	// nothing answers there, the server reflexive candidate is never gathered
+	cfg.WHIP.ICEServers = []string{"stun:127.0.0.1:9"}
+	server, err := NewWHIPServer(cfg, nil)
+	require.NoError(t, err)
+
+	_, offer := browserOffer(t, webrtc.RTPCodecTypeVideo)
+
+	pc, err := server.api.NewPeerConnection(webrtc.Configuration{ICEServers: server.iceServers()})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	startedAt := time.Now()
+	_, err = server.negotiate(ctx, pc, offer)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(startedAt), time.Second)
+}
+
+// the answer is written after the gathering, within the write timeout of the webserver serving the endpoint
+func TestGatherTimeout_LeavesTimeToWriteTheAnswer(t *testing.T) {
+	assert.Less(t, gatherTimeout, webserver.WriteTimeout-answerMargin)
+	assert.Positive(t, answerMargin)
+}
+
+// fakeUserService knows a single stream key
+type fakeUserService struct {
+	userId uuid.UUID
+}
+
+func (s fakeUserService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(dto.GetUserResponseDTO{ID: s.userId})
+	}
+}
+
+type fakeRegistry struct {
+	addr string
+}
+
+func (r fakeRegistry) Register(ctx context.Context, hostPort string, serviceHealthCheckURL string, serviceName string, instanceID string, tags []string) error {
+	return nil
+}
+
+func (r fakeRegistry) Deregister(ctx context.Context, serviceName string, instanceID string) error {
+	return nil
+}
+
+func (r fakeRegistry) ServiceAddresses(ctx context.Context, serviceName string) ([]string, error) {
+	return []string{r.addr}, nil
+}
+
+func (r fakeRegistry) ServiceAddress(ctx context.Context, serviceName string) (string, error) {
+	return r.addr, nil
+}
+
+// brokenWriter stands for a client gone, or a write timeout passed, when the answer is written
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w brokenWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("i/o timeout")
+}
+
+func TestCreateSession_EndsThePublishIfTheAnswerIsNotWritten(t *testing.T) {
+	logger.Init(logger.Debug)
+
+	users := fakeUserService{userId: uuid.Must(uuid.NewV4())}
+	userServer := httptest.NewServer(users)
+	defer userServer.Close()
+
+	ffmpegPath := filepath.Join(t.TempDir(), "ffmpeg")
+	require.NoError(t, os.WriteFile(ffmpegPath, []byte("#!/bin/sh\nexec cat > /dev/null\n"), 0755))
+
+	var cfg config.Config
+	cfg.Transcode.PublicHLSPath = t.TempDir()
+	cfg.Transcode.FFMpegSetting = config.FFMpegSetting{
+		FFMpegPath:     ffmpegPath,
+		MasterFileName: "index.m3u8",
+		HLSTime:        2,
+		HlsListSize:    5,
+		HlsMaxSize:     8,
+		Qualities:      []config.Quality{{Resolution: "1280x720", MaxBitrate: "3000k", FPS: 30, BufSize: "6000k"}},
+	}
+
+	sessionManager := session.NewSessionManager()
+	publisher := ingest.NewPublisher(cfg, usergateway.NewUserGateway(fakeRegistry{addr: userServer.Listener.Addr().String()}), sessionManager, nil)
+	server, err := NewWHIPServer(cfg, publisher)
+	require.NoError(t, err)
+
+	_, offer := browserOffer(t, webrtc.RTPCodecTypeVideo)
+	request := httptest.NewRequest(http.MethodPost, "/v1/whip", strings.NewReader(offer))
+	request.Header.Set("Content-Type", "application/sdp")
+	request.Header.Set("Authorization", "Bearer key")
+
+	server.createSession(brokenWriter{httptest.NewRecorder()}, request)
+
+	assert.Eventually(t, func() bool {
+		_, live := sessionManager.Get(users.userId.String())
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return !live && len(server.sessions) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+}
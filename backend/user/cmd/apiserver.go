@@ -25,13 +25,14 @@ type APIServer struct {
 	errorHandler  *handlers.ErrorHandler
 	healthHandler *handlers.HealthHandler
 	userHandler   *handlers.UserHandler
+	vodHandler    *handlers.VODHandler
 
 	loggingMiddleware middlewares.Middleware
 	corsMiddleware    middlewares.Middleware
 }
 
 // TODO: make tls usable
-func NewAPIServer(userHandler *handlers.UserHandler, cfg config.Config) *APIServer {
+func NewAPIServer(userHandler *handlers.UserHandler, vodHandler *handlers.VODHandler, cfg config.Config) *APIServer {
 	return &APIServer{
 		logger: logger.Logger,
 		config: cfg,
@@ -39,6 +40,7 @@ func NewAPIServer(userHandler *handlers.UserHandler, cfg config.Config) *APIServ
 		errorHandler:  handlers.NewErrorHandler(),
 		healthHandler: handlers.NewHeathHandler(),
 		userHandler:   userHandler,
+		vodHandler:    vodHandler,
 
 		loggingMiddleware: middlewares.NewLoggingMiddleware(logger.Logger),
 		corsMiddleware:    middlewares.NewCORSMiddleware(),
@@ -105,6 +107,9 @@ func (a *APIServer) getHandler() http.Handler {
 	sm.HandleFunc("PUT /v1/user/{id}", a.userHandler.UpdateUser)
 	sm.HandleFunc("GET /v1/user/me", a.userHandler.GetCurrentUserInfo)
 
+	sm.HandleFunc("GET /v1/user/{id}/vods", a.vodHandler.GetUserVODs)
+	sm.HandleFunc("POST /v1/user/{id}/vods", a.vodHandler.CreateVOD)
+
 	sm.HandleFunc("GET /v1/user/health", a.healthHandler.GetHealthyState)
 
 	sm.HandleFunc("GET /v1/swagger", httpSwagger.Handler(
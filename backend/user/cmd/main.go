@@ -72,5 +72,9 @@ func SetupServer(dbConn *pgxpool.Pool, cfg cfg.Config) *APIServer {
 	var userRepo = repositories.NewUserRepository(dbConn)
 	var userCtrl = controllers.NewUserController(userRepo)
 	var userHandler = handlers.NewUserHandler(userCtrl)
-	return NewAPIServer(userHandler, cfg)
+
+	var vodRepo = repositories.NewVODRepository(dbConn)
+	var vodCtrl = controllers.NewVODController(vodRepo, userRepo)
+	var vodHandler = handlers.NewVODHandler(vodCtrl)
+	return NewAPIServer(userHandler, vodHandler, cfg)
 }
@@ -93,6 +93,10 @@ func (c *userController) Update(updateDTO dto.UpdateUserRequestDTO) (*dto.Update
 		updateUser.IsOnline = *updateDTO.IsOnline
 	}
 
+	if updateDTO.ThumbnailURL != nil {
+		updateUser.ThumbnailURL = *updateDTO.ThumbnailURL
+	}
+
 	updatedUser, err := c.repo.Update(*updateUser)
 
 	if err != nil {
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"sen1or/lets-live/user/dto"
+	"sen1or/lets-live/user/mapper"
+	"sen1or/lets-live/user/repositories"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+type VODController interface {
+	Create(body dto.CreateVODRequestDTO) (*dto.GetVODResponseDTO, error)
+	GetByUserID(userID uuid.UUID) ([]*dto.GetVODResponseDTO, error)
+}
+
+type vodController struct {
+	repo     repositories.VODRepository
+	userRepo repositories.UserRepository
+}
+
+func NewVODController(repo repositories.VODRepository, userRepo repositories.UserRepository) VODController {
+	return &vodController{
+		repo:     repo,
+		userRepo: userRepo,
+	}
+}
+
+func (c *vodController) Create(body dto.CreateVODRequestDTO) (*dto.GetVODResponseDTO, error) {
+	// returns ErrRecordNotFound for an unknown user
+	if _, err := c.userRepo.GetByID(body.UserID); err != nil {
+		return nil, err
+	}
+
+	vod := mapper.CreateVODRequestDTOToVOD(body)
+	createdVOD, err := c.repo.Create(*vod)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapper.VODToGetVODResponseDTO(*createdVOD), nil
+}
+
+func (c *vodController) GetByUserID(userID uuid.UUID) ([]*dto.GetVODResponseDTO, error) {
+	if _, err := c.userRepo.GetByID(userID); err != nil {
+		return nil, err
+	}
+
+	vods, err := c.repo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result = []*dto.GetVODResponseDTO{}
+	for _, vod := range vods {
+		result = append(result, mapper.VODToGetVODResponseDTO(vod))
+	}
+
+	return result, nil
+}
@@ -13,4 +13,5 @@ type User struct {
 	IsOnline     bool      `json:"isOnline" db:"is_online"`
 	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
 	StreamAPIKey uuid.UUID `json:"streamAPIKey" db:"stream_api_key"`
+	ThumbnailURL string    `json:"thumbnailUrl" db:"thumbnail_url"` // the latest preview of the stream, empty when offline
 }
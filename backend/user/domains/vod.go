@@ -0,0 +1,18 @@
+package domains
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// VOD is the recording of a finished broadcast
+type VOD struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	UserID      uuid.UUID `json:"userId" db:"user_id"`
+	PlaylistURL string    `json:"playlistUrl" db:"playlist_url"`
+	Duration    float64   `json:"duration" db:"duration"` // seconds
+	StartedAt   time.Time `json:"startedAt" db:"started_at"`
+	EndedAt     time.Time `json:"endedAt" db:"ended_at"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
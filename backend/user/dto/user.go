@@ -18,6 +18,7 @@ type CreateUserResponseDTO struct {
 	IsOnline     bool      `json:"isOnline"`
 	CreatedAt    time.Time `json:"createdAt"`
 	StreamAPIKey uuid.UUID `json:"streamAPIKey"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
 }
 
 type GetUserRequestDTO struct{}
@@ -29,6 +30,7 @@ type GetUserResponseDTO struct {
 	IsOnline     bool      `json:"isOnline"`
 	CreatedAt    time.Time `json:"createdAt"`
 	StreamAPIKey uuid.UUID `json:"streamAPIKey"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
 }
 
 type GetUserByStreamAPIKeyRequestDTO struct{}
@@ -40,12 +42,15 @@ type GetUserByStreamAPIKeyResponseDTO struct {
 	IsOnline     bool      `json:"isOnline"`
 	CreatedAt    time.Time `json:"createdAt"`
 	StreamAPIKey uuid.UUID `json:"streamAPIKey"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
 }
 
 type UpdateUserRequestDTO struct {
 	ID       uuid.UUID `json:"id" validate:"uuid"`
 	Username *string   `json:"username,omitempty" validate:"omitempty,gte=6,lte=20"`
 	IsOnline *bool     `json:"isOnline,omitempty" validate:""`
+	// set by the transcode service while the user is live
+	ThumbnailURL *string `json:"thumbnailUrl,omitempty"`
 }
 
 type UpdateUserResponseDTO struct {
@@ -55,4 +60,5 @@ type UpdateUserResponseDTO struct {
 	IsOnline     bool      `json:"isOnline"`
 	StreamAPIKey uuid.UUID `json:"streamAPIKey"`
 	CreatedAt    time.Time `json:"createdAt"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
 }
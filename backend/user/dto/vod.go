@@ -0,0 +1,25 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+type CreateVODRequestDTO struct {
+	UserID      uuid.UUID `json:"userId" validate:"uuid"`
+	PlaylistURL string    `json:"playlistUrl" validate:"required"`
+	Duration    float64   `json:"duration" validate:"gte=0"`
+	StartedAt   time.Time `json:"startedAt" validate:"required"`
+	EndedAt     time.Time `json:"endedAt" validate:"required"`
+}
+
+type GetVODResponseDTO struct {
+	ID          uuid.UUID `json:"id"`
+	UserID      uuid.UUID `json:"userId"`
+	PlaylistURL string    `json:"playlistUrl"`
+	Duration    float64   `json:"duration"`
+	StartedAt   time.Time `json:"startedAt"`
+	EndedAt     time.Time `json:"endedAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sen1or/lets-live/user/controllers"
+	"sen1or/lets-live/user/dto"
+	"sen1or/lets-live/user/repositories"
+	"sen1or/lets-live/user/utils"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+type VODHandler struct {
+	ErrorHandler
+	ctrl controllers.VODController
+}
+
+func NewVODHandler(ctrl controllers.VODController) *VODHandler {
+	return &VODHandler{
+		ctrl: ctrl,
+	}
+}
+
+// list the past broadcasts of the user, the most recent first
+func (h *VODHandler) GetUserVODs(w http.ResponseWriter, r *http.Request) {
+	userUUID, err := uuid.FromString(r.PathValue("id"))
+	if err != nil {
+		h.WriteErrorResponse(w, http.StatusBadRequest, errors.New("userId not valid"))
+		return
+	}
+
+	vods, err := h.ctrl.GetByUserID(userUUID)
+	if err != nil && errors.Is(err, repositories.ErrRecordNotFound) {
+		h.WriteErrorResponse(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	} else if err != nil {
+		h.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vods)
+}
+
+// register the recording of a finished broadcast, called by the transcode service
+func (h *VODHandler) CreateVOD(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	userUUID, err := uuid.FromString(r.PathValue("id"))
+	if err != nil {
+		h.WriteErrorResponse(w, http.StatusBadRequest, errors.New("userId not valid"))
+		return
+	}
+
+	var body dto.CreateVODRequestDTO
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		h.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("error decoding request body: %s", err.Error()))
+		return
+	}
+	body.UserID = userUUID
+
+	if err := utils.Validator.Struct(&body); err != nil {
+		h.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("error validating payload: %s", err))
+		return
+	}
+
+	createdVOD, err := h.ctrl.Create(body)
+	if err != nil && errors.Is(err, repositories.ErrRecordNotFound) {
+		h.WriteErrorResponse(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	} else if err != nil {
+		h.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createdVOD)
+}
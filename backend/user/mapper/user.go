@@ -20,6 +20,7 @@ func UserToCreateUserResponseDTO(user domains.User) *dto.CreateUserResponseDTO {
 		IsOnline:     user.IsOnline,
 		CreatedAt:    user.CreatedAt,
 		StreamAPIKey: user.StreamAPIKey,
+		ThumbnailURL: user.ThumbnailURL,
 	}
 }
 
@@ -31,6 +32,7 @@ func UserToGetUserResponseDTO(user domains.User) *dto.GetUserResponseDTO {
 		IsOnline:     user.IsOnline,
 		CreatedAt:    user.CreatedAt,
 		StreamAPIKey: user.StreamAPIKey,
+		ThumbnailURL: user.ThumbnailURL,
 	}
 }
 
@@ -42,5 +44,6 @@ func UserToUpdateUserResponseDTO(user domains.User) *dto.UpdateUserResponseDTO {
 		IsOnline:     user.IsOnline,
 		CreatedAt:    user.CreatedAt,
 		StreamAPIKey: user.StreamAPIKey,
+		ThumbnailURL: user.ThumbnailURL,
 	}
 }
@@ -0,0 +1,28 @@
+package mapper
+
+import (
+	"sen1or/lets-live/user/domains"
+	"sen1or/lets-live/user/dto"
+)
+
+func CreateVODRequestDTOToVOD(dto dto.CreateVODRequestDTO) *domains.VOD {
+	return &domains.VOD{
+		UserID:      dto.UserID,
+		PlaylistURL: dto.PlaylistURL,
+		Duration:    dto.Duration,
+		StartedAt:   dto.StartedAt,
+		EndedAt:     dto.EndedAt,
+	}
+}
+
+func VODToGetVODResponseDTO(vod domains.VOD) *dto.GetVODResponseDTO {
+	return &dto.GetVODResponseDTO{
+		ID:          vod.ID,
+		UserID:      vod.UserID,
+		PlaylistURL: vod.PlaylistURL,
+		Duration:    vod.Duration,
+		StartedAt:   vod.StartedAt,
+		EndedAt:     vod.EndedAt,
+		CreatedAt:   vod.CreatedAt,
+	}
+}
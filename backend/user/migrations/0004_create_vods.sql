@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE "vods" (
+  "id" uuid DEFAULT uuid_generate_v4(),
+  "user_id" uuid NOT NULL,
+  "playlist_url" text NOT NULL,
+  "duration" double precision NOT NULL DEFAULT 0,
+  "started_at" timestamptz NOT NULL,
+  "ended_at" timestamptz NOT NULL,
+  "created_at" timestamptz DEFAULT current_timestamp,
+  PRIMARY KEY ("id"),
+  CONSTRAINT "fk_vods_user" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE
+);
+
+CREATE INDEX "idx_vods_user_id" ON "vods" ("user_id");
+
+-- +goose Down
+DROP TABLE IF EXISTS "vods";
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN "thumbnail_url" text NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN "thumbnail_url";
@@ -168,8 +168,8 @@ func (r *postgresUserRepo) Create(newUser domains.User) (*domains.User, error) {
 }
 
 func (r *postgresUserRepo) Update(user domains.User) (*domains.User, error) {
-	logger.Infof("UPDATE users SET username = %s, is_online = %v WHERE id = %s RETURNING *", user.Username, user.IsOnline, user.ID)
-	rows, err := r.dbConn.Query(context.Background(), "UPDATE users SET username = $1, is_online = $2 WHERE id = $3 RETURNING *", user.Username, user.IsOnline, user.ID)
+	logger.Infof("UPDATE users SET username = %s, is_online = %v, thumbnail_url = %s WHERE id = %s RETURNING *", user.Username, user.IsOnline, user.ThumbnailURL, user.ID)
+	rows, err := r.dbConn.Query(context.Background(), "UPDATE users SET username = $1, is_online = $2, thumbnail_url = $3 WHERE id = $4 RETURNING *", user.Username, user.IsOnline, user.ThumbnailURL, user.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,61 @@
+package repositories
+
+import (
+	"context"
+
+	"sen1or/lets-live/user/domains"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type VODRepository interface {
+	GetByUserID(uuid.UUID) ([]domains.VOD, error)
+
+	Create(domains.VOD) (*domains.VOD, error)
+}
+
+type postgresVODRepo struct {
+	dbConn *pgxpool.Pool
+}
+
+func NewVODRepository(conn *pgxpool.Pool) VODRepository {
+	return &postgresVODRepo{
+		dbConn: conn,
+	}
+}
+
+// the most recent broadcasts first
+func (r *postgresVODRepo) GetByUserID(userId uuid.UUID) ([]domains.VOD, error) {
+	rows, err := r.dbConn.Query(context.Background(), "select * from vods where user_id = $1 order by started_at desc", userId.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[domains.VOD])
+}
+
+func (r *postgresVODRepo) Create(newVOD domains.VOD) (*domains.VOD, error) {
+	params := pgx.NamedArgs{
+		"user_id":      newVOD.UserID,
+		"playlist_url": newVOD.PlaylistURL,
+		"duration":     newVOD.Duration,
+		"started_at":   newVOD.StartedAt,
+		"ended_at":     newVOD.EndedAt,
+	}
+
+	rows, err := r.dbConn.Query(context.Background(), "insert into vods (user_id, playlist_url, duration, started_at, ended_at) values (@user_id, @playlist_url, @duration, @started_at, @ended_at) returning *", params)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vod, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[domains.VOD])
+	if err != nil {
+		return nil, err
+	}
+
+	return &vod, nil
+}
@@ -0,0 +1,24 @@
+package test
+
+import (
+	"sen1or/lets-live/user/dto"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockVODController struct {
+	mock.Mock
+}
+
+func (m *MockVODController) Create(body dto.CreateVODRequestDTO) (*dto.GetVODResponseDTO, error) {
+	args := m.Called(body)
+	vod, _ := args.Get(0).(*dto.GetVODResponseDTO)
+	return vod, args.Error(1)
+}
+
+func (m *MockVODController) GetByUserID(userID uuid.UUID) ([]*dto.GetVODResponseDTO, error) {
+	args := m.Called(userID)
+	vods, _ := args.Get(0).([]*dto.GetVODResponseDTO)
+	return vods, args.Error(1)
+}
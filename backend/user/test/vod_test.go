@@ -0,0 +1,156 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sen1or/lets-live/user/dto"
+	"sen1or/lets-live/user/handlers"
+	"sen1or/lets-live/user/repositories"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func vodRequest(method string, userId string, body string) *http.Request {
+	req := httptest.NewRequest(method, "/v1/user/"+userId+"/vods", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetPathValue("id", userId)
+	return req
+}
+
+func TestGetUserVODs_Success(t *testing.T) {
+	userId := uuid.Must(uuid.NewV4())
+	vods := []*dto.GetVODResponseDTO{{ID: uuid.Must(uuid.NewV4()), UserID: userId, PlaylistURL: "http://storage/vod/index.m3u8", Duration: 62.5}}
+	mockController := &MockVODController{}
+	mockController.On("GetByUserID", userId).Return(vods, nil).Once()
+	handler := handlers.NewVODHandler(mockController)
+
+	res := httptest.NewRecorder()
+	handler.GetUserVODs(res, vodRequest(http.MethodGet, userId.String(), ""))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	var response []dto.GetVODResponseDTO
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	assert.Len(t, response, 1)
+	assert.Equal(t, vods[0].PlaylistURL, response[0].PlaylistURL)
+	mockController.AssertExpectations(t)
+}
+
+func TestGetUserVODs_Errors(t *testing.T) {
+	userId := uuid.Must(uuid.NewV4())
+
+	tests := []struct {
+		name           string
+		userId         string
+		controllerErr  error
+		expectedStatus int
+	}{
+		{name: "Bad Id", userId: "not-a-uuid", expectedStatus: http.StatusBadRequest},
+		{name: "Unknown User", userId: userId.String(), controllerErr: repositories.ErrRecordNotFound, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockController := &MockVODController{}
+			if tt.controllerErr != nil {
+				mockController.On("GetByUserID", userId).Return(nil, tt.controllerErr).Once()
+			}
+			handler := handlers.NewVODHandler(mockController)
+
+			res := httptest.NewRecorder()
+			handler.GetUserVODs(res, vodRequest(http.MethodGet, tt.userId, ""))
+
+			assert.Equal(t, tt.expectedStatus, res.Code)
+			mockController.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCreateVOD_Success(t *testing.T) {
+	userId := uuid.Must(uuid.NewV4())
+	startedAt := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	endedAt := startedAt.Add(time.Hour)
+	expectedBody := dto.CreateVODRequestDTO{UserID: userId, PlaylistURL: "http://storage/vod/index.m3u8", Duration: 3600, StartedAt: startedAt, EndedAt: endedAt}
+	created := &dto.GetVODResponseDTO{ID: uuid.Must(uuid.NewV4()), UserID: userId, PlaylistURL: expectedBody.PlaylistURL, Duration: 3600, StartedAt: startedAt, EndedAt: endedAt}
+
+	mockController := &MockVODController{}
+	mockController.On("Create", expectedBody).Return(created, nil).Once()
+	handler := handlers.NewVODHandler(mockController)
+
+	body := `{ "playlistUrl": "http://storage/vod/index.m3u8", "duration": 3600, "startedAt": "2024-01-02T15:00:00Z", "endedAt": "2024-01-02T16:00:00Z" }`
+	res := httptest.NewRecorder()
+	handler.CreateVOD(res, vodRequest(http.MethodPost, userId.String(), body))
+
+	assert.Equal(t, http.StatusCreated, res.Code)
+	var response dto.GetVODResponseDTO
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	assert.Equal(t, created.ID, response.ID)
+	assert.Equal(t, userId, response.UserID)
+	mockController.AssertExpectations(t)
+}
+
+func TestCreateVOD_TableDriven(t *testing.T) {
+	userId := uuid.Must(uuid.NewV4())
+	validBody := `{ "playlistUrl": "http://storage/vod/index.m3u8", "duration": 3600, "startedAt": "2024-01-02T15:00:00Z", "endedAt": "2024-01-02T16:00:00Z" }`
+
+	tests := []struct {
+		name           string
+		userId         string
+		requestBody    string
+		controllerErr  error
+		expectedStatus int
+	}{
+		{
+			name:           "Bad Id",
+			userId:         "not-a-uuid",
+			requestBody:    validBody,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Bad Body",
+			userId:         userId.String(),
+			requestBody:    `{ "playlistUrl": `,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Validation Error",
+			userId:         userId.String(),
+			requestBody:    `{ "playlistUrl": "", "duration": 3600, "startedAt": "2024-01-02T15:00:00Z", "endedAt": "2024-01-02T16:00:00Z" }`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Validation Error",
+			userId:         userId.String(),
+			requestBody:    `{ "playlistUrl": "http://storage/vod/index.m3u8", "duration": -1, "startedAt": "2024-01-02T15:00:00Z", "endedAt": "2024-01-02T16:00:00Z" }`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown User",
+			userId:         userId.String(),
+			requestBody:    validBody,
+			controllerErr:  repositories.ErrRecordNotFound,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockController := &MockVODController{}
+			if tt.controllerErr != nil {
+				mockController.On("Create", mock.Anything).Return(nil, tt.controllerErr).Once()
+			}
+			handler := handlers.NewVODHandler(mockController)
+
+			res := httptest.NewRecorder()
+			handler.CreateVOD(res, vodRequest(http.MethodPost, tt.userId, tt.requestBody))
+
+			assert.Equal(t, tt.expectedStatus, res.Code)
+			mockController.AssertExpectations(t)
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	ipns "github.com/ipfs/boxo/ipns"
 	datastore "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
+	leveldb "github.com/ipfs/go-ds-leveldb"
 	libp2p "github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
@@ -32,6 +33,20 @@ func NewInMemoryDatastore() datastore.Batching {
 	return dssync.MutexWrap(datastore.NewMapDatastore())
 }
 
+// NewLevelDBDatastore provides a datastore persisted in the directory, the blocks and the dht records survive a restart
+func NewLevelDBDatastore(path string) (datastore.Batching, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the datastore directory: %s", err)
+	}
+
+	ds, err := leveldb.NewDatastore(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the datastore: %s", err)
+	}
+
+	return ds, nil
+}
+
 var connMgr, _ = connmgr.NewConnManager(100, 400, connmgr.WithGracePeriod(time.Minute))
 
 func NewLibp2pBoostrapHost(
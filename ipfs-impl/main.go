@@ -7,8 +7,11 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"time"
 
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"github.com/libp2p/go-libp2p/core/peer"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/multiformats/go-multiaddr"
@@ -18,6 +21,18 @@ import (
 
 var (
 	ipfsNode *Peer
+	repoPath string
+
+	// the files uploaded by the transcoder: mpeg-ts or cmaf (fmp4) segments and the fmp4 init files
+	contentTypes = map[string]string{
+		".ts":  "video/MP2T",
+		".m4s": "video/iso.segment",
+		".mp4": "video/mp4",
+		// the vod playlists uploaded by the recorder
+		".m3u8": "application/vnd.apple.mpegurl",
+		// the thumbnails and sprite sheets
+		".jpg": "image/jpeg",
+	}
 )
 
 func main() {
@@ -28,6 +43,9 @@ func main() {
 
 	isBootstrapNode := flag.Bool("b", false, "Use if the node is a bootstrap node")
 	flag.StringVar(&bootstrapNodeAddr, "a", "", "The boostrap node address")
+	flag.StringVar(&repoPath, "repo", "", "The directory of the datastore, in memory if empty")
+	gcInterval := flag.Duration("gc-interval", 10*time.Minute, "The time between two removals of the cached blocks, 0 to keep them")
+	maxCacheSize := flag.Int64("max-cache-mb", 0, "The size the cached blocks are removed above, they are removed at every gc interval if 0")
 
 	flag.Parse()
 
@@ -45,9 +63,53 @@ func main() {
 		}
 	}
 
+	if *gcInterval > 0 {
+		go collectGarbage(ctx, *gcInterval, *maxCacheSize*1024*1024)
+	}
+
 	select {}
 }
 
+func newDatastore() (datastore.Batching, error) {
+	if len(repoPath) == 0 {
+		return NewInMemoryDatastore(), nil
+	}
+
+	return NewLevelDBDatastore(repoPath)
+}
+
+// the node keeps every block it serves, drop them now and then so the disk usage stays bounded,
+// with a max size they are only dropped above it
+func collectGarbage(ctx context.Context, interval time.Duration, maxSize int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if maxSize > 0 {
+				size, err := ipfsNode.CacheSize(ctx)
+				if err != nil {
+					log.Printf("failed to get the cache size: %s\n", err)
+					continue
+				}
+				if size <= maxSize {
+					continue
+				}
+			}
+
+			removed, err := ipfsNode.GC(ctx)
+			if err != nil {
+				log.Printf("failed to collect garbage: %s\n", err)
+				continue
+			}
+			log.Printf("garbage collected, %d blocks removed\n", removed)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func RunBootstrapNode(ctx context.Context) error {
 	// setting prometheus
 	rcmgr.MustRegisterWith(prom.DefaultRegisterer)
@@ -62,7 +124,10 @@ func RunBootstrapNode(ctx context.Context) error {
 	}
 
 	// create node
-	ds := NewInMemoryDatastore()
+	ds, err := newDatastore()
+	if err != nil {
+		return err
+	}
 	host, dht, err := NewLibp2pBoostrapHost(ctx, ds, rmgr)
 	if err != nil {
 		return err
@@ -128,8 +193,12 @@ func getFileHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	defer file.Close()
 
-	// set the appropriate headers for file serving
-	w.Header().Set("Content-Type", "video/MP2T")
+	// set the appropriate headers for file serving, the type comes from the name given by the transcoder
+	contentType, ok := contentTypes[path.Ext(fileName)]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
 
 	// copy the file content to the response writer
@@ -151,7 +220,10 @@ func RunNormalNode(ctx context.Context, bootstrapNodeAddr string) error {
 	}
 
 	// create node
-	ds := NewInMemoryDatastore()
+	ds, err := newDatastore()
+	if err != nil {
+		return err
+	}
 	host, dht, err := NewLibp2pHost(ctx, ds)
 	if err != nil {
 		return err
@@ -39,7 +39,7 @@ type Peer struct {
 
 	ipld.DAGService // become a DAG service
 	exch            exchange.Interface
-	bstore          blockstore.Blockstore
+	bstore          blockstore.GCBlockstore
 	bserv           blockservice.BlockService
 	reprovider      provider.System
 }
@@ -62,7 +62,7 @@ func NewIPFSNode(
 	}
 
 	// get the default blockstore implementation
-	p.bstore = blockstore.NewBlockstore(p.store)
+	p.bstore = blockstore.NewGCBlockstore(blockstore.NewBlockstore(p.store), blockstore.NewGCLocker())
 
 	err := p.setupBlockService()
 	if err != nil {
@@ -107,6 +107,59 @@ func (p *Peer) onClose() {
 	<-p.ctx.Done()
 	p.reprovider.Close()
 	p.bserv.Close()
+	// flush an on disk datastore
+	p.store.Close()
+}
+
+// CacheSize returns the size of the blocks the node keeps, in bytes
+func (p *Peer) CacheSize(ctx context.Context) (int64, error) {
+	// stops the listing if returning early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keys, err := p.bstore.AllKeysChan(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for c := range keys {
+		blockSize, err := p.bstore.GetSize(ctx, c)
+		if ipld.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += int64(blockSize)
+	}
+
+	return size, nil
+}
+
+// GC deletes the blocks of the node and returns how many were deleted, nothing is pinned here,
+// the blocks are a cache of the files served, they are fetched again from the transcode nodes when requested
+func (p *Peer) GC(ctx context.Context) (int, error) {
+	unlocker := p.bstore.GCLock(ctx)
+	defer unlocker.Unlock(ctx)
+
+	keys, err := p.bstore.AllKeysChan(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var sweep []cid.Cid
+	for c := range keys {
+		sweep = append(sweep, c)
+	}
+
+	for i, c := range sweep {
+		if err := p.bstore.DeleteBlock(ctx, c); err != nil {
+			return i, err
+		}
+	}
+
+	return len(sweep), nil
 }
 
 func (p *Peer) Session(ctx context.Context) ipld.NodeGetter {